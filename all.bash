@@ -6,7 +6,7 @@ done
 
 for p in zoekt zoekt-webserver zoekt-indexserver \
     zoekt-index zoekt-git-index zoekt-repo-index zoekt-mirror-github \
-    zoekt-mirror-gitiles zoekt-test; do
+    zoekt-mirror-gitiles zoekt-test zoekt-verify; do
     go install github.com/google/zoekt/cmd/$p
 done
 
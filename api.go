@@ -51,6 +51,16 @@ type FileMatch struct {
 
 	// Commit SHA1 (hex) of the (sub)repo holding the file.
 	Version string
+
+	// LastCommit is the commit that last changed the file, and
+	// LastCommitTime its time, if they were indexed. See
+	// Document.LastCommit.
+	LastCommit     string
+	LastCommitTime time.Time
+
+	// Mode is the git file mode of the file, if it was indexed.
+	// See Document.Mode.
+	Mode uint32
 }
 
 // LineMatch holds the matches within a single line in a file.
@@ -169,16 +179,90 @@ type Repository struct {
 	// Nil if this is not the super project.
 	SubRepoMap map[string]*Repository
 
-	// URL template to link to the commit of a branch
+	// URL template to link to the commit of a branch. Has access
+	// to {{.Version}} and {{.Branch}}, the branch name.
 	CommitURLTemplate string
 
 	// The repository URL for getting to a file.  Has access to
-	// {{Branch}}, {{Path}}
+	// {{.Branch}}, {{.Version}} and {{.Path}}. Branch is the first
+	// branch the file was found in, and may be empty.
 	FileURLTemplate string
 
 	// The URL fragment to add to a file URL for line numbers.
-	// has access to {{LineNumber}}.
+	// has access to {{LineNumber}}. If it starts with '?' or '&',
+	// it is added to the query of the file URL instead.
 	LineFragmentTemplate string
+
+	// Archived is set for repositories that are no longer
+	// maintained.
+	Archived bool `json:",omitempty"`
+
+	// FingerprintExtra holds caller supplied data that the index
+	// was built with. See build.Options.FingerprintExtra.
+	FingerprintExtra []byte `json:",omitempty"`
+
+	// BranchDocuments holds the number of indexed documents for
+	// each branch. In a shard, it only counts the documents of
+	// that shard.
+	BranchDocuments map[string]int `json:",omitempty"`
+
+	// LanguageBytes holds the number of content bytes per
+	// language, counted over documents that have a Language set
+	// and are not Generated. Content of sub-repositories is counted
+	// in their SubRepoMap entry. In a shard, it only counts the
+	// documents of that shard.
+	LanguageBytes map[string]int64 `json:",omitempty"`
+
+	// SignedBranches holds the branches whose commit carries a GPG
+	// signature. The signatures are not verified.
+	SignedBranches map[string]bool `json:",omitempty"`
+
+	// BranchRefs maps the names of branches that were indexed
+	// under another name than their name in the repository to
+	// that name.
+	BranchRefs map[string]string `json:",omitempty"`
+
+	// DeltaBase is set if the index only holds the files that
+	// changed since this commit, as a supplement to an index of
+	// DeltaBase itself.
+	DeltaBase string `json:",omitempty"`
+
+	// DeletedPaths holds, for each branch of a DeltaBase index,
+	// the paths that were deleted since DeltaBase, so they can be
+	// dropped when merging it with the index of DeltaBase.
+	DeletedPaths map[string][]string `json:",omitempty"`
+
+	// Members holds the paths in SubRepoMap of the repositories
+	// that were indexed together as this one, see
+	// gitindex.IndexGitRepos. Repo queries for the name of a
+	// member match its files.
+	Members []string `json:",omitempty"`
+}
+
+// AddBranchDocuments adds the per branch document counts of o to r.
+func (r *Repository) AddBranchDocuments(o *Repository) {
+	if len(o.BranchDocuments) == 0 {
+		return
+	}
+	if r.BranchDocuments == nil {
+		r.BranchDocuments = map[string]int{}
+	}
+	for br, n := range o.BranchDocuments {
+		r.BranchDocuments[br] += n
+	}
+}
+
+// AddLanguageBytes adds the per language byte counts of o to r.
+func (r *Repository) AddLanguageBytes(o *Repository) {
+	if len(o.LanguageBytes) == 0 {
+		return
+	}
+	if r.LanguageBytes == nil {
+		r.LanguageBytes = map[string]int64{}
+	}
+	for lang, n := range o.LanguageBytes {
+		r.LanguageBytes[lang] += n
+	}
 }
 
 // IndexMetadata holds metadata stored in the index file.
@@ -187,6 +271,15 @@ type IndexMetadata struct {
 	IndexFeatureVersion int
 	IndexTime           time.Time
 	PlainASCII          bool
+
+	// If positive, matched lines in search results are cut to
+	// this many bytes.
+	TruncateLongLines int `json:",omitempty"`
+
+	// Supersedes is only set for segments. It holds the names of
+	// the documents that the segment replaces or deletes in the
+	// base shard and earlier segments.
+	Supersedes []string `json:",omitempty"`
 }
 
 // Statistics of a (collection of) repositories.
@@ -265,6 +358,9 @@ type SearchOptions struct {
 
 	// Abort the search after this much time has passed.
 	MaxWallTime time.Duration
+
+	// If set, skip documents that were indexed as Generated.
+	SkipGenerated bool
 }
 
 func (s *SearchOptions) String() string {
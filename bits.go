@@ -16,6 +16,10 @@ package zoekt
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -43,16 +47,6 @@ func generateCaseNgrams(g ngram) []ngram {
 	return variants
 }
 
-func toLower(in []byte) []byte {
-	out := make([]byte, 0, len(in))
-	var buf [4]byte
-	for _, c := range string(in) {
-		i := utf8.EncodeRune(buf[:], unicode.ToLower(c))
-		out = append(out, buf[:i]...)
-	}
-	return out
-}
-
 func isASCII(in []byte) bool {
 	for len(in) > 0 {
 		_, sz := utf8.DecodeRune(in)
@@ -83,22 +77,49 @@ func caseFoldingEqualsASCII(lower, mixed []byte) bool {
 	return true
 }
 
-// compare 'lower' and 'mixed', where lower is the needle. 'mixed' may
-// be larger than 'lower'.
-func caseFoldingEqualsRunes(lower, mixed []byte) bool {
-	for len(lower) > 0 && len(mixed) > 0 {
-		lr, lsz := utf8.DecodeRune(lower)
-		lower = lower[lsz:]
+// foldRune returns the smallest rune of the Unicode simple case
+// folding orbit of r, so runes that only differ in case fold to the
+// same rune. The orbits are the variants that generateCaseNgrams
+// looks up. Folds that change the number of runes, like 'ß' to "ss",
+// are not simple folds.
+func foldRune(r rune) rune {
+	if r < utf8.RuneSelf {
+		// The lower case 'k' and 's' also have non-ASCII
+		// variants, but they sort after the upper case.
+		if 'a' <= r && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		return r
+	}
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// compare 'needle' and 'mixed' under simple case folding. 'mixed' may
+// be larger than 'needle'. It returns the number of bytes of 'mixed'
+// that matched, which may differ from the size of the needle, eg. for
+// the Kelvin sign matching 'k'.
+func caseFoldingEqualsRunes(needle, mixed []byte) (int, bool) {
+	sz := 0
+	for len(needle) > 0 && len(mixed) > 0 {
+		nr, nsz := utf8.DecodeRune(needle)
+		needle = needle[nsz:]
 
 		mr, msz := utf8.DecodeRune(mixed)
 		mixed = mixed[msz:]
 
-		if lr != unicode.ToLower(mr) {
-			return false
+		if foldRune(nr) != foldRune(mr) {
+			return 0, false
 		}
+		sz += msz
 	}
 
-	return len(lower) == 0
+	return sz, len(needle) == 0
 }
 
 type ngram uint64
@@ -291,3 +312,638 @@ func fromDeltas(data []byte, buf []uint32) []uint32 {
 	}
 	return buf
 }
+
+// Encodings of a posting list in a codecPostings section, given by
+// its first byte.
+const (
+	// postingsVarint is followed by the deltas as for fromDeltas.
+	postingsVarint byte = 0
+
+	// postingsPacked is followed by the number of offsets and the
+	// first offset as uvarints, a byte with the bit width of the
+	// deltas, and the remaining deltas packed in that many bits
+	// each, least significant bit first.
+	postingsPacked byte = 1
+)
+
+// toTaggedDeltas returns the posting list with the given varint
+// deltas in the smaller of the two encodings. Dense lists have small
+// deltas, which pack into fewer bits than a varint takes.
+func toTaggedDeltas(deltas []byte) []byte {
+	packed := packDeltas(fromDeltas(deltas, nil))
+	if len(packed) < len(deltas)+1 {
+		return packed
+	}
+	return append([]byte{postingsVarint}, deltas...)
+}
+
+func packDeltas(offsets []uint32) []byte {
+	var enc [binary.MaxVarintLen64]byte
+	out := []byte{postingsPacked}
+	m := binary.PutUvarint(enc[:], uint64(len(offsets)))
+	out = append(out, enc[:m]...)
+	if len(offsets) == 0 {
+		return out
+	}
+	m = binary.PutUvarint(enc[:], uint64(offsets[0]))
+	out = append(out, enc[:m]...)
+
+	// unpackDeltas rejects width 0 for more than one offset, so that a
+	// corrupt count cannot pass for a list of empty deltas.
+	width := uint(1)
+	for i := 1; i < len(offsets); i++ {
+		for d := offsets[i] - offsets[i-1]; d>>width != 0; width++ {
+		}
+	}
+	out = append(out, byte(width))
+
+	var acc uint64
+	var bits uint
+	for i := 1; i < len(offsets); i++ {
+		acc |= uint64(offsets[i]-offsets[i-1]) << bits
+		bits += width
+		for bits >= 8 {
+			out = append(out, byte(acc))
+			acc >>= 8
+			bits -= 8
+		}
+	}
+	if bits > 0 {
+		out = append(out, byte(acc))
+	}
+	return out
+}
+
+// fromTaggedDeltas decodes a posting list from a codecPostings
+// section. Empty data, as for an ngram that is not in the index, is
+// an empty list.
+func fromTaggedDeltas(data []byte, buf []uint32) ([]uint32, error) {
+	if len(data) == 0 {
+		return buf[:0], nil
+	}
+	switch data[0] {
+	case postingsVarint:
+		return fromDeltas(data[1:], buf), nil
+	case postingsPacked:
+		return unpackDeltas(data[1:], buf)
+	}
+	return nil, fmt.Errorf("unknown posting list encoding %d", data[0])
+}
+
+func unpackDeltas(data []byte, buf []uint32) ([]uint32, error) {
+	count, m := binary.Uvarint(data)
+	if m <= 0 {
+		return nil, fmt.Errorf("bad count in packed posting list")
+	}
+	data = data[m:]
+	buf = buf[:0]
+	if count == 0 {
+		return buf, nil
+	}
+
+	first, m := binary.Uvarint(data)
+	if m <= 0 || len(data) == m {
+		return nil, fmt.Errorf("bad first offset in packed posting list")
+	}
+	width := uint(data[m])
+	data = data[m+1:]
+	if width > 32 {
+		return nil, fmt.Errorf("packed posting list has width %d", width)
+	}
+	if width == 0 && count > 1 {
+		return nil, fmt.Errorf("packed posting list of %d offsets has width 0", count)
+	}
+	if width > 0 && count-1 > uint64(len(data))*8/uint64(width) {
+		return nil, fmt.Errorf("packed posting list has %d bytes for %d offsets", len(data), count)
+	}
+	if need := ((count-1)*uint64(width) + 7) / 8; uint64(len(data)) < need {
+		return nil, fmt.Errorf("packed posting list has %d bytes, want %d", len(data), need)
+	}
+
+	if uint64(cap(buf)) < count {
+		buf = make([]uint32, 0, count)
+	}
+	last := uint32(first)
+	buf = append(buf, last)
+	mask := uint64(1)<<width - 1
+	var acc uint64
+	var bits uint
+	for i := uint64(1); i < count; i++ {
+		for bits < width {
+			acc |= uint64(data[0]) << bits
+			data = data[1:]
+			bits += 8
+		}
+		last += uint32(acc & mask)
+		acc >>= width
+		bits -= width
+		buf = append(buf, last)
+	}
+	return buf, nil
+}
+
+// decodePostings decodes a posting list from a section with codec c.
+func decodePostings(c sectionCodec, data []byte, buf []uint32) ([]uint32, error) {
+	if c == codecPostings {
+		return fromTaggedDeltas(data, buf)
+	}
+	return fromDeltas(data, buf), nil
+}
+
+// marshalRankSignals encodes the signals per document. It writes the
+// sorted signal names, followed by an entry for each document that
+// has signals: the delta to the previous such document, the number of
+// signals, and (name index, float64 bits) pairs.
+func marshalRankSignals(docs []map[string]float64) []byte {
+	nameSet := map[string]struct{}{}
+	for _, signals := range docs {
+		for n := range signals {
+			nameSet[n] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(nameSet))
+	for n := range nameSet {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	index := make(map[string]uint64, len(names))
+	for i, n := range names {
+		index[n] = uint64(i)
+	}
+
+	var enc [binary.MaxVarintLen64]byte
+	var out []byte
+	putUvarint := func(n uint64) {
+		m := binary.PutUvarint(enc[:], n)
+		out = append(out, enc[:m]...)
+	}
+
+	putUvarint(uint64(len(names)))
+	for _, n := range names {
+		putUvarint(uint64(len(n)))
+		out = append(out, n...)
+	}
+
+	last := 0
+	for i, signals := range docs {
+		if len(signals) == 0 {
+			continue
+		}
+		putUvarint(uint64(i - last))
+		last = i
+		putUvarint(uint64(len(signals)))
+
+		keys := make([]string, 0, len(signals))
+		for n := range signals {
+			keys = append(keys, n)
+		}
+		sort.Strings(keys)
+		for _, n := range keys {
+			putUvarint(index[n])
+			binary.BigEndian.PutUint64(enc[:], math.Float64bits(signals[n]))
+			out = append(out, enc[:8]...)
+		}
+	}
+	return out
+}
+
+// unmarshalRankSignals decodes the output of marshalRankSignals into
+// a document index => signals map.
+func unmarshalRankSignals(in []byte) (map[uint32]map[string]float64, error) {
+	if len(in) == 0 {
+		// Shards from before rank signals.
+		return map[uint32]map[string]float64{}, nil
+	}
+	uvarint := func() (uint64, error) {
+		n, m := binary.Uvarint(in)
+		if m <= 0 {
+			return 0, fmt.Errorf("rank signals: corrupt varint")
+		}
+		in = in[m:]
+		return n, nil
+	}
+
+	count, err := uvarint()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := uint64(0); i < count; i++ {
+		sz, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if sz > uint64(len(in)) {
+			return nil, fmt.Errorf("rank signals: name out of bounds")
+		}
+		names = append(names, string(in[:sz]))
+		in = in[sz:]
+	}
+
+	result := map[uint32]map[string]float64{}
+	var doc uint64
+	for len(in) > 0 {
+		delta, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		doc += delta
+		n, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		signals := make(map[string]float64, n)
+		for j := uint64(0); j < n; j++ {
+			idx, err := uvarint()
+			if err != nil {
+				return nil, err
+			}
+			if idx >= uint64(len(names)) || len(in) < 8 {
+				return nil, fmt.Errorf("rank signals: signal out of bounds")
+			}
+			signals[names[idx]] = math.Float64frombits(binary.BigEndian.Uint64(in))
+			in = in[8:]
+		}
+		result[uint32(doc)] = signals
+	}
+	return result, nil
+}
+
+// firstLastCommitVersion is the first format version that stores the
+// last commits of documents.
+const firstLastCommitVersion = 19
+
+// lastCommit is the commit that last changed a document.
+type lastCommit struct {
+	id   string
+	time time.Time
+}
+
+// marshalLastCommits encodes the commits per document. It writes an
+// entry for each document with a commit ID: the delta to the previous
+// such document, the length of the ID, the ID, and the commit time in
+// seconds since the epoch as a signed varint.
+func marshalLastCommits(docs []lastCommit) []byte {
+	var enc [binary.MaxVarintLen64]byte
+	var out []byte
+	last := 0
+	for i, c := range docs {
+		if c.id == "" {
+			continue
+		}
+		m := binary.PutUvarint(enc[:], uint64(i-last))
+		out = append(out, enc[:m]...)
+		last = i
+		m = binary.PutUvarint(enc[:], uint64(len(c.id)))
+		out = append(out, enc[:m]...)
+		out = append(out, c.id...)
+		m = binary.PutVarint(enc[:], c.time.Unix())
+		out = append(out, enc[:m]...)
+	}
+	return out
+}
+
+// unmarshalLastCommits decodes the output of marshalLastCommits into
+// a document index => commit map. It returns nil if there are no
+// commits.
+func unmarshalLastCommits(in []byte) (map[uint32]lastCommit, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	result := map[uint32]lastCommit{}
+	var doc uint64
+	for len(in) > 0 {
+		delta, m := binary.Uvarint(in)
+		if m <= 0 {
+			return nil, fmt.Errorf("last commits: corrupt varint")
+		}
+		in = in[m:]
+		doc += delta
+
+		sz, m := binary.Uvarint(in)
+		if m <= 0 || sz > uint64(len(in)-m) {
+			return nil, fmt.Errorf("last commits: commit ID out of bounds")
+		}
+		in = in[m:]
+		id := string(in[:sz])
+		in = in[sz:]
+
+		secs, m := binary.Varint(in)
+		if m <= 0 {
+			return nil, fmt.Errorf("last commits: corrupt varint")
+		}
+		in = in[m:]
+		result[uint32(doc)] = lastCommit{id: id, time: time.Unix(secs, 0)}
+	}
+	return result, nil
+}
+
+// firstContentSlotsVersion is the first format version in which
+// documents with the same content share its copy in the file
+// contents section.
+const firstContentSlotsVersion = 21
+
+// marshalContentSlots encodes the item of the file contents section
+// that holds each document. A document whose content is not stored
+// earlier gets the next item. Only the other documents are written:
+// the delta to the previous such document, and the item, both as
+// varints. If no content is shared, the output is empty.
+func marshalContentSlots(slots []uint32) []byte {
+	var enc [binary.MaxVarintLen64]byte
+	var out []byte
+	next := uint32(0)
+	last := 0
+	for i, s := range slots {
+		if s == next {
+			next++
+			continue
+		}
+		m := binary.PutUvarint(enc[:], uint64(i-last))
+		out = append(out, enc[:m]...)
+		last = i
+		m = binary.PutUvarint(enc[:], uint64(s))
+		out = append(out, enc[:m]...)
+	}
+	return out
+}
+
+// firstFileModeVersion is the first format version that stores the
+// file modes of documents.
+const firstFileModeVersion = 22
+
+// marshalFileModes encodes the file modes per document as runs: the
+// number of consecutive documents with the same mode, and the mode,
+// both as varints. Most documents share a mode, so the runs are few.
+// If no document has a mode, the output is empty.
+func marshalFileModes(modes []uint32) []byte {
+	known := false
+	for _, m := range modes {
+		if m != 0 {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil
+	}
+
+	var enc [binary.MaxVarintLen64]byte
+	var out []byte
+	for i := 0; i < len(modes); {
+		j := i + 1
+		for j < len(modes) && modes[j] == modes[i] {
+			j++
+		}
+		m := binary.PutUvarint(enc[:], uint64(j-i))
+		out = append(out, enc[:m]...)
+		m = binary.PutUvarint(enc[:], uint64(modes[i]))
+		out = append(out, enc[:m]...)
+		i = j
+	}
+	return out
+}
+
+// unmarshalContentSlots decodes the output of marshalContentSlots for
+// n documents and a file contents section of items items. It returns
+// nil if no content is shared.
+func unmarshalContentSlots(in []byte, n, items int) ([]uint32, error) {
+	if len(in) == 0 {
+		if n != items {
+			return nil, fmt.Errorf("content slots: got %d items for %d documents", items, n)
+		}
+		return nil, nil
+	}
+	result := make([]uint32, 0, n)
+	next := uint32(0)
+	// add fills in the documents before doc, which have their own
+	// item.
+	add := func(doc uint64) error {
+		if doc > uint64(n) {
+			return fmt.Errorf("content slots: document out of bounds")
+		}
+		for uint64(len(result)) < doc {
+			result = append(result, next)
+			next++
+		}
+		return nil
+	}
+	var doc uint64
+	for len(in) > 0 {
+		delta, m := binary.Uvarint(in)
+		if m <= 0 || delta > uint64(n) || (len(result) > 0 && delta == 0) {
+			return nil, fmt.Errorf("content slots: corrupt document delta")
+		}
+		in = in[m:]
+		doc += delta
+		if err := add(doc); err != nil {
+			return nil, err
+		}
+		if doc == uint64(n) {
+			return nil, fmt.Errorf("content slots: document out of bounds")
+		}
+
+		slot, m := binary.Uvarint(in)
+		if m <= 0 || slot >= uint64(next) {
+			return nil, fmt.Errorf("content slots: item out of bounds")
+		}
+		in = in[m:]
+		result = append(result, uint32(slot))
+	}
+	if err := add(uint64(n)); err != nil {
+		return nil, err
+	}
+	if int(next) != items {
+		return nil, fmt.Errorf("content slots: got %d items, want %d", items, next)
+	}
+	return result, nil
+}
+
+// contentBoundaries returns the offsets of the documents' contents,
+// laid out back to back, plus a final marking the end of the last,
+// from the offsets of the items in the file contents section, as
+// relativeIndex returns them, and the item of each document. If slots
+// is nil, those are the item offsets.
+func contentBoundaries(items []uint32, slots []uint32) []uint32 {
+	if slots == nil {
+		return items
+	}
+	result := make([]uint32, 0, len(slots)+1)
+	var off uint32
+	for _, s := range slots {
+		result = append(result, off)
+		off += items[s+1] - items[s]
+	}
+	return append(result, off)
+}
+
+// unmarshalFileModes decodes the output of marshalFileModes for n
+// documents. It returns nil if there are no modes.
+func unmarshalFileModes(in []byte, n int) ([]uint32, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	result := make([]uint32, 0, n)
+	for len(in) > 0 {
+		count, m := binary.Uvarint(in)
+		if m <= 0 || count > uint64(n-len(result)) {
+			return nil, fmt.Errorf("file modes: run out of bounds")
+		}
+		in = in[m:]
+		mode, m := binary.Uvarint(in)
+		if m <= 0 || mode > math.MaxUint32 {
+			return nil, fmt.Errorf("file modes: corrupt varint")
+		}
+		in = in[m:]
+		for i := uint64(0); i < count; i++ {
+			result = append(result, uint32(mode))
+		}
+	}
+	if len(result) != n {
+		return nil, fmt.Errorf("file modes: got %d documents, want %d", len(result), n)
+	}
+	return result, nil
+}
+
+// firstGeneratedVersion is the first format version that marks
+// generated documents in a section of their own. Before, they had the
+// rank signal legacyGeneratedSignal.
+const firstGeneratedVersion = 23
+
+// legacyGeneratedSignal is the rank signal that marks generated
+// documents before firstGeneratedVersion.
+const legacyGeneratedSignal = "zoekt.generated"
+
+// marshalGenerated encodes the generated documents as the deltas
+// between their indices, as varints. If no document is generated, the
+// output is empty.
+func marshalGenerated(generated []bool) []byte {
+	var enc [binary.MaxVarintLen64]byte
+	var out []byte
+	last := 0
+	for i, g := range generated {
+		if !g {
+			continue
+		}
+		m := binary.PutUvarint(enc[:], uint64(i-last))
+		out = append(out, enc[:m]...)
+		last = i
+	}
+	return out
+}
+
+// unmarshalGenerated decodes the output of marshalGenerated for n
+// documents. It returns nil if no document is generated.
+func unmarshalGenerated(in []byte, n int) (map[uint32]bool, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	result := map[uint32]bool{}
+	var doc uint64
+	for len(in) > 0 {
+		delta, m := binary.Uvarint(in)
+		if m <= 0 || delta > uint64(n) || (len(result) > 0 && delta == 0) {
+			return nil, fmt.Errorf("generated: corrupt document delta")
+		}
+		in = in[m:]
+		doc += delta
+		if doc >= uint64(n) {
+			return nil, fmt.Errorf("generated: document out of bounds")
+		}
+		result[uint32(doc)] = true
+	}
+	return result, nil
+}
+
+// firstLanguageVersion is the first format version that stores the
+// languages of documents.
+const firstLanguageVersion = 24
+
+// marshalLanguages encodes the language per document: the number of
+// distinct languages and their names, each as a varint length and the
+// bytes, followed by runs of consecutive documents with the same
+// language, as the number of documents and 1 plus the index of the
+// name, or 0 for no language, both as varints. If no document has a
+// language, the output is empty.
+func marshalLanguages(langs []string) []byte {
+	ids := map[string]int{}
+	var names []string
+	for _, l := range langs {
+		if _, ok := ids[l]; !ok && l != "" {
+			ids[l] = len(names) + 1
+			names = append(names, l)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	var enc [binary.MaxVarintLen64]byte
+	var out []byte
+	m := binary.PutUvarint(enc[:], uint64(len(names)))
+	out = append(out, enc[:m]...)
+	for _, n := range names {
+		m = binary.PutUvarint(enc[:], uint64(len(n)))
+		out = append(out, enc[:m]...)
+		out = append(out, n...)
+	}
+	for i := 0; i < len(langs); {
+		j := i + 1
+		for j < len(langs) && langs[j] == langs[i] {
+			j++
+		}
+		m = binary.PutUvarint(enc[:], uint64(j-i))
+		out = append(out, enc[:m]...)
+		m = binary.PutUvarint(enc[:], uint64(ids[langs[i]]))
+		out = append(out, enc[:m]...)
+		i = j
+	}
+	return out
+}
+
+// unmarshalLanguages decodes the output of marshalLanguages for n
+// documents. It returns nil if there are no languages.
+func unmarshalLanguages(in []byte, n int) ([]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	count, m := binary.Uvarint(in)
+	if m <= 0 || count > uint64(len(in)) {
+		return nil, fmt.Errorf("languages: corrupt name count")
+	}
+	in = in[m:]
+	names := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		sz, m := binary.Uvarint(in)
+		if m <= 0 || sz > uint64(len(in)-m) {
+			return nil, fmt.Errorf("languages: name out of bounds")
+		}
+		names = append(names, string(in[m:m+int(sz)]))
+		in = in[m+int(sz):]
+	}
+
+	result := make([]string, 0, n)
+	for len(in) > 0 {
+		run, m := binary.Uvarint(in)
+		if m <= 0 || run > uint64(n-len(result)) {
+			return nil, fmt.Errorf("languages: run out of bounds")
+		}
+		in = in[m:]
+		id, m := binary.Uvarint(in)
+		if m <= 0 || id > uint64(len(names)) {
+			return nil, fmt.Errorf("languages: name index out of bounds")
+		}
+		in = in[m:]
+		lang := ""
+		if id > 0 {
+			lang = names[id-1]
+		}
+		for i := uint64(0); i < run; i++ {
+			result = append(result, lang)
+		}
+	}
+	if len(result) != n {
+		return nil, fmt.Errorf("languages: got %d documents, want %d", len(result), n)
+	}
+	return result, nil
+}
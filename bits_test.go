@@ -18,6 +18,7 @@ import (
 	"log"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var _ = log.Println
@@ -72,3 +73,148 @@ func TestMergeUInt32(t *testing.T) {
 		t.Errorf("DeepEqual: got %v want %v", got, want)
 	}
 }
+
+func TestRankSignals(t *testing.T) {
+	in := []map[string]float64{
+		nil,
+		{"recency": 0.5, "popularity": 12},
+		{},
+		{"recency": -1},
+	}
+	roundtrip, err := unmarshalRankSignals(marshalRankSignals(in))
+	if err != nil {
+		t.Fatalf("unmarshalRankSignals: %v", err)
+	}
+	want := map[uint32]map[string]float64{
+		1: {"recency": 0.5, "popularity": 12},
+		3: {"recency": -1},
+	}
+	if !reflect.DeepEqual(roundtrip, want) {
+		t.Errorf("got %v, want %v", roundtrip, want)
+	}
+
+	if got := marshalRankSignals([]map[string]float64{nil, nil}); len(got) != 1 {
+		t.Errorf("got %d bytes for documents without signals, want 1", len(got))
+	}
+}
+
+func TestLastCommits(t *testing.T) {
+	in := []lastCommit{
+		{},
+		{id: "b2ca0fef", time: time.Unix(1500000000, 0)},
+		{},
+		{id: "848145503bf7", time: time.Unix(-5, 0)},
+	}
+	roundtrip, err := unmarshalLastCommits(marshalLastCommits(in))
+	if err != nil {
+		t.Fatalf("unmarshalLastCommits: %v", err)
+	}
+	want := map[uint32]lastCommit{1: in[1], 3: in[3]}
+	if !reflect.DeepEqual(roundtrip, want) {
+		t.Errorf("got %v, want %v", roundtrip, want)
+	}
+
+	if got := marshalLastCommits([]lastCommit{{}, {}}); len(got) != 0 {
+		t.Errorf("got %d bytes for documents without commits, want 0", len(got))
+	}
+	if _, err := unmarshalLastCommits([]byte{0, 40, 'x'}); err == nil {
+		t.Error("unmarshalLastCommits succeeded for a truncated ID")
+	}
+}
+
+func TestContentSlots(t *testing.T) {
+	in := []uint32{0, 1, 0, 2, 1, 1, 3}
+	roundtrip, err := unmarshalContentSlots(marshalContentSlots(in), len(in), 4)
+	if err != nil {
+		t.Fatalf("unmarshalContentSlots: %v", err)
+	}
+	if !reflect.DeepEqual(roundtrip, in) {
+		t.Errorf("got %v, want %v", roundtrip, in)
+	}
+
+	if got := marshalContentSlots([]uint32{0, 1, 2}); len(got) != 0 {
+		t.Errorf("got %d bytes without shared content, want 0", len(got))
+	}
+	if got, err := unmarshalContentSlots(nil, 3, 3); err != nil || got != nil {
+		t.Errorf("got %v, %v without shared content, want nil", got, err)
+	}
+	if _, err := unmarshalContentSlots(nil, 3, 2); err == nil {
+		t.Error("unmarshalContentSlots succeeded for fewer items than documents")
+	}
+	if _, err := unmarshalContentSlots(marshalContentSlots(in), len(in), 5); err == nil {
+		t.Error("unmarshalContentSlots succeeded for the wrong number of items")
+	}
+	if _, err := unmarshalContentSlots(marshalContentSlots(in), 3, 2); err == nil {
+		t.Error("unmarshalContentSlots succeeded for too few documents")
+	}
+	// Document 1 can't share the content of the later item 1.
+	if _, err := unmarshalContentSlots([]byte{1, 1}, 3, 2); err == nil {
+		t.Error("unmarshalContentSlots succeeded for an item that is not stored yet")
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	in := []uint32{0100644, 0100644, 0100755, 0120000, 0, 0100644}
+	roundtrip, err := unmarshalFileModes(marshalFileModes(in), len(in))
+	if err != nil {
+		t.Fatalf("unmarshalFileModes: %v", err)
+	}
+	if !reflect.DeepEqual(roundtrip, in) {
+		t.Errorf("got %o, want %o", roundtrip, in)
+	}
+
+	if got := marshalFileModes([]uint32{0, 0}); len(got) != 0 {
+		t.Errorf("got %d bytes for documents without modes, want 0", len(got))
+	}
+	if _, err := unmarshalFileModes(marshalFileModes(in), len(in)+1); err == nil {
+		t.Error("unmarshalFileModes succeeded for too few documents")
+	}
+	if _, err := unmarshalFileModes(marshalFileModes(in), len(in)-1); err == nil {
+		t.Error("unmarshalFileModes succeeded for too many documents")
+	}
+}
+
+func TestGenerated(t *testing.T) {
+	in := []bool{true, false, false, true, true, false}
+	got, err := unmarshalGenerated(marshalGenerated(in), len(in))
+	if err != nil {
+		t.Fatalf("unmarshalGenerated: %v", err)
+	}
+	if want := map[uint32]bool{0: true, 3: true, 4: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := marshalGenerated([]bool{false, false}); len(got) != 0 {
+		t.Errorf("got %d bytes without generated documents, want 0", len(got))
+	}
+	if _, err := unmarshalGenerated(marshalGenerated(in), 4); err == nil {
+		t.Error("unmarshalGenerated succeeded for too few documents")
+	}
+	if _, err := unmarshalGenerated([]byte{1, 0}, 4); err == nil {
+		t.Error("unmarshalGenerated succeeded for a repeated document")
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	in := []string{"Go", "Go", "", "C", "Go", ""}
+	roundtrip, err := unmarshalLanguages(marshalLanguages(in), len(in))
+	if err != nil {
+		t.Fatalf("unmarshalLanguages: %v", err)
+	}
+	if !reflect.DeepEqual(roundtrip, in) {
+		t.Errorf("got %q, want %q", roundtrip, in)
+	}
+
+	if got := marshalLanguages([]string{"", ""}); len(got) != 0 {
+		t.Errorf("got %d bytes for documents without languages, want 0", len(got))
+	}
+	if _, err := unmarshalLanguages(marshalLanguages(in), len(in)+1); err == nil {
+		t.Error("unmarshalLanguages succeeded for too few documents")
+	}
+	if _, err := unmarshalLanguages(marshalLanguages(in), len(in)-1); err == nil {
+		t.Error("unmarshalLanguages succeeded for too many documents")
+	}
+	if _, err := unmarshalLanguages([]byte{1, 5, 'G'}, 1); err == nil {
+		t.Error("unmarshalLanguages succeeded for a truncated name")
+	}
+}
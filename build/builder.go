@@ -17,18 +17,23 @@
 package build
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
 
 	"github.com/google/zoekt"
+	"golang.org/x/net/context"
 )
 
 var DefaultDir = filepath.Join(os.Getenv("HOME"), ".zoekt")
@@ -47,6 +52,13 @@ type Options struct {
 	// SizeMax is the maximum file size
 	SizeMax int
 
+	// SizeMaxByExtension maps lowercase file extensions, including
+	// the dot (eg. ".json" or ".min.js"), to a maximum file size
+	// that replaces SizeMax for files with that extension, whether
+	// it is lower or higher. If several entries match a file, the
+	// longest extension wins; if none match, SizeMax applies.
+	SizeMaxByExtension map[string]int
+
 	// Parallelism is the maximum number of shards to index in parallel
 	Parallelism int
 
@@ -73,6 +85,77 @@ type Options struct {
 
 	// Write memory profiles to this file.
 	MemProfile string
+
+	// ShardNameFunc returns the file name (without directory) for
+	// the given shard of the repository. The name must end in
+	// ".zoekt". If unset, the name is derived from RepoDir.
+	ShardNameFunc func(repoName string, shardIndex int) string
+
+	// FingerprintExtra is stored in the index. Incremental
+	// indexing rebuilds the index if it was built with different
+	// data, so callers can set it to something that changes with
+	// inputs outside of the repository, such as a hash of their
+	// configuration.
+	FingerprintExtra []byte
+
+	// MaxOffsetTableSize is the maximum size in bytes of the
+	// offset table of a single index section. Shards whose tables
+	// would be larger fail to build. If unset,
+	// zoekt.DefaultMaxOffsetTableSize is used.
+	MaxOffsetTableSize int
+
+	// TruncateLongLines, if positive, makes search results cut
+	// matched lines to this many bytes. Documents with lines over
+	// 1000 bytes are not indexed at all, so only smaller values
+	// have an effect.
+	TruncateLongLines int
+
+	// CompressContent stores file contents compressed with zstd.
+	// This makes shards smaller, but loading content for
+	// matches slower.
+	CompressContent bool
+
+	// PackPostings bit-packs posting lists where that is smaller
+	// than varint deltas. Each list then takes an extra byte, so
+	// this only makes shards smaller if many lists are dense.
+	PackPostings bool
+
+	// MaxBuildMemory, if positive, bounds the size of the
+	// documents handed to shard builds that haven't finished.
+	// Once it is reached, Add waits for running builds, and
+	// shards are cut at this size if it is below ShardMax. This
+	// reduces parallelism and produces more, smaller shards, so
+	// indexing takes longer.
+	MaxBuildMemory int
+
+	// MaxTrigramsPerDoc is the maximum number of distinct
+	// trigrams in a document. Documents with more are skipped. If
+	// unset, the default limit of zoekt.IsText applies.
+	MaxTrigramsPerDoc int
+
+	// If set, write a JSON manifest next to each shard.
+	Manifest bool
+
+	// If set, the manifest lists the size and trigram count of
+	// each document. Implies Manifest.
+	ManifestVerbose bool
+}
+
+// Manifest summarizes the contents of a shard.
+type Manifest struct {
+	Repository   string
+	Shard        string
+	Documents    int
+	ContentBytes int64
+	IndexBytes   int64
+
+	// Only set for Options.ManifestVerbose.
+	Files []zoekt.DocumentStat `json:",omitempty"`
+}
+
+// manifestName returns the name of the manifest for a shard file.
+func manifestName(shardName string) string {
+	return strings.TrimSuffix(shardName, ".zoekt") + ".manifest.json"
 }
 
 // Builder manages (parallel) creation of uniformly sized shards.
@@ -80,6 +163,9 @@ type Builder struct {
 	opts     Options
 	throttle chan int
 
+	// ctx stops the build once it is done.
+	ctx context.Context
+
 	nextShardNum int
 	todo         []*zoekt.Document
 	size         int
@@ -92,10 +178,26 @@ type Builder struct {
 	// temp name => final name for finished shards. We only rename
 	// them once all shards succeed to avoid Frankstein corpuses.
 	finishedShards map[string]string
+
+	// final name => shard number, to detect name collisions.
+	shardNames map[string]int
+
+	// Number of documents skipped for MaxTrigramsPerDoc.
+	trigramSkipped int
+
+	// Size of the documents in shards that are being built, for
+	// MaxBuildMemory. memCond is signaled when it decreases.
+	memMu       sync.Mutex
+	memCond     *sync.Cond
+	pending     int
+	peakPending int
 }
 
 type finishedShard struct {
 	temp, final string
+
+	// The manifest written for the shard, if any.
+	manifest *finishedShard
 }
 
 // SetDefaults sets reasonable default options.
@@ -132,6 +234,14 @@ func (o *Options) SetDefaults() {
 
 // ShardName returns the name the given index shard.
 func (o *Options) shardName(n int) (string, error) {
+	if o.ShardNameFunc != nil {
+		name := o.ShardNameFunc(o.RepositoryDescription.Name, n)
+		if err := checkShardName(name); err != nil {
+			return "", err
+		}
+		return filepath.Join(o.IndexDir, name), nil
+	}
+
 	abs, err := filepath.Abs(o.RepoDir)
 	if err != nil {
 		return "", err
@@ -141,9 +251,74 @@ func (o *Options) shardName(n int) (string, error) {
 		fmt.Sprintf("%s_v%d.%05d.zoekt", strings.Replace(abs, "/", "_", -1), zoekt.IndexFormatVersion, n)), nil
 }
 
+// LockName returns the name of the file used to lock the shards of
+// the repository against concurrent indexing.
+func (o *Options) LockName() (string, error) {
+	fn, err := o.shardName(0)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(fn, ".zoekt") + ".lock", nil
+}
+
+// checkShardName verifies that a name returned from ShardNameFunc
+// is a plain file name that the shard loader will pick up.
+func checkShardName(name string) error {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid shard name %q", name)
+	}
+	if !strings.HasSuffix(name, ".zoekt") {
+		return fmt.Errorf("shard name %q must end in .zoekt", name)
+	}
+	return nil
+}
+
+// SizeMaxFor returns the maximum size for the file with the given
+// name, following SizeMaxByExtension.
+func (o *Options) SizeMaxFor(name string) int {
+	if len(o.SizeMaxByExtension) == 0 {
+		return o.SizeMax
+	}
+
+	base := strings.ToLower(path.Base(name))
+	for i := 1; i < len(base); i++ {
+		if base[i] != '.' {
+			continue
+		}
+		if max, ok := o.SizeMaxByExtension[base[i:]]; ok {
+			return max
+		}
+	}
+	return o.SizeMax
+}
+
 // IndexVersions returns the versions as present in the index, for
 // implementing incremental indexing.
 func (o *Options) IndexVersions() []zoekt.RepositoryBranch {
+	repo := o.indexRepository()
+	if repo == nil {
+		return nil
+	}
+	return repo.Branches
+}
+
+// IndexUpToDate returns true if the index holds the branches and
+// versions of RepositoryDescription, for the same BranchRefs, and was
+// built with the same FingerprintExtra.
+func (o *Options) IndexUpToDate() bool {
+	repo := o.indexRepository()
+	if repo == nil {
+		return false
+	}
+	return reflect.DeepEqual(repo.Branches, o.RepositoryDescription.Branches) &&
+		reflect.DeepEqual(repo.BranchRefs, o.RepositoryDescription.BranchRefs) &&
+		bytes.Equal(repo.FingerprintExtra, o.FingerprintExtra)
+}
+
+// indexRepository returns the repository stored in the first shard,
+// or nil if it can't be read or is from another feature version.
+func (o *Options) indexRepository() *zoekt.Repository {
 	fn, err := o.shardName(0)
 	if err != nil {
 		return nil
@@ -168,54 +343,112 @@ func (o *Options) IndexVersions() []zoekt.RepositoryBranch {
 		return nil
 	}
 
-	return repo.Branches
+	return repo
+}
+
+// FindAllShards returns the file names of the existing shards of the
+// repository.
+func (o *Options) FindAllShards() []string {
+	var names []string
+	for n := 0; ; n++ {
+		name, err := o.shardName(n)
+		if err != nil {
+			break
+		}
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	return names
 }
 
 // NewBuilder creates a new Builder instance.
 func NewBuilder(opt Options) (*Builder, error) {
+	return NewBuilderContext(context.Background(), opt)
+}
+
+// NewBuilderContext is NewBuilder, but the build stops once ctx is
+// done: running ctags processes are killed, Add and Finish return
+// ctx.Err(), and no shards are written.
+func NewBuilderContext(ctx context.Context, opt Options) (*Builder, error) {
 	if opt.RepoDir == "" {
 		return nil, fmt.Errorf("must set options.RepoDir")
 	}
 
 	b := &Builder{
 		opts:           opt,
+		ctx:            ctx,
 		throttle:       make(chan int, opt.Parallelism),
 		finishedShards: map[string]string{},
+		shardNames:     map[string]int{},
 	}
+	b.memCond = sync.NewCond(&b.memMu)
 
 	if _, err := b.newShardBuilder(); err != nil {
 		return nil, err
 	}
+	if _, err := opt.shardName(0); err != nil {
+		return nil, err
+	}
 
 	return b, nil
 }
 
+// TrigramSkipped returns the number of documents that were skipped
+// because they exceeded Options.MaxTrigramsPerDoc.
+func (b *Builder) TrigramSkipped() int {
+	return b.trigramSkipped
+}
+
 func (b *Builder) AddFile(name string, content []byte) {
 	b.Add(zoekt.Document{Name: name, Content: content})
 }
 
-func (b *Builder) Add(doc zoekt.Document) error {
-	if len(doc.Content) > b.opts.SizeMax {
-		return nil
+// Add adds a document to the index. It returns false if the
+// document was skipped, because it is too large or not text.
+func (b *Builder) Add(doc zoekt.Document) (bool, error) {
+	if err := b.ctx.Err(); err != nil {
+		return false, err
+	}
+	if len(doc.Content) > b.opts.SizeMaxFor(doc.Name) {
+		return false, nil
 	}
 
-	if !zoekt.IsText(doc.Content) {
-		return nil
+	if b.opts.MaxTrigramsPerDoc > 0 {
+		isText, trigrams := zoekt.CheckText(doc.Content, b.opts.MaxTrigramsPerDoc)
+		if trigrams > b.opts.MaxTrigramsPerDoc {
+			b.trigramSkipped++
+		}
+		if !isText {
+			return false, nil
+		}
+	} else if !zoekt.IsText(doc.Content) {
+		return false, nil
 	}
 
 	b.todo = append(b.todo, &doc)
 	b.size += len(doc.Name) + len(doc.Content)
-	if b.size > b.opts.ShardMax {
-		return b.flush()
+	if b.size > b.opts.ShardMax ||
+		(b.opts.MaxBuildMemory > 0 && b.size > b.opts.MaxBuildMemory) {
+		return true, b.flush()
 	}
 
-	return nil
+	return true, nil
 }
 
 func (b *Builder) Finish() error {
 	b.flush()
 	b.building.Wait()
 
+	if err := b.ctx.Err(); err != nil && b.buildError == nil {
+		b.buildError = err
+	}
+
+	if b.trigramSkipped > 0 {
+		log.Printf("skipped %d documents with more than %d trigrams", b.trigramSkipped, b.opts.MaxTrigramsPerDoc)
+	}
+
 	if b.buildError != nil {
 		for tmp := range b.finishedShards {
 			os.Remove(tmp)
@@ -226,7 +459,9 @@ func (b *Builder) Finish() error {
 	for tmp, final := range b.finishedShards {
 		if err := os.Rename(tmp, final); err != nil {
 			b.buildError = err
+			continue
 		}
+		removeSegments(final)
 	}
 
 	if b.nextShardNum > 0 {
@@ -247,13 +482,52 @@ func (b *Builder) deleteRemainingShards() {
 		if err := os.Remove(name); os.IsNotExist(err) {
 			break
 		}
+		os.Remove(manifestName(name))
+		removeSegments(name)
 	}
 }
 
+// acquireMemory waits until size bytes of documents can be built
+// without going over MaxBuildMemory. A single shard may go over it,
+// if nothing else is being built.
+func (b *Builder) acquireMemory(size int) {
+	b.memMu.Lock()
+	defer b.memMu.Unlock()
+	if b.opts.MaxBuildMemory > 0 {
+		for b.pending > 0 && b.pending+size > b.opts.MaxBuildMemory {
+			b.memCond.Wait()
+		}
+	}
+	b.pending += size
+	if b.pending > b.peakPending {
+		b.peakPending = b.pending
+	}
+}
+
+func (b *Builder) releaseMemory(size int) {
+	b.memMu.Lock()
+	defer b.memMu.Unlock()
+	b.pending -= size
+	b.memCond.Broadcast()
+}
+
 func (b *Builder) flush() error {
 	todo := b.todo
+	size := b.size
 	b.todo = nil
 	b.size = 0
+
+	async := false
+	if len(todo) > 0 {
+		// Wait before taking errMu, which finishing builds need.
+		b.acquireMemory(size)
+		defer func() {
+			if !async {
+				b.releaseMemory(size)
+			}
+		}()
+	}
+
 	b.errMu.Lock()
 	defer b.errMu.Unlock()
 	if b.buildError != nil {
@@ -267,28 +541,43 @@ func (b *Builder) flush() error {
 	shard := b.nextShardNum
 	b.nextShardNum++
 
+	name, err := b.opts.shardName(shard)
+	if err != nil {
+		b.buildError = err
+		return err
+	}
+	if other, ok := b.shardNames[name]; ok {
+		b.buildError = fmt.Errorf("shards %d and %d both named %q", other, shard, name)
+		return b.buildError
+	}
+	b.shardNames[name] = shard
+
 	if b.opts.Parallelism > 1 {
+		async = true
 		b.building.Add(1)
 		go func() {
 			b.throttle <- 1
-			done, err := b.buildShard(todo, shard)
+			done, err := b.buildShard(todo, name)
 			<-b.throttle
+			b.releaseMemory(size)
 
 			b.errMu.Lock()
 			defer b.errMu.Unlock()
 			if err != nil && b.buildError == nil {
 				b.buildError = err
 			}
-			b.finishedShards[done.temp] = done.final
+			if err == nil {
+				b.addFinished(done)
+			}
 			b.building.Done()
 		}()
 	} else {
 		// No goroutines when we're not parallel. This
 		// simplifies memory profiling.
-		done, err := b.buildShard(todo, shard)
+		done, err := b.buildShard(todo, name)
 		b.buildError = err
 		if err == nil {
-			b.finishedShards[done.temp] = done.final
+			b.addFinished(done)
 		}
 		if b.opts.MemProfile != "" {
 			// drop memory, and profile.
@@ -302,6 +591,15 @@ func (b *Builder) flush() error {
 	return nil
 }
 
+// addFinished records a finished shard. Must be called with errMu
+// held.
+func (b *Builder) addFinished(done *finishedShard) {
+	b.finishedShards[done.temp] = done.final
+	if done.manifest != nil {
+		b.finishedShards[done.manifest.temp] = done.manifest.final
+	}
+}
+
 var profileNumber int
 
 func (b *Builder) writeMemProfile(name string) {
@@ -319,12 +617,18 @@ func (b *Builder) writeMemProfile(name string) {
 	log.Printf("wrote mem profile %q", nm)
 }
 
-func (b *Builder) buildShard(todo []*zoekt.Document, nextShardNum int) (*finishedShard, error) {
+func (b *Builder) buildShard(todo []*zoekt.Document, name string) (*finishedShard, error) {
+	if err := b.ctx.Err(); err != nil {
+		return nil, err
+	}
 	if b.opts.CTags == "" && b.opts.CTagsMustSucceed {
 		return nil, fmt.Errorf("ctags binary not found, but CTagsMustSucceed set.")
 	}
 	if b.opts.CTags != "" {
-		err := ctagsAddSymbols(todo, b.opts.CTags, b.opts.NamespaceSandbox)
+		err := ctagsAddSymbols(b.ctx, todo, b.opts.CTags, b.opts.NamespaceSandbox)
+		if ctxErr := b.ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		if b.opts.CTagsMustSucceed && err != nil {
 			return nil, err
 		}
@@ -333,11 +637,6 @@ func (b *Builder) buildShard(todo []*zoekt.Document, nextShardNum int) (*finishe
 		}
 	}
 
-	name, err := b.opts.shardName(nextShardNum)
-	if err != nil {
-		return nil, err
-	}
-
 	shardBuilder, err := b.newShardBuilder()
 	if err != nil {
 		return nil, err
@@ -353,11 +652,16 @@ func (b *Builder) buildShard(todo []*zoekt.Document, nextShardNum int) (*finishe
 func (b *Builder) newShardBuilder() (*zoekt.IndexBuilder, error) {
 	desc := b.opts.RepositoryDescription
 	desc.SubRepoMap = b.opts.SubRepositories
+	desc.FingerprintExtra = b.opts.FingerprintExtra
 
 	shardBuilder, err := zoekt.NewIndexBuilder(&desc)
 	if err != nil {
 		return nil, err
 	}
+	shardBuilder.SetMaxOffsetTableSize(b.opts.MaxOffsetTableSize)
+	shardBuilder.SetTruncateLongLines(b.opts.TruncateLongLines)
+	shardBuilder.SetCompressContent(b.opts.CompressContent)
+	shardBuilder.SetPackPostings(b.opts.PackPostings)
 	return shardBuilder, nil
 }
 
@@ -374,7 +678,8 @@ func (b *Builder) writeShard(fn string, ib *zoekt.IndexBuilder) (*finishedShard,
 
 	defer f.Close()
 	if err := ib.Write(f); err != nil {
-		return nil, err
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("%s: %v", fn, err)
 	}
 	fi, err := f.Stat()
 	if err != nil {
@@ -387,5 +692,51 @@ func (b *Builder) writeShard(fn string, ib *zoekt.IndexBuilder) (*finishedShard,
 	log.Printf("finished %s: %d index bytes (overhead %3.1f)", fn, fi.Size(),
 		float64(fi.Size())/float64(ib.ContentSize()+1))
 
-	return &finishedShard{f.Name(), fn}, nil
+	done := &finishedShard{temp: f.Name(), final: fn}
+	if b.opts.Manifest || b.opts.ManifestVerbose {
+		done.manifest, err = b.writeManifest(fn, ib, fi.Size())
+		if err != nil {
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+
+	return done, nil
+}
+
+// writeManifest writes the manifest for the shard to a temporary
+// file, which is renamed together with the shard.
+func (b *Builder) writeManifest(fn string, ib *zoekt.IndexBuilder, indexBytes int64) (*finishedShard, error) {
+	stats := ib.DocumentStats()
+	m := Manifest{
+		Repository:   b.opts.RepositoryDescription.Name,
+		Shard:        filepath.Base(fn),
+		Documents:    len(stats),
+		ContentBytes: int64(ib.ContentSize()),
+		IndexBytes:   indexBytes,
+	}
+	if b.opts.ManifestVerbose {
+		m.Files = stats
+	}
+
+	blob, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	final := manifestName(fn)
+	f, err := ioutil.TempFile(filepath.Dir(final), filepath.Base(final))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(blob); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &finishedShard{temp: f.Name(), final: final}, nil
 }
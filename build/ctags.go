@@ -26,9 +26,10 @@ import (
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/ctags"
+	"golang.org/x/net/context"
 )
 
-func runCTags(bin string, sandboxBin string, inputs map[string][]byte) ([]*ctags.Entry, error) {
+func runCTags(ctx context.Context, bin string, sandboxBin string, inputs map[string][]byte) ([]*ctags.Entry, error) {
 	const debug = false
 	if len(inputs) == 0 {
 		return nil, nil
@@ -100,7 +101,7 @@ func runCTags(bin string, sandboxBin string, inputs map[string][]byte) ([]*ctags
 		log.Println("WARNING: running ctags without sandboxing.")
 	}
 
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 	cmd.Dir = dir
 
 	var errBuf, outBuf bytes.Buffer
@@ -145,7 +146,7 @@ func runCTags(bin string, sandboxBin string, inputs map[string][]byte) ([]*ctags
 	return entries, nil
 }
 
-func runCTagsChunked(bin, sandboxBin string, in map[string][]byte) ([]*ctags.Entry, error) {
+func runCTagsChunked(ctx context.Context, bin, sandboxBin string, in map[string][]byte) ([]*ctags.Entry, error) {
 	var res []*ctags.Entry
 
 	cur := map[string][]byte{}
@@ -156,7 +157,7 @@ func runCTagsChunked(bin, sandboxBin string, in map[string][]byte) ([]*ctags.Ent
 
 		// 100k seems reasonable.
 		if sz > (100 << 10) {
-			r, err := runCTags(bin, sandboxBin, cur)
+			r, err := runCTags(ctx, bin, sandboxBin, cur)
 			if err != nil {
 				return nil, err
 			}
@@ -166,7 +167,7 @@ func runCTagsChunked(bin, sandboxBin string, in map[string][]byte) ([]*ctags.Ent
 			sz = 0
 		}
 	}
-	r, err := runCTags(bin, sandboxBin, cur)
+	r, err := runCTags(ctx, bin, sandboxBin, cur)
 	if err != nil {
 		return nil, err
 	}
@@ -174,7 +175,7 @@ func runCTagsChunked(bin, sandboxBin string, in map[string][]byte) ([]*ctags.Ent
 	return res, nil
 }
 
-func ctagsAddSymbols(todo []*zoekt.Document, bin, sandboxBin string) error {
+func ctagsAddSymbols(ctx context.Context, todo []*zoekt.Document, bin, sandboxBin string) error {
 	pathIndices := map[string]int{}
 	contents := map[string][]byte{}
 	for i, t := range todo {
@@ -191,7 +192,7 @@ func ctagsAddSymbols(todo []*zoekt.Document, bin, sandboxBin string) error {
 		contents[t.Name] = t.Content
 	}
 
-	entries, err := runCTagsChunked(bin, sandboxBin, contents)
+	entries, err := runCTagsChunked(ctx, bin, sandboxBin, contents)
 	if err != nil {
 		return err
 	}
@@ -15,11 +15,14 @@
 package build
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -290,3 +293,473 @@ func TestPartialSuccess(t *testing.T) {
 		t.Errorf("got shards %v, want []", fs)
 	}
 }
+
+func TestShardNameFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		ShardMax: 1024,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir: "/repo",
+		SizeMax: 1 << 20,
+		ShardNameFunc: func(name string, n int) string {
+			return fmt.Sprintf("bucket-%s-%d.zoekt", name, n)
+		},
+	}
+	opts.SetDefaults()
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		b.AddFile(fmt.Sprintf("F%d", i), []byte(strings.Repeat("01234567\n", 128)))
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	fs, _ := filepath.Glob(dir + "/*")
+	want := []string{filepath.Join(dir, "bucket-repo-0.zoekt"), filepath.Join(dir, "bucket-repo-1.zoekt")}
+	if !reflect.DeepEqual(fs, want) {
+		t.Errorf("got shards %v, want %v", fs, want)
+	}
+
+	opts.ShardNameFunc = func(string, int) string { return "same.zoekt" }
+	b, err = NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		b.AddFile(fmt.Sprintf("F%d", i), []byte(strings.Repeat("01234567\n", 128)))
+	}
+	if err := b.Finish(); err == nil {
+		t.Errorf("Finish with duplicate names succeeded")
+	}
+
+	for _, bad := range []string{"", "..", "sub/x.zoekt", "x.idx"} {
+		opts.ShardNameFunc = func(string, int) string { return bad }
+		if _, err := NewBuilder(opts); err == nil {
+			t.Errorf("NewBuilder with shard name %q succeeded", bad)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir:         "/repo",
+		ManifestVerbose: true,
+	}
+	opts.SetDefaults()
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("F0", []byte("abcabc"))
+	b.AddFile("F1", []byte("xyz"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	fs, _ := filepath.Glob(dir + "/*.manifest.json")
+	if len(fs) != 1 {
+		t.Fatalf("got manifests %v, want 1", fs)
+	}
+
+	blob, err := ioutil.ReadFile(fs[0])
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(blob, &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if m.Repository != "repo" || m.Documents != 2 || m.IndexBytes == 0 {
+		t.Errorf("got manifest %#v", m)
+	}
+	want := []zoekt.DocumentStat{
+		{Name: "F0", Size: 6, Trigrams: 3},
+		{Name: "F1", Size: 3, Trigrams: 1},
+	}
+	if !reflect.DeepEqual(m.Files, want) {
+		t.Errorf("got files %v, want %v", m.Files, want)
+	}
+}
+
+func TestMaxTrigramsPerDoc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir:           "/repo",
+		MaxTrigramsPerDoc: 5,
+	}
+	opts.SetDefaults()
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("dense", []byte("abcdefghij"))
+	b.AddFile("sparse", []byte("abcabcabcabc"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if got := b.TrigramSkipped(); got != 1 {
+		t.Errorf("got TrigramSkipped %d, want 1", got)
+	}
+
+	ss, err := shards.NewShardedSearcher(dir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	result, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(result.Files) != 1 || result.Files[0].FileName != "sparse" {
+		t.Errorf("got %v, want only 'sparse'", result.Files)
+	}
+}
+
+func TestSizeMaxByExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir: "/repo",
+		SizeMax: 10,
+		SizeMaxByExtension: map[string]int{
+			".json":   5,
+			".js":     20,
+			".min.js": 5,
+		},
+	}
+	opts.SetDefaults()
+
+	for name, want := range map[string]int{
+		"a.go":         10,
+		"dir/a.JSON":   5,
+		"a.js":         20,
+		"x/app.min.js": 5,
+		"Makefile":     10,
+	} {
+		if got := opts.SizeMaxFor(name); got != want {
+			t.Errorf("SizeMaxFor(%q): got %d, want %d", name, got, want)
+		}
+	}
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	content := []byte("abcdefgh")
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"data.json", content, false},
+		{"main.go", content, true},
+		{"app.js", []byte("abcdefghijklmno"), true},
+		{"binary.go", []byte("a\x00b"), false},
+	} {
+		kept, err := b.Add(zoekt.Document{Name: tc.name, Content: tc.content})
+		if err != nil {
+			t.Fatalf("Add(%s): %v", tc.name, err)
+		}
+		if kept != tc.want {
+			t.Errorf("Add(%s): got kept %v, want %v", tc.name, kept, tc.want)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	ss, err := shards.NewShardedSearcher(dir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+
+	result, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	var got []string
+	for _, f := range result.Files {
+		got = append(got, f.FileName)
+	}
+	sort.Strings(got)
+	if want := []string{"app.js", "main.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIndexUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name:     "repo",
+			Branches: []zoekt.RepositoryBranch{{Name: "master", Version: "v1"}},
+		},
+		RepoDir:          "/repo",
+		FingerprintExtra: []byte("config1"),
+	}
+	opts.SetDefaults()
+
+	if opts.IndexUpToDate() {
+		t.Fatalf("IndexUpToDate without index")
+	}
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("F", []byte("content"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	if !opts.IndexUpToDate() {
+		t.Errorf("got IndexUpToDate false after build")
+	}
+
+	changed := opts
+	changed.FingerprintExtra = []byte("config2")
+	if changed.IndexUpToDate() {
+		t.Errorf("got IndexUpToDate true for different FingerprintExtra")
+	}
+
+	changed = opts
+	changed.RepositoryDescription.Branches = []zoekt.RepositoryBranch{{Name: "master", Version: "v2"}}
+	if changed.IndexUpToDate() {
+		t.Errorf("got IndexUpToDate true for different version")
+	}
+
+	changed = opts
+	changed.RepositoryDescription.BranchRefs = map[string]string{"master": "release"}
+	if changed.IndexUpToDate() {
+		t.Errorf("got IndexUpToDate true for master indexed from another branch")
+	}
+}
+
+func TestMaxBuildMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir:        "/repo",
+		Parallelism:    4,
+		MaxBuildMemory: 3000,
+	}
+	opts.SetDefaults()
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		s := fmt.Sprintf("%d", i)
+		b.AddFile("F"+s, []byte(strings.Repeat(s, 500)))
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	// A shard is cut once it goes over the limit, so it may be
+	// over the limit by one document.
+	if limit := opts.MaxBuildMemory + 502; b.peakPending > limit {
+		t.Errorf("got peak %d bytes in flight, want at most %d", b.peakPending, limit)
+	}
+	if b.pending != 0 {
+		t.Errorf("got %d bytes pending after Finish", b.pending)
+	}
+
+	fs, _ := filepath.Glob(dir + "/*.zoekt")
+	if len(fs) < 5 {
+		t.Errorf("got shards %v, want at least 5", fs)
+	}
+
+	ss, err := shards.NewShardedSearcher(dir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher(%s): %v", dir, err)
+	}
+	defer ss.Close()
+	rl, err := ss.List(context.Background(), &query.Repo{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rl.Repos) != 1 || rl.Repos[0].Stats.Documents != 20 {
+		t.Errorf("got %v, want 1 repo with 20 documents", rl.Repos)
+	}
+}
+
+func TestBuilderContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A ctags that hangs, to check that it is killed.
+	ctagsBin := filepath.Join(dir, "ctags")
+	if err := ioutil.WriteFile(ctagsBin, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	indexDir := filepath.Join(dir, "index")
+	opts := Options{
+		IndexDir: indexDir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir: "/repo",
+		CTags:   ctagsBin,
+	}
+	opts.SetDefaults()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	b, err := NewBuilderContext(ctx, opts)
+	if err != nil {
+		t.Fatalf("NewBuilderContext: %v", err)
+	}
+	b.AddFile("F", []byte("func main() {}\n"))
+
+	start := time.Now()
+	if err := b.Finish(); err != context.DeadlineExceeded {
+		t.Errorf("Finish: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Finish took %s", d)
+	}
+	if fs, _ := filepath.Glob(indexDir + "/*"); len(fs) != 0 {
+		t.Errorf("got files %v, want none", fs)
+	}
+	if _, err := b.Add(zoekt.Document{Name: "G", Content: []byte("x")}); err != context.DeadlineExceeded {
+		t.Errorf("Add after deadline: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		IndexDir: dir,
+		RepositoryDescription: zoekt.Repository{
+			Name: "repo",
+		},
+		RepoDir: "/repo",
+	}
+	opts.SetDefaults()
+
+	b, err := NewBuilder(opts)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+	b.AddFile("f1", []byte("needle one"))
+	b.AddFile("f2", []byte("needle two"))
+	b.AddFile("f3", []byte("needle three"))
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	shard := opts.FindAllShards()[0]
+
+	if _, err := AppendSegment(shard, nil, []zoekt.Document{
+		{Name: "f2", Content: []byte("haystack two")},
+		{Name: "f4", Content: []byte("needle four")},
+	}, []string{"f3"}); err != nil {
+		t.Fatalf("AppendSegment: %v", err)
+	}
+	if _, err := AppendSegment(shard, nil, []zoekt.Document{
+		{Name: "f4", Content: []byte("needle four, again")},
+	}, nil); err != nil {
+		t.Fatalf("AppendSegment: %v", err)
+	}
+
+	search := func() []string {
+		ss, err := shards.NewShardedSearcher(dir)
+		if err != nil {
+			t.Fatalf("NewShardedSearcher: %v", err)
+		}
+		defer ss.Close()
+
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName+":"+string(f.LineMatches[0].Line))
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	want := []string{"f1:needle one", "f4:needle four, again"}
+	if got := search(); !reflect.DeepEqual(got, want) {
+		t.Errorf("with segments: got %v, want %v", got, want)
+	}
+
+	if err := CompactSegments(shard); err != nil {
+		t.Fatalf("CompactSegments: %v", err)
+	}
+	if segs, err := zoekt.FindSegments(shard); err != nil || len(segs) != 0 {
+		t.Errorf("got segments %v (err %v) after compaction", segs, err)
+	}
+	if got := search(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after compaction: got %v, want %v", got, want)
+	}
+}
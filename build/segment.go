@@ -0,0 +1,192 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/zoekt"
+)
+
+// AppendSegment writes a segment for the given shard, holding docs.
+// The segment hides the documents with the same names in the shard
+// and its earlier segments, as well as the documents named in
+// removed. If repo is nil, the repository of the shard is used;
+// otherwise it must have the same branches, though their versions
+// may differ. Documents that are not text are left out, but still
+// hide older versions. It returns the name of the segment.
+func AppendSegment(shard string, repo *zoekt.Repository, docs []zoekt.Document, removed []string) (string, error) {
+	baseRepo, md, err := readShardMetadata(shard)
+	if err != nil {
+		return "", err
+	}
+	if repo == nil {
+		repo = baseRepo
+	} else if err := sameBranches(baseRepo, repo); err != nil {
+		return "", err
+	}
+
+	ib, err := zoekt.NewIndexBuilder(repo)
+	if err != nil {
+		return "", err
+	}
+	ib.SetTruncateLongLines(md.TruncateLongLines)
+
+	supersedes := map[string]bool{}
+	for _, name := range removed {
+		supersedes[name] = true
+	}
+	for _, doc := range docs {
+		supersedes[doc.Name] = true
+		if !zoekt.IsText(doc.Content) {
+			continue
+		}
+		if err := ib.Add(doc); err != nil {
+			return "", err
+		}
+	}
+	names := make([]string, 0, len(supersedes))
+	for name := range supersedes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ib.SetSupersedes(names)
+
+	segments, err := zoekt.FindSegments(shard)
+	if err != nil {
+		return "", err
+	}
+	fn := zoekt.SegmentName(shard, len(segments)+1)
+	if err := writeIndexFile(fn, ib); err != nil {
+		return "", err
+	}
+	return fn, nil
+}
+
+// CompactSegments merges the segments of the shard back into it, and
+// removes them. It must not run concurrently with AppendSegment for
+// the same shard. Searchers loaded in between the rename of the
+// shard and the removal of the segments may briefly see documents
+// hidden that are in the new shard.
+func CompactSegments(shard string) error {
+	segments, err := zoekt.FindSegments(shard)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+
+	var files []zoekt.IndexFile
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, fn := range append([]string{shard}, segments...) {
+		f, err := openIndexFile(fn)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	repo, md, docs, err := zoekt.ReadSegmentedDocuments(files[0], files[1:])
+	if err != nil {
+		return err
+	}
+
+	ib, err := zoekt.NewIndexBuilder(repo)
+	if err != nil {
+		return err
+	}
+	ib.SetTruncateLongLines(md.TruncateLongLines)
+	for _, doc := range docs {
+		if err := ib.Add(doc); err != nil {
+			return err
+		}
+	}
+	if err := writeIndexFile(shard, ib); err != nil {
+		return err
+	}
+
+	// Newest first, so the remaining segments stay consistent
+	// with each other.
+	for i := len(segments) - 1; i >= 0; i-- {
+		if err := os.Remove(segments[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSegments removes the segments of a shard that was rewritten
+// from scratch.
+func removeSegments(shard string) {
+	segments, _ := zoekt.FindSegments(shard)
+	for _, fn := range segments {
+		os.Remove(fn)
+	}
+}
+
+func openIndexFile(fn string) (zoekt.IndexFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	return zoekt.NewIndexFile(f)
+}
+
+func readShardMetadata(fn string) (*zoekt.Repository, *zoekt.IndexMetadata, error) {
+	f, err := openIndexFile(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return zoekt.ReadMetadata(f)
+}
+
+// sameBranches checks that a segment with repository b can be
+// appended to a shard of repository a.
+func sameBranches(a, b *zoekt.Repository) error {
+	if len(a.Branches) != len(b.Branches) {
+		return fmt.Errorf("got %d branches, shard has %d", len(b.Branches), len(a.Branches))
+	}
+	for i := range a.Branches {
+		if a.Branches[i].Name != b.Branches[i].Name {
+			return fmt.Errorf("got branch %q, shard has %q", b.Branches[i].Name, a.Branches[i].Name)
+		}
+	}
+	return nil
+}
+
+// writeIndexFile writes the index to fn through a temporary file.
+func writeIndexFile(fn string, ib *zoekt.IndexBuilder) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ib.Write(f); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
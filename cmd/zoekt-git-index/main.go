@@ -31,19 +31,62 @@ func main() {
 	var sizeMax = flag.Int("file_limit", 128*1024, "maximum file size")
 	var shardLimit = flag.Int("shard_limit", 100<<20, "maximum corpus size for a shard")
 	var parallelism = flag.Int("parallelism", 4, "maximum number of parallel indexing processes.")
+	indexConcurrency := flag.Int("index_concurrency", 1, "number of goroutines reading blobs for each repository.")
 	allowMissing := flag.Bool("allow_missing_branches", false, "allow missing branches.")
-	submodules := flag.Bool("submodules", true, "if set to false, do not recurse into submodules")
-	branchesStr := flag.String("branches", "HEAD", "git branches to index.")
+	defaultBranch := flag.String("default_branch", "", "branch to index in place of HEAD if HEAD can't be resolved, eg. in a fresh mirror.")
+	submodules := flag.Bool("submodules", true, "if set to false, do not recurse into submodules. Submodules are only indexed with -repo_cache.")
+	branchesStr := flag.String("branches", "HEAD", "git branches to index. Wildcards are allowed, and names starting with 're:' are regular expressions matching the whole branch name.")
 	branchPrefix := flag.String("prefix", "refs/heads/", "prefix for branch names")
+	refPrefixesStr := flag.String("ref_prefixes", "", "comma separated ref namespaces, eg. 'refs/changes/'. If set, -branches holds patterns for full ref names in these namespaces, eg. 're:refs/changes/\\d+/\\d+/\\d+', in place of branch names.")
+	tagsStr := flag.String("tags", "", "git tags to index as branches, eg. 'v*'.")
+	includePathsStr := flag.String("include_paths", "", "comma separated gitignore-style patterns; if set, only matching files are indexed.")
+	excludePathsStr := flag.String("exclude_paths", "", "comma separated gitignore-style patterns for files not to index.")
 
 	indexDir := flag.String("index", build.DefaultDir, "index directory for *.zoekt files.")
 	incremental := flag.Bool("incremental", true, "only index changed repositories")
 	repoCacheDir := flag.String("repo_cache", "", "directory holding bare git repos, named by URL. "+
 		"this is used to find repositories for submodules. "+
 		"It also affects name if the indexed repository is under this directory.")
+	repoCacheMaxEntries := flag.Int("repo_cache_max_entries", 0, "if set, delete the least recently used repositories from the repo cache to keep at most this many.")
+	repoCacheMaxBytes := flag.Int64("repo_cache_max_bytes", 0, "if set, delete the least recently used repositories from the repo cache to keep its size below this.")
 	ctags := flag.Bool("require_ctags", false, "If set, ctags calls must succeed.")
+	skipMarker := flag.String("skip_marker", "", "if set, skip files that contain this string near the start.")
+	skipMinified := flag.Bool("skip_minified", false, "if set, skip files that look like minified JavaScript or CSS.")
+	maxFailureRate := flag.Float64("max_failure_rate", 0, "exit with an error only if more than this fraction of the repositories fails to index.")
+	resolveAnnex := flag.Bool("resolve_annex", false, "if set, index the locally present content of git-annex symlinks.")
+	indexSymlinks := flag.Bool("index_symlinks", false, "if set, index symlinks to files in the repository with the content of the file.")
+	commitMessages := flag.Bool("index_commit_messages", false, "if set, index the commit messages of each branch as a file .zoekt/commits.")
+	lastCommit := flag.Bool("last_commit", false, "if set, store the commit that last changed each file. This walks the history of each branch, so it is slow for long histories.")
+	followRenames := flag.Bool("follow_renames", false, "if set with -last_commit, files renamed without changes keep the commit that changed them under their old name. Rename detection makes the history walk slower.")
+	gitattributes := flag.Bool("gitattributes", false, "if set, skip export-ignore files and mark linguist-generated files as generated.")
+	gitignore := flag.Bool("gitignore", false, "if set, skip files ignored by .gitignore files, .git/info/exclude or core.excludesFile, even if they are committed.")
+	blobOrder := flag.String("blob_order", "name", "order for reading blobs: name, oid or tree. A different order than name may be faster on lazily fetching file systems.")
+	noRepoSearch := flag.Bool("no_repo_search", false, "if set, the arguments must be repositories themselves, not directories inside one.")
+	hostTemplates := flag.String("host_templates", "", "comma separated HOST-SUFFIX=TYPE pairs, for URL templates of repositories and submodules on hosts that are not recognized otherwise. TYPE is as for zoekt.web-url-type, eg. '.gitlab.example.com=gitlab'.")
+	sinceCommit := flag.String("since_commit", "", "if set, only index the files changed since this commit, for a supplemental index. Use a separate -index directory.")
+	readRetries := flag.Int("read_retries", 0, "number of times to retry failed blob reads, eg. on network file systems. The delay doubles with each retry, starting at 100ms.")
+	repoTimeout := flag.Duration("repo_timeout", 0, "if set, give up on a repository that takes longer than this to index, and continue with the next one.")
+	configSection := flag.String("config_section", "", "git config section for the repository name and URL templates, in place of 'zoekt', eg. 'zoekt-team-a' for zoekt-team-a.web-url.")
+	dryRun := flag.Bool("dry_run", false, "if set, only report how many files and bytes would be indexed.")
 	flag.Parse()
 
+	blobReadOrder, err := gitindex.ParseBlobReadOrder(*blobOrder)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *hostTemplates != "" {
+		for _, pair := range strings.Split(*hostTemplates, ",") {
+			i := strings.Index(pair, "=")
+			if i < 0 {
+				log.Fatalf("-host_templates: %q is not HOST-SUFFIX=TYPE", pair)
+			}
+			if err := gitindex.RegisterHostTemplate(pair[:i], pair[i+1:]); err != nil {
+				log.Fatalf("-host_templates: %v", err)
+			}
+		}
+	}
+
 	if *repoCacheDir != "" {
 		dir, err := filepath.Abs(*repoCacheDir)
 		if err != nil {
@@ -64,6 +107,21 @@ func main() {
 	if *branchesStr != "" {
 		branches = strings.Split(*branchesStr, ",")
 	}
+	var refPrefixes []string
+	if *refPrefixesStr != "" {
+		refPrefixes = strings.Split(*refPrefixesStr, ",")
+	}
+	var tags []string
+	if *tagsStr != "" {
+		tags = strings.Split(*tagsStr, ",")
+	}
+	var includePaths, excludePaths []string
+	if *includePathsStr != "" {
+		includePaths = strings.Split(*includePathsStr, ",")
+	}
+	if *excludePathsStr != "" {
+		excludePaths = strings.Split(*excludePathsStr, ",")
+	}
 
 	gitRepos := map[string]string{}
 	for _, repoDir := range flag.Args() {
@@ -86,25 +144,71 @@ func main() {
 		gitRepos[repoDir] = name
 	}
 
-	exitStatus := 0
+	var excludeByContent []func([]byte) bool
+	if *skipMinified {
+		excludeByContent = append(excludeByContent, gitindex.MinifiedJS)
+	}
+
+	cacheLimits := gitindex.RepoCacheLimits{
+		MaxEntries: *repoCacheMaxEntries,
+		MaxBytes:   *repoCacheMaxBytes,
+		OnEvict: func(e gitindex.RepoCacheEviction) {
+			log.Printf("evicted %s (%d bytes, last used %s) from repo cache", e.Dir, e.Bytes, e.LastUsed)
+		},
+	}
+
+	var batch gitindex.Batch
 	for dir, name := range gitRepos {
 		opts.RepositoryDescription.Name = name
 		opts.RepoDir = filepath.Clean(dir)
 
 		gitOpts := gitindex.Options{
-			BranchPrefix:       *branchPrefix,
-			Incremental:        *incremental,
-			Submodules:         *submodules,
-			RepoCacheDir:       *repoCacheDir,
-			AllowMissingBranch: *allowMissing,
-			BuildOptions:       opts,
-			Branches:           branches,
+			BranchPrefix:         *branchPrefix,
+			Incremental:          *incremental,
+			Submodules:           *submodules && *repoCacheDir != "",
+			RepoCacheDir:         *repoCacheDir,
+			RepoCacheLimits:      cacheLimits,
+			AllowMissingBranch:   *allowMissing,
+			DefaultBranch:        *defaultBranch,
+			BuildOptions:         opts,
+			Branches:             branches,
+			RefPrefixes:          refPrefixes,
+			Tags:                 tags,
+			IncludePaths:         includePaths,
+			ExcludePaths:         excludePaths,
+			SkipMarker:           *skipMarker,
+			ExcludeByContent:     excludeByContent,
+			NoRepoSearch:         *noRepoSearch,
+			ResolveAnnex:         *resolveAnnex,
+			IndexSymlinks:        *indexSymlinks,
+			IndexCommitMessages:  *commitMessages,
+			ComputeLastCommit:    *lastCommit,
+			FollowRenames:        *followRenames,
+			SinceCommit:          *sinceCommit,
+			RespectGitattributes: *gitattributes,
+			RespectGitignore:     *gitignore,
+			BlobReadOrder:        blobReadOrder,
+			IndexConcurrency:     *indexConcurrency,
+			ReadRetries:          *readRetries,
+			Timeout:              *repoTimeout,
+			ConfigSection:        *configSection,
+			DryRun:               *dryRun,
 		}
 
-		if err := gitindex.IndexGitRepo(gitOpts); err != nil {
+		if err := batch.Index(gitOpts); err != nil {
 			log.Printf("indexGitRepo(%s): %v", dir, err)
-			exitStatus = 1
 		}
 	}
-	os.Exit(exitStatus)
+
+	for _, r := range batch.Results {
+		if r.DryRun != nil {
+			log.Printf("dry run for %s:\n%s", r.RepoDir, r.DryRun)
+		}
+	}
+	if len(batch.Results) > 1 {
+		log.Print(batch.Summary())
+	}
+	if len(batch.Failed()) > 0 && batch.FailureRate() > *maxFailureRate {
+		os.Exit(1)
+	}
 }
@@ -33,6 +33,16 @@ type fileAggregator struct {
 }
 
 func (a *fileAggregator) add(path string, info os.FileInfo, err error) error {
+	// Never index git internals, whatever -ignore_dirs says. In
+	// submodules and worktrees, .git is a file pointing to the
+	// real git directory.
+	if filepath.Base(path) == ".git" {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
 	if info.IsDir() {
 		base := filepath.Base(path)
 		if _, ok := a.ignoreDirs[base]; ok {
@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSkipGitDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fn := range []string{
+		"file",
+		".git/config",
+		".git/objects/ab/cdef",
+		"sub/file",
+		// submodule checkout, where .git is a file.
+		"sub/.git",
+	} {
+		p := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte("content"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	sink := make(chan string, 10)
+	agg := fileAggregator{
+		// Even with no ignored directories, .git is skipped.
+		ignoreDirs: map[string]struct{}{},
+		sink:       sink,
+		sizeMax:    1024,
+	}
+	if err := filepath.Walk(dir, agg.add); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	close(sink)
+
+	var got []string
+	for f := range sink {
+		got = append(got, strings.TrimPrefix(f, dir+"/"))
+	}
+	sort.Strings(got)
+	if want := []string{"file", "sub/file"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -36,7 +36,6 @@ import (
 	"net/url"
 	"path"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strings"
 
@@ -239,8 +238,7 @@ func main() {
 	}
 
 	if *incremental {
-		versions := opts.IndexVersions()
-		if reflect.DeepEqual(versions, opts.RepositoryDescription.Branches) {
+		if opts.IndexUpToDate() {
 			return
 		}
 	}
@@ -265,7 +263,7 @@ func main() {
 		for _, br := range branches {
 			doc.Branches = append(doc.Branches, br)
 		}
-		if err := builder.Add(doc); err != nil {
+		if _, err := builder.Add(doc); err != nil {
 			log.Fatalf("Add(%s): %v", doc.Name, err)
 		}
 	}
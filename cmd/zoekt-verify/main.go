@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// zoekt-verify checks that index shards are internally consistent. It
+// exits with an error if one of them is not.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/zoekt"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s SHARD-OR-INDEX-DIR...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var shards []string
+	for _, arg := range flag.Args() {
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			fns, err := filepath.Glob(filepath.Join(arg, "*.zoekt"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			shards = append(shards, fns...)
+			continue
+		}
+		shards = append(shards, arg)
+	}
+
+	failed := 0
+	for _, fn := range shards {
+		if err := zoekt.VerifyIndex(fn); err != nil {
+			log.Printf("%s: %v", fn, err)
+			failed++
+		}
+	}
+	log.Printf("verified %d shards, %d corrupt", len(shards), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
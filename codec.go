@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// sectionCodec says how the items of a compound section are
+// stored. It is recorded in the header of the section index.
+type sectionCodec uint32
+
+const (
+	// codecNone stores items as is.
+	codecNone sectionCodec = 0
+
+	// codecZstd prefixes each item with an itemFlag, and
+	// compresses it with zstd if that makes it smaller.
+	codecZstd sectionCodec = 1
+
+	// codecPostings stores posting lists as is, but each starts
+	// with a byte for its encoding; see fromTaggedDeltas. The
+	// posting lists in codecNone sections are plain deltas.
+	codecPostings sectionCodec = 2
+)
+
+// storesSizes returns true if the section index holds the decoded
+// size of each item.
+func (c sectionCodec) storesSizes() bool {
+	return c == codecZstd
+}
+
+// itemFlag is the first byte of an item in a section that is not
+// codecNone.
+const (
+	itemRaw  byte = 0
+	itemZstd byte = 1
+)
+
+// firstCodecVersion is the first format version that has a codec
+// header in compound sections.
+const firstCodecVersion = 17
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd sets up the shared encoder and decoder. Both are safe
+// for concurrent use with EncodeAll and DecodeAll.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// encodeItem returns item as stored with codec c.
+func (c sectionCodec) encodeItem(item []byte) ([]byte, error) {
+	switch c {
+	case codecNone, codecPostings:
+		return item, nil
+	case codecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		enc := zstdEncoder.EncodeAll(item, []byte{itemZstd})
+		if len(enc) < len(item)+1 {
+			return enc, nil
+		}
+		return append([]byte{itemRaw}, item...), nil
+	}
+	return nil, fmt.Errorf("unknown codec %d", c)
+}
+
+// decodeItem is the inverse of encodeItem.
+func (c sectionCodec) decodeItem(blob []byte) ([]byte, error) {
+	switch c {
+	case codecNone, codecPostings:
+		return blob, nil
+	case codecZstd:
+		if len(blob) == 0 {
+			return nil, fmt.Errorf("item without flag")
+		}
+		switch blob[0] {
+		case itemRaw:
+			return blob[1:], nil
+		case itemZstd:
+			if err := initZstd(); err != nil {
+				return nil, err
+			}
+			return zstdDecoder.DecodeAll(blob[1:], nil)
+		}
+		return nil, fmt.Errorf("unknown item flag %d", blob[0])
+	}
+	return nil, fmt.Errorf("unknown codec %d", c)
+}
@@ -15,7 +15,6 @@
 package zoekt
 
 import (
-	"bytes"
 	"log"
 	"sort"
 	"unicode/utf8"
@@ -71,6 +70,22 @@ func (p *contentProvider) newlines() []uint32 {
 	return p._nl
 }
 
+// lineBounds returns the byte offsets of the start and the end of
+// line lineNum (base-1) of the document, using the stored newline
+// offsets. The end is the offset of the terminating newline, or the
+// file size for the last line.
+func (p *contentProvider) lineBounds(lineNum int) (start, end int) {
+	nls := p.newlines()
+	if lineNum > 1 && lineNum-2 < len(nls) {
+		start = int(nls[lineNum-2]) + 1
+	}
+	end = int(p.fileSize)
+	if lineNum > 0 && lineNum-1 < len(nls) {
+		end = int(nls[lineNum-1])
+	}
+	return start, end
+}
+
 func (p *contentProvider) data(fileName bool) []byte {
 	if fileName {
 		return p.id.fileNameContent[p.id.fileNameIndex[p.idx]:p.id.fileNameIndex[p.idx+1]]
@@ -196,19 +211,12 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
 				m.byteOffset)
 		}
 
-		data := p.data(false)
-
 		// Due to merging matches, we may have a match that
 		// crosses a line boundary. Prevent confusion by
 		// taking lines until we pass the last match
-		for lineEnd < len(data) && endMatch > uint32(lineEnd) {
-			next := bytes.IndexByte(data[lineEnd+1:], '\n')
-			if next == -1 {
-				lineEnd = len(data)
-			} else {
-				// TODO(hanwen): test that checks "+1" part here.
-				lineEnd += next + 1
-			}
+		for endNum := num; lineEnd < int(p.fileSize) && endMatch > uint32(lineEnd); {
+			endNum++
+			_, lineEnd = p.lineBounds(endNum)
 		}
 
 		finalMatch := LineMatch{
@@ -226,11 +234,75 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
 			}
 			finalMatch.LineFragments = append(finalMatch.LineFragments, fragment)
 		}
+		truncateLine(&finalMatch, p.id.metaData.TruncateLongLines)
 		result = append(result, finalMatch)
 	}
 	return result
 }
 
+const ellipsis = "\u2026"
+
+// truncateLine cuts the line of m to max bytes around its first
+// fragment, marking the cut off ends with an ellipsis. Fragments are
+// clipped to the remaining text.
+func truncateLine(m *LineMatch, max int) {
+	line := m.Line
+	if max <= 0 || len(line) <= max {
+		return
+	}
+
+	start := 0
+	if len(m.LineFragments) > 0 {
+		f := m.LineFragments[0]
+		if f.LineOffset+f.MatchLength > max {
+			start = f.LineOffset - max/2
+		}
+		if start < 0 {
+			start = 0
+		}
+	}
+	end := start + max
+	if end > len(line) {
+		end = len(line)
+	}
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start--
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end--
+	}
+
+	var out []byte
+	if start > 0 {
+		out = append(out, ellipsis...)
+	}
+	prefix := len(out)
+	out = append(out, line[start:end]...)
+	if end < len(line) {
+		out = append(out, ellipsis...)
+	}
+
+	var frags []LineFragmentMatch
+	for _, f := range m.LineFragments {
+		fStart, fEnd := f.LineOffset, f.LineOffset+f.MatchLength
+		if fEnd <= start || fStart >= end {
+			continue
+		}
+		if fStart < start {
+			f.Offset += uint32(start - fStart)
+			fStart = start
+		}
+		if fEnd > end {
+			fEnd = end
+		}
+		f.LineOffset = fStart - start + prefix
+		f.MatchLength = fEnd - fStart
+		frags = append(frags, f)
+	}
+	m.Line = out
+	m.LineFragments = frags
+}
+
 const (
 	// TODO - how to scale this relative to rank?
 	scorePartialWordMatch   = 50.0
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ShardDiff describes the difference between the document sets of
+// two shards. All lists are sorted by name.
+type ShardDiff struct {
+	// Added holds names only present in the second shard.
+	Added []string
+
+	// Removed holds names only present in the first shard.
+	Removed []string
+
+	// Changed holds names present in both shards, but with
+	// different content.
+	Changed []string
+}
+
+// Empty returns true if the shards hold the same documents.
+func (d *ShardDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String returns the diff in a stable, line-oriented format.
+func (d *ShardDiff) String() string {
+	marks := map[string]string{}
+	for _, n := range d.Removed {
+		marks[n] = "-"
+	}
+	for _, n := range d.Added {
+		marks[n] = "+"
+	}
+	for _, n := range d.Changed {
+		marks[n] = "~"
+	}
+
+	var names []string
+	for n := range marks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, n := range names {
+		fmt.Fprintf(&buf, "%s %s\n", marks[n], n)
+	}
+	return buf.String()
+}
+
+// openIndexData reads the index data of the shard in the named file.
+func openIndexData(fn string) (*indexData, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	iFile, err := NewIndexFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := newReader(iFile)
+	if err != nil {
+		iFile.Close()
+		return nil, err
+	}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		iFile.Close()
+		return nil, err
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		iFile.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// documentChecksums returns a name => content checksums map for all
+// documents in the shard. A name maps to multiple checksums if it has
+// different content across branches.
+func (d *indexData) documentChecksums() map[string][]string {
+	result := map[string][]string{}
+	for i := 0; i+1 < len(d.fileNameIndex); i++ {
+		name := string(d.fileName(uint32(i)))
+		result[name] = append(result[name], fmt.Sprintf("%x", d.getChecksum(uint32(i))))
+	}
+	for _, sums := range result {
+		sort.Strings(sums)
+	}
+	return result
+}
+
+// DiffShards reports the documents that were added, removed or
+// changed going from shard file a to shard file b. Documents are
+// identified by name, and compared by content checksum.
+func DiffShards(a, b string) (*ShardDiff, error) {
+	aData, err := openIndexData(a)
+	if err != nil {
+		return nil, err
+	}
+	defer aData.Close()
+
+	bData, err := openIndexData(b)
+	if err != nil {
+		return nil, err
+	}
+	defer bData.Close()
+
+	before := aData.documentChecksums()
+	after := bData.documentChecksums()
+
+	var diff ShardDiff
+	for name, sums := range before {
+		other, ok := after[name]
+		if !ok {
+			diff.Removed = append(diff.Removed, name)
+		} else if strings.Join(sums, ",") != strings.Join(other, ",") {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return &diff, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestShard(t *testing.T, fn string, docs ...Document) {
+	b := testIndexBuilder(t, nil, docs...)
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if err := b.Write(f); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func TestDiffShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.zoekt")
+	b := filepath.Join(dir, "b.zoekt")
+	writeTestShard(t, a,
+		Document{Name: "same", Content: []byte("same content")},
+		Document{Name: "changed", Content: []byte("old content")},
+		Document{Name: "removed", Content: []byte("removed content")})
+	writeTestShard(t, b,
+		Document{Name: "added", Content: []byte("added content")},
+		Document{Name: "changed", Content: []byte("new content")},
+		Document{Name: "same", Content: []byte("same content")})
+
+	diff, err := DiffShards(a, b)
+	if err != nil {
+		t.Fatalf("DiffShards: %v", err)
+	}
+
+	want := &ShardDiff{
+		Added:   []string{"added"},
+		Removed: []string{"removed"},
+		Changed: []string{"changed"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("got %#v, want %#v", diff, want)
+	}
+
+	if got, want := diff.String(), "+ added\n~ changed\n- removed\n"; got != want {
+		t.Errorf("got String() %q, want %q", got, want)
+	}
+
+	if diff, err := DiffShards(a, a); err != nil {
+		t.Fatalf("DiffShards: %v", err)
+	} else if !diff.Empty() {
+		t.Errorf("got %v, want empty diff", diff)
+	}
+}
@@ -30,8 +30,7 @@ type candidateMatch struct {
 	caseSensitive bool
 	fileName      bool
 
-	substrBytes   []byte
-	substrLowered []byte
+	substrBytes []byte
 
 	file uint32
 
@@ -57,7 +56,11 @@ func (m *candidateMatch) matchContent(content []byte) bool {
 		// as upper case variant). We can only degrade to
 		// ASCII if we are sure that both the corpus and the
 		// query is ASCII only
-		return caseFoldingEqualsRunes(m.substrLowered, content[m.byteOffset:])
+		sz, ok := caseFoldingEqualsRunes(m.substrBytes, content[m.byteOffset:])
+		if ok {
+			m.byteMatchSz = uint32(sz)
+		}
+		return ok
 	}
 }
 
@@ -97,7 +100,6 @@ type ngramDocIterator struct {
 
 func (s *ngramDocIterator) candidates() []*candidateMatch {
 	patBytes := []byte(s.query.Pattern)
-	lowerPatBytes := toLower(patBytes)
 
 	fileIdx := 0
 	var candidates []*candidateMatch
@@ -132,9 +134,9 @@ func (s *ngramDocIterator) candidates() []*candidateMatch {
 				caseSensitive: s.query.CaseSensitive,
 				fileName:      s.query.FileName,
 				substrBytes:   patBytes,
-				substrLowered: lowerPatBytes,
-				// TODO - this is wrong for casefolding searches.
-				byteMatchSz: uint32(len(lowerPatBytes)),
+				// Set to the size of the match by
+				// matchContent for casefolding searches.
+				byteMatchSz: uint32(len(patBytes)),
 				file:        uint32(fileIdx),
 				runeOffset:  p1 - fileStart - s.leftPad,
 			}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"regexp/syntax"
 	"sort"
 	"strings"
 	"unicode/utf8"
@@ -311,6 +312,11 @@ func (p *contentProvider) evalContentMatches(s *substrMatchTree) {
 		// TODO - this side effect is kind of hidden and surprising.
 		for _, cm := range s.current {
 			cm.byteOffset = p.findOffset(cm.fileName, cm.runeOffset)
+			if !cm.caseSensitive {
+				// Sets the size, as case variants
+				// may differ in size.
+				p.matchContent(cm)
+			}
 		}
 	}
 	s.contEvaluated = true
@@ -527,13 +533,45 @@ func (d *indexData) newSubstringMatchTree(s *query.Substring, stats *Stats) (mat
 func (d *indexData) simplify(in query.Q) query.Q {
 	eval := query.Map(in, func(q query.Q) query.Q {
 		if r, ok := q.(*query.Repo); ok {
-			return &query.Const{strings.Contains(d.repoMetaData.Name, r.Pattern)}
+			return d.repoQuery(r)
 		}
 		return q
 	})
 	return query.Simplify(eval)
 }
 
+// repoQuery returns the query for r in this shard. If r only matches
+// members of the repository, it selects their files by path.
+func (d *indexData) repoQuery(r *query.Repo) query.Q {
+	if strings.Contains(d.repoMetaData.Name, r.Pattern) {
+		return &query.Const{Value: true}
+	}
+	paths := d.memberPaths(r.Pattern)
+	if len(paths) == 0 {
+		return &query.Const{Value: false}
+	}
+	for i, p := range paths {
+		paths[i] = regexp.QuoteMeta(p)
+	}
+	re, err := syntax.Parse("^(?:"+strings.Join(paths, "|")+")/", syntax.Perl)
+	if err != nil {
+		log.Panicf("member path regexp: %v", err)
+	}
+	return &query.Regexp{Regexp: re, FileName: true, CaseSensitive: true}
+}
+
+// memberPaths returns the paths of the members whose name contains
+// pattern.
+func (d *indexData) memberPaths(pattern string) []string {
+	var paths []string
+	for _, p := range d.repoMetaData.Members {
+		if sub, ok := d.repoMetaData.SubRepoMap[p]; ok && strings.Contains(sub.Name, pattern) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
 func (o *SearchOptions) SetDefaults() {
 	if o.ShardMaxMatchCount == 0 {
 		// We cap the total number of matches, so overly broad
@@ -626,8 +664,11 @@ nextFileMatch:
 		}
 		lastDoc = int(nextDoc)
 
-		res.Stats.FilesConsidered++
 		mt.prepare(nextDoc)
+		if d.tombstones[nextDoc] || (opts.SkipGenerated && d.generated[nextDoc]) {
+			continue
+		}
+		res.Stats.FilesConsidered++
 		if canceled || res.Stats.MatchCount >= opts.ShardMaxMatchCount ||
 			importantMatchCount >= opts.ShardMaxImportantMatch {
 			res.Stats.FilesSkipped++
@@ -681,6 +722,13 @@ nextFileMatch:
 			Score:    10 * float64(nextDoc) / float64(len(d.boundaries)),
 			Checksum: d.getChecksum(nextDoc),
 		}
+		if c, ok := d.lastCommits[nextDoc]; ok {
+			fileMatch.LastCommit = c.id
+			fileMatch.LastCommitTime = c.time
+		}
+		if d.fileModes != nil {
+			fileMatch.Mode = d.fileModes[nextDoc]
+		}
 
 		if s := d.subRepos[nextDoc]; s > 0 {
 			if s >= uint32(len(d.subRepoPaths)) {
@@ -691,7 +739,7 @@ nextFileMatch:
 			sr := d.repoMetaData.SubRepoMap[path]
 			fileMatch.SubRepositoryName = sr.Name
 			if idx := d.branchIndex(nextDoc); idx >= 0 {
-				fileMatch.Version = sr.Branches[idx].Version
+				fileMatch.Version = branchVersion(sr, d.repoMetaData.Branches[idx].Name)
 			}
 		} else {
 			idx := d.branchIndex(nextDoc)
@@ -714,7 +762,6 @@ nextFileMatch:
 					caseSensitive: false,
 					fileName:      true,
 					substrBytes:   nm,
-					substrLowered: nm,
 					file:          nextDoc,
 					runeOffset:    0,
 					byteOffset:    0,
@@ -867,6 +914,18 @@ func (d *indexData) branchIndex(docID uint32) int {
 	return -1
 }
 
+// branchVersion returns the version of the named branch in repo. A
+// sub-repository only has the branches it is present in, so its
+// branches may not line up with those of the shard.
+func branchVersion(repo *Repository, name string) string {
+	for _, b := range repo.Branches {
+		if b.Name == name {
+			return b.Version
+		}
+	}
+	return ""
+}
+
 // gatherBranches returns a list of branch names.
 func (d *indexData) gatherBranches(docID uint32, mt matchTree, known map[matchTree]bool) []string {
 	foundBranchQuery := false
@@ -896,7 +955,13 @@ func (d *indexData) gatherBranches(docID uint32, mt matchTree, known map[matchTr
 }
 
 func (d *indexData) List(ctx context.Context, q query.Q) (*RepoList, error) {
-	q = d.simplify(q)
+	// The repository is listed if one of its members matches.
+	q = query.Simplify(query.Map(q, func(q query.Q) query.Q {
+		if r, ok := q.(*query.Repo); ok {
+			return &query.Const{Value: strings.Contains(d.repoMetaData.Name, r.Pattern) || len(d.memberPaths(r.Pattern)) > 0}
+		}
+		return q
+	}))
 	c, ok := q.(*query.Const)
 
 	if !ok {
@@ -0,0 +1,155 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// maxAlternateDepth is how deep libgit2 follows alternates of
+// alternates.
+const maxAlternateDepth = 5
+
+// The priorities libgit2 gives to the loose and packed objects of
+// alternates.
+const (
+	loosePriority  = 1
+	packedPriority = 2
+)
+
+// readAlternates returns the entries of objects/info/alternates in
+// object directory dir. Relative entries are relative to dir.
+func readAlternates(dir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if err != nil {
+		return nil
+	}
+	var alts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		alts = append(alts, line)
+	}
+	return alts
+}
+
+// missingObjectDirs returns the object directories that objDir
+// borrows from, as git reads them, but that libgit2 does not load
+// itself. libgit2 ignores relative paths in the alternates of an
+// alternate, and the GIT_ALTERNATE_OBJECT_DIRECTORIES environment
+// variable.
+func missingObjectDirs(objDir string) []string {
+	objDir = filepath.Clean(objDir)
+
+	loaded := map[string]bool{}
+	var load func(dir string, depth int)
+	load = func(dir string, depth int) {
+		loaded[dir] = true
+		if depth > maxAlternateDepth {
+			return
+		}
+		for _, alt := range readAlternates(dir) {
+			if !filepath.IsAbs(alt) {
+				if depth > 0 {
+					continue
+				}
+				alt = filepath.Join(dir, alt)
+			}
+			if alt = filepath.Clean(alt); !loaded[alt] {
+				load(alt, depth+1)
+			}
+		}
+	}
+	load(objDir, 0)
+
+	dirs := objectDirs(objDir)
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")) {
+		if abs, err := filepath.Abs(dir); err == nil && dir != "" {
+			dirs = append(dirs, objectDirs(abs)...)
+		}
+	}
+	var missing []string
+	for _, dir := range dirs {
+		if !loaded[dir] {
+			loaded[dir] = true
+			missing = append(missing, dir)
+		}
+	}
+	return missing
+}
+
+// objectsDir returns the object directory of repo, which is shared
+// by linked worktrees.
+func objectsDir(repo *git.Repository) string {
+	gitDir := repo.Path()
+	if data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		gitDir = common
+	}
+	return filepath.Join(gitDir, "objects")
+}
+
+// addAlternates adds the object directories of repo that libgit2
+// does not load itself to its object database, so blobs stored there
+// can be read.
+func addAlternates(repo *git.Repository) error {
+	missing := missingObjectDirs(objectsDir(repo))
+	if len(missing) == 0 {
+		return nil
+	}
+	odb, err := repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+
+	for _, dir := range missing {
+		if _, err := os.Stat(dir); err != nil {
+			// git skips missing alternates too.
+			continue
+		}
+		loose, err := git.NewOdbBackendLoose(dir, -1, false, 0, 0)
+		if err != nil {
+			return err
+		}
+		if err := odb.AddAlternate(loose, loosePriority); err != nil {
+			return err
+		}
+		idxs, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+		if err != nil {
+			return err
+		}
+		for _, idx := range idxs {
+			pack, err := git.NewOdbBackendOnePack(idx)
+			if err != nil {
+				return err
+			}
+			if err := odb.AddAlternate(pack, packedPriority); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMissingObjectDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	objDir := func(name string) string {
+		return filepath.Join(dir, name, "objects")
+	}
+	// repo borrows from mid, which borrows from base through a
+	// relative path, and base from other.
+	for name, alternates := range map[string]string{
+		"repo":  objDir("mid") + "\n",
+		"mid":   "# reference clone\n../../base/objects\n",
+		"base":  objDir("other") + "\n",
+		"other": "",
+		"env":   "",
+	} {
+		if err := os.MkdirAll(filepath.Join(objDir(name), "info"), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if alternates == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(objDir(name), "info", "alternates"), []byte(alternates), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	if got, want := missingObjectDirs(objDir("repo")), []string{objDir("base"), objDir("other")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := missingObjectDirs(objDir("mid")); len(got) != 0 {
+		t.Errorf("got %v for relative alternate of the repository, want none", got)
+	}
+
+	defer os.Unsetenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")
+	os.Setenv("GIT_ALTERNATE_OBJECT_DIRECTORIES", objDir("env")+string(filepath.ListSeparator)+objDir("other"))
+	if got, want := missingObjectDirs(objDir("other")), []string{objDir("env")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with environment: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const annexObjectDir = ".git/annex/objects/"
+
+// annexObjectPath returns the file holding the content for a
+// git-annex symlink with the given target. Annex links are relative
+// to the directory of the link, and point into .git/annex/objects/,
+// so we resolve the part starting at annex/ against gitDir. This also
+// works for bare repositories, where gitDir is the repository itself.
+func annexObjectPath(gitDir string, target []byte) (string, bool) {
+	t := filepath.ToSlash(string(target))
+	idx := strings.Index(t, annexObjectDir)
+	if idx < 0 {
+		return "", false
+	}
+	if idx > 0 && t[idx-1] != '/' {
+		return "", false
+	}
+
+	rel := t[idx+len(".git/"):]
+	for _, seg := range strings.Split(rel, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join(gitDir, filepath.FromSlash(rel)), true
+}
+
+// readAnnexObject returns the annexed content for a symlink with the
+// given target. It returns nil if the link is not an annex link,
+// the content is not present locally, or it is larger than sizeMax.
+func readAnnexObject(gitDir string, target []byte, sizeMax int) ([]byte, error) {
+	fn, ok := annexObjectPath(gitDir, target)
+	if !ok {
+		return nil, nil
+	}
+
+	fi, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() > int64(sizeMax) {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	return content, nil
+}
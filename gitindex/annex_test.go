@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadAnnexObject(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(gitDir)
+
+	key := "SHA256E-s5--abc.txt"
+	objDir := filepath.Join(gitDir, "annex", "objects", "Xy", "Zw", key)
+	if err := os.MkdirAll(objDir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(objDir, key), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, tc := range []struct {
+		target  string
+		sizeMax int
+		want    string
+		present bool
+	}{
+		{"../../.git/annex/objects/Xy/Zw/" + key + "/" + key, 100, "hello", true},
+		{".git/annex/objects/Xy/Zw/" + key + "/" + key, 100, "hello", true},
+		// too large.
+		{".git/annex/objects/Xy/Zw/" + key + "/" + key, 4, "", false},
+		// not present locally.
+		{".git/annex/objects/Xy/Zw/other/other", 100, "", false},
+		// not an annex link.
+		{"../some/file", 100, "", false},
+		{"x.git/annex/objects/Xy/Zw/" + key + "/" + key, 100, "", false},
+		// escapes the annex.
+		{".git/annex/objects/../../../etc/passwd", 100, "", false},
+	} {
+		got, err := readAnnexObject(gitDir, []byte(tc.target), tc.sizeMax)
+		if err != nil {
+			t.Errorf("readAnnexObject(%q): %v", tc.target, err)
+			continue
+		}
+		if (got != nil) != tc.present || string(got) != tc.want {
+			t.Errorf("readAnnexObject(%q, %d): got %q, want %q (present %v)", tc.target, tc.sizeMax, got, tc.want, tc.present)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BatchResult is the outcome of indexing a single repository.
+type BatchResult struct {
+	RepoDir string
+
+	// Err is the indexing error, if any.
+	Err error
+
+	// Skipped is set if an incremental run found the index to be
+	// up to date.
+	Skipped bool
+
+	// IndexBytes is the size of the shards after indexing.
+	IndexBytes int64
+
+	// DryRun holds the outcome if Options.DryRun was set.
+	DryRun *DryRunSummary
+
+	// BranchDocuments holds the number of documents indexed for
+	// each branch; a file on several branches counts for each.
+	// Branches without documents are left out. It is nil if the
+	// repository was not indexed.
+	BranchDocuments map[string]int
+
+	Duration time.Duration
+}
+
+// Batch indexes a series of repositories, recording the outcome for
+// each rather than stopping at the first failure.
+type Batch struct {
+	Results []BatchResult
+}
+
+// Index indexes a repository, and records the result. It returns the
+// indexing error, if any.
+func (b *Batch) Index(opts Options) error {
+	start := time.Now()
+	var dryRun *DryRunSummary
+	if opts.DryRun {
+		dryRun = &DryRunSummary{}
+		opts.dryRunSummary = dryRun
+	}
+	branchDocs := map[string]int{}
+	opts.branchDocuments = branchDocs
+	skipped, err := indexGitRepo(opts)
+	r := BatchResult{
+		RepoDir:  opts.BuildOptions.RepoDir,
+		Err:      err,
+		Skipped:  skipped,
+		Duration: time.Since(start),
+	}
+	if err == nil {
+		r.DryRun = dryRun
+		if !skipped && !opts.DryRun {
+			r.BranchDocuments = branchDocs
+		}
+	}
+	if err == nil {
+		for _, fn := range opts.BuildOptions.FindAllShards() {
+			if fi, err := os.Stat(fn); err == nil {
+				r.IndexBytes += fi.Size()
+			}
+		}
+	}
+	b.Results = append(b.Results, r)
+	return err
+}
+
+// IndexDirs indexes the repositories in dirs, such as those returned
+// by FindGitRepos, with options opts, allowing each repository at
+// most timeout if it is positive. Failures and timeouts are recorded,
+// and indexing continues with the next repository. The repository
+// name is the base name of the directory, without ".git". It returns
+// the results for dirs, in order.
+func (b *Batch) IndexDirs(opts Options, dirs []string, timeout time.Duration) []BatchResult {
+	start := len(b.Results)
+	for _, dir := range dirs {
+		o := opts
+		o.BuildOptions.RepoDir = dir
+		o.BuildOptions.RepositoryDescription.Name = strings.TrimSuffix(filepath.Base(strings.TrimSuffix(dir, "/.git")), ".git")
+		o.Timeout = timeout
+		b.Index(o)
+	}
+	return b.Results[start:]
+}
+
+// Failed returns the results with errors.
+func (b *Batch) Failed() []BatchResult {
+	var failed []BatchResult
+	for _, r := range b.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// FailureRate returns the fraction of repositories that failed, or 0
+// for an empty batch.
+func (b *Batch) FailureRate() float64 {
+	if len(b.Results) == 0 {
+		return 0
+	}
+	return float64(len(b.Failed())) / float64(len(b.Results))
+}
+
+// Summary returns a human readable summary of the batch, listing the
+// failed repositories.
+func (b *Batch) Summary() string {
+	var succeeded, skipped, failed int
+	var indexBytes int64
+	var duration time.Duration
+	for _, r := range b.Results {
+		switch {
+		case r.Err != nil:
+			failed++
+		case r.Skipped:
+			skipped++
+		default:
+			succeeded++
+		}
+		indexBytes += r.IndexBytes
+		duration += r.Duration
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d repositories in %v: %d succeeded, %d skipped, %d failed, %d index bytes\n",
+		len(b.Results), duration, succeeded, skipped, failed, indexBytes)
+	for _, r := range b.Failed() {
+		fmt.Fprintf(&buf, "failed %s: %v\n", r.RepoDir, r.Err)
+	}
+	return buf.String()
+}
@@ -15,19 +15,51 @@
 package gitindex
 
 import (
+	"fmt"
+	"log"
 	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/libgit2/git2go"
 )
 
 type RepoCache struct {
 	baseDir string
+	limits  RepoCacheLimits
 
 	reposMu sync.Mutex
 	repos   map[string]*git.Repository
+
+	// releases marks the open repositories as no longer in use.
+	releases []func()
+}
+
+// RepoCacheLimits bounds the repositories kept in a cache directory.
+// Repositories are deleted, least recently opened first, when a
+// RepoCache is closed.
+type RepoCacheLimits struct {
+	// MaxEntries is the maximum number of repositories. If zero,
+	// there is no limit.
+	MaxEntries int
+
+	// MaxBytes is the maximum size of the repositories on disk. If
+	// zero, there is no limit.
+	MaxBytes int64
+
+	// OnEvict, if set, is called for each deleted repository.
+	OnEvict func(RepoCacheEviction)
+}
+
+// RepoCacheEviction describes a repository deleted from the cache.
+type RepoCacheEviction struct {
+	Dir      string
+	Bytes    int64
+	LastUsed time.Time
 }
 
 func NewRepoCache(dir string) *RepoCache {
@@ -37,12 +69,28 @@ func NewRepoCache(dir string) *RepoCache {
 	}
 }
 
+// SetLimits sets the limits that Evict enforces.
+func (rc *RepoCache) SetLimits(limits RepoCacheLimits) {
+	rc.limits = limits
+}
+
+// Close frees the repositories, and then evicts repositories from
+// the cache if it is over its limits.
 func (rc *RepoCache) Close() {
 	rc.reposMu.Lock()
 	defer rc.reposMu.Unlock()
 	for _, v := range rc.repos {
 		v.Free()
 	}
+	rc.repos = map[string]*git.Repository{}
+	for _, release := range rc.releases {
+		release()
+	}
+	rc.releases = nil
+
+	if err := rc.Evict(); err != nil {
+		log.Printf("evicting from repo cache %s: %v", rc.baseDir, err)
+	}
 }
 
 func repoKey(u *url.URL) string {
@@ -60,7 +108,8 @@ func Path(baseDir string, u *url.URL) string {
 }
 
 // Open opens a git repository. The cache retains a pointer to the
-// repository, so it cannot be freed.
+// repository, so it cannot be freed. The repository is not evicted
+// until the cache is closed.
 func (rc *RepoCache) Open(u *url.URL) (*git.Repository, error) {
 	key := repoKey(u)
 	dir := filepath.Join(rc.baseDir, key)
@@ -73,9 +122,226 @@ func (rc *RepoCache) Open(u *url.URL) (*git.Repository, error) {
 		return r, nil
 	}
 
+	release, err := lockCachedRepo(rc.baseDir, dir)
+	if err != nil {
+		return nil, err
+	}
 	repo, err := git.OpenRepository(dir)
-	if err == nil {
-		rc.repos[key] = repo
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := addAlternates(repo); err != nil {
+		repo.Free()
+		release()
+		return nil, err
+	}
+	rc.repos[key] = repo
+	rc.releases = append(rc.releases, release)
+
+	// The modification time of the directory records when it
+	// was last used.
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		log.Printf("repo cache: %v", err)
+	}
+	return repo, nil
+}
+
+// inUseDirs counts the users of repository directories in this
+// process, so they are not evicted while in use.
+var inUseDirs = struct {
+	sync.Mutex
+	count map[string]int
+}{count: map[string]int{}}
+
+// acquireRepoDir marks the repository in dir as in use. It returns a
+// function that releases it.
+func acquireRepoDir(dir string) func() {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	dir = filepath.Clean(dir)
+
+	inUseDirs.Lock()
+	inUseDirs.count[dir]++
+	inUseDirs.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inUseDirs.Lock()
+			defer inUseDirs.Unlock()
+			if inUseDirs.count[dir]--; inUseDirs.count[dir] == 0 {
+				delete(inUseDirs.count, dir)
+			}
+		})
+	}
+}
+
+// repoLockSuffix is appended to the directory of a cached repository
+// for the name of its lock file. The lock files are left in place
+// after eviction, so a process waiting for one can't end up locking a
+// file that another process has already replaced.
+const repoLockSuffix = ".lock"
+
+// lockCachedRepo marks the repository in dir as in use, like
+// acquireRepoDir. If dir is inside the cache directory baseDir, it
+// also takes a shared lock on its lock file, so indexers in other
+// processes don't evict it. It returns a function that releases it.
+func lockCachedRepo(baseDir, dir string) (func(), error) {
+	release := acquireRepoDir(dir)
+	if baseDir == "" {
+		return release, nil
+	}
+	base, err := filepath.Abs(baseDir)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if !strings.HasPrefix(filepath.Clean(abs), filepath.Clean(base)+string(filepath.Separator)) {
+		return release, nil
+	}
+
+	// The directory of a repository that is yet to be cloned may
+	// not exist.
+	name := filepath.Clean(abs) + repoLockSuffix
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		release()
+		return nil, err
+	}
+	unlock, err := lockShared(name)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// repoDirInUse returns true if dir, or a directory inside it, is in
+// use. The caller must hold inUseDirs.
+func repoDirInUse(dir string) bool {
+	for d := range inUseDirs.count {
+		if d == dir || strings.HasPrefix(d, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedRepo is a bare repository in the cache directory.
+type cachedRepo struct {
+	dir      string
+	bytes    int64
+	lastUsed time.Time
+}
+
+type reposByLastUse []cachedRepo
+
+func (r reposByLastUse) Len() int           { return len(r) }
+func (r reposByLastUse) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r reposByLastUse) Less(i, j int) bool { return r[i].lastUsed.Before(r[j].lastUsed) }
+
+// cachedRepos returns the bare repositories under baseDir.
+func cachedRepos(baseDir string) ([]cachedRepo, error) {
+	baseDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []cachedRepo
+	err = filepath.Walk(baseDir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() || !strings.HasSuffix(name, ".git") {
+			return nil
+		}
+		if objs, err := os.Lstat(filepath.Join(name, "objects")); err != nil || !objs.IsDir() {
+			return nil
+		}
+
+		r := cachedRepo{dir: name, lastUsed: fi.ModTime()}
+		if err := filepath.Walk(name, func(_ string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				r.bytes += fi.Size()
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		repos = append(repos, r)
+		return filepath.SkipDir
+	})
+	return repos, err
+}
+
+// Evict deletes the least recently opened repositories until the
+// cache is within its limits. Repositories in use, in this process or
+// in another one that holds the lock of a repository, are kept, even
+// if that leaves the cache over its limits.
+func (rc *RepoCache) Evict() error {
+	if rc.limits.MaxEntries == 0 && rc.limits.MaxBytes == 0 {
+		return nil
+	}
+
+	repos, err := cachedRepos(rc.baseDir)
+	if err != nil {
+		return err
+	}
+	sort.Sort(reposByLastUse(repos))
+
+	count := len(repos)
+	var total int64
+	for _, r := range repos {
+		total += r.bytes
+	}
+
+	over := func() bool {
+		return (rc.limits.MaxEntries > 0 && count > rc.limits.MaxEntries) ||
+			(rc.limits.MaxBytes > 0 && total > rc.limits.MaxBytes)
+	}
+
+	inUseDirs.Lock()
+	defer inUseDirs.Unlock()
+	for _, r := range repos {
+		if !over() {
+			break
+		}
+		if repoDirInUse(r.dir) {
+			continue
+		}
+		unlock, err := tryLock(r.dir + repoLockSuffix)
+		if err == ErrAlreadyIndexing {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("evict %s: %v", r.dir, err)
+		}
+		err = os.RemoveAll(r.dir)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("evict %s: %v", r.dir, err)
+		}
+		count--
+		total -= r.bytes
+		if rc.limits.OnEvict != nil {
+			rc.limits.OnEvict(RepoCacheEviction{
+				Dir:      r.dir,
+				Bytes:    r.bytes,
+				LastUsed: r.lastUsed,
+			})
+		}
 	}
-	return repo, err
+	return nil
 }
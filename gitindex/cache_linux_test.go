@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepoCacheEvictLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repocache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := filepath.Join(dir, "host/old.git")
+	createFakeCachedRepo(t, old, 100, now.Add(-2*time.Hour))
+	createFakeCachedRepo(t, filepath.Join(dir, "host/new.git"), 100, now.Add(-time.Hour))
+
+	// A lock taken through its own file handle, as another indexer
+	// process would, rather than through acquireRepoDir.
+	unlock, err := lockShared(old + repoLockSuffix)
+	if err != nil {
+		t.Fatalf("lockShared: %v", err)
+	}
+
+	rc := NewRepoCache(dir)
+	rc.SetLimits(RepoCacheLimits{MaxEntries: 1})
+	if err := rc.Evict(); err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Errorf("locked repository was evicted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "host/new.git")); !os.IsNotExist(err) {
+		t.Errorf("got %v for unlocked repository, want it evicted", err)
+	}
+
+	unlock()
+	createFakeCachedRepo(t, filepath.Join(dir, "host/new.git"), 100, now.Add(-time.Hour))
+	if err := rc.Evict(); err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("got %v after unlock, want old repository evicted", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// createFakeCachedRepo creates a directory that looks like a bare
+// repository holding size bytes, last used at t.
+func createFakeCachedRepo(t *testing.T, dir string, size int, used time.Time) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "objects", "pack"), make([]byte, size), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(dir, used, used); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+}
+
+func TestRepoCacheEvict(t *testing.T) {
+	for _, tc := range []struct {
+		limits RepoCacheLimits
+		inUse  string
+		want   []string
+	}{
+		{
+			limits: RepoCacheLimits{MaxEntries: 2},
+			want:   []string{"host/old.git"},
+		},
+		{
+			limits: RepoCacheLimits{MaxBytes: 150},
+			want:   []string{"host/old.git", "host/mid.git"},
+		},
+		{
+			// The oldest repository is in use, so the next
+			// one goes.
+			limits: RepoCacheLimits{MaxEntries: 2},
+			inUse:  "host/old.git",
+			want:   []string{"host/mid.git"},
+		},
+		{
+			limits: RepoCacheLimits{},
+		},
+	} {
+		dir, err := ioutil.TempDir("", "repocache")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		now := time.Now()
+		createFakeCachedRepo(t, filepath.Join(dir, "host/old.git"), 100, now.Add(-3*time.Hour))
+		createFakeCachedRepo(t, filepath.Join(dir, "host/mid.git"), 100, now.Add(-2*time.Hour))
+		createFakeCachedRepo(t, filepath.Join(dir, "host/new.git"), 100, now.Add(-time.Hour))
+
+		if tc.inUse != "" {
+			release := acquireRepoDir(filepath.Join(dir, tc.inUse))
+			defer release()
+		}
+
+		var evicted []string
+		limits := tc.limits
+		limits.OnEvict = func(e RepoCacheEviction) {
+			rel, err := filepath.Rel(dir, e.Dir)
+			if err != nil {
+				t.Fatalf("Rel: %v", err)
+			}
+			if e.Bytes != 100 {
+				t.Errorf("%s: got %d bytes, want 100", rel, e.Bytes)
+			}
+			evicted = append(evicted, rel)
+		}
+
+		rc := NewRepoCache(dir)
+		rc.SetLimits(limits)
+		if err := rc.Evict(); err != nil {
+			t.Fatalf("Evict: %v", err)
+		}
+		if !reflect.DeepEqual(evicted, tc.want) {
+			t.Errorf("%+v: got evicted %v, want %v", tc.limits, evicted, tc.want)
+		}
+
+		var gone []string
+		for _, name := range []string{"host/old.git", "host/mid.git", "host/new.git"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+				gone = append(gone, name)
+			}
+		}
+		if !reflect.DeepEqual(gone, tc.want) {
+			t.Errorf("%+v: got deleted %v, want %v", tc.limits, gone, tc.want)
+		}
+	}
+}
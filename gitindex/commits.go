@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// commitMessagesFile is the name of the document holding the commit
+// messages of a branch, if Options.IndexCommitMessages is set.
+const commitMessagesFile = ".zoekt/commits"
+
+// commitLog returns the first-parent history from head, newest
+// first, in the format of git log: the commit ID, author, date and
+// the indented message. Older commits are left out once the log
+// would exceed sizeMax bytes.
+func commitLog(repo *git.Repository, head *git.Commit, sizeMax int) ([]byte, error) {
+	walk, err := repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer walk.Free()
+
+	walk.Sorting(git.SortTopological)
+	walk.SimplifyFirstParent()
+	if err := walk.Push(head.Id()); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := walk.Iterate(func(c *git.Commit) bool {
+		entry := formatCommit(c)
+		if buf.Len()+len(entry) > sizeMax {
+			return false
+		}
+		buf.WriteString(entry)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func formatCommit(c *git.Commit) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "commit %s\n", c.Id())
+	if a := c.Author(); a != nil {
+		fmt.Fprintf(&b, "Author: %s <%s>\n", a.Name, a.Email)
+		fmt.Fprintf(&b, "Date:   %s\n", a.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+	}
+	b.WriteString("\n")
+	for _, l := range strings.Split(strings.TrimRight(c.Message(), "\n"), "\n") {
+		b.WriteString("    " + l + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// addCommitMessages adds a commitMessagesFile document for the head
+// of each branch to repos and branchMap, with its content in
+// carried. Branches with the same head share the document. The key
+// has the ID of the head commit, so the document is generated again
+// whenever the head changes.
+func addCommitMessages(repo *git.Repository, opts *Options, repos map[FileKey]BlobLocation, branchMap map[FileKey][]string, carried map[FileKey][]byte) error {
+	sizeMax := opts.BuildOptions.SizeMaxFor(commitMessagesFile)
+	for _, br := range opts.BuildOptions.RepositoryDescription.Branches {
+		id, err := git.NewOid(br.Version)
+		if err != nil {
+			return err
+		}
+		key := FileKey{Path: commitMessagesFile, ID: *id}
+		if _, ok := carried[key]; !ok {
+			commit, err := repo.LookupCommit(id)
+			if err != nil {
+				return err
+			}
+			content, err := commitLog(repo, commit, sizeMax)
+			commit.Free()
+			if err != nil {
+				return err
+			}
+			carried[key] = content
+			repos[key] = BlobLocation{Repo: repo}
+		}
+		branchMap[key] = append(branchMap[key], br.Name)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import "bytes"
+
+// minifiedLineLength is the length from which MinifiedJS considers a
+// line minified. Code written by hand rarely has lines this long.
+const minifiedLineLength = 1000
+
+// MinifiedJS returns true if prefix, the start of a file, looks like
+// minified JavaScript or CSS: it has a line of at least 1000 bytes
+// that holds code punctuation, and where fewer than one in 20 bytes
+// is a space. Long lines of prose have more spaces, and encoded data
+// has no punctuation. It can be used in Options.ExcludeByContent.
+func MinifiedJS(prefix []byte) bool {
+	for _, line := range bytes.Split(prefix, []byte{'\n'}) {
+		if len(line) < minifiedLineLength || !bytes.ContainsAny(line, ";{}") {
+			continue
+		}
+		spaces := bytes.Count(line, []byte{' '}) + bytes.Count(line, []byte{'\t'})
+		if spaces*20 < len(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedByContent returns true if one of o.ExcludeByContent rejects
+// the file starting with content. The detectors see at most
+// blobPrefixSize bytes, as they do for blobs that aren't read in full.
+func (o *Options) excludedByContent(content []byte) bool {
+	if len(content) > blobPrefixSize {
+		content = content[:blobPrefixSize]
+	}
+	for _, exclude := range o.ExcludeByContent {
+		if exclude(content) {
+			return true
+		}
+	}
+	return false
+}
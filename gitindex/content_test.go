@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMinifiedJS(t *testing.T) {
+	minified := "!function(e){var t={};function n(r){if(t[r])return t[r].exports;}" + strings.Repeat("n.d=function(e,t,r){n.o(e,t)||Object.defineProperty(e,t,{get:r})};", 20)
+	prose := strings.Repeat("This paragraph was written on a single line; editors wrap it. ", 20)
+
+	for name, tc := range map[string]struct {
+		content string
+		want    bool
+	}{
+		"minified":         {minified, true},
+		"minified license": {"/*! lib v1.0 | MIT */\n" + minified, true},
+		"source":           {strings.Repeat("function f(a) {\n  return a;\n}\n", 100), false},
+		"prose":            {prose, false},
+		"base64":           {strings.Repeat("QUJDREVGR0hJSktMTU5PUFFSU1RVVldY", 40), false},
+		"short":            {"var a=1;", false},
+	} {
+		if got := MinifiedJS([]byte(tc.content)); got != tc.want {
+			t.Errorf("%s: got %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestExcludedByContent(t *testing.T) {
+	var seen int
+	opts := Options{ExcludeByContent: []func([]byte) bool{
+		func(prefix []byte) bool {
+			seen = len(prefix)
+			return false
+		},
+		func(prefix []byte) bool {
+			return strings.HasPrefix(string(prefix), "<svg")
+		},
+	}}
+
+	if opts.excludedByContent(make([]byte, 3*blobPrefixSize)) {
+		t.Errorf("excluded content that no detector rejects")
+	}
+	if seen != blobPrefixSize {
+		t.Errorf("detector saw %d bytes, want %d", seen, blobPrefixSize)
+	}
+	if !opts.excludedByContent([]byte("<svg xmlns='http://www.w3.org/2000/svg'/>")) {
+		t.Errorf("SVG was not excluded")
+	}
+	if (&Options{}).excludedByContent([]byte("<svg")) {
+		t.Errorf("excluded content without detectors")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"path"
+	"sort"
+
+	git "github.com/libgit2/git2go"
+)
+
+// treeDelta holds the paths that differ between two trees.
+type treeDelta struct {
+	// changed holds the paths of added and modified entries. For
+	// a submodule whose commit changed, it holds the path of the
+	// submodule.
+	changed map[string]bool
+
+	// deleted holds the paths of removed entries, sorted. Files
+	// removed inside a submodule are not listed.
+	deleted []string
+}
+
+// diffTrees returns the paths changed from the tree old to new.
+// Renames are not detected, so a renamed file shows up as deleted
+// under its old path and added under the new one.
+func diffTrees(repo *git.Repository, old, new *git.Tree) (*treeDelta, error) {
+	diff, err := repo.DiffTreeToTree(old, new, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return nil, err
+	}
+	d := &treeDelta{changed: map[string]bool{}}
+	for i := 0; i < n; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, err
+		}
+		switch delta.Status {
+		case git.DeltaDeleted:
+			d.deleted = append(d.deleted, delta.OldFile.Path)
+		case git.DeltaUnmodified:
+		default:
+			d.changed[delta.NewFile.Path] = true
+		}
+	}
+	sort.Strings(d.deleted)
+	return d, nil
+}
+
+// keep returns true if the file is in a changed path. All files of a
+// changed submodule, and of the submodules nested in it, are kept.
+func (d *treeDelta) keep(key FileKey) bool {
+	if d.changed[key.FullPath()] {
+		return true
+	}
+	for p := key.SubRepoPath; p != "" && p != "."; p = path.Dir(p) {
+		if d.changed[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the files that are in changed paths.
+func (d *treeDelta) filter(files map[FileKey]BlobLocation) map[FileKey]BlobLocation {
+	result := map[FileKey]BlobLocation{}
+	for key, location := range files {
+		if d.keep(key) {
+			result[key] = location
+		}
+	}
+	return result
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/libgit2/git2go"
+)
+
+// DryRunSummary describes what indexing a repository would do.
+type DryRunSummary struct {
+	// UpToDate is set if an incremental run would leave the
+	// index alone. The other fields are then empty.
+	UpToDate bool
+
+	// Files is the number of files that would be indexed, and
+	// Bytes their total size.
+	Files int
+	Bytes int64
+
+	// TooLarge holds the files skipped for exceeding the size
+	// limit, in the order they would have been read.
+	TooLarge []DocumentMeta
+
+	// Branches breaks the numbers down by branch. A file on
+	// several branches counts for each of them.
+	Branches map[string]*DryRunBranch
+}
+
+// DryRunBranch is the part of a DryRunSummary for one branch.
+type DryRunBranch struct {
+	Files    int
+	Bytes    int64
+	TooLarge int
+}
+
+func (s *DryRunSummary) branch(name string) *DryRunBranch {
+	if s.Branches == nil {
+		s.Branches = map[string]*DryRunBranch{}
+	}
+	b := s.Branches[name]
+	if b == nil {
+		b = &DryRunBranch{}
+		s.Branches[name] = b
+	}
+	return b
+}
+
+// String returns a human readable summary, one line per branch.
+func (s *DryRunSummary) String() string {
+	if s.UpToDate {
+		return "index is up to date\n"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d files, %d bytes, %d too large\n", s.Files, s.Bytes, len(s.TooLarge))
+	var names []string
+	for name := range s.Branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := s.Branches[name]
+		fmt.Fprintf(&buf, "branch %s: %d files, %d bytes, %d too large\n", name, b.Files, b.Bytes, b.TooLarge)
+	}
+	return buf.String()
+}
+
+// DryRunGitRepo walks the repository like IndexGitRepo, but only
+// reports what would be indexed. No shards are written, and
+// opts.DryRun is implied.
+func DryRunGitRepo(opts Options) (*DryRunSummary, error) {
+	summary := &DryRunSummary{}
+	opts.DryRun = true
+	opts.dryRunSummary = summary
+	if _, err := indexGitRepo(opts); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// dryRunFiles fills in summary for the files in keys. Only the sizes
+// of the blobs are looked up, so files that would be dropped for
+// their content, such as binary files, are counted too.
+func dryRunFiles(opts *Options, summary *DryRunSummary, keys []FileKey, repos map[FileKey]BlobLocation, branchMap map[FileKey][]string, carried map[FileKey][]byte) error {
+	odbs := map[*git.Repository]*git.Odb{}
+	defer func() {
+		for _, odb := range odbs {
+			odb.Free()
+		}
+	}()
+
+	for _, key := range keys {
+		location := repos[key]
+
+		var size int64
+		if c, ok := carried[key]; ok {
+			size = int64(len(c))
+		} else if location.Symlink {
+			blob, err := location.Repo.LookupBlob(&key.ID)
+			if err != nil {
+				return err
+			}
+			fn, ok := annexObjectPath(location.Repo.Path(), blob.Contents())
+			blob.Free()
+			if !ok {
+				continue
+			}
+			fi, err := os.Stat(fn)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			size = fi.Size()
+		} else {
+			odb, ok := odbs[location.Repo]
+			if !ok {
+				var err error
+				odb, err = location.Repo.Odb()
+				if err != nil {
+					return err
+				}
+				odbs[location.Repo] = odb
+			}
+			sz, _, err := odb.ReadHeader(&key.ID)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key.FullPath(), err)
+			}
+			size = int64(sz)
+		}
+
+		brs := branchMap[key]
+		if size > int64(opts.BuildOptions.SizeMaxFor(key.FullPath())) {
+			summary.TooLarge = append(summary.TooLarge, DocumentMeta{
+				Name:              key.FullPath(),
+				SubRepositoryPath: key.SubRepoPath,
+				Branches:          brs,
+				Size:              int(size),
+			})
+			for _, b := range brs {
+				summary.branch(b).TooLarge++
+			}
+			continue
+		}
+		if opts.DocumentFilter != nil && !opts.DocumentFilter(key.FullPath(), size, nil) {
+			continue
+		}
+
+		summary.Files++
+		summary.Bytes += size
+		for _, b := range brs {
+			br := summary.branch(b)
+			br.Files++
+			br.Bytes += size
+		}
+	}
+	return nil
+}
@@ -15,27 +15,42 @@
 package gitindex
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
-	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
+	"golang.org/x/net/context"
 
 	git "github.com/libgit2/git2go"
 )
 
-// RepoModTime returns the time of last fetch of a git repository.
+// RepoModTime returns the time of last fetch of a git repository. It
+// also looks at the object stores, including the ones shared through
+// objects/info/alternates, so objects arriving in a shared store
+// count as a change.
 func RepoModTime(dir string) (time.Time, error) {
 	var last time.Time
-	refDir := filepath.Join(dir, "refs")
-	if _, err := os.Lstat(refDir); err == nil {
+	// Repositories using the reftable ref storage keep their refs
+	// in reftable/ instead.
+	for _, sub := range []string{"refs", "reftable"} {
+		refDir := filepath.Join(dir, sub)
+		if _, err := os.Lstat(refDir); err != nil {
+			continue
+		}
 		if err := filepath.Walk(refDir,
 			func(name string, fi os.FileInfo, err error) error {
 				if !fi.IsDir() && last.Before(fi.ModTime()) {
@@ -54,19 +69,156 @@ func RepoModTime(dir string) (time.Time, error) {
 		}
 	}
 
+	for _, objDir := range objectDirs(filepath.Join(dir, "objects")) {
+		// New loose objects touch their fan-out directory, and
+		// fetches add files to pack/.
+		for _, sub := range []string{"", "pack"} {
+			fis, err := ioutil.ReadDir(filepath.Join(objDir, sub))
+			if err != nil {
+				continue
+			}
+			for _, fi := range fis {
+				if last.Before(fi.ModTime()) {
+					last = fi.ModTime()
+				}
+			}
+		}
+	}
+
+	return last, nil
+}
+
+// RepoFetchTime returns the time of the most recent entry in the
+// reflog of HEAD, or the modification time of FETCH_HEAD if that is
+// later. Unlike RepoModTime, this is not fooled by git gc, which
+// rewrites packed-refs and leaves no loose refs. If neither file
+// exists, it returns the zero time.
+func RepoFetchTime(dir string) (time.Time, error) {
+	var last time.Time
+	if fi, err := os.Stat(filepath.Join(dir, "FETCH_HEAD")); err == nil {
+		last = fi.ModTime()
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "logs", "HEAD"))
+	if os.IsNotExist(err) {
+		return last, nil
+	} else if err != nil {
+		return last, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		t, err := reflogTime(line)
+		if err != nil {
+			return last, fmt.Errorf("%s: %v", filepath.Join(dir, "logs", "HEAD"), err)
+		}
+		if last.Before(t) {
+			last = t
+		}
+	}
 	return last, nil
 }
 
-// FindGitRepos finds directories holding git repositories.
+// reflogTime returns the time of a reflog entry, which looks like
+// "OLD NEW Name <email> 1500000000 +0200\tmessage".
+func reflogTime(line string) (time.Time, error) {
+	if i := strings.Index(line, "\t"); i >= 0 {
+		line = line[:i]
+	}
+	i := strings.LastIndex(line, ">")
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("no committer in reflog entry %q", line)
+	}
+	fields := strings.Fields(line[i+1:])
+	if len(fields) != 2 {
+		return time.Time{}, fmt.Errorf("no timestamp in reflog entry %q", line)
+	}
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp in reflog entry %q: %v", line, err)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// objectDirs returns objDir and the object directories it borrows
+// from through objects/info/alternates, recursively.
+func objectDirs(objDir string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	todo := []string{objDir}
+	for len(todo) > 0 {
+		dir := filepath.Clean(todo[0])
+		todo = todo[1:]
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+
+		for _, line := range readAlternates(dir) {
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(dir, line)
+			}
+			todo = append(todo, line)
+		}
+	}
+	return dirs
+}
+
+// isReftable returns true if the git directory uses the reftable ref
+// storage.
+func isReftable(gitDir string) bool {
+	fi, err := os.Stat(filepath.Join(gitDir, "reftable", "tables.list"))
+	return err == nil && !fi.IsDir()
+}
+
+// FindGitRepos finds directories holding git repositories. For
+// linked worktrees, whose .git is a file, it returns the git
+// directory the file points to, even if that is outside arg.
 func FindGitRepos(arg string) ([]string, error) {
+	return FindGitReposLimited(arg, 0, nil)
+}
+
+// FindGitReposLimited is like FindGitRepos, but does not look
+// further than maxDepth directories below arg, if maxDepth is
+// positive, and skips directories whose base name matches one of
+// the skipDirs globs, eg. "node_modules" or "*.bak".
+func FindGitReposLimited(arg string, maxDepth int, skipDirs []string) ([]string, error) {
+	for _, pat := range skipDirs {
+		if _, err := filepath.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("skip pattern %q: %v", pat, err)
+		}
+	}
+
 	arg, err := filepath.Abs(arg)
 	if err != nil {
 		return nil, err
 	}
 	var dirs []string
+	seen := map[string]bool{}
 	if err := filepath.Walk(arg, func(name string, fi os.FileInfo, err error) error {
-		if fi, err := os.Lstat(filepath.Join(name, ".git")); err == nil && fi.IsDir() {
-			dirs = append(dirs, filepath.Join(name, ".git"))
+		if err == nil && fi.IsDir() && name != arg {
+			if skipDir(name, arg, maxDepth, skipDirs) {
+				return filepath.SkipDir
+			}
+		}
+
+		dotGit := filepath.Join(name, ".git")
+		if fi, err := os.Lstat(dotGit); err == nil && fi.IsDir() {
+			dirs = append(dirs, dotGit)
+			return filepath.SkipDir
+		} else if err == nil && fi.Mode().IsRegular() {
+			gitDir, err := readGitFile(dotGit)
+			if err != nil {
+				log.Printf("%s: %v", dotGit, err)
+				return nil
+			}
+			if !seen[gitDir] {
+				seen[gitDir] = true
+				dirs = append(dirs, gitDir)
+			}
 			return filepath.SkipDir
 		}
 
@@ -88,8 +240,93 @@ func FindGitRepos(arg string) ([]string, error) {
 	return dirs, nil
 }
 
+// skipDir returns true if FindGitReposLimited should not descend
+// into the directory name below root.
+func skipDir(name, root string, maxDepth int, skipDirs []string) bool {
+	if maxDepth > 0 {
+		rel, err := filepath.Rel(root, name)
+		if err == nil && strings.Count(rel, string(filepath.Separator))+1 > maxDepth {
+			return true
+		}
+	}
+	base := filepath.Base(name)
+	for _, pat := range skipDirs {
+		if matched, _ := filepath.Match(pat, base); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// readGitFile returns the git directory named by a .git file, as
+// used for linked worktrees. Relative paths are taken relative to
+// the directory holding the file.
+func readGitFile(name string) (string, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	const prefix = "gitdir: "
+	line := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(line, prefix) {
+		return "", fmt.Errorf("no %q line", strings.TrimSpace(prefix))
+	}
+
+	dir := strings.TrimPrefix(line, prefix)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(name), dir)
+	}
+	dir = filepath.Clean(dir)
+	if fi, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("gitdir %s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// templatesForOrigin returns the URL and templates for a repository
+// cloned from u. The template type registered with
+// RegisterHostTemplate for the host is used if there is one, and
+// otherwise that of a well-known hosting site. The templates are
+// based on the web URL for u, so SSH clone URLs work too.
 func templatesForOrigin(u *url.URL) (*zoekt.Repository, error) {
-	return nil, fmt.Errorf("unknown URL %s", u)
+	typ := hostTemplateType(u)
+	if typ == "" {
+		return nil, fmt.Errorf("unknown git hosting site %q", u)
+	}
+
+	base := *webURL(u, typ)
+	if trimGitSuffix[typ] {
+		base.Path = strings.TrimSuffix(base.Path, ".git")
+	}
+	repo := &zoekt.Repository{}
+	if err := setTemplates(repo, &base, typ); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// knownHostTemplate returns the template type of well-known git
+// hosting sites, or "".
+func knownHostTemplate(host string) string {
+	switch {
+	case strings.HasSuffix(host, ".googlesource.com"):
+		return "gitiles"
+	case host == "github.com":
+		return "github"
+	case host == "gitlab.com":
+		return "gitlab"
+	case host == "git.sr.ht":
+		return "sourcehut"
+	case host == "bitbucket.org":
+		return "bitbucket-cloud"
+	case host == "dev.azure.com" || host == "ssh.dev.azure.com" || strings.HasSuffix(host, ".visualstudio.com"):
+		return "azure-devops"
+	case strings.HasPrefix(host, "git-codecommit.") && strings.HasSuffix(host, ".amazonaws.com"):
+		return "codecommit"
+	}
+	return ""
 }
 
 // setTemplates fills in URL templates for known git hosting
@@ -113,7 +350,9 @@ func setTemplates(repo *zoekt.Repository, u *url.URL, typ string) error {
 		// http://git.savannah.gnu.org/cgit/lilypond.git/tree/elisp/lilypond-mode.el?h=dev/philh&id=b2ca0fefe3018477aaca23b6f672c7199ba5238e#n100
 
 		repo.CommitURLTemplate = u.String() + "/commit/?id={{.Version}}"
-		repo.FileURLTemplate = u.String() + "/tree/{{.Path}}/?id={{.Version}}"
+		// The branch is optional: without h=, cgit resolves the
+		// commit relative to the default branch.
+		repo.FileURLTemplate = u.String() + "/tree/{{.Path}}/?{{if .Branch}}h={{.Branch}}&{{end}}id={{.Version}}"
 		repo.LineFragmentTemplate = "n{{.LineNumber}}"
 
 	case "gitweb":
@@ -122,12 +361,85 @@ func setTemplates(repo *zoekt.Repository, u *url.URL, typ string) error {
 		repo.CommitURLTemplate = u.String() + ";a=commit;h={{.Version}}"
 		repo.LineFragmentTemplate = "l{{.LineNumber}}"
 
+	case "gitlab":
+		// eg. https://gitlab.com/gitlab-org/gitlab-runner/-/blob/main/Makefile#L10
+		repo.CommitURLTemplate = u.String() + "/-/commit/{{.Version}}"
+		repo.FileURLTemplate = u.String() + "/-/blob/{{.Version}}/{{.Path}}"
+		repo.LineFragmentTemplate = "L{{.LineNumber}}"
+
+	case "gitea", "forgejo":
+		// eg. https://gitea.com/gitea/tea/src/commit/COMMIT/main.go#L10
+		repo.CommitURLTemplate = u.String() + "/commit/{{.Version}}"
+		repo.FileURLTemplate = u.String() + "/src/commit/{{.Version}}/{{.Path}}"
+		repo.LineFragmentTemplate = "L{{.LineNumber}}"
+
+	case "sourcehut":
+		// eg. https://git.sr.ht/~sircmpwn/scdoc/tree/master/item/README.md#L10
+		repo.CommitURLTemplate = u.String() + "/commit/{{.Version}}"
+		repo.FileURLTemplate = u.String() + "/tree/{{.Version}}/item/{{.Path}}"
+		repo.LineFragmentTemplate = "L{{.LineNumber}}"
+
+	case "bitbucket-server":
+		// https://stash.example.com/projects/FOO/repos/bar/browse/path/to/file.go?at=master#10
+		repo.CommitURLTemplate = u.String() + "/commits/{{.Version}}"
+		repo.FileURLTemplate = u.String() + "/browse/{{.Path}}?at={{.Version}}"
+		repo.LineFragmentTemplate = "{{.LineNumber}}"
+
+	case "bitbucket-cloud":
+		// https://bitbucket.org/atlassian/atlaskit/src/master/build/index.js#lines-10
+		repo.CommitURLTemplate = u.String() + "/commits/{{.Version}}"
+		repo.FileURLTemplate = u.String() + "/src/{{.Version}}/{{.Path}}"
+		repo.LineFragmentTemplate = "lines-{{.LineNumber}}"
+
+	case "azure-devops":
+		// https://dev.azure.com/org/project/_git/repo?path=/README.md&version=GCb2ca0fef&line=10
+		// The line is a query parameter rather than a fragment.
+		base := *u
+		base.User = nil
+		repo.URL = base.String()
+		repo.CommitURLTemplate = base.String() + "/commit/{{.Version}}"
+		repo.FileURLTemplate = base.String() + "?path=/{{.Path}}&version=GC{{.Version}}"
+		repo.LineFragmentTemplate = "&line={{.LineNumber}}"
+
+	case "codecommit":
+		// https://us-east-1.console.aws.amazon.com/codesuite/codecommit/repositories/repo/browse/b2ca0fef/--/README.md?region=us-east-1&lines=10-10
+		// u is the clone URL, or the repository in the console.
+		base, region, err := codeCommitConsoleURL(u)
+		if err != nil {
+			return err
+		}
+		repo.URL = base + "/browse?region=" + region
+		repo.CommitURLTemplate = base + "/commit/{{.Version}}?region=" + region
+		repo.FileURLTemplate = base + "/browse/{{.Version}}/--/{{.Path}}?region=" + region
+		repo.LineFragmentTemplate = "&lines={{.LineNumber}}-{{.LineNumber}}"
+
 	default:
 		return fmt.Errorf("URL scheme type %q unknown", typ)
 	}
 	return nil
 }
 
+// codeCommitConsoleURL returns the AWS console URL of the CodeCommit
+// repository with clone or console URL u, and its region.
+func codeCommitConsoleURL(u *url.URL) (string, string, error) {
+	host := u.Hostname()
+	var region, name string
+	switch {
+	case strings.HasPrefix(host, "git-codecommit.") && strings.HasSuffix(host, ".amazonaws.com"):
+		// https://git-codecommit.us-east-1.amazonaws.com/v1/repos/repo
+		region = strings.TrimSuffix(strings.TrimPrefix(host, "git-codecommit."), ".amazonaws.com")
+		name = strings.TrimPrefix(u.Path, "/v1/repos/")
+	case strings.HasSuffix(host, ".console.aws.amazon.com"):
+		region = strings.TrimSuffix(host, ".console.aws.amazon.com")
+		name = strings.TrimPrefix(u.Path, "/codesuite/codecommit/repositories/")
+	}
+	name = strings.Trim(name, "/")
+	if region == "" || strings.Contains(region, ".") || name == "" || name == strings.Trim(u.Path, "/") || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("%q is not a CodeCommit repository URL", u)
+	}
+	return "https://" + region + ".console.aws.amazon.com/codesuite/codecommit/repositories/" + name, region, nil
+}
+
 // getCommit returns a tree object for the given reference.
 func getCommit(repo *git.Repository, ref string) (*git.Commit, error) {
 	obj, err := repo.RevparseSingle(ref)
@@ -143,6 +455,17 @@ func getCommit(repo *git.Repository, ref string) (*git.Commit, error) {
 	return commitObj.AsCommit()
 }
 
+// isSigned returns true if the commit has a signature.
+func isSigned(c *git.Commit) (bool, error) {
+	sig, _, err := c.ExtractSignature()
+	if git.IsErrorCode(err, git.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return sig != "", nil
+}
+
 func clearEmptyConfig(err error) error {
 	if git.IsErrorClass(err, git.ErrClassConfig) && git.IsErrorCode(err, git.ErrNotFound) {
 		return nil
@@ -150,11 +473,29 @@ func clearEmptyConfig(err error) error {
 	return err
 }
 
+// validConfigSection returns whether s can be used as a git config
+// section, which holds letters, digits, '-' and '.'. The empty string
+// stands for the default section.
+func validConfigSection(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return !strings.HasPrefix(s, ".") && !strings.HasSuffix(s, ".")
+}
+
 func isMissingBranchError(err error) bool {
 	return git.IsErrorClass(err, git.ErrClassReference) && git.IsErrorCode(err, git.ErrNotFound)
 }
 
-func setTemplatesFromConfig(desc *zoekt.Repository, repoDir string) error {
+// setTemplatesFromConfig sets the name and URL templates of desc from
+// the settings in the git config section, eg. zoekt.web-url, or else
+// from the origin. If section is empty, it is "zoekt".
+func setTemplatesFromConfig(desc *zoekt.Repository, repoDir, section string) error {
+	if section == "" {
+		section = "zoekt"
+	}
 	base, err := git.NewConfig()
 	if err != nil {
 		return err
@@ -166,13 +507,38 @@ func setTemplatesFromConfig(desc *zoekt.Repository, repoDir string) error {
 	}
 	defer cfg.Free()
 
-	webURLStr, err := cfg.LookupString("zoekt.web-url")
+	// Explicit templates override those for web-url-type and those
+	// derived from the origin, even if the origin is unknown.
+	overrides := map[string]string{}
+	for _, key := range []string{section + ".file-url-template", section + ".commit-url-template", section + ".line-fragment-template"} {
+		v, err := cfg.LookupString(key)
+		err = clearEmptyConfig(err)
+		if err != nil {
+			return err
+		}
+		if v != "" {
+			overrides[key] = v
+		}
+	}
+	defer func() {
+		for key, dest := range map[string]*string{
+			section + ".file-url-template":      &desc.FileURLTemplate,
+			section + ".commit-url-template":    &desc.CommitURLTemplate,
+			section + ".line-fragment-template": &desc.LineFragmentTemplate,
+		} {
+			if v, ok := overrides[key]; ok {
+				*dest = v
+			}
+		}
+	}()
+
+	webURLStr, err := cfg.LookupString(section + ".web-url")
 	err = clearEmptyConfig(err)
 	if err != nil {
 		return err
 	}
 
-	webURLType, err := cfg.LookupString("zoekt.web-url-type")
+	webURLType, err := cfg.LookupString(section + ".web-url-type")
 	err = clearEmptyConfig(err)
 	if err != nil {
 		return err
@@ -186,9 +552,18 @@ func setTemplatesFromConfig(desc *zoekt.Repository, repoDir string) error {
 		if err := setTemplates(desc, webURL, webURLType); err != nil {
 			return err
 		}
+	} else if webURLStr != "" && len(overrides) > 0 {
+		desc.URL = webURLStr
+	}
+
+	archived, err := cfg.LookupBool(section + ".archived")
+	err = clearEmptyConfig(err)
+	if err != nil {
+		return err
 	}
+	desc.Archived = archived
 
-	name, err := cfg.LookupString("zoekt.name")
+	name, err := cfg.LookupString(section + ".name")
 	err = clearEmptyConfig(err)
 	if err != nil {
 		return err
@@ -202,7 +577,7 @@ func setTemplatesFromConfig(desc *zoekt.Repository, repoDir string) error {
 		if err != nil || remoteURL == "" {
 			return err
 		}
-		u, err := url.Parse(remoteURL)
+		u, err := parseCloneURL(remoteURL)
 		if err != nil {
 			return err
 		}
@@ -213,24 +588,73 @@ func setTemplatesFromConfig(desc *zoekt.Repository, repoDir string) error {
 	return nil
 }
 
-// SetTemplates fills in templates based on the origin URL.
-func SetTemplatesFromOrigin(desc *zoekt.Repository, u *url.URL) error {
-	desc.Name = filepath.Join(u.Host, strings.TrimSuffix(u.Path, ".git"))
+// hostTemplates maps host suffixes to template types, as registered
+// with RegisterHostTemplate.
+var hostTemplates = struct {
+	sync.Mutex
+	types map[string]string
+}{types: map[string]string{}}
+
+// trimGitSuffix holds the template types for which the web URL of a
+// repository is its clone URL without the ".git" suffix.
+var trimGitSuffix = map[string]bool{
+	"github":          true,
+	"sourcehut":       true,
+	"bitbucket-cloud": true,
+	"gitlab":          true,
+	"gitea":           true,
+	"forgejo":         true,
+}
 
-	if strings.HasSuffix(u.Host, ".googlesource.com") {
-		return setTemplates(desc, u, "gitiles")
-	} else if u.Host == "github.com" {
-		u.Path = strings.TrimSuffix(u.Path, ".git")
-		return setTemplates(desc, u, "github")
-	} else {
-		return fmt.Errorf("unknown git hosting site %q", u)
+// RegisterHostTemplate makes SetTemplatesFromOrigin use the URL
+// templates of type typ, as for the zoekt.web-url-type setting, for
+// hosts ending in hostSuffix, eg. ".gitlab.example.com". This also
+// applies to submodules. Registered suffixes take precedence over
+// the hosts that are recognized anyway, and the longest matching
+// suffix wins. CodeCommit URLs are only recognized on the AWS hosts,
+// so codecommit can't be registered.
+func RegisterHostTemplate(hostSuffix, typ string) error {
+	if hostSuffix == "" {
+		return fmt.Errorf("empty host suffix")
+	}
+	if typ == "codecommit" {
+		return fmt.Errorf("codecommit templates need an AWS CodeCommit host")
+	}
+	if err := setTemplates(&zoekt.Repository{}, &url.URL{}, typ); err != nil {
+		return err
 	}
+	hostTemplates.Lock()
+	defer hostTemplates.Unlock()
+	hostTemplates.types[hostSuffix] = typ
+	return nil
+}
 
-	found, err := templatesForOrigin(u)
+// registeredHostTemplate returns the template type registered for
+// host, or "".
+func registeredHostTemplate(host string) string {
+	hostTemplates.Lock()
+	defer hostTemplates.Unlock()
+	var suffix, typ string
+	for s, t := range hostTemplates.types {
+		if strings.HasSuffix(host, s) && len(s) > len(suffix) {
+			suffix, typ = s, t
+		}
+	}
+	return typ
+}
+
+// SetTemplatesFromOrigin sets the name of desc from the origin URL,
+// and fills in its URL and templates as templatesForOrigin finds
+// them. For hosts that are neither registered nor well-known, it
+// returns an error, and desc only gets a name. An SSH origin gives
+// the same name as the HTTPS one for the repository.
+func SetTemplatesFromOrigin(desc *zoekt.Repository, u *url.URL) error {
+	w := webURL(u, "")
+	desc.Name = filepath.Join(w.Host, strings.TrimSuffix(w.Path, ".git"))
 
+	found, err := templatesForOrigin(u)
 	if err != nil {
 		return err
-
 	}
 
 	desc.URL = found.URL
@@ -241,198 +665,1662 @@ func SetTemplatesFromOrigin(desc *zoekt.Repository, u *url.URL) error {
 }
 
 type Options struct {
-	Submodules         bool
+	// If set, submodules are indexed from their clones in
+	// RepoCacheDir, which must be set.
+	Submodules bool
+
+	// MaxSubmoduleDepth limits how deeply nested submodules are
+	// indexed. Deeper submodules are recorded as sub-repositories,
+	// but their files are not indexed. If zero, there is no limit.
+	MaxSubmoduleDepth int
+
+	// Incremental leaves the index alone if it holds the current
+	// branch versions. Otherwise, files whose blob is unchanged
+	// are taken from the existing shards instead of the
+	// repository.
 	Incremental        bool
 	AllowMissingBranch bool
-	RepoCacheDir       string
-	BuildOptions       build.Options
 
-	BranchPrefix string
-	Branches     []string
-}
+	// DefaultBranch is indexed in place of the branch "HEAD" if
+	// HEAD can't be resolved, eg. because it points to a branch
+	// that doesn't exist in a fresh mirror. It is relative to
+	// BranchPrefix. If it doesn't exist either, indexing fails
+	// unless AllowMissingBranch is set. Without DefaultBranch,
+	// AllowMissingBranch makes indexing skip a HEAD that points to
+	// a missing branch.
+	DefaultBranch string
 
-func expandBranches(repo *git.Repository, bs []string, prefix string) ([]string, error) {
-	var result []string
-	for _, b := range bs {
-		if b == "HEAD" {
-			_, ref, err := repo.RevparseExt(b)
-			if err != nil {
-				return nil, err
-			}
+	RepoCacheDir string
 
-			result = append(result, strings.TrimPrefix(ref.Name(), prefix))
-			continue
-		}
+	// RepoCacheLimits bounds the repositories kept in
+	// RepoCacheDir. Repositories in use by an indexing run are
+	// not evicted.
+	RepoCacheLimits RepoCacheLimits
 
-		if strings.Contains(b, "*") {
-			iter, err := repo.NewBranchIterator(git.BranchAll)
-			if err != nil {
-				log.Println("boem")
-				return nil, err
-			}
+	BuildOptions build.Options
 
-			for {
-				br, _, err := iter.Next()
-				if git.IsErrorCode(err, git.ErrIterOver) {
-					break
-				}
-				if err != nil {
-					log.Printf("bam %#v", err)
-					return nil, err
-				}
+	BranchPrefix string
 
-				name, err := br.Name()
-				if err != nil {
-					return nil, err
-				}
-				if matched, err := filepath.Match(b, name); err != nil {
-					return nil, err
-				} else if !matched {
-					continue
-				}
+	// Branches holds the names of the branches to index. Names
+	// with "*" are globs, and names starting with "re:" are
+	// regular expressions that must match the whole branch name,
+	// eg. `re:v\d+\.\d+`.
+	Branches []string
+
+	// RefPrefixes holds the ref namespaces that the patterns in
+	// Branches are matched in, eg. "refs/changes/" for Gerrit
+	// changes or "refs/pull/" for GitHub pull requests, in place
+	// of the local and remote branches. Branches then holds full
+	// ref names, eg. `re:refs/changes/\d+/\d+/\d+`, the refs are
+	// indexed under their full name, and BranchPrefix is not used.
+	RefPrefixes []string
+
+	// ExcludeBranches holds patterns for branches that are not
+	// indexed, even if Branches names them explicitly. They are
+	// globs or regular expressions as in Branches.
+	ExcludeBranches []string
+
+	// IncludePaths and ExcludePaths hold gitignore-style patterns
+	// for the files to index, matched against their path in the
+	// repository, including submodule prefixes. If IncludePaths
+	// is set, only files it matches are indexed. ExcludePaths
+	// takes precedence, like exclude pathspecs in git.
+	IncludePaths []string
+	ExcludePaths []string
+
+	// Tags are indexed as branches too, under the tag name. Like
+	// Branches, they may contain wildcards. If a tag has the same
+	// name as a branch, it is indexed as "tags/NAME".
+	Tags []string
+
+	// If set, index these commits under the given branch names,
+	// instead of resolving Branches and Tags.
+	BranchCommits []BranchCommit
+
+	// BranchNameMap maps branch names to the names stored in the
+	// index and shown in search results. The branches are still
+	// resolved by their real names, which are stored as
+	// zoekt.Repository.BranchRefs, so an incremental run rebuilds
+	// the index if a display name moves to another branch.
+	BranchNameMap map[string]string
+
+	// If set, files holding this string in their first
+	// skipMarkerScanSize bytes are not indexed.
+	SkipMarker string
+
+	// ExcludeByContent holds detectors for files not to index,
+	// such as MinifiedJS. They are called with the first 8 KB of
+	// each file, so a rejected blob is not read completely, and a
+	// file is skipped if one of them returns true.
+	ExcludeByContent []func(prefix []byte) bool
+
+	// If set, ComputeLastCommit follows files across renames: a
+	// file that was renamed without changes gets the commit that
+	// last changed it under its old name, rather than the rename.
+	// Renames are found by comparing the contents of the files
+	// added and deleted by each commit, so this makes the history
+	// walk considerably slower.
+	FollowRenames bool
+
+	// If set, index the content of git-annex symlinks that is
+	// present in the local annex. Other symlinks are skipped as
+	// before.
+	ResolveAnnex bool
+
+	// If set, symlinks to files that are indexed themselves are
+	// indexed too, under the name of the link and with the content
+	// of the file. Other symlinks are skipped, as they are if this
+	// is not set; the link target is never indexed as content.
+	IndexSymlinks bool
+
+	// If set, blob contents are read through the reader returned
+	// by BlobReaderWrap, for example to decompress them. Blobs
+	// are streamed from the object database where it can, so
+	// they needn't be held in memory in full. SizeMax then
+	// applies to the transformed content rather than the blob,
+	// and reading stops once the limit is exceeded. If
+	// IndexConcurrency is above 1, it is called concurrently.
+	BlobReaderWrap func(key FileKey, r io.Reader) io.Reader
+
+	// If set, DocumentFilter decides which files are indexed;
+	// returning false skips the file. It is called twice per
+	// file: first before the blob is read, with nil content and
+	// the blob size, or -1 if the size is only known after reading,
+	// as for git-annex content and BlobReaderWrap; and then, if
+	// the file is within the size limits, with its content before
+	// it is added. A filter that only looks at the path and size
+	// thus saves reading the blobs it skips, and a filter on
+	// content should accept nil content. If IndexConcurrency is
+	// above 1, it is called concurrently.
+	DocumentFilter func(path string, size int64, content []byte) bool
+
+	// IndexConcurrency is the number of goroutines reading blobs.
+	// Documents are still added to the index one at a time, in
+	// the same order as with a single goroutine. If zero, blobs
+	// are read serially.
+	IndexConcurrency int
+
+	// ReadRetries is the number of times a failed blob read is
+	// retried before indexing fails, for object databases on
+	// flaky network file systems. Missing objects are not
+	// retried.
+	ReadRetries int
+
+	// ReadRetryBackoff is the delay before the first retry of a
+	// blob read. It doubles with each further retry. If zero, it
+	// is 100ms.
+	ReadRetryBackoff time.Duration
+
+	// Timeout limits the time IndexGitRepo takes, including the
+	// fetch of CloneAndIndex. Once it has passed, indexing fails
+	// with ErrTimeout and no shards are written. It is checked
+	// before each branch is walked and each file is read, and
+	// ctags and git are killed when it runs out, but a single
+	// slow blob read can overrun it. If zero, there is no limit.
+	Timeout time.Duration
+
+	// ctx stops indexing once it is done. Nil means never.
+	ctx context.Context
+
+	// ConfigSection is the git config section that holds the
+	// repository name and URL templates, eg. "zoekt-team-a" for
+	// zoekt-team-a.web-url, so that one config can describe the
+	// repository for several indexers. If empty, it is "zoekt".
+	ConfigSection string
+
+	// BlobReadOrder is the order in which blobs are read and
+	// added to the index.
+	BlobReadOrder BlobReadOrder
+
+	// If set, OnDocument is called for each document the builder
+	// keeps.
+	OnDocument func(DocumentMeta)
+
+	// If set, BuildOptions.RepoDir must be a repository itself,
+	// rather than a directory inside one.
+	NoRepoSearch bool
+
+	// LockTimeout is how long to wait for another indexer of the
+	// same shards to finish. If zero, IndexGitRepo returns
+	// ErrAlreadyIndexing right away.
+	LockTimeout time.Duration
+
+	// If set, the shards are not locked while indexing. Only use
+	// this if no other indexer can write the same shards.
+	IgnoreLock bool
+
+	// If set, spans are started on Tracer around the phases of
+	// indexing.
+	Tracer Tracer
+
+	// If set, files that .gitattributes marks export-ignore are
+	// skipped, files marked linguist-generated are indexed as
+	// zoekt.Document.Generated, and linguist-language sets
+	// zoekt.Document.Language. As in git, deeper .gitattributes
+	// files take precedence, and within a file, later lines do.
+	RespectGitattributes bool
+
+	// If set, files ignored by the .gitignore files in the tree,
+	// by info/exclude in the git directory or by the file in
+	// core.excludesFile are skipped. Unlike in git, this also
+	// skips files that are committed, so a tree is indexed as if
+	// it were a checkout with only the files git doesn't ignore.
+	RespectGitignore bool
+
+	// If set, RankSignals is called for each document, and the
+	// signals it returns are stored in the index. Only documents
+	// with signals take up space.
+	RankSignals func(key FileKey) map[string]float64
+
+	// If set, the trees are walked and the files filtered by size
+	// as usual, but nothing is indexed and no shards are written
+	// or locked. IndexGitRepo logs what would have been indexed;
+	// DryRunGitRepo returns it.
+	DryRun bool
+
+	// If set, the commit messages of each branch are indexed as
+	// a document named .zoekt/commits on that branch. It holds
+	// the first-parent history of the branch, newest first, in
+	// the format of git log, up to the size limit for documents.
+	IndexCommitMessages bool
+
+	// If set, only the files that differ between SinceCommit and
+	// each branch are indexed, for a small index supplementing
+	// that of SinceCommit. The branch versions are recorded as
+	// usual, and the index records SinceCommit and the deleted
+	// paths as zoekt.Repository.DeltaBase and DeletedPaths. Set
+	// BuildOptions.IndexDir or ShardNameFunc so the supplemental
+	// shards don't replace the full ones.
+	SinceCommit string
+
+	// If set, each file of the top-level repository is indexed
+	// with the commit that last changed it on the first-parent
+	// history of its branch, as zoekt.Document.LastCommit. A
+	// file on several branches gets the most recent one. This
+	// diffs each commit with its parent, back to the oldest
+	// commit that last changed a file, so it is slow for long
+	// histories; commits shared by branches are only diffed once.
+	ComputeLastCommit bool
+
+	// dryRunSummary receives the outcome of a dry run.
+	dryRunSummary *DryRunSummary
+
+	// memberRepos holds the descriptions of the repositories
+	// indexed by IndexGitRepos, by path.
+	memberRepos map[string]*zoekt.Repository
+
+	// branchDocuments receives the number of documents indexed
+	// for each branch.
+	branchDocuments map[string]int
+}
 
-				result = append(result, strings.TrimPrefix(name, prefix))
-			}
-			continue
-		}
+// ErrTimeout is returned by IndexGitRepo if indexing takes longer
+// than Options.Timeout.
+var ErrTimeout = errors.New("indexing timed out")
 
-		result = append(result, b)
+// context returns the context that stops indexing.
+func (o *Options) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
 	}
+	return o.ctx
+}
 
-	return result, nil
-
+// startTimeout makes the context of o run out after Timeout, if it
+// is set. Timeout is cleared, so it is not started twice. The
+// returned function releases the timer.
+func (o *Options) startTimeout() func() {
+	if o.Timeout <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(o.context(), o.Timeout)
+	o.ctx = ctx
+	o.Timeout = 0
+	return cancel
 }
 
-// IndexGitRepo indexes the git repository as specified by the options.
-func IndexGitRepo(opts Options) error {
-	repo, err := git.OpenRepository(opts.BuildOptions.RepoDir)
-	if err != nil {
+// checkDeadline returns ErrTimeout if the deadline of the context of
+// o has passed, and the context's error if it was cancelled.
+func (o *Options) checkDeadline() error {
+	switch err := o.context().Err(); err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	default:
 		return err
 	}
+}
 
-	if err := setTemplatesFromConfig(&opts.BuildOptions.RepositoryDescription, opts.BuildOptions.RepoDir); err != nil {
-		log.Printf("setTemplatesFromConfig(%s): %s", opts.BuildOptions.RepoDir, err)
+// branchRefPrefix returns the prefix that makes the names in Branches
+// ref names.
+func (o *Options) branchRefPrefix() string {
+	if len(o.RefPrefixes) > 0 {
+		return ""
 	}
+	return o.BranchPrefix
+}
 
-	repoCache := NewRepoCache(opts.RepoCacheDir)
-	defer repoCache.Close()
-
-	// branch => (path, sha1) => repo.
-	repos := map[FileKey]BlobLocation{}
-
-	// FileKey => branches
-	branchMap := map[FileKey][]string{}
-
-	// Branch => Repo => SHA1
-	branchVersions := map[string]map[string]git.Oid{}
-
-	branches, err := expandBranches(repo, opts.Branches, opts.BranchPrefix)
-	if err != nil {
-		return err
+// Validate checks the options for mistakes that would otherwise
+// show up as confusing errors while indexing. All problems found are
+// reported in a single error.
+func (o Options) Validate() error {
+	var errs []string
+	if o.BuildOptions.RepoDir == "" {
+		errs = append(errs, "BuildOptions.RepoDir must be set")
 	}
-	for _, b := range branches {
-		fullName := filepath.Join(opts.BranchPrefix, b)
-
-		commit, err := getCommit(repo, fullName)
-		if opts.AllowMissingBranch && isMissingBranchError(err) {
-			continue
-		}
-
-		if err != nil {
-			return err
+	if o.Submodules && o.RepoCacheDir == "" {
+		errs = append(errs, "Submodules requires RepoCacheDir, where submodules are found")
+	}
+	if o.BuildOptions.IndexDir == "" {
+		errs = append(errs, "BuildOptions.IndexDir must be set")
+	}
+	if o.BuildOptions.SizeMax <= 0 {
+		errs = append(errs, fmt.Sprintf("BuildOptions.SizeMax is %d, must be positive (see build.Options.SetDefaults)", o.BuildOptions.SizeMax))
+	}
+	for ext, max := range o.BuildOptions.SizeMaxByExtension {
+		if max <= 0 {
+			errs = append(errs, fmt.Sprintf("BuildOptions.SizeMaxByExtension[%q] is %d, must be positive", ext, max))
 		}
-		defer commit.Free()
-		opts.BuildOptions.RepositoryDescription.Branches = append(opts.BuildOptions.RepositoryDescription.Branches, zoekt.RepositoryBranch{
-			Name:    b,
-			Version: commit.Id().String(),
-		})
+	}
+	if o.BuildOptions.ShardMax <= 0 {
+		errs = append(errs, fmt.Sprintf("BuildOptions.ShardMax is %d, must be positive (see build.Options.SetDefaults)", o.BuildOptions.ShardMax))
+	}
 
-		tree, err := commit.Tree()
-		if err != nil {
-			return err
+	if len(o.Branches) == 0 && len(o.Tags) == 0 && len(o.BranchCommits) == 0 {
+		errs = append(errs, "no branches: set Branches, Tags or BranchCommits")
+	}
+	for _, b := range o.Branches {
+		if _, err := parseBranchPattern(b); err != nil {
+			errs = append(errs, fmt.Sprintf("branch pattern %q: %v", b, err))
 		}
-		defer tree.Free()
-
-		files, subVersions, err := TreeToFiles(repo, tree, opts.BuildOptions.RepositoryDescription.URL, repoCache)
-		if err != nil {
-			return err
+	}
+	if o.DefaultBranch != "" {
+		if p, err := parseBranchPattern(o.DefaultBranch); err != nil || !p.literal() {
+			errs = append(errs, fmt.Sprintf("DefaultBranch %q must be a branch name", o.DefaultBranch))
 		}
-		for k, v := range files {
-			repos[k] = v
-			branchMap[k] = append(branchMap[k], b)
+	}
+	for _, b := range o.ExcludeBranches {
+		if _, err := parseBranchPattern(b); err != nil {
+			errs = append(errs, fmt.Sprintf("exclude branch pattern %q: %v", b, err))
 		}
-
-		branchVersions[b] = subVersions
 	}
-
-	if opts.Incremental {
-		versions := opts.BuildOptions.IndexVersions()
-		if reflect.DeepEqual(versions, opts.BuildOptions.RepositoryDescription.Branches) {
-			return nil
+	for _, p := range o.RefPrefixes {
+		if !strings.HasPrefix(p, "refs/") {
+			errs = append(errs, fmt.Sprintf("ref prefix %q must start with refs/", p))
 		}
 	}
-
-	reposByPath := map[string]BlobLocation{}
-	for key, location := range repos {
-		reposByPath[key.SubRepoPath] = location
+	if o.Timeout < 0 {
+		errs = append(errs, fmt.Sprintf("Timeout %s must not be negative", o.Timeout))
 	}
-
-	opts.BuildOptions.SubRepositories = map[string]*zoekt.Repository{}
-	for path, location := range reposByPath {
-		tpl := opts.BuildOptions.RepositoryDescription
-		if path != "" {
-			tpl = zoekt.Repository{URL: location.URL.String()}
-			if err := SetTemplatesFromOrigin(&tpl, location.URL); err != nil {
-				log.Printf("setTemplatesFromOrigin(%s, %s): %s", path, location.URL, err)
-			}
+	if o.ReadRetries < 0 || o.ReadRetryBackoff < 0 {
+		errs = append(errs, fmt.Sprintf("ReadRetries %d and ReadRetryBackoff %s must not be negative", o.ReadRetries, o.ReadRetryBackoff))
+	}
+	if !validConfigSection(o.ConfigSection) {
+		errs = append(errs, fmt.Sprintf("ConfigSection %q is not a git config section name", o.ConfigSection))
+	}
+	if _, err := newPathFilter(o.IncludePaths, o.ExcludePaths); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, tag := range o.Tags {
+		if _, err := filepath.Match(tag, ""); err != nil {
+			errs = append(errs, fmt.Sprintf("tag pattern %q: %v", tag, err))
 		}
-		opts.BuildOptions.SubRepositories[path] = &tpl
 	}
-	for _, br := range opts.BuildOptions.RepositoryDescription.Branches {
-		for path, repo := range opts.BuildOptions.SubRepositories {
-			id := branchVersions[br.Name][path]
-			repo.Branches = append(repo.Branches, zoekt.RepositoryBranch{
-				Name:    br.Name,
-				Version: id.String(),
-			})
+	for _, bc := range o.BranchCommits {
+		if bc.Name == "" || bc.Commit == "" {
+			errs = append(errs, fmt.Sprintf("branch commit %+v needs Name and Commit", bc))
 		}
 	}
 
-	builder, err := build.NewBuilder(opts.BuildOptions)
-	if err != nil {
-		return err
+	if o.BlobReadOrder < BlobReadByName || o.BlobReadOrder > BlobReadByTree {
+		errs = append(errs, fmt.Sprintf("unknown BlobReadOrder %d", o.BlobReadOrder))
+	}
+	if o.IndexConcurrency < 0 {
+		errs = append(errs, fmt.Sprintf("IndexConcurrency is %d, must not be negative", o.IndexConcurrency))
+	}
+	if o.MaxSubmoduleDepth < 0 {
+		errs = append(errs, fmt.Sprintf("MaxSubmoduleDepth is %d, must not be negative", o.MaxSubmoduleDepth))
+	}
+	if o.RepoCacheLimits.MaxEntries < 0 || o.RepoCacheLimits.MaxBytes < 0 {
+		errs = append(errs, fmt.Sprintf("RepoCacheLimits has MaxEntries %d and MaxBytes %d, must not be negative", o.RepoCacheLimits.MaxEntries, o.RepoCacheLimits.MaxBytes))
+	}
+	if o.LockTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("LockTimeout is %v, must not be negative", o.LockTimeout))
+	}
+	if o.IgnoreLock && o.LockTimeout > 0 {
+		errs = append(errs, "IgnoreLock and LockTimeout cannot both be set")
 	}
 
-	var names []string
-	fileKeys := map[string][]FileKey{}
-	for key := range repos {
-		n := key.FullPath()
-		fileKeys[n] = append(fileKeys[n], key)
-		names = append(names, n)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid options: %s", strings.Join(errs, "; "))
 	}
-	// not strictly necessary, but nice for reproducibility.
-	sort.Strings(names)
+	return nil
+}
 
-	for _, name := range names {
-		keys := fileKeys[name]
-		for _, key := range keys {
-			brs := branchMap[key]
-			blob, err := repos[key].Repo.LookupBlob(&key.ID)
-			if err != nil {
-				return err
-			}
+// BranchCommit is a commit to index as a branch. Commit may be
+// anything that git rev-parse accepts.
+type BranchCommit struct {
+	Name   string
+	Commit string
+}
 
-			if blob.Size() > int64(opts.BuildOptions.SizeMax) {
+// BlobReadOrder is an order for reading blobs. If blobs are fetched
+// lazily, for example through a virtual file system, the order can
+// make a large difference in speed.
+type BlobReadOrder int
+
+const (
+	// BlobReadByName reads blobs sorted by path. This is the
+	// default, because it makes the index reproducible.
+	BlobReadByName BlobReadOrder = iota
+
+	// BlobReadByOID reads blobs sorted by object ID.
+	BlobReadByOID
+
+	// BlobReadByTree reads the blobs directory by directory, so
+	// blobs from the same tree are read together.
+	BlobReadByTree
+)
+
+// ParseBlobReadOrder parses "name", "oid" or "tree".
+func ParseBlobReadOrder(s string) (BlobReadOrder, error) {
+	switch s {
+	case "name", "":
+		return BlobReadByName, nil
+	case "oid":
+		return BlobReadByOID, nil
+	case "tree":
+		return BlobReadByTree, nil
+	}
+	return 0, fmt.Errorf("unknown blob read order %q", s)
+}
+
+// sortFileKeys sorts keys for reading in the given order. Ties are
+// broken by path and object ID, so the result is deterministic.
+func sortFileKeys(keys []FileKey, order BlobReadOrder) {
+	byName := func(a, b *FileKey) bool {
+		if a.FullPath() != b.FullPath() {
+			return a.FullPath() < b.FullPath()
+		}
+		return bytes.Compare(a.ID[:], b.ID[:]) < 0
+	}
+	var less func(a, b *FileKey) bool
+	switch order {
+	case BlobReadByOID:
+		less = func(a, b *FileKey) bool {
+			if c := bytes.Compare(a.ID[:], b.ID[:]); c != 0 {
+				return c < 0
+			}
+			return byName(a, b)
+		}
+	case BlobReadByTree:
+		less = func(a, b *FileKey) bool {
+			if a.SubRepoPath != b.SubRepoPath {
+				return a.SubRepoPath < b.SubRepoPath
+			}
+			if da, db := filepath.Dir(a.Path), filepath.Dir(b.Path); da != db {
+				return da < db
+			}
+			return byName(a, b)
+		}
+	default:
+		less = byName
+	}
+	sort.Sort(&fileKeySlice{keys, less})
+}
+
+type fileKeySlice struct {
+	keys []FileKey
+	less func(a, b *FileKey) bool
+}
+
+func (s *fileKeySlice) Len() int           { return len(s.keys) }
+func (s *fileKeySlice) Swap(i, j int)      { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s *fileKeySlice) Less(i, j int) bool { return s.less(&s.keys[i], &s.keys[j]) }
+
+// DocumentMeta describes a document that was passed to the builder.
+type DocumentMeta struct {
+	Name              string
+	SubRepositoryPath string
+	Branches          []string
+	Size              int
+
+	// Language is zoekt.Document.Language, from linguist-language
+	// if RespectGitattributes is set.
+	Language string
+}
+
+// readLimited reads r to the end. It returns nil if there are more
+// than sizeMax bytes.
+func readLimited(r io.Reader, sizeMax int) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, int64(sizeMax)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > sizeMax {
+		return nil, nil
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	return content, nil
+}
+
+// skipMarkerScanSize is how far into a file we look for the
+// SkipMarker.
+const skipMarkerScanSize = 1024
+
+// hasSkipMarker returns true if the start of content holds the
+// marker. Binary content is never considered marked.
+func hasSkipMarker(content []byte, marker string) bool {
+	if marker == "" {
+		return false
+	}
+	if len(content) > skipMarkerScanSize {
+		content = content[:skipMarkerScanSize]
+	}
+	if bytes.IndexByte(content, 0) != -1 {
+		return false
+	}
+	return bytes.Contains(content, []byte(marker))
+}
+
+// blobPrefixSize is how much of a blob is read to decide whether it
+// should be indexed at all.
+const blobPrefixSize = 8 << 10
+
+// rejectPrefix returns true if a blob starting with prefix should not
+// be indexed. Content with a NUL byte would be dropped as binary by
+// the builder anyway.
+func rejectPrefix(prefix []byte, marker string) bool {
+	return bytes.IndexByte(prefix, 0) != -1 || hasSkipMarker(prefix, marker)
+}
+
+// openBlob returns a reader for the content of a blob, and a function
+// that frees it. The object is streamed if the object database
+// supports it; otherwise it is inflated completely.
+func openBlob(repo *git.Repository, odb *git.Odb, id *git.Oid) (io.Reader, func(), error) {
+	stream, err := odb.NewReadStream(id)
+	if err == nil {
+		return stream, stream.Free, nil
+	}
+
+	// Packed objects can't be streamed.
+	blob, err := repo.LookupBlob(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(blob.Contents()), blob.Free, nil
+}
+
+// readBlob returns the content of a blob, or nil if it is larger than
+// sizeMax or reject returns true for its first blobPrefixSize bytes.
+// The object is streamed if the object database supports it, so
+// rejected blobs are not read in full. Otherwise, it is inflated
+// once, and the prefix is taken from that.
+func readBlob(repo *git.Repository, odb *git.Odb, id *git.Oid, sizeMax int, reject func(prefix []byte) bool) ([]byte, error) {
+	size, _, err := odb.ReadHeader(id)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(sizeMax) {
+		return nil, nil
+	}
+
+	stream, err := odb.NewReadStream(id)
+	if err != nil {
+		// Packed objects can't be streamed.
+		blob, err := repo.LookupBlob(id)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Free()
+		content := blob.Contents()
+		prefix := content
+		if len(prefix) > blobPrefixSize {
+			prefix = prefix[:blobPrefixSize]
+		}
+		if reject(prefix) {
+			return nil, nil
+		}
+		return content, nil
+	}
+	defer stream.Free()
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(buf, io.LimitReader(stream, blobPrefixSize)); err != nil {
+		return nil, err
+	}
+	if reject(buf.Bytes()) {
+		return nil, nil
+	}
+	if _, err := io.Copy(buf, stream); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// branchExcluded returns true if name matches one of the patterns in
+// excludes.
+func branchExcluded(name string, excludes []string) (bool, error) {
+	for _, e := range excludes {
+		p, err := parseBranchPattern(e)
+		if err != nil {
+			return false, err
+		}
+		if p.match(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// regexpBranchPrefix starts branch patterns that are regular
+// expressions rather than globs.
+const regexpBranchPrefix = "re:"
+
+// branchPattern matches branch names, either with a glob or with a
+// regular expression.
+type branchPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// parseBranchPattern parses a branch name or glob, or a regular
+// expression prefixed with "re:". The expression must match the
+// whole name.
+func parseBranchPattern(s string) (*branchPattern, error) {
+	if strings.HasPrefix(s, regexpBranchPrefix) {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(s, regexpBranchPrefix) + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &branchPattern{re: re}, nil
+	}
+	if _, err := filepath.Match(s, ""); err != nil {
+		return nil, err
+	}
+	return &branchPattern{glob: s}, nil
+}
+
+// literal returns true if the pattern only matches the branch of
+// its own name, so the branches needn't be listed to expand it.
+func (p *branchPattern) literal() bool {
+	return p.re == nil && !strings.Contains(p.glob, "*")
+}
+
+func (p *branchPattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	matched, _ := filepath.Match(p.glob, name)
+	return matched
+}
+
+// expandBranches returns the branches named or matched by bs, less
+// those matching excludes. Names are matched before prefix is
+// trimmed from them. Patterns match the local and remote branches,
+// or if refPrefixes is set, the full names of the refs under those
+// prefixes. If HEAD can't be resolved, defaultBranch is used
+// instead; without one, a HEAD pointing to a missing branch is left
+// out if allowMissing is set.
+func expandBranches(repo *git.Repository, bs []string, prefix string, refPrefixes []string, excludes []string, defaultBranch string, allowMissing bool) ([]string, error) {
+	var result []string
+	add := func(name string) error {
+		if excluded, err := branchExcluded(name, excludes); err != nil {
+			return err
+		} else if !excluded {
+			result = append(result, strings.TrimPrefix(name, prefix))
+		}
+		return nil
+	}
+
+	for _, b := range bs {
+		if b == "HEAD" {
+			var name string
+			_, ref, err := repo.RevparseExt(b)
+			switch {
+			case err == nil:
+				name = ref.Name()
+			case defaultBranch != "":
+				log.Printf("resolving HEAD: %v; using default branch %q", err, defaultBranch)
+				name = filepath.Join(prefix, defaultBranch)
+			case allowMissing && isMissingBranchError(err):
+				log.Printf("resolving HEAD: %v; skipping", err)
 				continue
+			default:
+				return nil, fmt.Errorf("resolving HEAD: %v", err)
 			}
 
-			builder.Add(zoekt.Document{
-				SubRepositoryPath: key.SubRepoPath,
+			if err := add(name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		pattern, err := parseBranchPattern(b)
+		if err != nil {
+			return nil, fmt.Errorf("branch pattern %q: %v", b, err)
+		}
+		if !pattern.literal() {
+			var names []string
+			if len(refPrefixes) > 0 {
+				names, err = matchingRefs(repo, refPrefixes, pattern)
+			} else {
+				names, err = matchingBranches(repo, pattern)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("expanding branch pattern %q: %v", b, err)
+			}
+			if len(names) == 0 {
+				log.Printf("branch pattern %q matches no branches", b)
+			}
+			for _, name := range names {
+				if err := add(name); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if err := add(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+
+}
+
+// matchingBranches returns the names of the local and remote
+// branches that match pattern.
+func matchingBranches(repo *git.Repository, pattern *branchPattern) ([]string, error) {
+	iter, err := repo.NewBranchIterator(git.BranchAll)
+	if err != nil {
+		return nil, fmt.Errorf("listing branches: %v", err)
+	}
+	defer iter.Free()
+
+	var names []string
+	for {
+		br, _, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing branches: %v", err)
+		}
+
+		name, err := br.Name()
+		br.Free()
+		if err != nil {
+			return nil, fmt.Errorf("branch name: %v", err)
+		}
+		if pattern.match(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// matchingRefs returns the full names of the refs under prefixes that
+// match pattern, sorted.
+func matchingRefs(repo *git.Repository, prefixes []string, pattern *branchPattern) ([]string, error) {
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %v", err)
+	}
+	defer iter.Free()
+
+	var result []string
+	names := iter.Names()
+	for {
+		name, err := names.Next()
+		if git.IsErrorCode(err, git.ErrIterOver) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing refs: %v", err)
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(name, p) && pattern.match(name) {
+				result = append(result, name)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// expandTags returns the names of the tags matching the patterns in
+// ts, without the refs/tags/ prefix. The matches of a wildcard are
+// sorted.
+func expandTags(repo *git.Repository, ts []string) ([]string, error) {
+	var result []string
+	for _, t := range ts {
+		if !strings.Contains(t, "*") {
+			result = append(result, t)
+			continue
+		}
+
+		var matches []string
+		iter, err := repo.NewReferenceIteratorGlob("refs/tags/*")
+		if err != nil {
+			return nil, err
+		}
+		names := iter.Names()
+		for {
+			name, err := names.Next()
+			if git.IsErrorCode(err, git.ErrIterOver) {
+				break
+			}
+			if err != nil {
+				iter.Free()
+				return nil, err
+			}
+
+			name = strings.TrimPrefix(name, "refs/tags/")
+			if matched, err := filepath.Match(t, name); err != nil {
+				iter.Free()
+				return nil, err
+			} else if matched {
+				matches = append(matches, name)
+			}
+		}
+		iter.Free()
+
+		sort.Strings(matches)
+		result = append(result, matches...)
+	}
+	return result, nil
+}
+
+// tagCommits returns the branch commits for indexing tags. A tag
+// that has the same name as one of branches is prefixed with "tags/".
+// getCommit peels annotated tags to the commit they point to.
+func tagCommits(tags []string, branches []BranchCommit) []BranchCommit {
+	taken := map[string]bool{}
+	for _, bc := range branches {
+		taken[bc.Name] = true
+	}
+
+	seen := map[string]bool{}
+	var result []BranchCommit
+	for _, tag := range tags {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		name := tag
+		if taken[name] {
+			name = "tags/" + tag
+		}
+		taken[name] = true
+		result = append(result, BranchCommit{
+			Name:   name,
+			Commit: "refs/tags/" + tag,
+		})
+	}
+	return result
+}
+
+// setSubRepoBranches fills in the branches for each sub repository,
+// in the order of the branches of the super project. A sub repository
+// only gets the branches it is present in, and each branch only
+// once. The super project (path "") already has its branches.
+func setSubRepoBranches(subRepos map[string]*zoekt.Repository, branches []zoekt.RepositoryBranch, branchVersions map[string]map[string]git.Oid) {
+	var paths []string
+	for path := range subRepos {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		repo := subRepos[path]
+
+		// Don't append to a slice shared with another Repository.
+		repo.Branches = nil
+		seen := map[string]bool{}
+		for _, br := range branches {
+			id, ok := branchVersions[br.Name][path]
+			if !ok || seen[br.Name] {
+				continue
+			}
+			seen[br.Name] = true
+			repo.Branches = append(repo.Branches, zoekt.RepositoryBranch{
+				Name:    br.Name,
+				Version: id.String(),
+			})
+		}
+	}
+}
+
+// sortedSubRepoPaths returns the keys of reposByPath in sorted order.
+func sortedSubRepoPaths(reposByPath map[string]BlobLocation) []string {
+	paths := make([]string, 0, len(reposByPath))
+	for path := range reposByPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// openRepository opens the repository at dir. Unless noSearch is
+// set, libgit2 looks for the repository in the parent directories
+// too. Objects are also read from the alternates that libgit2 skips.
+func openRepository(dir string, noSearch bool) (*git.Repository, error) {
+	var repo *git.Repository
+	var err error
+	if !noSearch {
+		repo, err = git.OpenRepository(dir)
+	} else {
+		repo, err = git.OpenRepositoryExtended(dir, git.RepositoryOpenNoSearch, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := addAlternates(repo); err != nil {
+		repo.Free()
+		return nil, fmt.Errorf("alternates of %s: %v", dir, err)
+	}
+	return repo, nil
+}
+
+// IndexGitRepo indexes the git repository as specified by the options.
+func IndexGitRepo(opts Options) error {
+	_, err := indexGitRepo(opts)
+	return err
+}
+
+// IndexGitRepoContext is IndexGitRepo, but indexing stops once ctx
+// is done. It then fails with ErrTimeout if the deadline of ctx has
+// passed, and with ctx.Err() otherwise, and no shards are written.
+func IndexGitRepoContext(ctx context.Context, opts Options) error {
+	opts.ctx = ctx
+	return IndexGitRepo(opts)
+}
+
+// indexGitRepo is IndexGitRepo, but also returns true if the index
+// was left alone because it was up to date.
+func indexGitRepo(opts Options) (bool, error) {
+	return indexGitRepoFrom(opts, "")
+}
+
+// indexGitRepoFrom is indexGitRepo, but if prevShard is set, the
+// content of unchanged files is taken from that shard. See
+// ReindexChanged.
+func indexGitRepoFrom(opts Options, prevShard string) (bool, error) {
+	if err := opts.Validate(); err != nil {
+		return false, err
+	}
+	stop := opts.startTimeout()
+	defer stop()
+
+	// libgit2 only reads loose and packed refs, so it would not
+	// find any branches.
+	for _, dir := range []string{opts.BuildOptions.RepoDir, filepath.Join(opts.BuildOptions.RepoDir, ".git")} {
+		if isReftable(dir) {
+			return false, fmt.Errorf("%s: reftable ref storage is not supported", dir)
+		}
+	}
+
+	repo, err := openRepository(opts.BuildOptions.RepoDir, opts.NoRepoSearch)
+	if err != nil {
+		return false, err
+	}
+
+	if err := setTemplatesFromConfig(&opts.BuildOptions.RepositoryDescription, opts.BuildOptions.RepoDir, opts.ConfigSection); err != nil {
+		log.Printf("setTemplatesFromConfig(%s): %s", opts.BuildOptions.RepoDir, err)
+	}
+
+	if !opts.IgnoreLock && !opts.DryRun {
+		lockName, err := opts.BuildOptions.LockName()
+		if err != nil {
+			return false, err
+		}
+		unlock, err := lockShards(lockName, opts.LockTimeout)
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+	}
+
+	// The repository may itself be in the cache directory.
+	release, err := lockCachedRepo(opts.RepoCacheDir, opts.BuildOptions.RepoDir)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	repoCache := NewRepoCache(opts.RepoCacheDir)
+	repoCache.SetLimits(opts.RepoCacheLimits)
+	defer repoCache.Close()
+
+	// branch => (path, sha1) => repo.
+	repos := map[FileKey]BlobLocation{}
+
+	// FileKey => branches
+	branchMap := map[FileKey][]string{}
+
+	// Branch => Repo => SHA1
+	branchVersions := map[string]map[string]git.Oid{}
+
+	// Files marked linguist-generated.
+	generated := map[FileKey]bool{}
+
+	// Languages from linguist-language.
+	languages := map[FileKey]string{}
+
+	// Path => URL for submodules that were not walked.
+	skippedSubRepos := map[string]*url.URL{}
+
+	// Commits that last changed the files, if ComputeLastCommit.
+	lastCommits := map[FileKey]fileCommit{}
+	var lastCommitsFinder *lastCommitFinder
+	if opts.ComputeLastCommit {
+		lastCommitsFinder = newLastCommitFinder(repo, opts.FollowRenames)
+	}
+
+	tracer := opts.tracer()
+	repoName := opts.BuildOptions.RepositoryDescription.Name
+
+	branchCommits := opts.BranchCommits
+	if len(branchCommits) == 0 {
+		span := tracer.StartSpan(SpanResolveRefs, map[string]interface{}{"repo": repoName})
+		branches, err := expandBranches(repo, opts.Branches, opts.branchRefPrefix(), opts.RefPrefixes, opts.ExcludeBranches, opts.DefaultBranch, opts.AllowMissingBranch)
+		if err != nil {
+			span.End()
+			return false, err
+		}
+		tags, err := expandTags(repo, opts.Tags)
+		span.End()
+		if err != nil {
+			return false, err
+		}
+
+		for _, b := range branches {
+			branchCommits = append(branchCommits, BranchCommit{
+				Name:   b,
+				Commit: filepath.Join(opts.branchRefPrefix(), b),
+			})
+		}
+		branchCommits = append(branchCommits, tagCommits(tags, branchCommits)...)
+	}
+
+	var sinceTree *git.Tree
+	if opts.SinceCommit != "" {
+		since, err := getCommit(repo, opts.SinceCommit)
+		if err != nil {
+			return false, fmt.Errorf("SinceCommit %q: %v", opts.SinceCommit, err)
+		}
+		defer since.Free()
+		sinceTree, err = since.Tree()
+		if err != nil {
+			return false, err
+		}
+		defer sinceTree.Free()
+		opts.BuildOptions.RepositoryDescription.DeltaBase = since.Id().String()
+	}
+
+	filter, err := newPathFilter(opts.IncludePaths, opts.ExcludePaths)
+	if err != nil {
+		return false, err
+	}
+	var globalExcludes, localExcludes *PathMatcher
+	if opts.RespectGitignore {
+		globalExcludes, localExcludes, err = readExcludes(repo)
+		if err != nil {
+			return false, err
+		}
+	}
+	displayNames := map[string]string{}
+	for _, bc := range branchCommits {
+		b := bc.Name
+		if name, ok := opts.BranchNameMap[b]; ok {
+			b = name
+		}
+		if other, ok := displayNames[b]; ok && other != bc.Name {
+			return false, fmt.Errorf("branches %q and %q both named %q", other, bc.Name, b)
+		}
+		displayNames[b] = bc.Name
+		if err := opts.checkDeadline(); err != nil {
+			return false, err
+		}
+
+		span := tracer.StartSpan(SpanWalkTree, map[string]interface{}{
+			"repo":   repoName,
+			"branch": b,
+		})
+		commit, err := getCommit(repo, bc.Commit)
+		if opts.AllowMissingBranch && isMissingBranchError(err) {
+			span.End()
+			continue
+		}
+
+		if err != nil {
+			span.End()
+			return false, err
+		}
+		defer commit.Free()
+		opts.BuildOptions.RepositoryDescription.Branches = append(opts.BuildOptions.RepositoryDescription.Branches, zoekt.RepositoryBranch{
+			Name:    b,
+			Version: commit.Id().String(),
+		})
+		if b != bc.Name {
+			desc := &opts.BuildOptions.RepositoryDescription
+			if desc.BranchRefs == nil {
+				desc.BranchRefs = map[string]string{}
+			}
+			desc.BranchRefs[b] = bc.Name
+		}
+		if signed, err := isSigned(commit); err != nil {
+			span.End()
+			return false, err
+		} else if signed {
+			desc := &opts.BuildOptions.RepositoryDescription
+			if desc.SignedBranches == nil {
+				desc.SignedBranches = map[string]bool{}
+			}
+			desc.SignedBranches[b] = true
+		}
+
+		tree, err := commit.Tree()
+		if err != nil {
+			span.End()
+			return false, err
+		}
+		defer tree.Free()
+
+		w, err := walkTree(repo, tree, opts.BuildOptions.RepositoryDescription.URL, repoCache, opts.ResolveAnnex || opts.IndexSymlinks, opts.MaxSubmoduleDepth, filter)
+		var files map[FileKey]BlobLocation
+		if err == nil {
+			files = w.tree
+			for p, u := range w.skippedSubRepos {
+				skippedSubRepos[p] = u
+			}
+		}
+		if err == nil && opts.IndexSymlinks {
+			files, err = resolveSymlinks(files, opts.ResolveAnnex)
+		}
+		if err == nil && opts.RespectGitattributes {
+			files, err = applyGitattributes(files, generated, languages)
+		}
+		if err == nil && opts.RespectGitignore {
+			files, err = applyGitignore(files, globalExcludes, localExcludes)
+		}
+		if err == nil && sinceTree != nil {
+			var delta *treeDelta
+			delta, err = diffTrees(repo, sinceTree, tree)
+			if err == nil {
+				files = delta.filter(files)
+				if len(delta.deleted) > 0 {
+					desc := &opts.BuildOptions.RepositoryDescription
+					if desc.DeletedPaths == nil {
+						desc.DeletedPaths = map[string][]string{}
+					}
+					desc.DeletedPaths[b] = delta.deleted
+				}
+			}
+		}
+		if err == nil && lastCommitsFinder != nil {
+			err = addLastCommits(lastCommitsFinder, commit, files, lastCommits)
+		}
+		span.SetAttribute("files", len(files))
+		span.End()
+		if err != nil {
+			return false, err
+		}
+		for k, v := range files {
+			repos[k] = v
+			branchMap[k] = append(branchMap[k], b)
+		}
+
+		branchVersions[b] = w.subRepoVersions
+	}
+
+	if opts.Incremental {
+		if opts.BuildOptions.IndexUpToDate() {
+			if opts.dryRunSummary != nil {
+				opts.dryRunSummary.UpToDate = true
+			}
+			return true, nil
+		}
+	}
+
+	var carried map[FileKey][]byte
+	if prevShard != "" {
+		carried, err = carryForward(repo, repoCache, prevShard, &opts, branchMap)
+		if err != nil {
+			return false, err
+		}
+	} else if opts.Incremental {
+		carried = indexedBlobs(opts.BuildOptions.FindAllShards(), opts.BuildOptions.FingerprintExtra, repos)
+	}
+
+	if opts.IndexCommitMessages {
+		if carried == nil {
+			carried = map[FileKey][]byte{}
+		}
+		if err := addCommitMessages(repo, &opts, repos, branchMap, carried); err != nil {
+			return false, err
+		}
+	}
+
+	return false, indexFiles(&opts, repos, branchMap, branchVersions, carried, generated, languages, lastCommits, skippedSubRepos)
+}
+
+// IndexGitTree indexes a single tree, as a branch called "HEAD"
+// whose version is the tree ID. The repository description is taken
+// from desc. Submodules are not followed.
+func IndexGitTree(repo *git.Repository, treeOID git.Oid, desc zoekt.Repository, buildOpts build.Options) error {
+	tree, err := repo.LookupTree(&treeOID)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	const branch = "HEAD"
+	desc.Branches = []zoekt.RepositoryBranch{{
+		Name:    branch,
+		Version: treeOID.String(),
+	}}
+	buildOpts.RepositoryDescription = desc
+
+	files, subVersions, err := TreeToFiles(repo, tree, desc.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	branchMap := map[FileKey][]string{}
+	for k := range files {
+		branchMap[k] = []string{branch}
+	}
+
+	opts := Options{BuildOptions: buildOpts}
+	return indexFiles(&opts, files, branchMap, map[string]map[string]git.Oid{
+		branch: subVersions,
+	}, nil, nil, nil, nil, nil)
+}
+
+// indexFiles builds the index for the given files. The branches must
+// already be set in opts.BuildOptions.RepositoryDescription. Files in
+// carried are not read from the repository, files in generated are
+// marked as such, files in languages get that language, and files in
+// lastCommits get that commit. The
+// submodules in skippedSubRepos become sub-repositories even if none
+// of their files are indexed.
+func indexFiles(opts *Options, repos map[FileKey]BlobLocation, branchMap map[FileKey][]string, branchVersions map[string]map[string]git.Oid, carried map[FileKey][]byte, generated map[FileKey]bool, languages map[FileKey]string, lastCommits map[FileKey]fileCommit, skippedSubRepos map[string]*url.URL) error {
+	reposByPath := map[string]BlobLocation{}
+	for key, location := range repos {
+		reposByPath[key.SubRepoPath] = location
+	}
+	for path, u := range skippedSubRepos {
+		if _, ok := reposByPath[path]; !ok {
+			reposByPath[path] = BlobLocation{URL: u}
+		}
+	}
+
+	opts.BuildOptions.SubRepositories = map[string]*zoekt.Repository{}
+	for _, path := range sortedSubRepoPaths(reposByPath) {
+		location := reposByPath[path]
+		tpl := opts.BuildOptions.RepositoryDescription
+		if desc, ok := opts.memberRepos[path]; ok {
+			tpl = *desc
+		} else if path != "" {
+			tpl = zoekt.Repository{URL: location.URL.String()}
+			if err := SetTemplatesFromOrigin(&tpl, location.URL); err != nil {
+				log.Printf("setTemplatesFromOrigin(%s, %s): %s", path, location.URL, err)
+			}
+		}
+		opts.BuildOptions.SubRepositories[path] = &tpl
+	}
+	setSubRepoBranches(opts.BuildOptions.SubRepositories,
+		opts.BuildOptions.RepositoryDescription.Branches, branchVersions)
+
+	keys := make([]FileKey, 0, len(repos))
+	for key := range repos {
+		keys = append(keys, key)
+	}
+	sortFileKeys(keys, opts.BlobReadOrder)
+
+	if opts.DryRun {
+		summary := opts.dryRunSummary
+		if summary == nil {
+			summary = &DryRunSummary{}
+		}
+		if err := dryRunFiles(opts, summary, keys, repos, branchMap, carried); err != nil {
+			return err
+		}
+		if opts.dryRunSummary == nil {
+			log.Printf("dry run for %s:\n%s", opts.BuildOptions.RepositoryDescription.Name, summary)
+		}
+		return nil
+	}
+
+	builder, err := build.NewBuilderContext(opts.context(), opts.BuildOptions)
+	if err != nil {
+		return err
+	}
+
+	tracer := opts.tracer()
+	span := tracer.StartSpan(SpanAddFiles, map[string]interface{}{
+		"repo":  opts.BuildOptions.RepositoryDescription.Name,
+		"files": len(keys),
+	})
+	docs, branchDocs, err := addFiles(opts, builder, keys, repos, branchMap, carried, generated, languages, lastCommits)
+	span.SetAttribute("documents", docs)
+	span.End()
+	if err != nil {
+		// The builder fails with the context's error.
+		if ctxErr := opts.checkDeadline(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	for _, br := range opts.BuildOptions.RepositoryDescription.Branches {
+		if branchDocs[br.Name] == 0 {
+			log.Printf("%s: branch %s has no documents", opts.BuildOptions.RepositoryDescription.Name, br.Name)
+		}
+	}
+	if opts.branchDocuments != nil {
+		for br, n := range branchDocs {
+			opts.branchDocuments[br] += n
+		}
+	}
+
+	if err := opts.checkDeadline(); err != nil {
+		return err
+	}
+	span = tracer.StartSpan(SpanFinish, map[string]interface{}{
+		"repo": opts.BuildOptions.RepositoryDescription.Name,
+	})
+	defer span.End()
+	if err := builder.Finish(); err != nil {
+		// The builder fails with the context's error.
+		if ctxErr := opts.checkDeadline(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+// addFiles reads the blobs for keys and adds them to the builder,
+// using the content in carried where present. It returns the number
+// of documents the builder kept, in total and for each branch. A
+// document on several branches counts for each.
+func addFiles(opts *Options, builder *build.Builder, keys []FileKey, repos map[FileKey]BlobLocation, branchMap map[FileKey][]string, carried map[FileKey][]byte, generated map[FileKey]bool, languages map[FileKey]string, lastCommits map[FileKey]fileCommit) (int, map[string]int, error) {
+	docs := 0
+	branchDocs := map[string]int{}
+	add := func(key FileKey, content []byte) error {
+		brs := branchMap[key]
+		doc := zoekt.Document{
+			SubRepositoryPath: key.SubRepoPath,
+			Name:              key.FullPath(),
+			Content:           content,
+			Branches:          brs,
+			Generated:         generated[key],
+			Language:          languages[key],
+			Mode:              uint32(repos[key].Mode),
+		}
+		if opts.RankSignals != nil {
+			doc.RankSignals = opts.RankSignals(key)
+		}
+		if c, ok := lastCommits[key]; ok {
+			doc.LastCommit = c.ID.String()
+			doc.LastCommitTime = c.Time
+		}
+		kept, err := builder.Add(doc)
+		if !kept {
+			return err
+		}
+		docs++
+		for _, br := range brs {
+			branchDocs[br]++
+		}
+		if opts.OnDocument != nil {
+			opts.OnDocument(DocumentMeta{
 				Name:              key.FullPath(),
-				Content:           blob.Contents(),
+				SubRepositoryPath: key.SubRepoPath,
 				Branches:          brs,
+				Size:              len(content),
+				Language:          doc.Language,
 			})
 		}
+		return err
+	}
+
+	newRead := func() (func(FileKey) ([]byte, error), func()) {
+		r := &fileReader{
+			opts:    opts,
+			repos:   repos,
+			carried: carried,
+			odbs:    map[*git.Repository]*git.Odb{},
+		}
+		return r.read, r.close
+	}
+	err := readFiles(opts.IndexConcurrency, keys, newRead, add)
+	return docs, branchDocs, err
+}
+
+// readFiles reads the files in keys, and calls add for the ones
+// that are not skipped, in the order of keys. It stops at the first
+// error from reading or from add. If n is above 1, n goroutines read
+// files concurrently, each with its own read function from newRead.
+// add is only called from the calling goroutine, so it needn't be
+// safe for concurrent use.
+func readFiles(n int, keys []FileKey, newRead func() (read func(FileKey) ([]byte, error), done func()), add func(FileKey, []byte) error) error {
+	if n <= 1 {
+		read, done := newRead()
+		defer done()
+		for _, key := range keys {
+			content, err := read(key)
+			if err != nil {
+				return err
+			}
+			if content != nil {
+				if err := add(key, content); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	type result struct {
+		content []byte
+		err     error
+	}
+	results := make([]chan result, len(keys))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// window bounds the number of files read ahead of add.
+	window := make(chan struct{}, 4*n)
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		for i := range keys {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read, done := newRead()
+			defer done()
+			for i := range jobs {
+				content, err := read(keys[i])
+				results[i] <- result{content, err}
+			}
+		}()
+	}
+
+	var err error
+	for i, key := range keys {
+		res := <-results[i]
+		<-window
+		if res.err != nil {
+			err = res.err
+			break
+		}
+		if res.content != nil {
+			if err = add(key, res.content); err != nil {
+				break
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	return err
+}
+
+// fileReader reads the content of files for the index. It is not
+// safe for concurrent use.
+type fileReader struct {
+	opts    *Options
+	repos   map[FileKey]BlobLocation
+	carried map[FileKey][]byte
+	odbs    map[*git.Repository]*git.Odb
+}
+
+func (r *fileReader) close() {
+	for _, odb := range r.odbs {
+		odb.Free()
+	}
+}
+
+// read returns the content of the file, or nil if it is skipped.
+func (r *fileReader) read(key FileKey) ([]byte, error) {
+	opts := r.opts
+	location := r.repos[key]
+	if err := opts.checkDeadline(); err != nil {
+		return nil, err
+	}
+
+	if opts.DocumentFilter != nil {
+		size, err := r.size(key, location)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.DocumentFilter(key.FullPath(), size, nil) {
+			return nil, nil
+		}
+	}
+
+	content, err := r.readContent(key, location)
+	if err != nil || content == nil {
+		return nil, err
+	}
+	if opts.DocumentFilter != nil && !opts.DocumentFilter(key.FullPath(), int64(len(content)), content) {
+		return nil, nil
+	}
+	return content, nil
+}
+
+// odb returns the object database of repo.
+func (r *fileReader) odb(repo *git.Repository) (*git.Odb, error) {
+	if odb, ok := r.odbs[repo]; ok {
+		return odb, nil
+	}
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	r.odbs[repo] = odb
+	return odb, nil
+}
+
+// size returns the size of the file as far as it is known before
+// reading it, or -1.
+func (r *fileReader) size(key FileKey, location BlobLocation) (int64, error) {
+	if c, ok := r.carried[key]; ok {
+		return int64(len(c)), nil
+	}
+	if location.Symlink || r.opts.BlobReaderWrap != nil {
+		return -1, nil
+	}
+	odb, err := r.odb(location.Repo)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	err = r.opts.retryRead(key.FullPath(), func() error {
+		var err error
+		size, _, err = odb.ReadHeader(&key.ID)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key.FullPath(), err)
+	}
+	return int64(size), nil
+}
+
+// readContent returns the content of the file, or nil if it is too
+// large, has the skip marker or is excluded by its content.
+func (r *fileReader) readContent(key FileKey, location BlobLocation) ([]byte, error) {
+	opts := r.opts
+
+	var content []byte
+	sizeMax := opts.BuildOptions.SizeMaxFor(key.FullPath())
+	if c, ok := r.carried[key]; ok {
+		content = c
+		if hasSkipMarker(content, opts.SkipMarker) || opts.excludedByContent(content) {
+			return nil, nil
+		}
+	} else if !location.Symlink && opts.BlobReaderWrap == nil {
+		odb, err := r.odb(location.Repo)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.retryRead(key.FullPath(), func() error {
+			var err error
+			content, err = readBlob(location.Repo, odb, &key.ID, sizeMax, func(prefix []byte) bool {
+				return rejectPrefix(prefix, opts.SkipMarker) || opts.excludedByContent(prefix)
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key.FullPath(), err)
+		}
+	} else if !location.Symlink {
+		odb, err := r.odb(location.Repo)
+		if err != nil {
+			return nil, err
+		}
+
+		err = opts.retryRead(key.FullPath(), func() error {
+			blobReader, free, err := openBlob(location.Repo, odb, &key.ID)
+			if err != nil {
+				return err
+			}
+			defer free()
+			content, err = readLimited(opts.BlobReaderWrap(key, blobReader), sizeMax)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key.FullPath(), err)
+		}
+		if content == nil {
+			return nil, nil
+		}
+		if hasSkipMarker(content, opts.SkipMarker) || opts.excludedByContent(content) {
+			return nil, nil
+		}
+	} else {
+		var blob *git.Blob
+		err := opts.retryRead(key.FullPath(), func() error {
+			var err error
+			blob, err = location.Repo.LookupBlob(&key.ID)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key.FullPath(), err)
+		}
+		defer blob.Free()
+
+		content, err = readAnnexObject(location.Repo.Path(), blob.Contents(), sizeMax)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key.FullPath(), err)
+		}
+		if content == nil {
+			return nil, nil
+		}
+
+		if opts.BlobReaderWrap != nil {
+			content, err = readLimited(opts.BlobReaderWrap(key, bytes.NewReader(content)), sizeMax)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key.FullPath(), err)
+			}
+			if content == nil {
+				return nil, nil
+			}
+		}
+
+		if hasSkipMarker(content, opts.SkipMarker) || opts.excludedByContent(content) {
+			return nil, nil
+		}
 	}
-	return builder.Finish()
+	return content, nil
 }
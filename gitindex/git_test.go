@@ -0,0 +1,1081 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestFindGitReposWorktree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The main repository of the worktree is outside the search
+	// root.
+	script := `git init main
+cd main
+echo x > file
+git add file
+git commit -am msg
+git worktree add ../root/linked
+cd ..
+git init root/own
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	got, err := FindGitRepos(filepath.Join(dir, "root"))
+	if err != nil {
+		t.Fatalf("FindGitRepos: %v", err)
+	}
+	sort.Strings(got)
+	want := []string{
+		filepath.Join(dir, "main/.git/worktrees/linked"),
+		filepath.Join(dir, "root/own/.git"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFindGitReposLimited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `git init top
+git init top/nested
+git init a/b/deep
+git init --bare a/bare.git
+git init web/node_modules/pkg
+git init old.bak/repo
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	for _, tc := range []struct {
+		maxDepth int
+		skip     []string
+		want     []string
+	}{
+		{0, nil, []string{"a/b/deep/.git", "a/bare.git", "old.bak/repo/.git", "top/.git", "web/node_modules/pkg/.git"}},
+		{2, nil, []string{"a/bare.git", "old.bak/repo/.git", "top/.git"}},
+		{0, []string{"node_modules", "*.bak"}, []string{"a/b/deep/.git", "a/bare.git", "top/.git"}},
+		{1, []string{"a"}, []string{"top/.git"}},
+	} {
+		got, err := FindGitReposLimited(dir, tc.maxDepth, tc.skip)
+		if err != nil {
+			t.Fatalf("FindGitReposLimited: %v", err)
+		}
+		var rel []string
+		for _, g := range got {
+			rel = append(rel, strings.TrimPrefix(g, dir+"/"))
+		}
+		sort.Strings(rel)
+		if !reflect.DeepEqual(rel, tc.want) {
+			t.Errorf("depth %d, skip %v: got %v, want %v", tc.maxDepth, tc.skip, rel, tc.want)
+		}
+	}
+
+	if _, err := FindGitReposLimited(dir, 0, []string{"["}); err == nil {
+		t.Error("FindGitReposLimited succeeded with a bad pattern")
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	var keys []FileKey
+	for i := 0; i < 50; i++ {
+		keys = append(keys, FileKey{Path: fmt.Sprintf("f%02d", i)})
+	}
+	newRead := func() (func(FileKey) ([]byte, error), func()) {
+		return func(key FileKey) ([]byte, error) {
+			// Finish out of order.
+			time.Sleep(time.Duration(key.Path[2]%7) * 100 * time.Microsecond)
+			switch key.Path {
+			case "f13":
+				return nil, nil
+			case "f40":
+				return nil, fmt.Errorf("broken")
+			}
+			return []byte(key.Path), nil
+		}, func() {}
+	}
+
+	for _, n := range []int{0, 1, 4} {
+		var got []string
+		err := readFiles(n, keys, newRead, func(key FileKey, content []byte) error {
+			if string(content) != key.Path {
+				t.Errorf("%s: got content %q", key.Path, content)
+			}
+			got = append(got, key.Path)
+			return nil
+		})
+		if err == nil || err.Error() != "broken" {
+			t.Errorf("n=%d: got error %v, want broken", n, err)
+		}
+
+		var want []string
+		for i := 0; i < 40; i++ {
+			if i != 13 {
+				want = append(want, fmt.Sprintf("f%02d", i))
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("n=%d: got %v, want %v", n, got, want)
+		}
+
+		got = nil
+		err = readFiles(n, keys, newRead, func(key FileKey, content []byte) error {
+			got = append(got, key.Path)
+			if key.Path == "f05" {
+				return fmt.Errorf("full")
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "full" {
+			t.Errorf("n=%d: got error %v, want full", n, err)
+		}
+		if want := want[:6]; !reflect.DeepEqual(got, want) {
+			t.Errorf("n=%d: got %v after an add error, want %v", n, got, want)
+		}
+	}
+}
+
+func TestHasSkipMarker(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		marker  string
+		want    bool
+	}{
+		{"// zoekt:skip\npackage x", "zoekt:skip", true},
+		{"// zoekt:skip\npackage x", "", false},
+		{"package x", "zoekt:skip", false},
+		{"\x00// zoekt:skip", "zoekt:skip", false},
+		{strings.Repeat("x", skipMarkerScanSize) + "zoekt:skip", "zoekt:skip", false},
+	} {
+		if got := hasSkipMarker([]byte(tc.content), tc.marker); got != tc.want {
+			t.Errorf("hasSkipMarker(%q, %q): got %v, want %v", tc.content, tc.marker, got, tc.want)
+		}
+	}
+}
+
+func TestSetSubRepoBranches(t *testing.T) {
+	root := &zoekt.Repository{
+		Name:     "root",
+		Branches: []zoekt.RepositoryBranch{{Name: "master", Version: "1"}},
+	}
+	sub := &zoekt.Repository{Name: "sub"}
+	subRepos := map[string]*zoekt.Repository{
+		"":    root,
+		"sub": sub,
+	}
+
+	branches := []zoekt.RepositoryBranch{
+		{Name: "master", Version: "1"},
+		{Name: "stable", Version: "2"},
+		{Name: "master", Version: "1"},
+	}
+	subID := git.Oid{1}
+	versions := map[string]map[string]git.Oid{
+		"master": {"sub": subID},
+		"stable": {},
+	}
+
+	setSubRepoBranches(subRepos, branches, versions)
+	setSubRepoBranches(subRepos, branches, versions)
+
+	if want := []zoekt.RepositoryBranch{{Name: "master", Version: "1"}}; !reflect.DeepEqual(root.Branches, want) {
+		t.Errorf("got root branches %v, want %v", root.Branches, want)
+	}
+	if want := []zoekt.RepositoryBranch{{Name: "master", Version: subID.String()}}; !reflect.DeepEqual(sub.Branches, want) {
+		t.Errorf("got sub branches %v, want %v", sub.Branches, want)
+	}
+}
+
+func TestBatchSummary(t *testing.T) {
+	b := Batch{Results: []BatchResult{
+		{RepoDir: "/a", IndexBytes: 10, Duration: time.Second},
+		{RepoDir: "/b", Skipped: true, IndexBytes: 5, Duration: time.Second},
+		{RepoDir: "/c", Err: fmt.Errorf("broken"), Duration: time.Second},
+		{RepoDir: "/d", IndexBytes: 20, Duration: time.Second},
+	}}
+
+	if got := b.FailureRate(); got != 0.25 {
+		t.Errorf("got FailureRate %v, want 0.25", got)
+	}
+	want := "4 repositories in 4s: 2 succeeded, 1 skipped, 1 failed, 35 index bytes\n" +
+		"failed /c: broken\n"
+	if got := b.Summary(); got != want {
+		t.Errorf("got summary %q, want %q", got, want)
+	}
+
+	var empty Batch
+	if got := empty.FailureRate(); got != 0 {
+		t.Errorf("got FailureRate %v for empty batch, want 0", got)
+	}
+}
+
+func TestDryRunSummaryString(t *testing.T) {
+	s := DryRunSummary{
+		Files:    3,
+		Bytes:    100,
+		TooLarge: []DocumentMeta{{Name: "big", Size: 1000}},
+		Branches: map[string]*DryRunBranch{
+			"master": {Files: 3, Bytes: 100, TooLarge: 1},
+			"dev":    {Files: 1, Bytes: 10},
+		},
+	}
+	want := "3 files, 100 bytes, 1 too large\n" +
+		"branch dev: 1 files, 10 bytes, 0 too large\n" +
+		"branch master: 3 files, 100 bytes, 1 too large\n"
+	if got := s.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSortedSubRepoPaths(t *testing.T) {
+	reposByPath := map[string]BlobLocation{}
+	for i := 0; i < 50; i++ {
+		reposByPath[fmt.Sprintf("sub/%02d", 49-i)] = BlobLocation{}
+	}
+	reposByPath[""] = BlobLocation{}
+
+	first := sortedSubRepoPaths(reposByPath)
+	for i := 0; i < 10; i++ {
+		if got := sortedSubRepoPaths(reposByPath); !reflect.DeepEqual(got, first) {
+			t.Fatalf("run %d: got %v, want %v", i, got, first)
+		}
+	}
+	if len(first) != 51 || first[0] != "" || first[1] != "sub/00" || first[50] != "sub/49" {
+		t.Errorf("got %v, want sorted paths", first)
+	}
+}
+
+func TestReftable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Layout of "git init --ref-format=reftable --bare".
+	for _, d := range []string{"refs/heads", "reftable", "objects"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	table := "reftable/0x000000000001-0x000000000002-01234567.ref"
+	for _, fn := range []string{"HEAD", "refs/heads/dummy", table, "reftable/tables.list"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte("x"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	old := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, fn := range []string{"refs/heads/dummy", "reftable/tables.list"} {
+		if err := os.Chtimes(filepath.Join(dir, fn), old, old); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	want := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, table), want, want); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	if !isReftable(dir) {
+		t.Errorf("isReftable: got false")
+	}
+	if got, err := RepoModTime(dir); err != nil {
+		t.Fatalf("RepoModTime: %v", err)
+	} else if !got.Equal(want) {
+		t.Errorf("got RepoModTime %v, want %v", got, want)
+	}
+
+	opts := Options{
+		BuildOptions: build.Options{RepoDir: dir, IndexDir: dir},
+		Branches:     []string{"HEAD"},
+	}
+	opts.BuildOptions.SetDefaults()
+	if err := IndexGitRepo(opts); err == nil || !strings.Contains(err.Error(), "reftable") {
+		t.Errorf("got IndexGitRepo error %v, want reftable error", err)
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		sizeMax int
+		want    []byte
+	}{
+		{"abc", 3, []byte("abc")},
+		{"abcd", 3, nil},
+		{"", 3, []byte{}},
+	} {
+		got, err := readLimited(strings.NewReader(tc.in), tc.sizeMax)
+		if err != nil {
+			t.Errorf("readLimited(%q): %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readLimited(%q, %d): got %q, want %q", tc.in, tc.sizeMax, got, tc.want)
+		}
+	}
+}
+
+func TestSortFileKeys(t *testing.T) {
+	oid := func(b byte) git.Oid {
+		var id git.Oid
+		id[0] = b
+		return id
+	}
+	keys := []FileKey{
+		{Path: "a/b/c", ID: oid(1)},
+		{Path: "a/b.txt", ID: oid(4)},
+		{Path: "a/b/d", ID: oid(2)},
+		{Path: "x", SubRepoPath: "sub", ID: oid(3)},
+		{Path: "z", ID: oid(5)},
+	}
+	paths := func(keys []FileKey) []string {
+		var r []string
+		for _, k := range keys {
+			r = append(r, k.FullPath())
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		order BlobReadOrder
+		want  []string
+	}{
+		{BlobReadByName, []string{"a/b.txt", "a/b/c", "a/b/d", "sub/x", "z"}},
+		{BlobReadByOID, []string{"a/b/c", "a/b/d", "sub/x", "a/b.txt", "z"}},
+		{BlobReadByTree, []string{"z", "a/b.txt", "a/b/c", "a/b/d", "sub/x"}},
+	} {
+		got := append([]FileKey{}, keys...)
+		sortFileKeys(got, tc.order)
+		if !reflect.DeepEqual(paths(got), tc.want) {
+			t.Errorf("order %d: got %v, want %v", tc.order, paths(got), tc.want)
+		}
+	}
+
+	if _, err := ParseBlobReadOrder("random"); err == nil {
+		t.Errorf("ParseBlobReadOrder(random): got no error")
+	}
+}
+
+func TestLockShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "repo.lock")
+	unlock, err := lockShards(name, 0)
+	if err != nil {
+		t.Fatalf("lockShards: %v", err)
+	}
+
+	if _, err := lockShards(name, 0); err != ErrAlreadyIndexing {
+		t.Fatalf("got %v, want ErrAlreadyIndexing", err)
+	}
+
+	go func() {
+		time.Sleep(2 * lockPollInterval)
+		unlock()
+	}()
+	unlock, err = lockShards(name, time.Minute)
+	if err != nil {
+		t.Fatalf("lockShards with timeout: %v", err)
+	}
+	unlock()
+
+	// The index directory is created by the first run.
+	unlock, err = lockShards(filepath.Join(dir, "new", "index", "repo.lock"), 0)
+	if err != nil {
+		t.Fatalf("lockShards in new directory: %v", err)
+	}
+	unlock()
+}
+
+func TestRejectPrefix(t *testing.T) {
+	for _, c := range []struct {
+		prefix string
+		marker string
+		want   bool
+	}{
+		{"package main", "", false},
+		{"package main", "zoekt:skip", false},
+		{"// zoekt:skip\npackage main", "zoekt:skip", true},
+		{"\x7fELF\x00\x01", "", true},
+	} {
+		if got := rejectPrefix([]byte(c.prefix), c.marker); got != c.want {
+			t.Errorf("rejectPrefix(%q, %q): got %v, want %v", c.prefix, c.marker, got, c.want)
+		}
+	}
+}
+
+func TestRepoModTimeAlternates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fork := filepath.Join(dir, "fork.git")
+	shared := filepath.Join(dir, "shared.git")
+	for _, d := range []string{
+		filepath.Join(fork, "refs", "heads"),
+		filepath.Join(fork, "objects", "info"),
+		filepath.Join(shared, "objects", "pack"),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(fork, "objects", "info", "alternates"),
+		[]byte("# shared objects\n../../shared.git/objects\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	old := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(name, old, old)
+	}); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	if got, err := RepoModTime(fork); err != nil {
+		t.Fatalf("RepoModTime: %v", err)
+	} else if !got.Equal(old) {
+		t.Errorf("got %v, want %v", got, old)
+	}
+
+	pack := filepath.Join(shared, "objects", "pack", "pack-1.pack")
+	if err := ioutil.WriteFile(pack, []byte("PACK"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	later := old.Add(time.Hour)
+	for _, name := range []string{pack, filepath.Dir(pack)} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+
+	if got, err := RepoModTime(fork); err != nil {
+		t.Fatalf("RepoModTime: %v", err)
+	} else if !got.Equal(later) {
+		t.Errorf("got %v after new pack in alternate, want %v", got, later)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Options{
+		BuildOptions: build.Options{RepoDir: "/repo", IndexDir: "/index"},
+		Branches:     []string{"master", "release-*"},
+	}
+	valid.BuildOptions.SetDefaults()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	for name, c := range map[string]struct {
+		change func(o *Options)
+		want   []string
+	}{
+		"no dirs": {
+			func(o *Options) { o.BuildOptions.RepoDir = ""; o.BuildOptions.IndexDir = "" },
+			[]string{"RepoDir", "IndexDir"},
+		},
+		"no defaults": {
+			func(o *Options) { o.BuildOptions.SizeMax = 0 },
+			[]string{"SizeMax"},
+		},
+		"branches": {
+			func(o *Options) {
+				o.Branches = []string{"[x"}
+				o.BranchCommits = []BranchCommit{{Name: "x"}}
+			},
+			[]string{`"[x"`, "needs Name and Commit"},
+		},
+		"branch regexp": {
+			func(o *Options) { o.ExcludeBranches = []string{"re:(tmp"} },
+			[]string{`"re:(tmp"`, "missing closing )"},
+		},
+		"default branch": {
+			func(o *Options) { o.DefaultBranch = "release-*" },
+			[]string{`DefaultBranch "release-*"`},
+		},
+		"no branches": {
+			func(o *Options) { o.Branches = nil },
+			[]string{"no branches"},
+		},
+		"lock": {
+			func(o *Options) { o.IgnoreLock = true; o.LockTimeout = time.Second },
+			[]string{"IgnoreLock"},
+		},
+		"submodules": {
+			func(o *Options) { o.Submodules = true },
+			[]string{"Submodules requires RepoCacheDir"},
+		},
+		"ref prefixes": {
+			func(o *Options) { o.RefPrefixes = []string{"changes/"} },
+			[]string{`ref prefix "changes/"`},
+		},
+		"timeout": {
+			func(o *Options) { o.Timeout = -time.Second },
+			[]string{"Timeout -1s"},
+		},
+		"read retries": {
+			func(o *Options) { o.ReadRetries = -1 },
+			[]string{"ReadRetries -1"},
+		},
+		"path patterns": {
+			func(o *Options) {
+				o.IncludePaths = []string{"src/", "!src/gen/"}
+				o.ExcludePaths = []string{"[a-"}
+			},
+			[]string{`exclude paths: pattern "[a-"`},
+		},
+		"config section": {
+			func(o *Options) { o.ConfigSection = "zoekt-team-a." },
+			[]string{`ConfigSection "zoekt-team-a."`},
+		},
+	} {
+		o := valid
+		c.change(&o)
+		err := o.Validate()
+		if err == nil {
+			t.Errorf("%s: got no error", name)
+			continue
+		}
+		for _, w := range c.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: got %v, want mention of %s", name, err, w)
+			}
+		}
+	}
+}
+
+func TestSetTemplatesBitbucket(t *testing.T) {
+	for typ, want := range map[string]zoekt.Repository{
+		"bitbucket-server": {
+			URL:                  "https://stash.example.com/projects/FOO/repos/bar",
+			CommitURLTemplate:    "https://stash.example.com/projects/FOO/repos/bar/commits/{{.Version}}",
+			FileURLTemplate:      "https://stash.example.com/projects/FOO/repos/bar/browse/{{.Path}}?at={{.Version}}",
+			LineFragmentTemplate: "{{.LineNumber}}",
+		},
+		"bitbucket-cloud": {
+			URL:                  "https://stash.example.com/projects/FOO/repos/bar",
+			CommitURLTemplate:    "https://stash.example.com/projects/FOO/repos/bar/commits/{{.Version}}",
+			FileURLTemplate:      "https://stash.example.com/projects/FOO/repos/bar/src/{{.Version}}/{{.Path}}",
+			LineFragmentTemplate: "lines-{{.LineNumber}}",
+		},
+	} {
+		u, err := url.Parse("https://stash.example.com/projects/FOO/repos/bar")
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		var got zoekt.Repository
+		if err := setTemplates(&got, u, typ); err != nil {
+			t.Fatalf("setTemplates(%q): %v", typ, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", typ, got, want)
+		}
+	}
+
+	u, err := url.Parse("https://bitbucket.org/atlassian/atlaskit.git")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var got zoekt.Repository
+	if err := SetTemplatesFromOrigin(&got, u); err != nil {
+		t.Fatalf("SetTemplatesFromOrigin: %v", err)
+	}
+	want := zoekt.Repository{
+		Name:                 "bitbucket.org/atlassian/atlaskit",
+		URL:                  "https://bitbucket.org/atlassian/atlaskit",
+		CommitURLTemplate:    "https://bitbucket.org/atlassian/atlaskit/commits/{{.Version}}",
+		FileURLTemplate:      "https://bitbucket.org/atlassian/atlaskit/src/{{.Version}}/{{.Path}}",
+		LineFragmentTemplate: "lines-{{.LineNumber}}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSetTemplatesGitLab(t *testing.T) {
+	want := zoekt.Repository{
+		URL:                  "https://gitlab.example.com/group/project",
+		CommitURLTemplate:    "https://gitlab.example.com/group/project/-/commit/{{.Version}}",
+		FileURLTemplate:      "https://gitlab.example.com/group/project/-/blob/{{.Version}}/{{.Path}}",
+		LineFragmentTemplate: "L{{.LineNumber}}",
+	}
+	u, err := url.Parse("https://gitlab.example.com/group/project")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var got zoekt.Repository
+	if err := setTemplates(&got, u, "gitlab"); err != nil {
+		t.Fatalf("setTemplates: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The origin URL loses its .git suffix, as for the other types.
+	u, err = url.Parse("https://gitlab.com/group/project.git")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got = zoekt.Repository{}
+	if err := SetTemplatesFromOrigin(&got, u); err != nil {
+		t.Fatalf("SetTemplatesFromOrigin: %v", err)
+	}
+	if want := "https://gitlab.com/group/project/-/blob/{{.Version}}/{{.Path}}"; got.FileURLTemplate != want {
+		t.Errorf("got FileURLTemplate %q, want %q", got.FileURLTemplate, want)
+	}
+	if want := "gitlab.com/group/project"; got.Name != want {
+		t.Errorf("got Name %q, want %q", got.Name, want)
+	}
+}
+
+func TestSetTemplatesFromOriginKeepsURL(t *testing.T) {
+	u, err := url.Parse("https://github.com/org/repo.git")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var got zoekt.Repository
+	if err := SetTemplatesFromOrigin(&got, u); err != nil {
+		t.Fatalf("SetTemplatesFromOrigin: %v", err)
+	}
+	if want := "https://github.com/org/repo"; got.URL != want {
+		t.Errorf("got URL %q, want %q", got.URL, want)
+	}
+	if want := "https://github.com/org/repo.git"; u.String() != want {
+		t.Errorf("origin URL changed to %q", u)
+	}
+
+	u, err = url.Parse("https://git.example.com/org/repo.git")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got = zoekt.Repository{}
+	if err := SetTemplatesFromOrigin(&got, u); err == nil {
+		t.Errorf("SetTemplatesFromOrigin succeeded for unknown host: %+v", got)
+	} else if want := "git.example.com/org/repo"; got.Name != want {
+		t.Errorf("got Name %q, want %q", got.Name, want)
+	}
+}
+
+func TestSetTemplatesGitea(t *testing.T) {
+	want := zoekt.Repository{
+		URL:                  "https://git.example.com/org/repo",
+		CommitURLTemplate:    "https://git.example.com/org/repo/commit/{{.Version}}",
+		FileURLTemplate:      "https://git.example.com/org/repo/src/commit/{{.Version}}/{{.Path}}",
+		LineFragmentTemplate: "L{{.LineNumber}}",
+	}
+	for _, typ := range []string{"gitea", "forgejo"} {
+		u, err := url.Parse("https://git.example.com/org/repo")
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		var got zoekt.Repository
+		if err := setTemplates(&got, u, typ); err != nil {
+			t.Fatalf("setTemplates: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", typ, got, want)
+		}
+	}
+}
+
+func TestSetTemplatesCgit(t *testing.T) {
+	u, err := url.Parse("https://git.example.com/cgit/repo.git")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var repo zoekt.Repository
+	if err := setTemplates(&repo, u, "cgit"); err != nil {
+		t.Fatalf("setTemplates: %v", err)
+	}
+
+	tpl, err := template.New("").Parse(repo.FileURLTemplate)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", repo.FileURLTemplate, err)
+	}
+	for branch, want := range map[string]string{
+		"dev/philh": "https://git.example.com/cgit/repo.git/tree/elisp/mode.el/?h=dev/philh&id=b2ca0fef",
+		"":          "https://git.example.com/cgit/repo.git/tree/elisp/mode.el/?id=b2ca0fef",
+	} {
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, map[string]string{
+			"Branch":  branch,
+			"Version": "b2ca0fef",
+			"Path":    "elisp/mode.el",
+		}); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("branch %q: got %q, want %q", branch, got, want)
+		}
+	}
+}
+
+func TestRegisterHostTemplate(t *testing.T) {
+	defer func() {
+		hostTemplates.types = map[string]string{}
+	}()
+
+	for suffix, typ := range map[string]string{
+		".gitlab.example.com":     "gitlab",
+		"code.gitlab.example.com": "gitea",
+		"ghe.example.com":         "github",
+		"github.com":              "gitea",
+	} {
+		if err := RegisterHostTemplate(suffix, typ); err != nil {
+			t.Fatalf("RegisterHostTemplate(%q, %q): %v", suffix, typ, err)
+		}
+	}
+	if err := RegisterHostTemplate("example.org", "unknown"); err == nil {
+		t.Errorf("RegisterHostTemplate succeeded for unknown type")
+	}
+
+	for origin, want := range map[string]string{
+		"https://sub.gitlab.example.com/org/repo.git":  "https://sub.gitlab.example.com/org/repo/-/blob/{{.Version}}/{{.Path}}",
+		"https://code.gitlab.example.com/org/repo.git": "https://code.gitlab.example.com/org/repo/src/commit/{{.Version}}/{{.Path}}",
+		"https://ghe.example.com:8443/org/repo.git":    "https://ghe.example.com:8443/org/repo/blob/{{.Version}}/{{.Path}}",
+		"https://github.com/org/repo":                  "https://github.com/org/repo/src/commit/{{.Version}}/{{.Path}}",
+	} {
+		u, err := url.Parse(origin)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		var got zoekt.Repository
+		if err := SetTemplatesFromOrigin(&got, u); err != nil {
+			t.Errorf("SetTemplatesFromOrigin(%s): %v", origin, err)
+		} else if got.FileURLTemplate != want {
+			t.Errorf("%s: got file template %q, want %q", origin, got.FileURLTemplate, want)
+		}
+	}
+
+	u, err := url.Parse("https://other.example.com/org/repo")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := SetTemplatesFromOrigin(&zoekt.Repository{}, u); err == nil {
+		t.Errorf("SetTemplatesFromOrigin succeeded for unregistered host")
+	}
+}
+
+func TestSetTemplatesSourcehut(t *testing.T) {
+	u, err := url.Parse("https://git.sr.ht/~sircmpwn/scdoc")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var got zoekt.Repository
+	if err := SetTemplatesFromOrigin(&got, u); err != nil {
+		t.Fatalf("SetTemplatesFromOrigin: %v", err)
+	}
+	if want := "git.sr.ht/~sircmpwn/scdoc"; got.Name != want {
+		t.Errorf("got Name %q, want %q", got.Name, want)
+	}
+
+	data := struct {
+		Version    string
+		Path       string
+		LineNumber int
+	}{"master", "README.md", 10}
+	for tpl, want := range map[string]string{
+		got.FileURLTemplate + "#" + got.LineFragmentTemplate: "https://git.sr.ht/~sircmpwn/scdoc/tree/master/item/README.md#L10",
+		got.CommitURLTemplate:                                "https://git.sr.ht/~sircmpwn/scdoc/commit/master",
+	} {
+		var buf bytes.Buffer
+		if err := template.Must(template.New("url").Parse(tpl)).Execute(&buf, data); err != nil {
+			t.Fatalf("Execute(%q): %v", tpl, err)
+		}
+		if buf.String() != want {
+			t.Errorf("%q: got %q, want %q", tpl, buf.String(), want)
+		}
+	}
+}
+
+// expandTemplates returns the file URL for a line, and the commit URL
+// of repo for version master and file README.md, line 10. The line
+// templates tested with it are added to the query of the file URL.
+func expandTemplates(t *testing.T, repo *zoekt.Repository) (string, string) {
+	data := struct {
+		Version    string
+		Path       string
+		LineNumber int
+	}{"master", "README.md", 10}
+	var result []string
+	for _, tpl := range []string{repo.FileURLTemplate + repo.LineFragmentTemplate, repo.CommitURLTemplate} {
+		var buf bytes.Buffer
+		if err := template.Must(template.New("url").Parse(tpl)).Execute(&buf, data); err != nil {
+			t.Fatalf("Execute(%q): %v", tpl, err)
+		}
+		result = append(result, buf.String())
+	}
+	return result[0], result[1]
+}
+
+func TestSetTemplatesAzureDevOps(t *testing.T) {
+	for _, origin := range []string{
+		"https://org@dev.azure.com/org/project/_git/repo",
+		"git@ssh.dev.azure.com:v3/org/project/repo",
+	} {
+		u, err := parseCloneURL(origin)
+		if err != nil {
+			t.Fatalf("parseCloneURL(%q): %v", origin, err)
+		}
+		var got zoekt.Repository
+		if err := SetTemplatesFromOrigin(&got, u); err != nil {
+			t.Fatalf("SetTemplatesFromOrigin(%s): %v", origin, err)
+		}
+		if want := "https://dev.azure.com/org/project/_git/repo"; got.URL != want {
+			t.Errorf("%s: got URL %q, want %q", origin, got.URL, want)
+		}
+		file, commit := expandTemplates(t, &got)
+		if want := "https://dev.azure.com/org/project/_git/repo?path=/README.md&version=GCmaster&line=10"; file != want {
+			t.Errorf("%s: got file URL %q, want %q", origin, file, want)
+		}
+		if want := "https://dev.azure.com/org/project/_git/repo/commit/master"; commit != want {
+			t.Errorf("%s: got commit URL %q, want %q", origin, commit, want)
+		}
+	}
+}
+
+func TestSetTemplatesCodeCommit(t *testing.T) {
+	const console = "https://eu-west-1.console.aws.amazon.com/codesuite/codecommit/repositories/repo"
+	for _, origin := range []string{
+		"https://git-codecommit.eu-west-1.amazonaws.com/v1/repos/repo",
+		"ssh://APKAEIBAERJR2EXAMPLE@git-codecommit.eu-west-1.amazonaws.com/v1/repos/repo",
+	} {
+		u, err := parseCloneURL(origin)
+		if err != nil {
+			t.Fatalf("parseCloneURL(%q): %v", origin, err)
+		}
+		var got zoekt.Repository
+		if err := SetTemplatesFromOrigin(&got, u); err != nil {
+			t.Fatalf("SetTemplatesFromOrigin(%s): %v", origin, err)
+		}
+		if want := console + "/browse?region=eu-west-1"; got.URL != want {
+			t.Errorf("%s: got URL %q, want %q", origin, got.URL, want)
+		}
+		file, commit := expandTemplates(t, &got)
+		if want := console + "/browse/master/--/README.md?region=eu-west-1&lines=10-10"; file != want {
+			t.Errorf("%s: got file URL %q, want %q", origin, file, want)
+		}
+		if want := console + "/commit/master?region=eu-west-1"; commit != want {
+			t.Errorf("%s: got commit URL %q, want %q", origin, commit, want)
+		}
+	}
+
+	// zoekt.web-url may also be the repository in the console.
+	u, err := url.Parse(console)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var got zoekt.Repository
+	if err := setTemplates(&got, u, "codecommit"); err != nil {
+		t.Fatalf("setTemplates: %v", err)
+	}
+	if file, _ := expandTemplates(t, &got); file != console+"/browse/master/--/README.md?region=eu-west-1&lines=10-10" {
+		t.Errorf("got file URL %q", file)
+	}
+
+	for _, bad := range []string{"https://github.com/org/repo", "https://git-codecommit.eu-west-1.amazonaws.com/v2/repo"} {
+		u, err := url.Parse(bad)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		if err := setTemplates(&zoekt.Repository{}, u, "codecommit"); err == nil {
+			t.Errorf("setTemplates(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestTagCommits(t *testing.T) {
+	got := tagCommits([]string{"v1", "master", "v1"}, []BranchCommit{{Name: "master", Commit: "refs/heads/master"}})
+	want := []BranchCommit{
+		{Name: "v1", Commit: "refs/tags/v1"},
+		{Name: "tags/master", Commit: "refs/tags/master"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBranchExcluded(t *testing.T) {
+	excludes := []string{"release/experimental-*", "tmp"}
+	for name, want := range map[string]bool{
+		"release/1.0":            false,
+		"release/experimental-x": true,
+		"tmp":                    true,
+		"tmp/x":                  false,
+	} {
+		got, err := branchExcluded(name, excludes)
+		if err != nil {
+			t.Fatalf("branchExcluded(%q): %v", name, err)
+		}
+		if got != want {
+			t.Errorf("branchExcluded(%q): got %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := branchExcluded("x", []string{"["}); err == nil {
+		t.Errorf("got no error for bad pattern")
+	}
+}
+
+func TestBranchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		literal bool
+		matches map[string]bool
+	}{
+		{"master", true, map[string]bool{"master": true, "master2": false}},
+		{"release/*", false, map[string]bool{"release/1.0": true, "release": false}},
+		{`re:v\d+\.\d+`, false, map[string]bool{"v1.2": true, "v10.20": true, "v1.2.3": false, "xv1.2": false}},
+		{"re:dev|main", false, map[string]bool{"dev": true, "main": true, "develop": false}},
+	} {
+		p, err := parseBranchPattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("parseBranchPattern(%q): %v", tc.pattern, err)
+		}
+		if got := p.literal(); got != tc.literal {
+			t.Errorf("%q: got literal %v, want %v", tc.pattern, got, tc.literal)
+		}
+		for name, want := range tc.matches {
+			if got := p.match(name); got != want {
+				t.Errorf("%q: match(%q) = %v, want %v", tc.pattern, name, got, want)
+			}
+		}
+	}
+
+	for _, bad := range []string{"[", "re:v(", "re:*"} {
+		if _, err := parseBranchPattern(bad); err == nil {
+			t.Errorf("parseBranchPattern(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRepoFetchTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if got, err := RepoFetchTime(dir); err != nil || !got.IsZero() {
+		t.Errorf("empty repo: got %v, %v, want zero time", got, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	zero := strings.Repeat("0", 40)
+	one := strings.Repeat("1", 40)
+	reflog := zero + " " + one + " A U Thor <author@example.com> 1500000000 +0200\tclone: from origin\n" +
+		one + " " + one + " A U Thor <author@example.com> 1500000500 -0700\tfetch: fast-forward\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "logs", "HEAD"), []byte(reflog), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, err := RepoFetchTime(dir); err != nil {
+		t.Fatalf("RepoFetchTime: %v", err)
+	} else if want := time.Unix(1500000500, 0); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fetchHead := filepath.Join(dir, "FETCH_HEAD")
+	if err := ioutil.WriteFile(fetchHead, []byte(one+"\t\tbranch 'master' of origin\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	later := time.Unix(1600000000, 0)
+	if err := os.Chtimes(fetchHead, later, later); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if got, err := RepoFetchTime(dir); err != nil {
+		t.Fatalf("RepoFetchTime: %v", err)
+	} else if !got.Equal(later) {
+		t.Errorf("got %v, want FETCH_HEAD time %v", got, later)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "logs", "HEAD"), []byte("garbage\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := RepoFetchTime(dir); err == nil {
+		t.Errorf("got no error for corrupt reflog")
+	}
+}
+
+func TestCheckMemberNames(t *testing.T) {
+	member := func(name string) Options {
+		return Options{BuildOptions: build.Options{
+			RepoDir:               "/repos/" + name,
+			RepositoryDescription: zoekt.Repository{Name: name},
+		}}
+	}
+	if err := checkMemberNames([]Options{member("svc/a"), member("svc/b"), member("lib")}); err != nil {
+		t.Errorf("checkMemberNames: %v", err)
+	}
+	for _, names := range [][]string{
+		{""},
+		{"../a"},
+		{"/a"},
+		{"a//b"},
+		{"a", "a"},
+		{"a", "a/b"},
+	} {
+		var members []Options
+		for _, n := range names {
+			members = append(members, member(n))
+		}
+		if err := checkMemberNames(members); err == nil {
+			t.Errorf("%q: got no error", names)
+		}
+	}
+}
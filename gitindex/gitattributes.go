@@ -0,0 +1,269 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+const gitattributesFile = ".gitattributes"
+
+// attrRule is a line of a .gitattributes file.
+type attrRule struct {
+	// dir holds the .gitattributes file, "" for the top level.
+	dir     string
+	pattern string
+
+	// attrs maps attribute names to "true" if set, "false" if
+	// unset and "" if unspecified; otherwise to their value.
+	attrs map[string]string
+}
+
+// gitattributes holds the rules of all .gitattributes files in a
+// tree.
+type gitattributes struct {
+	// rules are ordered by increasing precedence: files higher in
+	// the tree come first, and within a file, later lines win.
+	rules []attrRule
+}
+
+// newGitattributes returns the attributes for the given
+// .gitattributes files, keyed by their directory.
+func newGitattributes(files map[string][]byte) *gitattributes {
+	var dirs []string
+	for dir := range files {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(dirsByDepth(dirs))
+
+	g := &gitattributes{}
+	for _, dir := range dirs {
+		g.rules = append(g.rules, parseGitattributes(dir, files[dir])...)
+	}
+	return g
+}
+
+// dirsByDepth sorts directories so parents come before their
+// children.
+type dirsByDepth []string
+
+func (d dirsByDepth) Len() int      { return len(d) }
+func (d dirsByDepth) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dirsByDepth) Less(i, j int) bool {
+	if di, dj := depth(d[i]), depth(d[j]); di != dj {
+		return di < dj
+	}
+	return d[i] < d[j]
+}
+
+func depth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// parseGitattributes parses the .gitattributes file in dir. Macro
+// definitions and quoted patterns are not supported, and are
+// ignored.
+func parseGitattributes(dir string, content []byte) []attrRule {
+	var rules []attrRule
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") ||
+			strings.HasPrefix(fields[0], "[attr]") || strings.HasPrefix(fields[0], `"`) {
+			continue
+		}
+
+		r := attrRule{
+			dir:     dir,
+			pattern: fields[0],
+			attrs:   map[string]string{},
+		}
+		for _, f := range fields[1:] {
+			switch {
+			case strings.HasPrefix(f, "-"):
+				r.attrs[f[1:]] = "false"
+			case strings.HasPrefix(f, "!"):
+				r.attrs[f[1:]] = ""
+			case strings.Contains(f, "="):
+				i := strings.Index(f, "=")
+				r.attrs[f[:i]] = f[i+1:]
+			default:
+				r.attrs[f] = "true"
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// attributes returns the attributes of the file or directory p.
+// Unspecified attributes are left out.
+func (g *gitattributes) attributes(p string, isDir bool) map[string]string {
+	result := map[string]string{}
+	for _, r := range g.rules {
+		rel := p
+		if r.dir != "" {
+			if !strings.HasPrefix(p, r.dir+"/") {
+				continue
+			}
+			rel = p[len(r.dir)+1:]
+		}
+		if !matchAttrPattern(r.pattern, rel, isDir) {
+			continue
+		}
+		for k, v := range r.attrs {
+			if v == "" {
+				delete(result, k)
+			} else {
+				result[k] = v
+			}
+		}
+	}
+	return result
+}
+
+// exportIgnored returns true if the file p, or one of its
+// directories, has the export-ignore attribute. Like git archive,
+// this also honors patterns that only match a directory.
+func (g *gitattributes) exportIgnored(p string) bool {
+	if g.attributes(p, false)["export-ignore"] == "true" {
+		return true
+	}
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if g.attributes(dir, true)["export-ignore"] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// generated returns true if the file p has the linguist-generated
+// attribute.
+func (g *gitattributes) generated(p string) bool {
+	return g.attributes(p, false)["linguist-generated"] == "true"
+}
+
+// language returns the value of the linguist-language attribute of
+// the file p, or "" if it has none.
+func (g *gitattributes) language(p string) string {
+	lang := g.attributes(p, false)["linguist-language"]
+	if lang == "true" || lang == "false" {
+		return ""
+	}
+	return lang
+}
+
+// matchAttrPattern matches a .gitattributes pattern against the path
+// rel, relative to the directory of the .gitattributes file. A
+// pattern without a slash matches the base name at any depth, and
+// "**" matches any number of directories.
+func matchAttrPattern(pattern, rel string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(rel))
+		return matched
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			// A trailing "/**" matches everything inside.
+			return len(segments) > 0
+		}
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// applyGitattributes drops the files that are export-ignored
+// according to the .gitattributes files among them, adds the
+// linguist-generated ones to generated and records linguist-language
+// in languages. Each sub-repository has its own attributes.
+func applyGitattributes(files map[FileKey]BlobLocation, generated map[FileKey]bool, languages map[FileKey]string) (map[FileKey]BlobLocation, error) {
+	contents := map[string]map[string][]byte{}
+	for key, location := range files {
+		if path.Base(key.Path) != gitattributesFile || location.Symlink {
+			continue
+		}
+		content, err := location.Blob(&key.ID)
+		if err != nil {
+			return nil, err
+		}
+		dir := path.Dir(key.Path)
+		if dir == "." {
+			dir = ""
+		}
+		if contents[key.SubRepoPath] == nil {
+			contents[key.SubRepoPath] = map[string][]byte{}
+		}
+		contents[key.SubRepoPath][dir] = content
+	}
+	if len(contents) == 0 {
+		return files, nil
+	}
+
+	attrs := map[string]*gitattributes{}
+	for sub, c := range contents {
+		attrs[sub] = newGitattributes(c)
+	}
+
+	result := make(map[FileKey]BlobLocation, len(files))
+	for key, location := range files {
+		g := attrs[key.SubRepoPath]
+		if g != nil {
+			if g.exportIgnored(key.Path) {
+				continue
+			}
+			if g.generated(key.Path) {
+				generated[key] = true
+			}
+			if lang := g.language(key.Path); lang != "" {
+				languages[key] = lang
+			}
+		}
+		result[key] = location
+	}
+	return result, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import "testing"
+
+func TestMatchAttrPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.pb.go", "a.pb.go", false, true},
+		{"*.pb.go", "dir/sub/a.pb.go", false, true},
+		{"*.pb.go", "a.go", false, false},
+		{"/gen.go", "gen.go", false, true},
+		{"/gen.go", "dir/gen.go", false, false},
+		{"dir/*.go", "dir/a.go", false, true},
+		{"dir/*.go", "dir/sub/a.go", false, false},
+		{"dir/**/*.go", "dir/a.go", false, true},
+		{"dir/**/*.go", "dir/sub/deep/a.go", false, true},
+		{"**/gen/*", "x/y/gen/a", false, true},
+		{"vendor/**", "vendor/a/b.go", false, true},
+		{"vendor/**", "vendor", true, false},
+		{"vendor/", "vendor", true, true},
+		{"vendor/", "vendor", false, false},
+	} {
+		if got := matchAttrPattern(tc.pattern, tc.path, tc.isDir); got != tc.want {
+			t.Errorf("matchAttrPattern(%q, %q, %v): got %v, want %v", tc.pattern, tc.path, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestGitattributesPrecedence(t *testing.T) {
+	g := newGitattributes(map[string][]byte{
+		"": []byte(`# top level
+*.pb.go linguist-generated
+docs export-ignore
+/third_party/ export-ignore
+keep.pb.go -linguist-generated
+*.tmpl linguist-language=Go
+`),
+		"sub": []byte(`*.pb.go -linguist-generated
+special.pb.go linguist-generated=true
+*.tmpl linguist-language=HTML
+plain.tmpl -linguist-language
+`),
+		"sub/deeper": []byte(`*.pb.go !linguist-generated
+`),
+	})
+
+	for p, want := range map[string]bool{
+		"a.pb.go":              true,
+		"keep.pb.go":           false,
+		"x/a.pb.go":            true,
+		"sub/a.pb.go":          false,
+		"sub/special.pb.go":    true,
+		"sub/deeper/b.pb.go":   false,
+		"other/special.pb.go":  true,
+		"sub/deeper/x/c.pb.go": false,
+	} {
+		if got := g.generated(p); got != want {
+			t.Errorf("generated(%q): got %v, want %v", p, got, want)
+		}
+	}
+
+	for p, want := range map[string]bool{
+		"docs":               true,
+		"docs/index.md":      true,
+		"a/docs/index.md":    true,
+		"third_party/x/a.go": true,
+		"a/third_party/a.go": false,
+		"src/main.go":        false,
+	} {
+		if got := g.exportIgnored(p); got != want {
+			t.Errorf("exportIgnored(%q): got %v, want %v", p, got, want)
+		}
+	}
+
+	for p, want := range map[string]string{
+		"a.tmpl":         "Go",
+		"sub/a.tmpl":     "HTML",
+		"sub/plain.tmpl": "",
+		"a.go":           "",
+	} {
+		if got := g.language(p); got != want {
+			t.Errorf("language(%q): got %q, want %q", p, got, want)
+		}
+	}
+}
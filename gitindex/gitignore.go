@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+const gitignoreFile = ".gitignore"
+
+// gitignore holds the ignore rules that apply to a tree.
+type gitignore struct {
+	// dirs holds the patterns of the .gitignore files, by
+	// directory, "" for the top level.
+	dirs map[string]*PathMatcher
+
+	// local and global hold the patterns of info/exclude and
+	// core.excludesFile, relative to the top of the tree.
+	local, global *PathMatcher
+}
+
+// ignored returns true if the file p is ignored. As in git, patterns
+// in deeper .gitignore files take precedence, the excludes come
+// last, and a file in an ignored directory can't be re-included.
+func (g *gitignore) ignored(p string) bool {
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && g.ignoredOne(p[:i], true) {
+			return true
+		}
+	}
+	return g.ignoredOne(p, false)
+}
+
+func (g *gitignore) ignoredOne(p string, isDir bool) bool {
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		if m := g.dirs[dir]; m != nil {
+			rel := p
+			if dir != "" {
+				rel = p[len(dir)+1:]
+			}
+			if matched, ok := m.lastMatch(rel, isDir); ok {
+				return matched
+			}
+		}
+		if dir == "" {
+			break
+		}
+	}
+	if matched, ok := g.local.lastMatch(p, isDir); ok {
+		return matched
+	}
+	matched, _ := g.global.lastMatch(p, isDir)
+	return matched
+}
+
+// readExcludes returns the patterns of the excludes file configured
+// in core.excludesFile, and those of info/exclude in the git
+// directory of repo. Missing files yield nil matchers.
+func readExcludes(repo *git.Repository) (global, local *PathMatcher, err error) {
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cfg.Free()
+	excludesFile, err := cfg.LookupString("core.excludesfile")
+	if err = clearEmptyConfig(err); err != nil {
+		return nil, nil, err
+	}
+	if excludesFile == "" {
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			excludesFile = filepath.Join(xdg, "git", "ignore")
+		} else if home := os.Getenv("HOME"); home != "" {
+			excludesFile = filepath.Join(home, ".config", "git", "ignore")
+		}
+	} else if strings.HasPrefix(excludesFile, "~/") {
+		excludesFile = filepath.Join(os.Getenv("HOME"), excludesFile[2:])
+	}
+
+	if global, err = readPathMatcher(excludesFile); err != nil {
+		return nil, nil, err
+	}
+	if local, err = readPathMatcher(filepath.Join(repo.Path(), "info", "exclude")); err != nil {
+		return nil, nil, err
+	}
+	return global, local, nil
+}
+
+// readPathMatcher compiles the gitignore-style file name. It returns
+// nil if name is empty or doesn't exist.
+func readPathMatcher(name string) (*PathMatcher, error) {
+	if name == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParsePathMatcher(content)
+}
+
+// applyGitignore drops the files that are ignored according to the
+// .gitignore files among them and the excludes. Each sub-repository
+// has its own .gitignore files; global applies to all of them, and
+// local only to the top-level repository. .gitignore files with
+// invalid patterns are logged and skipped.
+func applyGitignore(files map[FileKey]BlobLocation, global, local *PathMatcher) (map[FileKey]BlobLocation, error) {
+	ignores := map[string]*gitignore{}
+	get := func(sub string) *gitignore {
+		g := ignores[sub]
+		if g == nil {
+			g = &gitignore{dirs: map[string]*PathMatcher{}, global: global}
+			if sub == "" {
+				g.local = local
+			}
+			ignores[sub] = g
+		}
+		return g
+	}
+
+	for key, location := range files {
+		if path.Base(key.Path) != gitignoreFile || location.Symlink {
+			continue
+		}
+		content, err := location.Blob(&key.ID)
+		if err != nil {
+			return nil, err
+		}
+		m, err := ParsePathMatcher(content)
+		if err != nil {
+			log.Printf("%s: %v", key.FullPath(), err)
+			continue
+		}
+		dir := path.Dir(key.Path)
+		if dir == "." {
+			dir = ""
+		}
+		get(key.SubRepoPath).dirs[dir] = m
+	}
+	if len(ignores) == 0 && global.Empty() && local.Empty() {
+		return files, nil
+	}
+
+	result := make(map[FileKey]BlobLocation, len(files))
+	for key, location := range files {
+		if get(key.SubRepoPath).ignored(key.Path) {
+			continue
+		}
+		result[key] = location
+	}
+	return result, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import "testing"
+
+func TestGitignorePrecedence(t *testing.T) {
+	parse := func(s string) *PathMatcher {
+		m, err := ParsePathMatcher([]byte(s))
+		if err != nil {
+			t.Fatalf("ParsePathMatcher(%q): %v", s, err)
+		}
+		return m
+	}
+	g := &gitignore{
+		dirs: map[string]*PathMatcher{
+			"":         parse("*.log\n/build/\n!keep.tmp\n"),
+			"sub":      parse("!*.log\n/local\n"),
+			"sub/deep": parse("debug.log\n"),
+		},
+		local:  parse("*.tmp\nsecret\n"),
+		global: parse("*.swp\n!secret\n*.bak\n"),
+	}
+
+	for p, want := range map[string]bool{
+		"main.go":            false,
+		"a.log":              true,
+		"x/y/a.log":          true,
+		"sub/a.log":          false,
+		"sub/deep/a.log":     false,
+		"sub/deep/debug.log": true,
+		"build/out":          true,
+		"x/build/out":        false,
+		"sub/local":          true,
+		"local":              false,
+		"a.tmp":              true,
+		"keep.tmp":           false,
+		"secret":             true,
+		"dir/a.swp":          true,
+		"a.bak":              true,
+	} {
+		if got := g.ignored(p); got != want {
+			t.Errorf("ignored(%q): got %v, want %v", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ignorePattern is a single compiled line of a gitignore file.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+
+	// segments holds the glob of each path segment of an anchored
+	// pattern, and is nil for patterns that match at any depth.
+	segments []string
+}
+
+// PathMatcher matches slash-separated paths against a list of
+// gitignore-style patterns. It supports comments, "!" negation,
+// trailing "/" for directories, anchoring with a leading or inner
+// "/", and "**" for any number of directories. As in git, the last
+// matching pattern decides, and a path is matched if one of its
+// parent directories is.
+type PathMatcher struct {
+	patterns []ignorePattern
+}
+
+// NewPathMatcher compiles the given patterns, one per element, using
+// the syntax of .gitignore lines. Blank lines and comments are
+// skipped.
+func NewPathMatcher(patterns []string) (*PathMatcher, error) {
+	m := &PathMatcher{}
+	if err := m.Add(patterns...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ParsePathMatcher compiles the contents of a .gitignore style file.
+func ParsePathMatcher(content []byte) (*PathMatcher, error) {
+	var lines []string
+	for _, l := range bytes.Split(content, []byte{'\n'}) {
+		lines = append(lines, string(bytes.TrimSuffix(l, []byte{'\r'})))
+	}
+	return NewPathMatcher(lines)
+}
+
+// Add compiles more patterns. They take precedence over the
+// patterns added before.
+func (m *PathMatcher) Add(patterns ...string) error {
+	for _, p := range patterns {
+		pat, ok, err := compileIgnorePattern(p)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %v", p, err)
+		}
+		if ok {
+			m.patterns = append(m.patterns, pat)
+		}
+	}
+	return nil
+}
+
+// Empty returns true if the matcher has no patterns.
+func (m *PathMatcher) Empty() bool {
+	return m == nil || len(m.patterns) == 0
+}
+
+// Match returns true if the path, which must be relative to the
+// directory holding the patterns, is matched. isDir indicates
+// whether path is a directory.
+func (m *PathMatcher) Match(path string, isDir bool) bool {
+	if m.Empty() {
+		return false
+	}
+	path = strings.Trim(path, "/")
+
+	// Files below a matched directory can't be re-included.
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && m.matchOne(path[:i], true) {
+			return true
+		}
+	}
+	return m.matchOne(path, isDir)
+}
+
+func (m *PathMatcher) matchOne(path string, isDir bool) bool {
+	matched, _ := m.lastMatch(path, isDir)
+	return matched
+}
+
+// lastMatch returns whether the last pattern that matches path
+// matches it, or false if it is a negation. ok is false if no
+// pattern matches. Parent directories are not considered.
+func (m *PathMatcher) lastMatch(path string, isDir bool) (matched, ok bool) {
+	if m == nil {
+		return false, false
+	}
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(path) {
+			matched, ok = !p.negate, true
+		}
+	}
+	return matched, ok
+}
+
+// mayMatchBelow returns true if a path inside the directory dir may
+// be matched by one of the patterns, not counting matches of dir
+// itself, so a walk for the matched paths can't skip dir.
+func (m *PathMatcher) mayMatchBelow(dir string) bool {
+	if m == nil {
+		return false
+	}
+	for _, p := range m.patterns {
+		if p.negate {
+			continue
+		}
+		if p.segments == nil {
+			return true
+		}
+		if segmentsMayMatchBelow(p.segments, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentsMayMatchBelow returns true if the anchored pattern with
+// the given segments may match a path inside dir.
+func segmentsMayMatchBelow(segments []string, dir string) bool {
+	for i, d := range strings.Split(dir, "/") {
+		if i >= len(segments) {
+			return false
+		}
+		if segments[i] == "**" {
+			return true
+		}
+		if matched, _ := path.Match(segments[i], d); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// compileIgnorePattern compiles one gitignore line. It returns false
+// if the line holds no pattern.
+func compileIgnorePattern(line string) (ignorePattern, bool, error) {
+	var pat ignorePattern
+
+	// Trailing spaces are ignored unless quoted with a backslash.
+	trimmed := strings.TrimRight(line, " ")
+	if strings.HasSuffix(trimmed, `\`) && len(trimmed) < len(line) {
+		trimmed += " "
+	}
+	line = trimmed
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pat, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		pat.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pat.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pat, false, nil
+	}
+
+	// A slash at the start or in the middle anchors the pattern
+	// to the directory holding it.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if anchored {
+		pat.segments = strings.Split(line, "/")
+	}
+
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+
+	segs := strings.Split(line, "/")
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		if seg == "**" {
+			if last {
+				expr.WriteString(".*")
+			} else {
+				expr.WriteString("(?:.*/)?")
+			}
+			continue
+		}
+		if err := globToRegexp(&expr, seg); err != nil {
+			return pat, false, err
+		}
+		if !last {
+			expr.WriteString("/")
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return pat, false, err
+	}
+	pat.re = re
+	return pat, true, nil
+}
+
+// globToRegexp translates a single path segment of a glob.
+func globToRegexp(out *bytes.Buffer, glob string) error {
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			out.WriteString("[^/]*")
+		case '?':
+			out.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			out.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			i += end + 1
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			out.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+		default:
+			out.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return nil
+}
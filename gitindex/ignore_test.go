@@ -0,0 +1,179 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"testing"
+)
+
+func TestPathMatcher(t *testing.T) {
+	type probe struct {
+		path  string
+		isDir bool
+		want  bool
+	}
+	for _, tc := range []struct {
+		patterns []string
+		probes   []probe
+	}{
+		// Patterns without a slash match at any level.
+		{[]string{"*.o"}, []probe{
+			{"a.o", false, true},
+			{"dir/a.o", false, true},
+			{"a.oo", false, false},
+			{"a.o/b", false, true},
+		}},
+		// A leading slash anchors.
+		{[]string{"/foo"}, []probe{
+			{"foo", false, true},
+			{"foo/bar", false, true},
+			{"a/foo", false, false},
+		}},
+		// A trailing slash only matches directories.
+		{[]string{"foo/"}, []probe{
+			{"foo", true, true},
+			{"foo", false, false},
+			{"a/foo", true, true},
+			{"foo/bar", false, true},
+		}},
+		// A middle slash anchors too.
+		{[]string{"doc/frotz/"}, []probe{
+			{"doc/frotz", true, true},
+			{"a/doc/frotz", true, false},
+		}},
+		{[]string{"doc/*.txt"}, []probe{
+			{"doc/a.txt", false, true},
+			{"doc/sub/a.txt", false, false},
+		}},
+		// Leading "**/" matches in all directories.
+		{[]string{"**/foo"}, []probe{
+			{"foo", false, true},
+			{"a/b/foo", false, true},
+			{"a/foox", false, false},
+		}},
+		{[]string{"**/foo/bar"}, []probe{
+			{"foo/bar", false, true},
+			{"x/foo/bar", false, true},
+			{"x/foo/baz", false, false},
+		}},
+		// Trailing "/**" matches everything inside.
+		{[]string{"abc/**"}, []probe{
+			{"abc", true, false},
+			{"abc/x", false, true},
+			{"abc/x/y", false, true},
+			{"x/abc/y", false, false},
+		}},
+		// "/**/" matches zero or more directories.
+		{[]string{"a/**/b"}, []probe{
+			{"a/b", false, true},
+			{"a/x/b", false, true},
+			{"a/x/y/b", false, true},
+			{"a/xb", false, false},
+		}},
+		// Negation re-includes; the last match decides.
+		{[]string{"*.log", "!important.log"}, []probe{
+			{"x.log", false, true},
+			{"important.log", false, false},
+			{"dir/important.log", false, false},
+		}},
+		{[]string{"!important.log", "*.log"}, []probe{
+			{"important.log", false, true},
+		}},
+		// Files in an excluded directory can't be re-included.
+		{[]string{"build/", "!build/keep"}, []probe{
+			{"build/keep", false, true},
+			{"build/other", false, true},
+		}},
+		// Example from the gitignore documentation.
+		{[]string{"/*", "!/foo", "/foo/*", "!/foo/bar"}, []probe{
+			{"foo/bar", false, false},
+			{"foo/bar/baz", false, false},
+			{"foo/baz", false, true},
+			{"other", false, true},
+		}},
+		// Comments, blank lines and escapes.
+		{[]string{"# comment", "", `\#file`, `\!bang`}, []probe{
+			{"# comment", false, false},
+			{"#file", false, true},
+			{"!bang", false, true},
+		}},
+		{[]string{"trailing  ", `space\ `}, []probe{
+			{"trailing", false, true},
+			{"space ", false, true},
+			{"space", false, false},
+		}},
+		// Single character wildcards and classes.
+		{[]string{"foo?"}, []probe{
+			{"foox", false, true},
+			{"fooxy", false, false},
+			{"foo", false, false},
+		}},
+		{[]string{"[a-c].txt"}, []probe{
+			{"b.txt", false, true},
+			{"d.txt", false, false},
+		}},
+		{[]string{"[!a-c].txt"}, []probe{
+			{"b.txt", false, false},
+			{"d.txt", false, true},
+		}},
+		{[]string{"a*b"}, []probe{
+			{"ab", false, true},
+			{"axxb", false, true},
+			{"ax/b", false, false},
+		}},
+		{[]string{"**"}, []probe{
+			{"a", false, true},
+			{"a/b", false, true},
+		}},
+		{nil, []probe{
+			{"a", false, false},
+		}},
+	} {
+		m, err := NewPathMatcher(tc.patterns)
+		if err != nil {
+			t.Fatalf("NewPathMatcher(%q): %v", tc.patterns, err)
+		}
+		for _, p := range tc.probes {
+			if got := m.Match(p.path, p.isDir); got != p.want {
+				t.Errorf("%q.Match(%q, %v): got %v, want %v", tc.patterns, p.path, p.isDir, got, p.want)
+			}
+		}
+	}
+}
+
+func TestPathMatcherErrors(t *testing.T) {
+	if _, err := NewPathMatcher([]string{"[abc"}); err == nil {
+		t.Errorf("unterminated class: got no error")
+	}
+}
+
+func TestParsePathMatcher(t *testing.T) {
+	m, err := ParsePathMatcher([]byte("# generated\r\n*.pb.go\r\n\nvendor/\n"))
+	if err != nil {
+		t.Fatalf("ParsePathMatcher: %v", err)
+	}
+	for path, want := range map[string]bool{
+		"x.pb.go":        true,
+		"vendor/a/b.go":  true,
+		"main.go":        false,
+		"# generated":    false,
+		"sub/y.pb.go":    true,
+		"notvendor/a.go": false,
+	} {
+		if got := m.Match(path, false); got != want {
+			t.Errorf("Match(%q): got %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// fileCommit is the commit that last changed a file.
+type fileCommit struct {
+	ID   git.Oid
+	Time time.Time
+}
+
+// lastCommitFinder finds the commits that last changed files. The
+// paths changed by each commit are kept, so branches that share
+// history only diff the shared commits once.
+type lastCommitFinder struct {
+	repo *git.Repository
+
+	// followRenames makes a file that was renamed without changes
+	// keep the commit that last changed it under its old name.
+	followRenames bool
+
+	// commit => changes relative to its first parent.
+	changes map[git.Oid]*commitChanges
+}
+
+// commitChanges are the changes of a commit to its first parent.
+type commitChanges struct {
+	// paths of the files added or modified.
+	paths map[string]bool
+
+	// renames maps the new path of files renamed without change
+	// to the old path. It is only set when following renames.
+	renames map[string]string
+}
+
+func newLastCommitFinder(repo *git.Repository, followRenames bool) *lastCommitFinder {
+	return &lastCommitFinder{
+		repo:          repo,
+		followRenames: followRenames,
+		changes:       map[git.Oid]*commitChanges{},
+	}
+}
+
+// find returns the commit that last changed each of paths, walking
+// the first-parent history from head. The walk stops once all paths
+// are found.
+func (f *lastCommitFinder) find(head *git.Commit, paths []string) (map[string]fileCommit, error) {
+	// path in the commit being walked => path at head.
+	remaining := make(map[string]string, len(paths))
+	for _, p := range paths {
+		remaining[p] = p
+	}
+	result := make(map[string]fileCommit, len(paths))
+	if len(remaining) == 0 {
+		return result, nil
+	}
+
+	walk, err := f.repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer walk.Free()
+
+	walk.Sorting(git.SortTopological)
+	walk.SimplifyFirstParent()
+	if err := walk.Push(head.Id()); err != nil {
+		return nil, err
+	}
+
+	var iterErr error
+	if err := walk.Iterate(func(c *git.Commit) bool {
+		changes, err := f.changed(c)
+		if err != nil {
+			iterErr = err
+			return false
+		}
+		for p := range changes.paths {
+			if orig, ok := remaining[p]; ok {
+				delete(remaining, p)
+				result[orig] = fileCommit{ID: *c.Id(), Time: c.Committer().When}
+			}
+		}
+		for newPath, oldPath := range changes.renames {
+			if orig, ok := remaining[newPath]; ok {
+				delete(remaining, newPath)
+				remaining[oldPath] = orig
+			}
+		}
+		return len(remaining) > 0
+	}); err != nil {
+		return nil, err
+	}
+	return result, iterErr
+}
+
+// changed returns the changes of c relative to its first parent.
+// When following renames, renamed files are found by comparing the
+// contents of the added and deleted files, which is much slower than
+// the plain diff.
+func (f *lastCommitFinder) changed(c *git.Commit) (*commitChanges, error) {
+	if changes, ok := f.changes[*c.Id()]; ok {
+		return changes, nil
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	var parentTree *git.Tree
+	if c.ParentCount() > 0 {
+		parent := c.Parent(0)
+		parentTree, err = parent.Tree()
+		parent.Free()
+		if err != nil {
+			return nil, err
+		}
+		defer parentTree.Free()
+	}
+
+	diff, err := f.repo.DiffTreeToTree(parentTree, tree, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+
+	if f.followRenames && parentTree != nil {
+		findOpts, err := git.DefaultDiffFindOptions()
+		if err != nil {
+			return nil, err
+		}
+		findOpts.Flags = git.DiffFindRenames
+		if err := diff.FindSimilar(&findOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return nil, err
+	}
+	changes := &commitChanges{paths: map[string]bool{}}
+	for i := 0; i < n; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case delta.Status == git.DeltaDeleted:
+		case delta.Status == git.DeltaRenamed && delta.OldFile.Oid.Equal(delta.NewFile.Oid):
+			if changes.renames == nil {
+				changes.renames = map[string]string{}
+			}
+			changes.renames[delta.NewFile.Path] = delta.OldFile.Path
+		default:
+			changes.paths[delta.NewFile.Path] = true
+		}
+	}
+	f.changes[*c.Id()] = changes
+	return changes, nil
+}
+
+// addLastCommits finds the last commits of the files of the top-level
+// repository in files on the branch with the given head, and records
+// them in lastCommits. A file on several branches gets the most
+// recent of its commits.
+func addLastCommits(f *lastCommitFinder, head *git.Commit, files map[FileKey]BlobLocation, lastCommits map[FileKey]fileCommit) error {
+	var paths []string
+	for key := range files {
+		if key.SubRepoPath == "" {
+			paths = append(paths, key.Path)
+		}
+	}
+	found, err := f.find(head, paths)
+	if err != nil {
+		return err
+	}
+	for key := range files {
+		c, ok := found[key.Path]
+		if !ok || key.SubRepoPath != "" {
+			continue
+		}
+		if old, ok := lastCommits[key]; !ok || c.Time.After(old.Time) {
+			lastCommits[key] = c
+		}
+	}
+	return nil
+}
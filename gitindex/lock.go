@@ -0,0 +1,51 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrAlreadyIndexing is returned by IndexGitRepo if another indexer
+// holds the lock on the shards of the repository.
+var ErrAlreadyIndexing = errors.New("repository is already being indexed")
+
+// lockPollInterval is how often lockShards retries while waiting.
+const lockPollInterval = 100 * time.Millisecond
+
+// lockShards takes the lock file name, waiting up to timeout for
+// another holder to release it. The directory of the lock file is
+// created if needed, as the index directory may not exist before the
+// first shard is written. It returns a function that releases the
+// lock.
+func lockShards(name string, timeout time.Duration) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		unlock, err := tryLock(name)
+		if err != ErrAlreadyIndexing {
+			return unlock, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, err
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package gitindex
+
+import (
+	"os"
+)
+
+// tryLock creates the named file exclusively, and removes it on
+// release. If the holder crashes, the file must be removed by hand.
+func tryLock(name string) (func(), error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, ErrAlreadyIndexing
+	} else if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() {
+		os.Remove(name)
+	}, nil
+}
+
+// lockShared does not lock, as exclusive files can't be shared. Only
+// the holders within one process are known, through acquireRepoDir.
+func lockShared(name string) (func(), error) {
+	return func() {}, nil
+}
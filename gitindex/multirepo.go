@@ -0,0 +1,246 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/zoekt"
+	git "github.com/libgit2/git2go"
+)
+
+// IndexGitRepos indexes several repositories into the shards of a
+// single repository, so that many small repositories can be searched
+// together. The shards are described by opts.BuildOptions, whose
+// RepoDir is not used.
+//
+// Each member becomes a sub-repository at the path of its
+// RepositoryDescription.Name, with its own branch versions and URL
+// templates, and repo queries for its name match its files. Of the
+// member options, only RepoDir, the repository name and URL, Branches,
+// BranchPrefix, RefPrefixes, ExcludeBranches, DefaultBranch,
+// AllowMissingBranch, IncludePaths, ExcludePaths, NoRepoSearch,
+// MaxSubmoduleDepth and ConfigSection are used.
+//
+// The branches of the shards are those of all members. The version of
+// a branch is a hash of the versions of the members that have it.
+func IndexGitRepos(opts Options, members []Options) error {
+	desc := &opts.BuildOptions.RepositoryDescription
+	if desc.Name == "" {
+		return fmt.Errorf("repository name must be set")
+	}
+	if opts.BuildOptions.IndexDir == "" {
+		return fmt.Errorf("BuildOptions.IndexDir must be set")
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("no repositories to index")
+	}
+	if err := checkMemberNames(members); err != nil {
+		return err
+	}
+
+	if !opts.IgnoreLock && !opts.DryRun {
+		lockName, err := opts.BuildOptions.LockName()
+		if err != nil {
+			return err
+		}
+		unlock, err := lockShards(lockName, opts.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	repoCache := NewRepoCache(opts.RepoCacheDir)
+	repoCache.SetLimits(opts.RepoCacheLimits)
+	defer repoCache.Close()
+
+	idx := &memberIndex{
+		repoCache:       repoCache,
+		repos:           map[FileKey]BlobLocation{},
+		branchMap:       map[FileKey][]string{},
+		branchVersions:  map[string]map[string]git.Oid{},
+		skippedSubRepos: map[string]*url.URL{},
+		descs:           map[string]*zoekt.Repository{},
+	}
+	for _, m := range members {
+		if err := idx.add(m); err != nil {
+			return fmt.Errorf("%s: %v", m.BuildOptions.RepositoryDescription.Name, err)
+		}
+	}
+
+	desc.Branches = nil
+	for _, b := range idx.branches {
+		desc.Branches = append(desc.Branches, zoekt.RepositoryBranch{
+			Name:    b,
+			Version: combinedVersion(idx.branchVersions[b], idx.descs),
+		})
+	}
+	desc.Members = nil
+	for _, m := range members {
+		desc.Members = append(desc.Members, m.BuildOptions.RepositoryDescription.Name)
+	}
+	sort.Strings(desc.Members)
+	opts.memberRepos = idx.descs
+
+	if opts.Incremental && opts.BuildOptions.IndexUpToDate() {
+		if opts.dryRunSummary != nil {
+			opts.dryRunSummary.UpToDate = true
+		}
+		return nil
+	}
+
+	var carried map[FileKey][]byte
+	if opts.Incremental {
+		carried = indexedBlobs(opts.BuildOptions.FindAllShards(), opts.BuildOptions.FingerprintExtra, idx.repos)
+	}
+	return indexFiles(&opts, idx.repos, idx.branchMap, idx.branchVersions, carried, nil, nil, nil, idx.skippedSubRepos)
+}
+
+// checkMemberNames returns an error if the member names can't be
+// used as distinct sub-repository paths.
+func checkMemberNames(members []Options) error {
+	var names []string
+	for _, m := range members {
+		name := m.BuildOptions.RepositoryDescription.Name
+		if name == "" || path.Clean(name) != name || name == "." || name == ".." ||
+			strings.HasPrefix(name, "/") || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("member name %q is not a relative path", name)
+		}
+		if m.BuildOptions.RepoDir == "" {
+			return fmt.Errorf("%s: BuildOptions.RepoDir must be set", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] || strings.HasPrefix(names[i], names[i-1]+"/") {
+			return fmt.Errorf("member names %q and %q overlap", names[i-1], names[i])
+		}
+	}
+	return nil
+}
+
+// memberIndex collects the files of the members of IndexGitRepos.
+type memberIndex struct {
+	repoCache *RepoCache
+
+	repos           map[FileKey]BlobLocation
+	branchMap       map[FileKey][]string
+	branchVersions  map[string]map[string]git.Oid
+	skippedSubRepos map[string]*url.URL
+
+	// descs holds the descriptions of the members, by path.
+	descs map[string]*zoekt.Repository
+
+	// branches holds the branch names in order of appearance.
+	branches []string
+}
+
+// add walks the branches of member m, and adds its files under the
+// path of its name.
+func (idx *memberIndex) add(m Options) error {
+	name := m.BuildOptions.RepositoryDescription.Name
+	repo, err := openRepository(m.BuildOptions.RepoDir, m.NoRepoSearch)
+	if err != nil {
+		return err
+	}
+
+	desc := m.BuildOptions.RepositoryDescription
+	if err := setTemplatesFromConfig(&desc, m.BuildOptions.RepoDir, m.ConfigSection); err != nil {
+		log.Printf("setTemplatesFromConfig(%s): %s", m.BuildOptions.RepoDir, err)
+	}
+	desc.Branches = nil
+	idx.descs[name] = &desc
+
+	branches, err := expandBranches(repo, m.Branches, m.branchRefPrefix(), m.RefPrefixes, m.ExcludeBranches, m.DefaultBranch, m.AllowMissingBranch)
+	if err != nil {
+		return err
+	}
+	filter, err := newPathFilter(m.IncludePaths, m.ExcludePaths)
+	if err != nil {
+		return err
+	}
+	for _, b := range branches {
+		commit, err := getCommit(repo, filepath.Join(m.branchRefPrefix(), b))
+		if m.AllowMissingBranch && isMissingBranchError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer commit.Free()
+		tree, err := commit.Tree()
+		if err != nil {
+			return err
+		}
+		defer tree.Free()
+
+		w, err := walkTree(repo, tree, desc.URL, idx.repoCache, false, m.MaxSubmoduleDepth, filter)
+		if err != nil {
+			return err
+		}
+		for k, v := range w.tree {
+			key := FileKey{
+				SubRepoPath: path.Join(name, k.SubRepoPath),
+				Path:        k.Path,
+				ID:          k.ID,
+			}
+			idx.repos[key] = v
+			idx.branchMap[key] = append(idx.branchMap[key], b)
+		}
+		for p, u := range w.skippedSubRepos {
+			idx.skippedSubRepos[path.Join(name, p)] = u
+		}
+
+		versions, ok := idx.branchVersions[b]
+		if !ok {
+			versions = map[string]git.Oid{}
+			idx.branchVersions[b] = versions
+			idx.branches = append(idx.branches, b)
+		}
+		versions[name] = *commit.Id()
+		for p, id := range w.subRepoVersions {
+			versions[path.Join(name, p)] = id
+		}
+	}
+	return nil
+}
+
+// combinedVersion returns a hash of the versions of the members in
+// versions, which also holds the versions of their submodules.
+func combinedVersion(versions map[string]git.Oid, members map[string]*zoekt.Repository) string {
+	var paths []string
+	for p := range versions {
+		if _, ok := members[p]; ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	h := sha1.New()
+	for _, p := range paths {
+		id := versions[p]
+		fmt.Fprintf(h, "%s %s\n", p, id.String())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
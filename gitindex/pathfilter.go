@@ -0,0 +1,72 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import "fmt"
+
+// pathFilter selects files by their path in the repository,
+// including submodule prefixes, using the gitignore patterns of
+// PathMatcher. Like git pathspecs, a file is selected if it matches
+// the include patterns (or there are none) and not the exclude
+// patterns. Exclusion always wins, so including a directory inside an
+// excluded one has no effect.
+type pathFilter struct {
+	include *PathMatcher
+	exclude *PathMatcher
+}
+
+// newPathFilter returns a filter for the given patterns, or nil if
+// there are none.
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &pathFilter{}
+	var err error
+	if f.include, err = NewPathMatcher(include); err != nil {
+		return nil, fmt.Errorf("include paths: %v", err)
+	}
+	if f.exclude, err = NewPathMatcher(exclude); err != nil {
+		return nil, fmt.Errorf("exclude paths: %v", err)
+	}
+	return f, nil
+}
+
+// selected returns true if the file p is selected. All files are
+// selected by a nil filter.
+func (f *pathFilter) selected(p string) bool {
+	if f == nil {
+		return true
+	}
+	if f.exclude.Match(p, false) {
+		return false
+	}
+	return f.include.Empty() || f.include.Match(p, false)
+}
+
+// skipDir returns true if no file inside the directory dir can be
+// selected, so it need not be walked.
+func (f *pathFilter) skipDir(dir string) bool {
+	if f == nil {
+		return false
+	}
+	if f.exclude.Match(dir, true) {
+		return true
+	}
+	if f.include.Empty() {
+		return false
+	}
+	return !f.include.Match(dir, true) && !f.include.mayMatchBelow(dir)
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import "testing"
+
+func TestPathFilter(t *testing.T) {
+	f, err := newPathFilter(
+		[]string{"frontend/", "docs", "third_party/keep/", "*.md"},
+		[]string{"frontend/node_modules/", "third_party/"})
+	if err != nil {
+		t.Fatalf("newPathFilter: %v", err)
+	}
+
+	for p, want := range map[string]bool{
+		"frontend/app.js":                  true,
+		"frontend/node_modules/x/index.js": false,
+		"docs/index.html":                  true,
+		"sub/docs/index.html":              true,
+		"backend/main.go":                  false,
+		"backend/README.md":                true,
+		"third_party/keep/a.go":            false,
+		"third_party/README.md":            false,
+	} {
+		if got := f.selected(p); got != want {
+			t.Errorf("selected(%q): got %v, want %v", p, got, want)
+		}
+	}
+
+	for dir, want := range map[string]bool{
+		"frontend":              false,
+		"frontend/node_modules": true,
+		"third_party":           true,
+		"third_party/keep":      true,
+		"backend":               false,
+	} {
+		if got := f.skipDir(dir); got != want {
+			t.Errorf("skipDir(%q): got %v, want %v", dir, got, want)
+		}
+	}
+
+	anchored, err := newPathFilter([]string{"/frontend/src/**"}, nil)
+	if err != nil {
+		t.Fatalf("newPathFilter: %v", err)
+	}
+	for dir, want := range map[string]bool{
+		"frontend":          false,
+		"frontend/src":      false,
+		"frontend/src/deep": false,
+		"frontend/test":     true,
+		"backend":           true,
+	} {
+		if got := anchored.skipDir(dir); got != want {
+			t.Errorf("anchored skipDir(%q): got %v, want %v", dir, got, want)
+		}
+	}
+
+	var none *pathFilter
+	if !none.selected("any/file") || none.skipDir("any") {
+		t.Errorf("nil filter must select everything")
+	}
+}
+
+func TestPathFilterGitignoreSyntax(t *testing.T) {
+	f, err := newPathFilter(
+		[]string{"*.go", "!*_test.go", "/docs/"},
+		[]string{"*.pb.go", "!keep.pb.go", "/build/"})
+	if err != nil {
+		t.Fatalf("newPathFilter: %v", err)
+	}
+	for p, want := range map[string]bool{
+		"main.go":            true,
+		"pkg/main_test.go":   false,
+		"api/api.pb.go":      false,
+		"api/keep.pb.go":     true,
+		"docs/index.html":    true,
+		"sub/docs/index.md":  false,
+		"build/gen.go":       false,
+		"sub/build/gen.go":   true,
+		"sub/build/notes.md": false,
+	} {
+		if got := f.selected(p); got != want {
+			t.Errorf("selected(%q): got %v, want %v", p, got, want)
+		}
+	}
+
+	for dir, want := range map[string]bool{
+		"build":     true,
+		"sub/build": false,
+		"sub/docs":  false,
+	} {
+		if got := f.skipDir(dir); got != want {
+			t.Errorf("skipDir(%q): got %v, want %v", dir, got, want)
+		}
+	}
+
+	if _, err := newPathFilter([]string{"[a-"}, nil); err == nil {
+		t.Errorf("got no error for bad pattern")
+	}
+}
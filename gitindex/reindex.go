@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/zoekt"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ReindexChanged indexes the repository like IndexGitRepo, but only
+// reads the blobs that changed since the shard at shardPath was
+// built.
+//
+// The shard records the commit it indexed for each branch. The tree
+// of that commit is walked again, and every file whose path and blob
+// ID are the same at the new tip of the branch is unchanged; its
+// content is carried forward from the shard's content section
+// instead of being read from the object store. Files that were
+// added or modified, and files the shard doesn't hold, are read
+// from the repository. The complete index, including the posting
+// lists, is then built again from this content, so the result is
+// the same as that of a full rebuild.
+//
+// The shard must have been built with the same content options,
+// such as BlobReaderWrap and ResolveAnnex, since carried content is
+// not transformed again. If a branch's old commit is no longer in
+// the repository, all of its files are read.
+func ReindexChanged(shardPath string, opts Options) error {
+	_, err := indexGitRepoFrom(opts, shardPath)
+	return err
+}
+
+// carryForward returns the content of the files in branchMap that
+// are unchanged relative to the shard at shardPath.
+func carryForward(repo *git.Repository, repoCache *RepoCache, shardPath string, opts *Options, branchMap map[FileKey][]string) (map[FileKey][]byte, error) {
+	f, err := os.Open(shardPath)
+	if err != nil {
+		return nil, err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer iFile.Close()
+
+	old, docs, err := zoekt.ReadDocuments(iFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// name => branch => content
+	contents := map[string]map[string][]byte{}
+	for _, d := range docs {
+		byBranch := contents[d.Name]
+		if byBranch == nil {
+			byBranch = map[string][]byte{}
+			contents[d.Name] = byBranch
+		}
+		for _, br := range d.Branches {
+			byBranch[br] = d.Content
+		}
+	}
+
+	carried := map[FileKey][]byte{}
+	for _, br := range old.Branches {
+		commit, err := getCommit(repo, br.Version)
+		if err != nil {
+			log.Printf("%s: old commit %s of branch %s: %v", shardPath, br.Version, br.Name, err)
+			continue
+		}
+		tree, err := commit.Tree()
+		commit.Free()
+		if err != nil {
+			return nil, err
+		}
+
+		oldFiles, _, err := treeToFiles(repo, tree, opts.BuildOptions.RepositoryDescription.URL, repoCache, opts.ResolveAnnex || opts.IndexSymlinks)
+		if err == nil && opts.IndexSymlinks {
+			oldFiles, err = resolveSymlinks(oldFiles, opts.ResolveAnnex)
+		}
+		tree.Free()
+		if err != nil {
+			return nil, err
+		}
+
+		for key := range oldFiles {
+			if !hasBranch(branchMap[key], br.Name) {
+				// Modified or removed on this branch.
+				continue
+			}
+			if c, ok := contents[key.FullPath()][br.Name]; ok {
+				carried[key] = c
+			}
+		}
+	}
+	return carried, nil
+}
+
+// indexedBlobs returns the content of the files of repos that one
+// of the given shards holds unchanged. The blob ID of a document is
+// computed from its indexed content, so documents whose content was
+// transformed while indexing never match. Shards that can't be read,
+// or that were built with a different fingerprintExtra, are skipped.
+func indexedBlobs(shards []string, fingerprintExtra []byte, repos map[FileKey]BlobLocation) map[FileKey][]byte {
+	carried := map[FileKey][]byte{}
+	for _, fn := range shards {
+		repo, docs, err := readShardDocuments(fn)
+		if err != nil {
+			log.Printf("%s: not reusing content: %v", fn, err)
+			continue
+		}
+		if !bytes.Equal(repo.FingerprintExtra, fingerprintExtra) {
+			continue
+		}
+
+		for _, d := range docs {
+			key := FileKey{
+				SubRepoPath: d.SubRepositoryPath,
+				Path:        d.Name,
+				ID:          blobID(d.Content),
+			}
+			if key.SubRepoPath != "" {
+				key.Path = strings.TrimPrefix(d.Name, key.SubRepoPath+"/")
+			}
+			if _, ok := repos[key]; ok {
+				carried[key] = d.Content
+			}
+		}
+	}
+	return carried
+}
+
+func readShardDocuments(fn string) (*zoekt.Repository, []zoekt.Document, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iFile.Close()
+	return zoekt.ReadDocuments(iFile)
+}
+
+// blobID returns the git object ID of a blob with the given content.
+func blobID(content []byte) git.Oid {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+
+	var id git.Oid
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+func hasBranch(branches []string, name string) bool {
+	for _, b := range branches {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ResolveSubmoduleURL returns the URL of a submodule whose URL in
+// .gitmodules is subURL, in a repository cloned from parent. As in
+// git, URLs starting with "./" or "../" are relative to parent, which
+// may then not be nil. Other URLs may use the scp-like syntax
+// user@host:path for SSH.
+func ResolveSubmoduleURL(parent *url.URL, subURL string) (*url.URL, error) {
+	if strings.HasPrefix(subURL, "./") || strings.HasPrefix(subURL, "../") {
+		if parent == nil {
+			return nil, fmt.Errorf("no URL for base repo.")
+		}
+		u := *parent
+		u.Path = path.Join(u.Path, subURL)
+		u.RawPath = ""
+		return &u, nil
+	}
+	return parseCloneURL(subURL)
+}
+
+// webURL returns the URL for browsing the repository cloned from u,
+// whose host has template type typ. SSH and git:// URLs are
+// rewritten to HTTPS on the same host, without user and port. For
+// Bitbucket Server and Azure DevOps, whose clone URLs differ from
+// their web URLs, the path and host are rewritten too.
+func webURL(u *url.URL, typ string) *url.URL {
+	w := *u
+	switch u.Scheme {
+	case "ssh", "git", "git+ssh", "ssh+git":
+		w.Scheme = "https"
+		w.User = nil
+		w.Host = u.Hostname()
+	}
+
+	if typ == "azure-devops" && u.Hostname() == "ssh.dev.azure.com" {
+		// git@ssh.dev.azure.com:v3/org/project/repo
+		parts := strings.Split(strings.Trim(w.Path, "/"), "/")
+		if len(parts) == 4 && parts[0] == "v3" {
+			w.Host = "dev.azure.com"
+			w.Path = "/" + strings.Join([]string{parts[1], parts[2], "_git", parts[3]}, "/")
+			w.RawPath = ""
+		}
+	}
+	if typ == "bitbucket-server" {
+		// Clone URLs are /scm/PROJECT/REPO.git for HTTPS, and
+		// /PROJECT/REPO.git for SSH.
+		p := strings.TrimSuffix(strings.Trim(w.Path, "/"), ".git")
+		if w.Scheme == u.Scheme {
+			p = strings.TrimPrefix(p, "scm/")
+		}
+		if parts := strings.Split(p, "/"); len(parts) == 2 {
+			w.Path = "/projects/" + parts[0] + "/repos/" + parts[1]
+			w.RawPath = ""
+		}
+	}
+	return &w
+}
+
+// hostTemplateType returns the template type for the host of u: the
+// one registered with RegisterHostTemplate if there is one, and
+// otherwise that of a well-known hosting site, or "".
+func hostTemplateType(u *url.URL) string {
+	if typ := registeredHostTemplate(u.Hostname()); typ != "" {
+		return typ
+	}
+	return knownHostTemplate(u.Hostname())
+}
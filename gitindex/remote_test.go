@@ -0,0 +1,90 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/zoekt"
+)
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	for _, tc := range []struct {
+		parent, sub, want string
+	}{
+		{"https://github.com/org/repo", "../sibling.git", "https://github.com/org/sibling.git"},
+		{"https://github.com/org/repo.git", "../sibling.git", "https://github.com/org/sibling.git"},
+		{"https://github.com/org/repo/", "./sub", "https://github.com/org/repo/sub"},
+		{"https://github.com/org/repo", "../../other/lib.git", "https://github.com/other/lib.git"},
+		{"ssh://git@github.com/org/repo.git", "../sibling.git", "ssh://git@github.com/org/sibling.git"},
+		{"https://github.com/org/repo", "git@github.com:org/lib.git", "ssh://git@github.com/org/lib.git"},
+		{"https://github.com/org/repo", "https://gitlab.com/group/project.git", "https://gitlab.com/group/project.git"},
+		{"", "https://gitlab.com/group/project.git", "https://gitlab.com/group/project.git"},
+	} {
+		var parent *url.URL
+		if tc.parent != "" {
+			var err error
+			if parent, err = parseCloneURL(tc.parent); err != nil {
+				t.Fatalf("parseCloneURL(%q): %v", tc.parent, err)
+			}
+		}
+		got, err := ResolveSubmoduleURL(parent, tc.sub)
+		if err != nil {
+			t.Errorf("ResolveSubmoduleURL(%q, %q): %v", tc.parent, tc.sub, err)
+		} else if got.String() != tc.want {
+			t.Errorf("ResolveSubmoduleURL(%q, %q): got %s, want %s", tc.parent, tc.sub, got, tc.want)
+		}
+	}
+
+	if _, err := ResolveSubmoduleURL(nil, "../sibling.git"); err == nil {
+		t.Errorf("relative URL resolved without a parent")
+	}
+}
+
+func TestSetTemplatesFromSSHOrigin(t *testing.T) {
+	defer func() {
+		hostTemplates.types = map[string]string{}
+	}()
+	if err := RegisterHostTemplate("stash.example.com", "bitbucket-server"); err != nil {
+		t.Fatalf("RegisterHostTemplate: %v", err)
+	}
+
+	for _, tc := range []struct {
+		origin, name, url string
+	}{
+		{"git@github.com:org/repo.git", "github.com/org/repo", "https://github.com/org/repo"},
+		{"ssh://git@github.com:22/org/repo.git", "github.com/org/repo", "https://github.com/org/repo"},
+		{"ssh://git@gitlab.com:2222/group/project.git", "gitlab.com/group/project", "https://gitlab.com/group/project"},
+		{"git://git.sr.ht/~user/repo", "git.sr.ht/~user/repo", "https://git.sr.ht/~user/repo"},
+		{"ssh://me@gerrit.googlesource.com:29418/gitiles", "gerrit.googlesource.com/gitiles", "https://gerrit.googlesource.com/gitiles"},
+		{"https://github.com/org/repo.git", "github.com/org/repo", "https://github.com/org/repo"},
+		{"ssh://git@stash.example.com:7999/foo/bar.git", "stash.example.com/foo/bar", "https://stash.example.com/projects/foo/repos/bar"},
+		{"https://stash.example.com/scm/foo/bar.git", "stash.example.com/scm/foo/bar", "https://stash.example.com/projects/foo/repos/bar"},
+	} {
+		u, err := parseCloneURL(tc.origin)
+		if err != nil {
+			t.Fatalf("parseCloneURL(%q): %v", tc.origin, err)
+		}
+		var got zoekt.Repository
+		if err := SetTemplatesFromOrigin(&got, u); err != nil {
+			t.Errorf("SetTemplatesFromOrigin(%s): %v", tc.origin, err)
+			continue
+		}
+		if got.Name != tc.name || got.URL != tc.url {
+			t.Errorf("%s: got name %q, URL %q, want %q, %q", tc.origin, got.Name, got.URL, tc.name, tc.url)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"log"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// defaultReadRetryBackoff is the delay before the first retry of a
+// failed read if Options.ReadRetryBackoff is not set.
+const defaultReadRetryBackoff = 100 * time.Millisecond
+
+// retryRead calls read until it succeeds, fails permanently, or has
+// been retried o.ReadRetries times, and returns its last error. The
+// delay before a retry doubles each time. name is the file being
+// read, for logging.
+func (o *Options) retryRead(name string, read func() error) error {
+	backoff := o.ReadRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultReadRetryBackoff
+	}
+	for i := 0; ; i++ {
+		err := read()
+		if err == nil || i >= o.ReadRetries || isPermanentReadError(err) {
+			return err
+		}
+		log.Printf("%s: %v; retrying in %s", name, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isPermanentReadError returns true for errors that retrying the
+// read can't fix, such as a missing object.
+func isPermanentReadError(err error) bool {
+	return git.IsErrorCode(err, git.ErrNotFound)
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestRetryRead(t *testing.T) {
+	opts := Options{ReadRetries: 3, ReadRetryBackoff: time.Millisecond}
+	transient := errors.New("stale file handle")
+
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		calls int
+		fail  bool
+	}{
+		{"success", nil, 1, false},
+		{"transient", []error{transient, transient}, 3, false},
+		{"too many", []error{transient, transient, transient, transient, transient}, 4, true},
+		{"missing object", []error{&git.GitError{Message: "object not found", Class: git.ErrClassOdb, Code: git.ErrNotFound}}, 1, true},
+	} {
+		calls := 0
+		err := opts.retryRead("file", func() error {
+			calls++
+			if calls <= len(tc.errs) {
+				return tc.errs[calls-1]
+			}
+			return nil
+		})
+		if (err != nil) != tc.fail {
+			t.Errorf("%s: got error %v, want failure %v", tc.name, err, tc.fail)
+		}
+		if calls != tc.calls {
+			t.Errorf("%s: got %d calls, want %d", tc.name, calls, tc.calls)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+	"github.com/google/zoekt/query"
+
+	git "github.com/libgit2/git2go"
+)
+
+const selfTestNeedle = "zoekt-selftest-needle"
+
+// createSelfTestRepo creates a bare repository with a single commit
+// on master. It only uses libgit2.
+func createSelfTestRepo(dir string) error {
+	repo, err := git.InitRepository(dir, true)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	blob := func(content string) (*git.Oid, error) {
+		return repo.CreateBlobFromBuffer([]byte(content))
+	}
+
+	sub, err := repo.TreeBuilder()
+	if err != nil {
+		return err
+	}
+	defer sub.Free()
+	id, err := blob("package src\n\n// " + selfTestNeedle + "\n")
+	if err != nil {
+		return err
+	}
+	if err := sub.Insert("needle.go", id, git.FilemodeBlob); err != nil {
+		return err
+	}
+	subID, err := sub.Write()
+	if err != nil {
+		return err
+	}
+
+	root, err := repo.TreeBuilder()
+	if err != nil {
+		return err
+	}
+	defer root.Free()
+	if id, err = blob("zoekt self test\n"); err != nil {
+		return err
+	}
+	if err := root.Insert("README", id, git.FilemodeBlob); err != nil {
+		return err
+	}
+	if err := root.Insert("src", subID, git.FilemodeTree); err != nil {
+		return err
+	}
+	rootID, err := root.Write()
+	if err != nil {
+		return err
+	}
+
+	tree, err := repo.LookupTree(rootID)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	sig := &git.Signature{Name: "zoekt", Email: "zoekt@localhost", When: time.Now()}
+	_, err = repo.CreateCommit("refs/heads/master", sig, sig, "self test", tree)
+	return err
+}
+
+// SelfTest creates a small repository in a temporary directory,
+// indexes it with IndexGitRepo, and searches the resulting shards.
+// It returns an error if any step fails or the search results are
+// wrong, so it checks that indexing works with the libgit2 at hand.
+func SelfTest() error {
+	dir, err := ioutil.TempDir("", "zoekt-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	repoDir := filepath.Join(dir, "repo.git")
+	if err := createSelfTestRepo(repoDir); err != nil {
+		return fmt.Errorf("createSelfTestRepo: %v", err)
+	}
+
+	opts := Options{
+		BuildOptions: build.Options{
+			IndexDir: filepath.Join(dir, "index"),
+			RepoDir:  repoDir,
+			RepositoryDescription: zoekt.Repository{
+				Name: "selftest",
+			},
+		},
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+	}
+	opts.BuildOptions.SetDefaults()
+	if err := IndexGitRepo(opts); err != nil {
+		return fmt.Errorf("IndexGitRepo: %v", err)
+	}
+
+	shards := opts.BuildOptions.FindAllShards()
+	if len(shards) != 1 {
+		return fmt.Errorf("got shards %v, want 1", shards)
+	}
+	f, err := os.Open(shards[0])
+	if err != nil {
+		return err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	searcher, err := zoekt.NewSearcher(iFile)
+	if err != nil {
+		iFile.Close()
+		return fmt.Errorf("NewSearcher(%s): %v", shards[0], err)
+	}
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(),
+		&query.Substring{Pattern: selfTestNeedle, Content: true},
+		&zoekt.SearchOptions{})
+	if err != nil {
+		return fmt.Errorf("Search: %v", err)
+	}
+	if len(res.Files) != 1 {
+		return fmt.Errorf("got %d files, want 1", len(res.Files))
+	}
+	if got := res.Files[0]; got.FileName != "src/needle.go" || got.Repository != "selftest" ||
+		len(got.Branches) != 1 || got.Branches[0] != "master" {
+		return fmt.Errorf("got match in %s (repo %q, branches %v), want src/needle.go in selftest on master",
+			got.FileName, got.Repository, got.Branches)
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ import (
 	"os"
 	"regexp"
 
+	"github.com/google/zoekt"
 	"github.com/libgit2/git2go"
 )
 
@@ -28,6 +29,40 @@ type SubmoduleEntry struct {
 	Branch string
 }
 
+// ReadSubRepositories returns the sub-repositories recorded in a
+// shard written by IndexGitRepo, keyed by their path. Each has the
+// URL and templates it was indexed with, and a branch for every
+// branch of the repository it is present in, at the version of the
+// submodule there. The repository itself has the empty path.
+func ReadSubRepositories(shard string) (map[string]*zoekt.Repository, error) {
+	f, err := os.Open(shard)
+	if err != nil {
+		return nil, err
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer iFile.Close()
+
+	repo, _, err := zoekt.ReadMetadata(iFile)
+	if err != nil {
+		return nil, err
+	}
+	subs := repo.SubRepoMap
+	if subs == nil {
+		subs = map[string]*zoekt.Repository{}
+	}
+	if _, ok := subs[""]; !ok {
+		// Shards without submodules need not have an entry
+		// for the repository itself.
+		top := *repo
+		top.SubRepoMap = nil
+		subs[""] = &top
+	}
+	return subs, nil
+}
+
 const submodREStr = "^submodule.([^.]*)\\.(.*)"
 
 var submodRE = regexp.MustCompile(submodREStr)
@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"path"
+	"strings"
+)
+
+// maxSymlinkDepth bounds the number of symlinks followed to find a
+// file, so cycles end.
+const maxSymlinkDepth = 8
+
+// resolveSymlinks replaces each symlink among files that leads to a
+// regular file among them, in the same repository, by that file
+// under the name of the link. If keepAnnex is set, git-annex links
+// are kept for readAnnexObject. Other symlinks, such as those to
+// directories or outside the repository, are dropped.
+func resolveSymlinks(files map[FileKey]BlobLocation, keepAnnex bool) (map[FileKey]BlobLocation, error) {
+	type repoPath struct {
+		sub, path string
+	}
+	byPath := make(map[repoPath]FileKey, len(files))
+	for key := range files {
+		byPath[repoPath{key.SubRepoPath, key.Path}] = key
+	}
+
+	result := make(map[FileKey]BlobLocation, len(files))
+	for key, location := range files {
+		if !location.Symlink {
+			result[key] = location
+			continue
+		}
+
+		target, err := location.Blob(&key.ID)
+		if err != nil {
+			return nil, err
+		}
+		if keepAnnex {
+			if _, ok := annexObjectPath(location.Repo.Path(), target); ok {
+				result[key] = location
+				continue
+			}
+		}
+
+		link := key
+		for i := 0; i < maxSymlinkDepth; i++ {
+			t := string(target)
+			if path.IsAbs(t) {
+				break
+			}
+			p := path.Join(path.Dir(link.Path), t)
+			if p == ".." || strings.HasPrefix(p, "../") {
+				break
+			}
+			next, ok := byPath[repoPath{link.SubRepoPath, p}]
+			if !ok {
+				break
+			}
+			nextLocation := files[next]
+			if !nextLocation.Symlink {
+				// The file is indexed under the link,
+				// so it keeps the mode of the link.
+				resolved := nextLocation
+				resolved.Mode = location.Mode
+				result[FileKey{
+					SubRepoPath: key.SubRepoPath,
+					Path:        key.Path,
+					ID:          next.ID,
+				}] = resolved
+				break
+			}
+
+			link = next
+			if target, err = nextLocation.Blob(&next.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
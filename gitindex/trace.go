@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+// Names of the spans started around the phases of indexing.
+const (
+	// SpanResolveRefs covers expanding Options.Branches.
+	SpanResolveRefs = "resolve-refs"
+
+	// SpanWalkTree covers resolving and walking the tree of a
+	// single branch.
+	SpanWalkTree = "walk-tree"
+
+	// SpanAddFiles covers reading the blobs and adding them to the
+	// builder.
+	SpanAddFiles = "add-files"
+
+	// SpanFinish covers waiting for the shards to be written.
+	SpanFinish = "finish"
+)
+
+// Tracer starts spans for the phases of indexing, so they can be
+// reported to a tracing system. Implementations decide what the
+// parent span is, for example from a context they hold.
+type Tracer interface {
+	// StartSpan starts a span. The attributes hold the
+	// repository name, and depending on the phase the branch and
+	// file or document counts.
+	StartSpan(name string, attrs map[string]interface{}) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(string, map[string]interface{}) Span { return noopSpan{} }
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End()                             {}
+
+func (o *Options) tracer() Tracer {
+	if o.Tracer == nil {
+		return noopTracer{}
+	}
+	return o.Tracer
+}
@@ -15,12 +15,12 @@
 package gitindex
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"path"
 	"path/filepath"
-	"strings"
 
 	git "github.com/libgit2/git2go"
 )
@@ -42,25 +42,45 @@ type repoWalker struct {
 
 	// If set, don't gasp on missing submodules.
 	ignoreMissingSubmodules bool
+
+	// If set, return symlinks too.
+	symlinks bool
+
+	// If positive, submodules nested deeper than this are not
+	// walked.
+	maxDepth int
+
+	// Nesting depth of this walker, 0 for the top level.
+	depth int
+
+	// URLs of the repositories enclosing this one, including its
+	// own, for detecting submodule cycles.
+	parents []string
+
+	// Path => URL for submodules that were not walked.
+	skippedSubRepos map[string]*url.URL
+
+	// filter selects the files to return. It applies to paths
+	// prefixed with prefix, the path of this repository in the
+	// top-level one.
+	filter *pathFilter
+	prefix string
 }
 
+// errSkipDir is returned by the walk callback to skip a directory.
+var errSkipDir = errors.New("skip this directory")
+
 // subURL returns the URL for a submodule.
 func (w *repoWalker) subURL(relURL string) (*url.URL, error) {
-	if w.repoURL == nil {
-		return nil, fmt.Errorf("no URL for base repo.")
-	}
-	if strings.HasPrefix(relURL, "../") {
-		u := *w.repoURL
-		u.Path = path.Join(u.Path, relURL)
-		return &u, nil
-	}
-
-	return url.Parse(relURL)
+	return ResolveSubmoduleURL(w.repoURL, relURL)
 }
 
 // newRepoWalker creates a new repoWalker.
 func newRepoWalker(r *git.Repository, repoURL string, repoCache *RepoCache) *repoWalker {
-	u, _ := url.Parse(repoURL)
+	var u *url.URL
+	if repoURL != "" {
+		u, _ = parseCloneURL(repoURL)
+	}
 	return &repoWalker{
 		repo:                    r,
 		repoURL:                 u,
@@ -68,6 +88,8 @@ func newRepoWalker(r *git.Repository, repoURL string, repoCache *RepoCache) *rep
 		repoCache:               repoCache,
 		subRepoVersions:         map[string]git.Oid{},
 		ignoreMissingSubmodules: true,
+		parents:                 []string{repoURL},
+		skippedSubRepos:         map[string]*url.URL{},
 	}
 }
 
@@ -97,17 +119,46 @@ func (rw *repoWalker) parseModuleMap(t *git.Tree) error {
 // that indicates in which repo each SHA1 can be found.
 func TreeToFiles(r *git.Repository, t *git.Tree,
 	repoURL string, repoCache *RepoCache) (map[FileKey]BlobLocation, map[string]git.Oid, error) {
-	ref := newRepoWalker(r, repoURL, repoCache)
+	return treeToFiles(r, t, repoURL, repoCache, false)
+}
 
-	if err := ref.parseModuleMap(t); err != nil {
+// treeToFiles is TreeToFiles, but if symlinks is set, symlinks are
+// returned too, marked in their BlobLocation.
+func treeToFiles(r *git.Repository, t *git.Tree,
+	repoURL string, repoCache *RepoCache, symlinks bool) (map[FileKey]BlobLocation, map[string]git.Oid, error) {
+	w, err := walkTree(r, t, repoURL, repoCache, symlinks, 0, nil)
+	if err != nil {
 		return nil, nil, err
 	}
+	return w.tree, w.subRepoVersions, nil
+}
+
+// walkTree walks the tree t, recursing into submodules up to
+// maxDepth levels deep if it is positive. Only the files selected by
+// filter are returned. The walker holds the results.
+func walkTree(r *git.Repository, t *git.Tree,
+	repoURL string, repoCache *RepoCache, symlinks bool, maxDepth int, filter *pathFilter) (*repoWalker, error) {
+	w := newRepoWalker(r, repoURL, repoCache)
+	w.symlinks = symlinks
+	w.maxDepth = maxDepth
+	w.filter = filter
+	return w, w.walk(t)
+}
 
-	t.Walk(ref.cbInt)
-	if ref.err != nil {
-		return nil, nil, ref.err
+func (w *repoWalker) walk(t *git.Tree) error {
+	if err := w.parseModuleMap(t); err != nil {
+		return err
 	}
-	return ref.tree, ref.subRepoVersions, nil
+
+	t.Walk(w.cbInt)
+	return w.err
+}
+
+// skipSubmodule records the submodule at p as a sub-repository
+// without walking it.
+func (r *repoWalker) skipSubmodule(p string, id *git.Oid, u *url.URL) {
+	r.subRepoVersions[p] = *id
+	r.skippedSubRepos[p] = u
 }
 
 func (r *repoWalker) tryHandleSubmodule(p string, id *git.Oid) error {
@@ -131,6 +182,18 @@ func (r *repoWalker) handleSubmodule(p string, id *git.Oid) error {
 		return err
 	}
 
+	if r.maxDepth > 0 && r.depth >= r.maxDepth {
+		r.skipSubmodule(p, id, subURL)
+		return nil
+	}
+	for _, parent := range r.parents {
+		if parent == subURL.String() {
+			log.Printf("submodule %s: %s is also an enclosing repository, not recursing", p, subURL)
+			r.skipSubmodule(p, id, subURL)
+			return nil
+		}
+	}
+
 	subRepo, err := r.repoCache.Open(subURL)
 	if err != nil {
 		return err
@@ -154,47 +217,68 @@ func (r *repoWalker) handleSubmodule(p string, id *git.Oid) error {
 	if err != nil {
 		return err
 	}
-	subTree, subVersions, err := TreeToFiles(subRepo, tree, subURL.String(), r.repoCache)
-	if err != nil {
+	sub := newRepoWalker(subRepo, subURL.String(), r.repoCache)
+	sub.symlinks = r.symlinks
+	sub.maxDepth = r.maxDepth
+	sub.depth = r.depth + 1
+	sub.parents = append(append([]string{}, r.parents...), subURL.String())
+	sub.filter = r.filter
+	sub.prefix = path.Join(r.prefix, p)
+	if err := sub.walk(tree); err != nil {
 		return err
 	}
-	for k, repo := range subTree {
+	for k, repo := range sub.tree {
 		r.tree[FileKey{
 			SubRepoPath: filepath.Join(p, k.SubRepoPath),
 			Path:        k.Path,
 			ID:          k.ID,
 		}] = repo
 	}
-	for k, v := range subVersions {
+	for k, v := range sub.subRepoVersions {
 		r.subRepoVersions[filepath.Join(p, k)] = v
 	}
+	for k, u := range sub.skippedSubRepos {
+		r.skippedSubRepos[filepath.Join(p, k)] = u
+	}
 	return nil
 }
 
 // cb is the git2go callback
 func (r *repoWalker) cb(n string, e *git.TreeEntry) error {
 	p := filepath.Join(n, e.Name)
+	full := path.Join(r.prefix, p)
+	if (e.Type == git.ObjectTree || e.Type == git.ObjectCommit) && r.filter.skipDir(full) {
+		return errSkipDir
+	}
 	if e.Type == git.ObjectCommit && r.repoCache != nil {
 		if err := r.tryHandleSubmodule(p, e.Id); err != nil {
 			return fmt.Errorf("submodule %s: %v", p, err)
 		}
 	}
 
+	symlink := false
 	switch e.Filemode {
 	case git.FilemodeBlob, git.FilemodeBlobExecutable:
+	case git.FilemodeLink:
+		if !r.symlinks {
+			return nil
+		}
+		symlink = true
 	default:
 		return nil
 	}
 
-	if e.Type != git.ObjectBlob {
+	if e.Type != git.ObjectBlob || !r.filter.selected(full) {
 		return nil
 	}
 	r.tree[FileKey{
 		Path: p,
 		ID:   *e.Id,
 	}] = BlobLocation{
-		Repo: r.repo,
-		URL:  r.repoURL,
+		Repo:    r.repo,
+		URL:     r.repoURL,
+		Symlink: symlink,
+		Mode:    e.Filemode,
 	}
 	return nil
 }
@@ -202,6 +286,9 @@ func (r *repoWalker) cb(n string, e *git.TreeEntry) error {
 // cbInt is the callback suitable for use with git2go.
 func (r *repoWalker) cbInt(n string, e *git.TreeEntry) int {
 	err := r.cb(n, e)
+	if err == errSkipDir {
+		return 1
+	}
 	if err != nil {
 		r.err = err
 		return 1
@@ -225,6 +312,12 @@ func (k *FileKey) FullPath() string {
 type BlobLocation struct {
 	Repo *git.Repository
 	URL  *url.URL
+
+	// Set if the blob holds the target of a symlink.
+	Symlink bool
+
+	// Mode is the mode of the tree entry.
+	Mode git.Filemode
 }
 
 func (l *BlobLocation) Blob(id *git.Oid) ([]byte, error) {
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -25,12 +26,17 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/build"
 	"github.com/google/zoekt/query"
 	"github.com/google/zoekt/shards"
+
+	git "github.com/libgit2/git2go"
 )
 
 func createSubmoduleRepo(dir string) error {
@@ -133,6 +139,153 @@ func TestTreeToFiles(t *testing.T) {
 	}
 }
 
+// createNestedSubmoduleRepo creates adir, which has bdir as
+// submodule bname, which has cdir as submodule cname. cdir has adir as
+// submodule aname, closing a cycle.
+func createNestedSubmoduleRepo(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	script := `for d in adir bdir cdir; do
+  mkdir $d
+  (cd $d && git init && echo $d > $d-file && git add $d-file && git commit -am $d)
+done
+(cd cdir && git -c protocol.file.allow=always submodule add --name aname -- ../adir aname && git commit -am amod)
+(cd bdir && git -c protocol.file.allow=always submodule add --name cname -- ../cdir cname && git commit -am cmod)
+(cd adir && git -c protocol.file.allow=always submodule add --name bname -- ../bdir bname && git commit -am bmod)
+
+mkdir gerrit.googlesource.com
+for d in adir bdir cdir; do
+  git clone --bare $d gerrit.googlesource.com/$d.git
+done
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("execution error: %v, output %s", err, out)
+	}
+	return nil
+}
+
+func TestWalkTreeMaxDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createNestedSubmoduleRepo(dir); err != nil {
+		t.Fatalf("createNestedSubmoduleRepo: %v", err)
+	}
+
+	cache := NewRepoCache(dir)
+	defer cache.Close()
+
+	aURL, _ := url.Parse("http://gerrit.googlesource.com/adir")
+	repo, err := cache.Open(aURL)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	obj, err := repo.RevparseSingle("HEAD:")
+	if err != nil {
+		t.Fatalf("HEAD tree: %v", err)
+	}
+	defer obj.Free()
+	tree, err := obj.AsTree()
+	if err != nil {
+		t.Fatalf("AsTree: %v", err)
+	}
+
+	for _, tc := range []struct {
+		maxDepth    int
+		wantFiles   []string
+		wantSkipped []string
+	}{
+		{
+			// The cycle back to adir is cut.
+			maxDepth:    0,
+			wantFiles:   []string{".gitmodules", "adir-file", "bname/.gitmodules", "bname/bdir-file", "bname/cname/.gitmodules", "bname/cname/cdir-file"},
+			wantSkipped: []string{"bname/cname/aname"},
+		},
+		{
+			maxDepth:    1,
+			wantFiles:   []string{".gitmodules", "adir-file", "bname/.gitmodules", "bname/bdir-file"},
+			wantSkipped: []string{"bname/cname"},
+		},
+	} {
+		w, err := walkTree(repo, tree, aURL.String(), cache, false, tc.maxDepth, nil)
+		if err != nil {
+			t.Fatalf("walkTree: %v", err)
+		}
+
+		var files []string
+		for k := range w.tree {
+			files = append(files, k.FullPath())
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, tc.wantFiles) {
+			t.Errorf("maxDepth %d: got files %v, want %v", tc.maxDepth, files, tc.wantFiles)
+		}
+
+		var skipped []string
+		for p := range w.skippedSubRepos {
+			skipped = append(skipped, p)
+			if _, ok := w.subRepoVersions[p]; !ok {
+				t.Errorf("maxDepth %d: no version for skipped %s", tc.maxDepth, p)
+			}
+		}
+		sort.Strings(skipped)
+		if !reflect.DeepEqual(skipped, tc.wantSkipped) {
+			t.Errorf("maxDepth %d: got skipped %v, want %v", tc.maxDepth, skipped, tc.wantSkipped)
+		}
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "gerrit.googlesource.com", "adir.git"),
+		RepositoryDescription: zoekt.Repository{
+			Name: "adir",
+			URL:  aURL.String(),
+		},
+	}
+	buildOpts.SetDefaults()
+	opts := Options{
+		RepoCacheDir:      dir,
+		BuildOptions:      buildOpts,
+		BranchPrefix:      "refs/heads/",
+		Branches:          []string{"master"},
+		Submodules:        true,
+		MaxSubmoduleDepth: 1,
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	results, err := searcher.List(context.Background(), &query.Repo{Pattern: ""})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(results.Repos) != 1 {
+		t.Fatalf("got %d repos, want 1", len(results.Repos))
+	}
+	sub := results.Repos[0].Repository.SubRepoMap["bname/cname"]
+	if sub == nil || sub.URL != "http://gerrit.googlesource.com/cdir" {
+		t.Errorf("got sub-repository bname/cname %+v, want cdir", sub)
+	}
+}
+
 func TestSubmoduleIndex(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -204,6 +357,28 @@ func TestSubmoduleIndex(t *testing.T) {
 	} else if f := results.Files[0]; f.Version == subVersion {
 		t.Errorf("version in super repo matched version is subrepo.")
 	}
+
+	shardNames := opts.BuildOptions.FindAllShards()
+	if len(shardNames) != 1 {
+		t.Fatalf("got shards %v, want 1", shardNames)
+	}
+	subs, err := ReadSubRepositories(shardNames[0])
+	if err != nil {
+		t.Fatalf("ReadSubRepositories: %v", err)
+	}
+	if sub := subs["bname"]; sub == nil {
+		t.Errorf("got sub-repositories %v, want bname", subs)
+	} else {
+		if sub.Name != "gerrit.googlesource.com/bdir" {
+			t.Errorf("got name %q, want gerrit.googlesource.com/bdir", sub.Name)
+		}
+		if want := []zoekt.RepositoryBranch{{Name: "master", Version: subVersion}}; !reflect.DeepEqual(sub.Branches, want) {
+			t.Errorf("got branches %v, want %v", sub.Branches, want)
+		}
+	}
+	if top := subs[""]; top == nil || top.Name != "gerrit.googlesource.com/adir" {
+		t.Errorf("got top-level repository %+v, want gerrit.googlesource.com/adir", top)
+	}
 }
 
 func TestAllowMissingBranch(t *testing.T) {
@@ -303,7 +478,6 @@ func TestBranchWildcard(t *testing.T) {
 		BuildOptions: buildOpts,
 		BranchPrefix: "refs/heads",
 		Branches:     []string{"branchdir/*"},
-		Submodules:   true,
 		Incremental:  true,
 	}
 	if err := IndexGitRepo(opts); err != nil {
@@ -363,3 +537,2199 @@ func TestSkipSubmodules(t *testing.T) {
 		t.Fatalf("IndexGitRepo: %v", err)
 	}
 }
+
+func TestIndexGitTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	repoDir := filepath.Join(dir, "repo")
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		t.Fatalf("OpenRepository: %v", err)
+	}
+	defer repo.Free()
+
+	obj, err := repo.RevparseSingle("branchdir/a:")
+	if err != nil {
+		t.Fatalf("RevparseSingle: %v", err)
+	}
+	defer obj.Free()
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  repoDir,
+	}
+	buildOpts.SetDefaults()
+
+	if err := IndexGitTree(repo, *obj.Id(), zoekt.Repository{Name: "repo"}, buildOpts); err != nil {
+		t.Fatalf("IndexGitTree: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	rlist, err := searcher.List(context.Background(), &query.Repo{Pattern: ""})
+	if err != nil {
+		t.Fatalf("List(): %v", err)
+	}
+	if len(rlist.Repos) != 1 {
+		t.Fatalf("got %v, want 1 result", rlist.Repos)
+	}
+	want := []zoekt.RepositoryBranch{{Name: "HEAD", Version: obj.Id().String()}}
+	if got := rlist.Repos[0].Repository.Branches; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+
+	results, err := searcher.Search(context.Background(), &query.Substring{Pattern: "acont"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results.Files) != 1 {
+		t.Errorf("got %v, want 1 file", results.Files)
+	}
+}
+
+func TestOpenRepositoryNoSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir outer
+cd outer
+git init
+mkdir plain
+echo plain > plain/file
+git add plain/file
+git commit -am outermsg
+mkdir inner
+cd inner
+git init
+echo inner > file
+git add file
+git commit -am innermsg
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("setup: %v: %s", err, out)
+	}
+
+	outer := filepath.Join(dir, "outer")
+	inner := filepath.Join(outer, "inner")
+	plain := filepath.Join(outer, "plain")
+
+	for _, tc := range []struct {
+		dir      string
+		noSearch bool
+		want     string
+	}{
+		{inner, true, inner},
+		{inner, false, inner},
+		{plain, false, outer},
+		{plain, true, ""},
+	} {
+		repo, err := openRepository(tc.dir, tc.noSearch)
+		if tc.want == "" {
+			if err == nil {
+				repo.Free()
+				t.Errorf("openRepository(%s, %v): got %s, want error", tc.dir, tc.noSearch, repo.Workdir())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("openRepository(%s, %v): %v", tc.dir, tc.noSearch, err)
+			continue
+		}
+		if got := filepath.Clean(repo.Workdir()); got != tc.want {
+			t.Errorf("openRepository(%s, %v): got %s, want %s", tc.dir, tc.noSearch, got, tc.want)
+		}
+		repo.Free()
+	}
+}
+
+func TestOnDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createSubmoduleRepo(dir); err != nil {
+		t.Fatalf("createSubmoduleRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "gerrit.googlesource.com", "adir.git"),
+	}
+	buildOpts.SetDefaults()
+
+	var docs []DocumentMeta
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+		Submodules:   true,
+		RepoCacheDir: dir,
+		OnDocument: func(d DocumentMeta) {
+			docs = append(docs, d)
+		},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	var names []string
+	for _, d := range docs {
+		names = append(names, d.Name)
+		if !reflect.DeepEqual(d.Branches, []string{"master"}) {
+			t.Errorf("%s: got branches %v, want [master]", d.Name, d.Branches)
+		}
+		if d.Name == "bname/bfile" && d.SubRepositoryPath != "bname" {
+			t.Errorf("%s: got subrepo path %q, want bname", d.Name, d.SubRepositoryPath)
+		}
+		if d.Name == "afile" && d.Size != len("acont\n") {
+			t.Errorf("%s: got size %d, want %d", d.Name, d.Size, len("acont\n"))
+		}
+		// Without a .gitattributes, no language is known.
+		if d.Language != "" {
+			t.Errorf("%s: got language %q, want none", d.Name, d.Language)
+		}
+	}
+	want := []string{".gitmodules", "afile", "bname/bfile", "subdir/sub-file"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got documents %v, want %v", names, want)
+	}
+}
+
+func TestBranchCommits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	repoDir := filepath.Join(dir, "repo")
+	cmd := exec.Command("git", "rev-parse", "branchdir/a")
+	cmd.Dir = repoDir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	wantVersion := string(bytes.TrimSpace(out))
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  repoDir,
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions: buildOpts,
+		// Branches is ignored if BranchCommits is set.
+		Branches: []string{"nonexist"},
+		BranchCommits: []BranchCommit{
+			{Name: "release", Commit: wantVersion},
+		},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	rlist, err := searcher.List(context.Background(), &query.Repo{Pattern: ""})
+	if err != nil {
+		t.Fatalf("List(): %v", err)
+	}
+	if len(rlist.Repos) != 1 {
+		t.Fatalf("got %v, want 1 result", rlist.Repos)
+	}
+	want := []zoekt.RepositoryBranch{{Name: "release", Version: wantVersion}}
+	if got := rlist.Repos[0].Repository.Branches; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+}
+
+func TestBlobReaderWrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+		BlobReaderWrap: func(key FileKey, r io.Reader) io.Reader {
+			if key.Path == "afile" {
+				return io.MultiReader(strings.NewReader("wrapped "), r)
+			}
+			return r
+		},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	results, err := searcher.Search(context.Background(),
+		&query.Substring{Pattern: "wrapped acont"},
+		&zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal("Search", err)
+	}
+	if len(results.Files) != 1 || results.Files[0].FileName != "afile" {
+		t.Errorf("got %v, want afile", results.Files)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func TestBlobReaderWrapSizeMax(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo needle > small
+head -c 1000000 /dev/zero | tr '\0' x > large
+git add .
+git commit -m initial
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+		SizeMax:  1000,
+	}
+	buildOpts.SetDefaults()
+
+	read := map[string]*int64{}
+	var mu sync.Mutex
+	if err := IndexGitRepo(Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+		BlobReaderWrap: func(key FileKey, r io.Reader) io.Reader {
+			mu.Lock()
+			defer mu.Unlock()
+			n := new(int64)
+			read[key.Path] = n
+			return countingReader{r, n}
+		},
+	}); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	if n := read["large"]; n == nil {
+		t.Errorf("large blob was not read")
+	} else if *n > int64(buildOpts.SizeMax)+1 {
+		t.Errorf("read %d bytes of large blob, want at most %d", *n, buildOpts.SizeMax+1)
+	}
+
+	searcher, err := shards.NewShardedSearcher(buildOpts.IndexDir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher: %v", err)
+	}
+	defer searcher.Close()
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "xxx"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 0 {
+		t.Errorf("got %v, want oversized blob skipped", res.Files)
+	}
+}
+
+func TestArchivedFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("/bin/sh", "-euxc", "git init --bare repo.git && git --git-dir=repo.git config zoekt.archived true")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("setup: %v: %s", err, out)
+	}
+
+	var desc zoekt.Repository
+	if err := setTemplatesFromConfig(&desc, filepath.Join(dir, "repo.git"), ""); err != nil {
+		t.Fatalf("setTemplatesFromConfig: %v", err)
+	}
+	if !desc.Archived {
+		t.Errorf("got Archived false, want true")
+	}
+}
+
+func TestWebURLTypeFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `git init --bare repo.git
+git --git-dir=repo.git config zoekt.web-url https://git.example.com/org/repo
+git --git-dir=repo.git config zoekt.web-url-type gitea
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("setup: %v: %s", err, out)
+	}
+
+	var desc zoekt.Repository
+	if err := setTemplatesFromConfig(&desc, filepath.Join(dir, "repo.git"), ""); err != nil {
+		t.Fatalf("setTemplatesFromConfig: %v", err)
+	}
+	if want := "https://git.example.com/org/repo/src/commit/{{.Version}}/{{.Path}}"; desc.FileURLTemplate != want {
+		t.Errorf("got FileURLTemplate %q, want %q", desc.FileURLTemplate, want)
+	}
+}
+
+func TestTemplatesFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `git init --bare repo.git
+git --git-dir=repo.git config zoekt.web-url https://git.example.com/org/repo
+git --git-dir=repo.git config zoekt.web-url-type gitea
+git --git-dir=repo.git config zoekt.file-url-template 'https://viewer.example.com/repo/{{.Version}}/{{.Path}}'
+git --git-dir=repo.git config zoekt.line-fragment-template 'line{{.LineNumber}}'
+git --git-dir=repo.git config zoekt.commit-url-template ''
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("setup: %v: %s", err, out)
+	}
+
+	var desc zoekt.Repository
+	if err := setTemplatesFromConfig(&desc, filepath.Join(dir, "repo.git"), ""); err != nil {
+		t.Fatalf("setTemplatesFromConfig: %v", err)
+	}
+	want := zoekt.Repository{
+		URL:                  "https://git.example.com/org/repo",
+		FileURLTemplate:      "https://viewer.example.com/repo/{{.Version}}/{{.Path}}",
+		LineFragmentTemplate: "line{{.LineNumber}}",
+		// The empty value leaves the gitea template.
+		CommitURLTemplate: "https://git.example.com/org/repo/commit/{{.Version}}",
+	}
+	if !reflect.DeepEqual(desc, want) {
+		t.Errorf("got %+v, want %+v", desc, want)
+	}
+}
+
+func TestConfigSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `git init --bare repo.git
+git --git-dir=repo.git config zoekt.name example.com/default
+git --git-dir=repo.git config zoekt-team-a.name example.com/team-a
+git --git-dir=repo.git config zoekt-team-a.web-url https://git.example.com/org/repo
+git --git-dir=repo.git config zoekt-team-a.web-url-type gitea
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("setup: %v: %s", err, out)
+	}
+
+	var desc zoekt.Repository
+	if err := setTemplatesFromConfig(&desc, filepath.Join(dir, "repo.git"), "zoekt-team-a"); err != nil {
+		t.Fatalf("setTemplatesFromConfig: %v", err)
+	}
+	if want := "example.com/team-a"; desc.Name != want {
+		t.Errorf("got Name %q, want %q", desc.Name, want)
+	}
+	if want := "https://git.example.com/org/repo/src/commit/{{.Version}}/{{.Path}}"; desc.FileURLTemplate != want {
+		t.Errorf("got FileURLTemplate %q, want %q", desc.FileURLTemplate, want)
+	}
+
+	desc = zoekt.Repository{}
+	if err := setTemplatesFromConfig(&desc, filepath.Join(dir, "repo.git"), ""); err != nil {
+		t.Fatalf("setTemplatesFromConfig: %v", err)
+	}
+	if want := "example.com/default"; desc.Name != want || desc.FileURLTemplate != "" {
+		t.Errorf("got %+v, want only Name %q", desc, want)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Errorf("SelfTest: %v", err)
+	}
+}
+
+func TestBranchNameMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions:  buildOpts,
+		BranchPrefix:  "refs/heads/",
+		Branches:      []string{"master", "branchdir/a"},
+		BranchNameMap: map[string]string{"master": "production"},
+		Incremental:   true,
+	}
+	if _, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	var got []string
+	for _, b := range opts.BuildOptions.IndexVersions() {
+		got = append(got, b.Name)
+	}
+	if want := []string{"production", "branchdir/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+
+	if skipped, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	} else if !skipped {
+		t.Errorf("second incremental run was not skipped")
+	}
+
+	opts.BranchNameMap["branchdir/a"] = "production"
+	if _, err := indexGitRepo(opts); err == nil {
+		t.Errorf("got no error for duplicate display name")
+	}
+
+	// A display name that moves to another branch at the same
+	// commit changes the index.
+	cmd := exec.Command("git", "branch", "release", "master")
+	cmd.Dir = buildOpts.RepoDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git branch: %v, output %s", err, out)
+	}
+	opts.Branches = []string{"master"}
+	opts.BranchNameMap = map[string]string{"master": "production"}
+	if _, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	opts.Branches = []string{"release"}
+	opts.BranchNameMap = map[string]string{"release": "production"}
+	if skipped, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	} else if skipped {
+		t.Errorf("run with production on another branch was skipped")
+	}
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher: %v", err)
+	}
+	defer searcher.Close()
+	rlist, err := searcher.List(context.Background(), &query.Repo{Pattern: ""})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rlist.Repos) != 1 {
+		t.Fatalf("got %d repos, want 1", len(rlist.Repos))
+	}
+	if got, want := rlist.Repos[0].Repository.BranchRefs, map[string]string{"production": "release"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branch refs %v, want %v", got, want)
+	}
+}
+
+func TestExcludeBranches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions:    buildOpts,
+		BranchPrefix:    "refs/heads/",
+		Branches:        []string{"master", "branchdir/*", "c"},
+		ExcludeBranches: []string{"branchdir/b", "c", "*/x"},
+	}
+	if _, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	var got []string
+	for _, b := range opts.BuildOptions.IndexVersions() {
+		got = append(got, b.Name)
+	}
+	if want := []string{"master", "branchdir/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+}
+
+func TestTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo v1 > afile
+git add afile
+git commit -am v1
+git tag v1.0
+echo v2 > afile
+git commit -am v2
+git tag -a v2.0 -m "release v2"
+git tag master
+echo v3 > afile
+git commit -am v3
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+		Tags:         []string{"v*", "master"},
+	}
+	if _, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	var got []string
+	for _, b := range opts.BuildOptions.IndexVersions() {
+		got = append(got, b.Name)
+	}
+	if want := []string{"master", "v1.0", "v2.0", "tags/master"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	for content, want := range map[string][]string{
+		"v1": {"v1.0"},
+		"v2": {"tags/master", "v2.0"},
+		"v3": {"master"},
+	} {
+		res, err := searcher.Search(context.Background(),
+			&query.Substring{Pattern: content, Content: true},
+			&zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", content, err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("%s: got %d files, want 1", content, len(res.Files))
+		}
+		got := res.Files[0].Branches
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got branches %v, want %v", content, got, want)
+		}
+	}
+}
+
+func TestRefPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo base > afile
+git add afile
+git commit -am base
+echo patchset1 > afile
+git commit -am change
+git update-ref refs/changes/34/1234/1 HEAD
+echo patchset2 > afile
+git commit --amend -am change
+git update-ref refs/changes/34/1234/2 HEAD
+git update-ref refs/changes/34/1234/meta HEAD~1
+git update-ref refs/pull/7/head HEAD
+git reset --hard HEAD~1
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		RefPrefixes:  []string{"refs/changes/"},
+		Branches:     []string{"HEAD", `re:refs/changes/\d+/\d+/\d+`},
+	}
+	if _, err := indexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	var got []string
+	for _, b := range opts.BuildOptions.IndexVersions() {
+		got = append(got, b.Name)
+	}
+	if want := []string{"refs/heads/master", "refs/changes/34/1234/1", "refs/changes/34/1234/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+}
+
+func TestRespectGitattributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+mkdir -p vendor/lib api
+echo needle > main.go
+echo needle > vendor/lib/lib.go
+echo needle > api/api.pb.go
+printf '/vendor export-ignore\n*.pb.go linguist-generated\n*.pb.go linguist-language=Protobuf\n' > .gitattributes
+git add .
+git commit -am msg
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions:         buildOpts,
+		BranchPrefix:         "refs/heads/",
+		Branches:             []string{"master"},
+		RespectGitattributes: true,
+	}
+	languages := map[string]string{}
+	opts.OnDocument = func(d DocumentMeta) {
+		languages[d.Name] = d.Language
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	if want := map[string]string{".gitattributes": "", "api/api.pb.go": "Protobuf", "main.go": ""}; !reflect.DeepEqual(languages, want) {
+		t.Errorf("got languages %v, want %v", languages, want)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	for skip, want := range map[bool][]string{
+		false: {"api/api.pb.go", "main.go"},
+		true:  {"main.go"},
+	} {
+		res, err := searcher.Search(context.Background(),
+			&query.Substring{Pattern: "needle", Content: true},
+			&zoekt.SearchOptions{SkipGenerated: skip})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SkipGenerated %v: got %v, want %v", skip, got, want)
+		}
+	}
+}
+
+type fakeTracer struct {
+	spans []string
+}
+
+func (t *fakeTracer) StartSpan(name string, attrs map[string]interface{}) Span {
+	if b, ok := attrs["branch"]; ok {
+		name += ":" + b.(string)
+	}
+	t.spans = append(t.spans, name)
+	return noopSpan{}
+}
+
+func TestTracer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	tracer := &fakeTracer{}
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master", "branchdir/a"},
+		Tracer:       tracer,
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	want := []string{
+		SpanResolveRefs,
+		SpanWalkTree + ":master",
+		SpanWalkTree + ":branchdir/a",
+		SpanAddFiles,
+		SpanFinish,
+	}
+	if !reflect.DeepEqual(tracer.spans, want) {
+		t.Errorf("got spans %v, want %v", tracer.spans, want)
+	}
+}
+
+func TestReindexChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+	repoDir := filepath.Join(dir, "repo")
+
+	index := func(name string, prevShard string) (string, int) {
+		buildOpts := build.Options{
+			IndexDir: filepath.Join(dir, name),
+			RepoDir:  repoDir,
+		}
+		buildOpts.SetDefaults()
+
+		reads := 0
+		opts := Options{
+			BuildOptions: buildOpts,
+			BranchPrefix: "refs/heads/",
+			Branches:     []string{"master", "branchdir/a"},
+			BlobReaderWrap: func(key FileKey, r io.Reader) io.Reader {
+				reads++
+				return r
+			},
+		}
+		if prevShard == "" {
+			err = IndexGitRepo(opts)
+		} else {
+			err = ReindexChanged(prevShard, opts)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		shards := opts.BuildOptions.FindAllShards()
+		if len(shards) != 1 {
+			t.Fatalf("%s: got shards %v, want 1", name, shards)
+		}
+		return shards[0], reads
+	}
+
+	old, _ := index("old", "")
+
+	script := `echo new > newfile
+echo changed >> subdir/sub-file
+git add newfile subdir/sub-file
+git commit -am change
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = repoDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	changed, reads := index("changed", old)
+	if reads != 2 {
+		t.Errorf("ReindexChanged read %d blobs, want 2", reads)
+	}
+
+	full, _ := index("full", "")
+	if diff, err := zoekt.DiffShards(full, changed); err != nil {
+		t.Fatalf("DiffShards: %v", err)
+	} else if !diff.Empty() {
+		t.Errorf("ReindexChanged differs from full rebuild:\n%s", diff)
+	}
+}
+
+func TestWalkTreePathFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createNestedSubmoduleRepo(dir); err != nil {
+		t.Fatalf("createNestedSubmoduleRepo: %v", err)
+	}
+
+	cache := NewRepoCache(dir)
+	defer cache.Close()
+
+	aURL, _ := url.Parse("http://gerrit.googlesource.com/adir")
+	repo, err := cache.Open(aURL)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	obj, err := repo.RevparseSingle("HEAD:")
+	if err != nil {
+		t.Fatalf("HEAD tree: %v", err)
+	}
+	defer obj.Free()
+	tree, err := obj.AsTree()
+	if err != nil {
+		t.Fatalf("AsTree: %v", err)
+	}
+
+	for _, tc := range []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{
+			include: []string{"*-file"},
+			want:    []string{"adir-file", "bname/bdir-file", "bname/cname/cdir-file"},
+		},
+		{
+			// Patterns see the submodule prefix.
+			include: []string{"bname/"},
+			exclude: []string{"bname/cname/"},
+			want:    []string{"bname/.gitmodules", "bname/bdir-file"},
+		},
+		{
+			// An include inside an excluded directory has
+			// no effect.
+			include: []string{"adir-file", "bname/cname/cdir-file"},
+			exclude: []string{"bname/cname"},
+			want:    []string{"adir-file"},
+		},
+	} {
+		filter, err := newPathFilter(tc.include, tc.exclude)
+		if err != nil {
+			t.Fatalf("newPathFilter: %v", err)
+		}
+		w, err := walkTree(repo, tree, aURL.String(), cache, false, 0, filter)
+		if err != nil {
+			t.Fatalf("walkTree: %v", err)
+		}
+
+		var files []string
+		for k := range w.tree {
+			files = append(files, k.FullPath())
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, tc.want) {
+			t.Errorf("include %v, exclude %v: got %v, want %v", tc.include, tc.exclude, files, tc.want)
+		}
+	}
+}
+
+func TestBlobID(t *testing.T) {
+	for content, want := range map[string]string{
+		"":        "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391",
+		"hello\n": "ce013625030ba8dba906f756967f9e9ca394464a",
+	} {
+		id := blobID([]byte(content))
+		if got := id.String(); got != want {
+			t.Errorf("blobID(%q): got %s, want %s", content, got, want)
+		}
+	}
+}
+
+func TestIndexConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	var shards []string
+	for _, n := range []int{0, 4} {
+		buildOpts := build.Options{
+			IndexDir: filepath.Join(dir, fmt.Sprintf("index%d", n)),
+			RepoDir:  filepath.Join(dir, "repo"),
+		}
+		buildOpts.SetDefaults()
+		opts := Options{
+			BuildOptions:     buildOpts,
+			BranchPrefix:     "refs/heads/",
+			Branches:         []string{"master", "branchdir/a"},
+			IndexConcurrency: n,
+		}
+		if err := IndexGitRepo(opts); err != nil {
+			t.Fatalf("IndexGitRepo(IndexConcurrency %d): %v", n, err)
+		}
+		shards = append(shards, opts.BuildOptions.FindAllShards()...)
+	}
+	if len(shards) != 2 {
+		t.Fatalf("got shards %v, want 2", shards)
+	}
+
+	if diff, err := zoekt.DiffShards(shards[0], shards[1]); err != nil {
+		t.Fatalf("DiffShards: %v", err)
+	} else if !diff.Empty() {
+		t.Errorf("concurrent indexing differs:\n%s", diff)
+	}
+}
+
+func TestIncrementalReusesBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+	repoDir := filepath.Join(dir, "repo")
+
+	index := func(name string, fingerprint string) (string, int) {
+		buildOpts := build.Options{
+			IndexDir:         filepath.Join(dir, name),
+			RepoDir:          repoDir,
+			FingerprintExtra: []byte(fingerprint),
+		}
+		buildOpts.SetDefaults()
+
+		reads := 0
+		opts := Options{
+			BuildOptions: buildOpts,
+			BranchPrefix: "refs/heads/",
+			Branches:     []string{"master", "branchdir/a"},
+			Incremental:  true,
+			BlobReaderWrap: func(key FileKey, r io.Reader) io.Reader {
+				reads++
+				return r
+			},
+		}
+		if err := IndexGitRepo(opts); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		shards := opts.BuildOptions.FindAllShards()
+		if len(shards) != 1 {
+			t.Fatalf("%s: got shards %v, want 1", name, shards)
+		}
+		return shards[0], reads
+	}
+
+	index("incremental", "")
+
+	script := `echo new > newfile
+echo changed >> subdir/sub-file
+git add newfile subdir/sub-file
+git commit -am change
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = repoDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	changed, reads := index("incremental", "")
+	if reads != 2 {
+		t.Errorf("incremental update read %d blobs, want 2", reads)
+	}
+
+	full, all := index("full", "")
+	if diff, err := zoekt.DiffShards(full, changed); err != nil {
+		t.Fatalf("DiffShards: %v", err)
+	} else if !diff.Empty() {
+		t.Errorf("incremental update differs from full rebuild:\n%s", diff)
+	}
+
+	// A different fingerprint means the content may have been
+	// produced differently, so nothing is reused.
+	if _, reads := index("incremental", "other"); reads != all {
+		t.Errorf("got %d reads with a new fingerprint, want %d", reads, all)
+	}
+}
+
+func TestSignedBranch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The signature is not verified, so a commit object with a
+	// gpgsig header is enough.
+	script := `git init repo
+cd repo
+echo content > file
+git add file
+git commit -m unsigned
+tree=$(git rev-parse HEAD^{tree})
+signed=$(printf 'tree %s\nauthor A <a@example.com> 1500000000 +0000\ncommitter A <a@example.com> 1500000000 +0000\ngpgsig -----BEGIN PGP SIGNATURE-----\n \n iQEzBAABCAAdFiEE\n -----END PGP SIGNATURE-----\n\nsigned\n' $tree | git hash-object -t commit -w --stdin)
+git branch signed $signed
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master", "signed"},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher: %v", err)
+	}
+	defer searcher.Close()
+
+	rlist, err := searcher.List(context.Background(), &query.Repo{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rlist.Repos) != 1 {
+		t.Fatalf("got %d repos, want 1", len(rlist.Repos))
+	}
+	if got, want := rlist.Repos[0].Repository.SignedBranches, map[string]bool{"signed": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got signed branches %v, want %v", got, want)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+	// afile on master has 12 bytes.
+	buildOpts.SizeMax = 10
+
+	summary, err := DryRunGitRepo(Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master", "branchdir/a"},
+	})
+	if err != nil {
+		t.Fatalf("DryRunGitRepo: %v", err)
+	}
+
+	want := &DryRunSummary{
+		Files: 2,
+		Bytes: 15,
+		TooLarge: []DocumentMeta{{
+			Name:     "afile",
+			Branches: []string{"master"},
+			Size:     12,
+		}},
+		Branches: map[string]*DryRunBranch{
+			"master":      {Files: 1, Bytes: 9, TooLarge: 1},
+			"branchdir/a": {Files: 2, Bytes: 15},
+		},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("got %v, want %v", summary, want)
+	}
+
+	if fs := buildOpts.FindAllShards(); len(fs) != 0 {
+		t.Errorf("dry run wrote shards %v", fs)
+	}
+}
+
+func TestIndexSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+mkdir subdir
+echo realcontent > subdir/real
+ln -s subdir/real alias
+ln -s alias chain
+ln -s subdir dirlink
+ln -s ../outside outside
+ln -s missing dangling
+ln -s loop2 loop1
+ln -s loop1 loop2
+git add .
+git commit -m links
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	for _, index := range []bool{false, true} {
+		indexDir := filepath.Join(dir, fmt.Sprintf("index-%v", index))
+		buildOpts := build.Options{
+			IndexDir: indexDir,
+			RepoDir:  filepath.Join(dir, "repo"),
+		}
+		buildOpts.SetDefaults()
+
+		var names []string
+		opts := Options{
+			BuildOptions:  buildOpts,
+			BranchPrefix:  "refs/heads/",
+			Branches:      []string{"master"},
+			IndexSymlinks: index,
+			OnDocument: func(d DocumentMeta) {
+				names = append(names, d.Name)
+			},
+		}
+		if err := IndexGitRepo(opts); err != nil {
+			t.Fatalf("IndexGitRepo: %v", err)
+		}
+		sort.Strings(names)
+
+		want := []string{"subdir/real"}
+		if index {
+			want = []string{"alias", "chain", "subdir/real"}
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("IndexSymlinks %v: got documents %v, want %v", index, names, want)
+		}
+
+		searcher, err := shards.NewShardedSearcher(indexDir)
+		if err != nil {
+			t.Fatalf("NewShardedSearcher: %v", err)
+		}
+		// Link targets are not content.
+		res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "subdir", Content: true}, &zoekt.SearchOptions{})
+		searcher.Close()
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != 0 {
+			t.Errorf("IndexSymlinks %v: link target found in %v", index, res.Files)
+		}
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo needle > plain
+echo needle > script
+chmod +x script
+ln -s plain link
+git add .
+git commit -m modes
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir := filepath.Join(dir, "index")
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+	opts := Options{
+		BuildOptions:  buildOpts,
+		BranchPrefix:  "refs/heads/",
+		Branches:      []string{"master"},
+		IndexSymlinks: true,
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher: %v", err)
+	}
+	defer searcher.Close()
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle", Content: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+
+	got := map[string]uint32{}
+	for _, f := range res.Files {
+		got[f.FileName] = f.Mode
+	}
+	want := map[string]uint32{
+		"plain":  uint32(git.FilemodeBlob),
+		"script": uint32(git.FilemodeBlobExecutable),
+		"link":   uint32(git.FilemodeLink),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got modes %v, want %v", got, want)
+	}
+}
+
+func TestIndexCommitMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo acont > afile
+git add afile
+git commit -am "initial import"
+git branch old
+echo more >> afile
+git commit -am "fix memory leak in the parser"
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir := filepath.Join(dir, "index")
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+	opts := Options{
+		BuildOptions:        buildOpts,
+		BranchPrefix:        "refs/heads/",
+		Branches:            []string{"master", "old"},
+		Incremental:         true,
+		IndexCommitMessages: true,
+	}
+
+	search := func(pattern string) []zoekt.FileMatch {
+		searcher, err := shards.NewShardedSearcher(indexDir)
+		if err != nil {
+			t.Fatalf("NewShardedSearcher: %v", err)
+		}
+		defer searcher.Close()
+		res, err := searcher.Search(context.Background(), &query.Substring{Pattern: pattern, Content: true}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		return res.Files
+	}
+
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	if got := search("memory leak"); len(got) != 1 || got[0].FileName != commitMessagesFile || !reflect.DeepEqual(got[0].Branches, []string{"master"}) {
+		t.Errorf("got %v, want %s on master", got, commitMessagesFile)
+	}
+	if got := search("initial import"); len(got) != 2 {
+		t.Errorf("got %v, want the commit log of both branches", got)
+	}
+
+	// A new head must replace the log.
+	cmd = exec.Command("/bin/sh", "-euxc", `git commit --allow-empty -m "add retry loop"`)
+	cmd.Dir = filepath.Join(dir, "repo")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	if got := search("retry loop"); len(got) != 1 || got[0].FileName != commitMessagesFile {
+		t.Errorf("after new commit: got %v, want %s", got, commitMessagesFile)
+	}
+}
+
+func TestSinceCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo same > same
+echo old > changed
+echo gone > removed
+git add .
+git commit -m base
+git tag base
+echo new > changed
+echo added > added
+git rm removed
+git add .
+git commit -m delta
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	var names []string
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+		SinceCommit:  "base",
+		OnDocument: func(d DocumentMeta) {
+			names = append(names, d.Name)
+		},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	sort.Strings(names)
+	if want := []string{"added", "changed"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got documents %v, want %v", names, want)
+	}
+
+	fns := buildOpts.FindAllShards()
+	if len(fns) != 1 {
+		t.Fatalf("got shards %v, want 1", fns)
+	}
+	f, err := os.Open(fns[0])
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	iFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		t.Fatalf("NewIndexFile: %v", err)
+	}
+	defer iFile.Close()
+	repo, _, err := zoekt.ReadMetadata(iFile)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if repo.DeltaBase == "" || len(repo.Branches) != 1 || repo.Branches[0].Version == repo.DeltaBase {
+		t.Errorf("got DeltaBase %q and branches %v, want base and head commits", repo.DeltaBase, repo.Branches)
+	}
+	if want := map[string][]string{"master": {"removed"}}; !reflect.DeepEqual(repo.DeletedPaths, want) {
+		t.Errorf("got DeletedPaths %v, want %v", repo.DeletedPaths, want)
+	}
+}
+
+func TestDocumentFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createMultibranchRepo(dir); err != nil {
+		t.Fatalf("createMultibranchRepo: %v", err)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	var docs []DocumentMeta
+	contentCalls := map[string]int{}
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master", "branchdir/a"},
+		DocumentFilter: func(path string, size int64, content []byte) bool {
+			if content == nil {
+				if size <= 0 {
+					t.Errorf("%s: got size %d before reading", path, size)
+				}
+				return !strings.HasPrefix(path, "subdir/")
+			}
+			contentCalls[path]++
+			return !bytes.Contains(content, []byte("acont\nacont"))
+		},
+		OnDocument: func(d DocumentMeta) {
+			docs = append(docs, d)
+		},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	want := []DocumentMeta{{
+		Name:     "afile",
+		Branches: []string{"branchdir/a"},
+		Size:     6,
+	}}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got documents %+v, want %+v", docs, want)
+	}
+	if n := contentCalls["subdir/sub-file"]; n != 0 {
+		t.Errorf("filter saw the content of a file skipped by path %d times", n)
+	}
+}
+
+func TestComputeLastCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo needle one > old
+echo needle one > changed
+git add .
+git commit -m first
+git tag first
+echo needle two > changed
+git add .
+git commit -m second
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	commits := map[string]string{}
+	for _, rev := range []string{"first", "master"} {
+		cmd := exec.Command("git", "rev-parse", rev)
+		cmd.Dir = filepath.Join(dir, "repo")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("rev-parse %s: %v", rev, err)
+		}
+		commits[rev] = strings.TrimSpace(string(out))
+	}
+
+	indexDir := filepath.Join(dir, "index")
+	buildOpts := build.Options{
+		IndexDir: indexDir,
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions:      buildOpts,
+		BranchPrefix:      "refs/heads/",
+		Branches:          []string{"master"},
+		ComputeLastCommit: true,
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(),
+		&query.Substring{Pattern: "needle", Content: true},
+		&zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range res.Files {
+		got[f.FileName] = f.LastCommit
+		if f.LastCommitTime.IsZero() {
+			t.Errorf("%s: got zero LastCommitTime", f.FileName)
+		}
+	}
+	want := map[string]string{
+		"old":     commits["first"],
+		"changed": commits["master"],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got last commits %v, want %v", got, want)
+	}
+}
+
+func TestComputeLastCommitFollowRenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo needle one > old
+echo needle one > other
+git add .
+git commit -m first
+git tag first
+echo needle two > other
+git commit -am second
+git mv old renamed
+git commit -m rename
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	commits := map[string]string{}
+	for _, rev := range []string{"first", "master"} {
+		cmd := exec.Command("git", "rev-parse", rev)
+		cmd.Dir = filepath.Join(dir, "repo")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("rev-parse %s: %v", rev, err)
+		}
+		commits[rev] = strings.TrimSpace(string(out))
+	}
+
+	for _, follow := range []bool{false, true} {
+		indexDir := filepath.Join(dir, fmt.Sprintf("index-%v", follow))
+		buildOpts := build.Options{
+			IndexDir: indexDir,
+			RepoDir:  filepath.Join(dir, "repo"),
+		}
+		buildOpts.SetDefaults()
+
+		if err := IndexGitRepo(Options{
+			BuildOptions:      buildOpts,
+			BranchPrefix:      "refs/heads/",
+			Branches:          []string{"master"},
+			ComputeLastCommit: true,
+			FollowRenames:     follow,
+		}); err != nil {
+			t.Fatalf("IndexGitRepo: %v", err)
+		}
+
+		searcher, err := shards.NewShardedSearcher(indexDir)
+		if err != nil {
+			t.Fatalf("NewShardedSearcher: %v", err)
+		}
+		res, err := searcher.Search(context.Background(),
+			&query.Substring{Pattern: "renamed", FileName: true},
+			&zoekt.SearchOptions{})
+		searcher.Close()
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("FollowRenames %v: got %v, want 1 file", follow, res.Files)
+		}
+
+		// The rename is the last change, unless the history
+		// is followed to the commit that added the file.
+		want := commits["master"]
+		if follow {
+			want = commits["first"]
+		}
+		if got := res.Files[0].LastCommit; got != want {
+			t.Errorf("FollowRenames %v: got last commit %s, want %s", follow, got, want)
+		}
+	}
+}
+
+func TestIndexGitRepos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `for r in svc-a svc-b; do
+  mkdir $r
+  (cd $r && git init && echo "needle in $r" > main.go && git add . && git commit -m initial)
+done
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	indexDir := filepath.Join(dir, "index")
+	buildOpts := build.Options{
+		IndexDir:              indexDir,
+		RepositoryDescription: zoekt.Repository{Name: "services"},
+	}
+	buildOpts.SetDefaults()
+
+	var members []Options
+	for _, name := range []string{"svc-a", "svc-b"} {
+		members = append(members, Options{
+			BuildOptions: build.Options{
+				RepoDir: filepath.Join(dir, name),
+				RepositoryDescription: zoekt.Repository{
+					Name:            name,
+					FileURLTemplate: "https://example.com/" + name + "/{{.Path}}",
+				},
+			},
+			BranchPrefix: "refs/heads/",
+			Branches:     []string{"master"},
+		})
+	}
+	if err := IndexGitRepos(Options{BuildOptions: buildOpts}, members); err != nil {
+		t.Fatalf("IndexGitRepos: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(indexDir)
+	if err != nil {
+		t.Fatal("NewShardedSearcher", err)
+	}
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(),
+		query.NewAnd(&query.Substring{Pattern: "needle"}, &query.Repo{Pattern: "svc-b"}),
+		&zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	f := res.Files[0]
+	if f.Repository != "services" || f.SubRepositoryName != "svc-b" || f.FileName != "svc-b/main.go" || f.Version == "" {
+		t.Errorf("got %+v, want svc-b/main.go in svc-b", f)
+	}
+	if got, want := res.RepoURLs["svc-b"], "https://example.com/svc-b/{{.Path}}"; got != want {
+		t.Errorf("got URL template %q, want %q", got, want)
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo content > file
+git add .
+git commit -m initial
+git symbolic-ref HEAD refs/heads/gone
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"HEAD"},
+	}
+	if err := IndexGitRepo(opts); err == nil {
+		t.Fatalf("IndexGitRepo succeeded with a missing HEAD")
+	}
+
+	var docs []DocumentMeta
+	opts.DefaultBranch = "master"
+	opts.OnDocument = func(d DocumentMeta) {
+		docs = append(docs, d)
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Branches, []string{"master"}) {
+		t.Errorf("got documents %+v, want file on master", docs)
+	}
+}
+
+func TestBranchDocuments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo shared > shared
+git add .
+git commit -m initial
+git branch dev
+echo master > master-only
+git add .
+git commit -m master
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	var b Batch
+	if err := b.Index(Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master", "dev", "release-*"},
+	}); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	want := map[string]int{"master": 2, "dev": 1}
+	if got := b.Results[0].BranchDocuments; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branch documents %v, want %v", got, want)
+	}
+}
+
+func TestIndexNewIndexDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+echo needle > file
+git add .
+git commit -m initial
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "does", "not", "exist"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+	if err := IndexGitRepo(Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+	}); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	if len(buildOpts.FindAllShards()) != 1 {
+		t.Errorf("got shards %v, want 1", buildOpts.FindAllShards())
+	}
+}
+
+func TestIndexDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `for r in a b; do
+  mkdir $r
+  (cd $r && git init && echo $r > file && git add . && git commit -m $r)
+done
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+	}
+	buildOpts.SetDefaults()
+	opts := Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+	}
+	dirs := []string{
+		filepath.Join(dir, "a", ".git"),
+		filepath.Join(dir, "missing"),
+		filepath.Join(dir, "b", ".git"),
+	}
+
+	var b Batch
+	results := b.IndexDirs(opts, dirs, time.Minute)
+	if len(results) != len(dirs) {
+		t.Fatalf("got %d results, want %d", len(results), len(dirs))
+	}
+	for i, r := range results {
+		if r.RepoDir != dirs[i] {
+			t.Errorf("result %d: got dir %s, want %s", i, r.RepoDir, dirs[i])
+		}
+		if wantErr := i == 1; (r.Err != nil) != wantErr {
+			t.Errorf("%s: got error %v", r.RepoDir, r.Err)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		o := buildOpts
+		o.RepositoryDescription.Name = name
+		if len(o.FindAllShards()) == 0 {
+			t.Errorf("no shards for %s", name)
+		}
+	}
+
+	opts.BuildOptions.IndexDir = filepath.Join(dir, "index-timeout")
+	results = b.IndexDirs(opts, dirs[:1], time.Nanosecond)
+	if len(results) != 1 || results[0].Err != ErrTimeout {
+		t.Errorf("got results %v, want ErrTimeout", results)
+	}
+	if len(b.Results) != len(dirs)+1 {
+		t.Errorf("got %d batch results, want %d", len(b.Results), len(dirs)+1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts.BuildOptions.RepoDir = dirs[0]
+	opts.BuildOptions.RepositoryDescription.Name = "a"
+	if err := IndexGitRepoContext(ctx, opts); err != context.Canceled {
+		t.Errorf("IndexGitRepoContext: got %v, want %v", err, context.Canceled)
+	}
+	if fs := opts.BuildOptions.FindAllShards(); len(fs) != 0 {
+		t.Errorf("got shards %v after cancelling", fs)
+	}
+}
+
+func TestIndexAlternates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The objects of repo.git live in base, which it reaches
+	// through the relative alternate of reference.git.
+	script := `mkdir base
+cd base
+git init
+echo needle > file
+git add .
+git commit -m initial
+cd ..
+git clone --bare --shared base reference.git
+echo ../../base/.git/objects > reference.git/objects/info/alternates
+git clone --bare --shared reference.git repo.git
+git --git-dir=repo.git cat-file -e HEAD:file
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo.git"),
+	}
+	buildOpts.SetDefaults()
+	if err := IndexGitRepo(Options{
+		BuildOptions: buildOpts,
+		BranchPrefix: "refs/heads/",
+		Branches:     []string{"master"},
+	}); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+
+	searcher, err := shards.NewShardedSearcher(buildOpts.IndexDir)
+	if err != nil {
+		t.Fatalf("NewShardedSearcher: %v", err)
+	}
+	defer searcher.Close()
+
+	results, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results.Files) != 1 || results.Files[0].FileName != "file" {
+		t.Errorf("got %v, want file", results.Files)
+	}
+}
+
+func TestRespectGitignore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `mkdir repo
+cd repo
+git init
+mkdir -p gen sub
+echo needle > main.go
+echo needle > gen/out.go
+echo needle > sub/a.log
+echo needle > sub/keep.log
+echo needle > notes.txt
+echo needle > main.go.swp
+printf '/gen/\n*.log\n' > .gitignore
+printf '!keep.log\n' > sub/.gitignore
+git add -f .
+git commit -am msg
+echo notes.txt > .git/info/exclude
+echo '*.swp' > ../global-ignore
+git config core.excludesFile "$(dirname "$PWD")/global-ignore"
+`
+	cmd := exec.Command("/bin/sh", "-euxc", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("execution error: %v, output %s", err, out)
+	}
+
+	buildOpts := build.Options{
+		IndexDir: filepath.Join(dir, "index"),
+		RepoDir:  filepath.Join(dir, "repo"),
+	}
+	buildOpts.SetDefaults()
+
+	var got []string
+	opts := Options{
+		BuildOptions:     buildOpts,
+		BranchPrefix:     "refs/heads/",
+		Branches:         []string{"master"},
+		RespectGitignore: true,
+		OnDocument: func(d DocumentMeta) {
+			got = append(got, d.Name)
+		},
+	}
+	if err := IndexGitRepo(opts); err != nil {
+		t.Fatalf("IndexGitRepo: %v", err)
+	}
+	sort.Strings(got)
+	if want := []string{".gitignore", "main.go", "sub/.gitignore", "sub/keep.log"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+}
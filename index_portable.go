@@ -43,6 +43,22 @@ type indexData struct {
 	boundariesStart uint32
 	boundaries      []uint32
 
+	// contentSlots is the item of the file contents section that
+	// holds each document, and slotIndex the offsets of the items
+	// as given by relativeIndex. Boundaries are then offsets in
+	// the contents of the documents laid out back to back. Nil if
+	// each document has its own item.
+	contentSlots []uint32
+	slotIndex    []uint32
+
+	// compressedContents is the file contents section if its
+	// items are encoded; boundaries are then offsets in the
+	// decoded contents.
+	compressedContents *compoundSection
+
+	// postingsCodec is the codec of the content posting lists.
+	postingsCodec sectionCodec
+
 	// rune offsets for the file content boundaries
 	fileEndRunes []uint32
 
@@ -73,6 +89,24 @@ type indexData struct {
 	// Checksums for all the files, at 8-byte intervals
 	checksums []byte
 
+	// Encoded rank signals, see marshalRankSignals.
+	rankSignals []byte
+
+	// Last commits by document. Nil if the shard has none.
+	lastCommits map[uint32]lastCommit
+
+	// File modes by document. Nil if the shard has none.
+	fileModes []uint32
+
+	// Documents hidden by a later segment. Nil for plain shards.
+	tombstones map[uint32]bool
+
+	// Generated documents. Nil if the shard has none.
+	generated map[uint32]bool
+
+	// Languages by document. Nil if the shard has none.
+	languages []string
+
 	repoListEntry RepoListEntry
 }
 
@@ -113,11 +147,15 @@ func (d *indexData) memoryUse() int {
 	for _, a := range [][]uint32{
 		d.newlinesIndex, d.docSectionsIndex,
 		d.boundaries, d.fileNameIndex,
+		d.contentSlots, d.slotIndex,
 		d.runeOffsets, d.fileNameRuneOffsets,
 		d.fileEndRunes, d.fileNameEndRunes,
 	} {
 		sz += 4 * len(a)
 	}
+	if c := d.compressedContents; c != nil {
+		sz += 4 * (len(c.offsets) + len(c.sizes))
+	}
 	sz += 8 * len(d.fileBranchMasks)
 	sz += 12 * len(d.ngrams)
 	for _, v := range d.fileNameNgrams {
@@ -254,7 +292,10 @@ func (d *indexData) readPostings(ng ngram, caseSensitive, fileName bool) ([]uint
 			return nil, 0, err
 		}
 		sz += sec.sz
-		ps := fromDeltas(blob, nil)
+		ps, err := decodePostings(d.postingsCodec, blob, nil)
+		if err != nil {
+			return nil, 0, err
+		}
 		if len(ps) > 0 {
 			postings = append(postings, ps)
 		}
@@ -20,6 +20,7 @@ import (
 	"log"
 	"reflect"
 	"regexp/syntax"
+	"sort"
 	"strings"
 	"testing"
 	"unicode"
@@ -471,6 +472,27 @@ func TestSearchMatchAll(t *testing.T) {
 	}
 }
 
+func TestLineBounds(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("x")},
+		Document{Name: "f2", Content: []byte("line1\nline2\n\nbla")})
+	// --------------------------------------012345 678901 2 345
+	d := searcherForTest(t, b).(*indexData)
+
+	cp := contentProvider{id: d, stats: &Stats{}}
+	cp.setDocument(1)
+	for n, want := range map[int][2]int{
+		1: {0, 5},
+		2: {6, 11},
+		3: {12, 12},
+		4: {13, 16},
+	} {
+		if start, end := cp.lineBounds(n); start != want[0] || end != want[1] {
+			t.Errorf("line %d: got (%d, %d), want %v", n, start, end, want)
+		}
+	}
+}
+
 func TestSearchNewline(t *testing.T) {
 	b, err := NewIndexBuilder(nil)
 	if err != nil {
@@ -1174,6 +1196,67 @@ func TestSubRepo(t *testing.T) {
 	}
 }
 
+func TestMemberRepos(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name:     "combined",
+		Branches: []RepositoryBranch{{Name: "master", Version: "v1"}, {Name: "stable", Version: "v2"}},
+		SubRepoMap: map[string]*Repository{
+			"svc-a": {
+				Name:     "svc-a",
+				Branches: []RepositoryBranch{{Name: "master", Version: "a1"}, {Name: "stable", Version: "a2"}},
+			},
+			"svc-b": {
+				Name:     "svc-b",
+				Branches: []RepositoryBranch{{Name: "stable", Version: "b2"}},
+			},
+		},
+		Members: []string{"svc-a", "svc-b"},
+	},
+		Document{Name: "svc-a/main.go", Content: []byte("needle a"), SubRepositoryPath: "svc-a", Branches: []string{"master", "stable"}},
+		Document{Name: "svc-b/main.go", Content: []byte("needle b"), SubRepositoryPath: "svc-b", Branches: []string{"stable"}})
+
+	for _, c := range []struct {
+		q    query.Q
+		want []string
+	}{
+		{&query.Repo{Pattern: "combined"}, []string{"svc-a/main.go", "svc-b/main.go"}},
+		{&query.Repo{Pattern: "svc-b"}, []string{"svc-b/main.go"}},
+		{&query.Repo{Pattern: "svc"}, []string{"svc-a/main.go", "svc-b/main.go"}},
+		{&query.Not{Child: &query.Repo{Pattern: "svc-a"}}, []string{"svc-b/main.go"}},
+		{&query.Repo{Pattern: "nomatch"}, nil},
+	} {
+		res := searchForTest(t, b, query.NewAnd(&query.Substring{Pattern: "needle"}, c.q))
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle b"})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	if f := res.Files[0]; f.SubRepositoryName != "svc-b" || f.Version != "b2" {
+		t.Errorf("got repository %q version %q, want svc-b version b2", f.SubRepositoryName, f.Version)
+	}
+
+	searcher := searcherForTest(t, b)
+	defer searcher.Close()
+	for pattern, want := range map[string]int{"svc-a": 1, "nomatch": 0} {
+		l, err := searcher.List(context.Background(), &query.Repo{Pattern: pattern})
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(l.Repos) != want {
+			t.Errorf("List(%s): got %d repositories, want %d", pattern, len(l.Repos), want)
+		}
+	}
+}
+
 func TestSearchEither(t *testing.T) {
 	b := testIndexBuilder(t, nil,
 		Document{Name: "f1", Content: []byte("bla needle bla")},
@@ -1278,6 +1361,58 @@ func TestUnicodeVariableLength(t *testing.T) {
 	}
 }
 
+func TestUnicodeSimpleFolding(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "greek", Content: []byte("ΟΔΥΣΣΕΥΣ")},
+		Document{Name: "kelvin", Content: []byte("273 \u212Aelvin")},
+		Document{Name: "german", Content: []byte("STRASSE STRAẞE")},
+		Document{Name: "turkish", Content: []byte("abcİxyz")},
+		// Holds the middle ngrams of abcixyz more often, so
+		// the turkish document is only rejected by the
+		// content check.
+		Document{Name: "ngrams", Content: []byte("bcix ixy bcix ixy")},
+	)
+
+	for _, c := range []struct {
+		pattern string
+		want    []string
+	}{
+		// The final sigma folds like the other sigmas.
+		{"οδυσσευς", []string{"greek"}},
+		{"kelvin", []string{"kelvin"}},
+		// 'ß' only folds to the capital sharp s, not to "SS".
+		{"straße", []string{"german"}},
+		// The dotted capital I does not fold to 'i'.
+		{"abcixyz", nil},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: c.pattern, Content: true})
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.pattern, got, c.want)
+		}
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "kelvin", Content: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 match", res.Files)
+	}
+	f := res.Files[0].LineMatches[0].LineFragments[0]
+	if want := len("\u212Aelvin"); f.Offset != 4 || f.MatchLength != want {
+		t.Errorf("got match at %d size %d, want 4 size %d", f.Offset, f.MatchLength, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "straße", Content: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 match", res.Files)
+	}
+	if got := res.Files[0].LineMatches[0].LineFragments; len(got) != 1 || got[0].Offset != 8 {
+		t.Errorf("got fragments %+v, want one at 8", got)
+	}
+}
+
 func TestUnicodeFileStartOffsets(t *testing.T) {
 	unicode := "世界"
 	wat := "waaaaaat"
@@ -1504,3 +1639,57 @@ func printLineMatches(ms []LineMatch) string {
 
 	return strings.Join(ss, ", ")
 }
+
+func TestTruncateLongLines(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte(strings.Repeat("a", 100) + "needle" + strings.Repeat("b", 100) + "\nshort needle\n")})
+	b.SetTruncateLongLines(20)
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 2 {
+		t.Fatalf("got %v, want 1 file with 2 lines", res.Files)
+	}
+
+	var long, short LineMatch
+	for _, m := range res.Files[0].LineMatches {
+		if m.LineNumber == 1 {
+			long = m
+		} else {
+			short = m
+		}
+	}
+	if want := ellipsis + "aaaaaaaaaaneedlebbbb" + ellipsis; string(long.Line) != want {
+		t.Errorf("got line %q, want %q", long.Line, want)
+	}
+	if len(long.LineFragments) != 1 {
+		t.Fatalf("got fragments %v, want 1", long.LineFragments)
+	}
+	if f := long.LineFragments[0]; string(long.Line[f.LineOffset:f.LineOffset+f.MatchLength]) != "needle" || f.Offset != 100 {
+		t.Errorf("got fragment %+v", f)
+	}
+
+	if string(short.Line) != "short needle" {
+		t.Errorf("got line %q, want %q", short.Line, "short needle")
+	}
+}
+
+func TestSkipGenerated(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle")},
+		Document{Name: "f2", Content: []byte("needle"), Generated: true})
+
+	for skip, want := range map[bool][]string{
+		false: {"f1", "f2"},
+		true:  {"f1"},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{SkipGenerated: skip})
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SkipGenerated %v: got %v, want %v", skip, got, want)
+		}
+	}
+}
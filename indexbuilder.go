@@ -15,6 +15,7 @@
 package zoekt
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc64"
@@ -22,6 +23,7 @@ import (
 	"log"
 	"path/filepath"
 	"sort"
+	"time"
 	"unicode/utf8"
 )
 
@@ -62,7 +64,9 @@ func newPostingsBuilder() *postingsBuilder {
 	}
 }
 
-func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
+// newSearchableString adds data to the postings. It also returns the
+// number of distinct trigrams in data.
+func (s *postingsBuilder) newSearchableString(data []byte) (*searchableString, int) {
 	dest := searchableString{
 		data: data,
 	}
@@ -75,6 +79,7 @@ func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
 	i := 0
 
 	endRune := s.runeCount
+	distinct := 0
 	for len(data) > 0 {
 		c, sz := utf8.DecodeRune(data)
 		if sz > 1 {
@@ -96,8 +101,11 @@ func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
 		}
 
 		ng := runesToNGram(runeGram)
-		lastOff := s.lastOffsets[ng]
+		lastOff, seen := s.lastOffsets[ng]
 		newOff := endRune + uint32(runeIndex) - 2
+		if !seen || lastOff < endRune {
+			distinct++
+		}
 
 		m := binary.PutUvarint(buf[:], uint64(newOff-lastOff))
 		s.postings[ng] = append(s.postings[ng], buf[:m]...)
@@ -106,7 +114,7 @@ func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
 
 	s.endRunes = append(s.endRunes, s.runeCount)
 	s.endByte += dataSz
-	return &dest
+	return &dest, distinct
 }
 
 // IndexBuilder builds a single index shard.
@@ -119,6 +127,33 @@ type IndexBuilder struct {
 	branchMasks []uint64
 	subRepos    []uint32
 
+	// number of distinct content trigrams for each document.
+	trigramCounts []uint32
+
+	// ranking signals for each document; nil if it has none.
+	rankSignals []map[string]float64
+
+	// last commit of each document; empty if unknown.
+	lastCommits []lastCommit
+
+	// item of the file contents section for each document, and
+	// the first document of each item. Documents with the same
+	// content share an item.
+	contentSlots []uint32
+	slotDocs     []int
+
+	// content checksum => items with that checksum.
+	slotsByChecksum map[uint64][]uint32
+
+	// git file mode of each document; 0 if unknown.
+	fileModes []uint32
+
+	// whether each document is generated.
+	generated []bool
+
+	// language of each document; empty if unknown.
+	languages []string
+
 	contentPostings *postingsBuilder
 	namePostings    *postingsBuilder
 
@@ -127,6 +162,59 @@ type IndexBuilder struct {
 
 	// name to index.
 	subRepoIndices map[string]uint32
+
+	// limit for offset tables in bytes; 0 is DefaultMaxOffsetTableSize.
+	maxOffsetTableSize int
+
+	// stored in IndexMetadata.TruncateLongLines.
+	truncateLongLines int
+
+	// stored in IndexMetadata.Supersedes.
+	supersedes []string
+
+	// codec for the file contents section.
+	contentCodec sectionCodec
+
+	// codec for the posting list sections.
+	postingsCodec sectionCodec
+}
+
+// SetSupersedes records that the index is a segment, which hides the
+// named documents in the shard and segments it is appended to.
+func (b *IndexBuilder) SetSupersedes(names []string) {
+	b.supersedes = names
+}
+
+// SetTruncateLongLines records in the index that matched lines
+// longer than n bytes should be cut in search results.
+func (b *IndexBuilder) SetTruncateLongLines(n int) {
+	b.truncateLongLines = n
+}
+
+// SetCompressContent makes Write compress the content of each file
+// with zstd. Files that don't get smaller are stored as is.
+func (b *IndexBuilder) SetCompressContent(compress bool) {
+	b.contentCodec = codecNone
+	if compress {
+		b.contentCodec = codecZstd
+	}
+}
+
+// SetPackPostings makes Write store each posting list either as
+// varint deltas or bit-packed, whichever is smaller. Shards written
+// this way can't be read by versions that predate the option.
+func (b *IndexBuilder) SetPackPostings(pack bool) {
+	b.postingsCodec = codecNone
+	if pack {
+		b.postingsCodec = codecPostings
+	}
+}
+
+// SetMaxOffsetTableSize sets the limit on the size in bytes of a
+// single offset table in the index. Write fails if the limit is
+// exceeded. If n is 0, DefaultMaxOffsetTableSize is used.
+func (b *IndexBuilder) SetMaxOffsetTableSize(n int) {
+	b.maxOffsetTableSize = n
 }
 
 func (d *Repository) verify() error {
@@ -151,6 +239,7 @@ func NewIndexBuilder(r *Repository) (*IndexBuilder, error) {
 	b := &IndexBuilder{
 		contentPostings: newPostingsBuilder(),
 		namePostings:    newPostingsBuilder(),
+		slotsByChecksum: map[uint64][]uint32{},
 	}
 
 	if r == nil {
@@ -184,11 +273,19 @@ func (b *IndexBuilder) setRepository(desc *Repository) error {
 	}
 
 	b.repo = *desc
+	b.repo.BranchDocuments = map[string]int{}
+	b.repo.LanguageBytes = map[string]int64{}
 	repoCopy := *desc
 	repoCopy.SubRepoMap = nil
-
-	if b.repo.SubRepoMap == nil {
-		b.repo.SubRepoMap = map[string]*Repository{}
+	repoCopy.LanguageBytes = nil
+
+	// Copy the sub-repositories, so we can count their languages
+	// without modifying desc.
+	b.repo.SubRepoMap = make(map[string]*Repository, len(desc.SubRepoMap)+1)
+	for path, sub := range desc.SubRepoMap {
+		subCopy := *sub
+		subCopy.LanguageBytes = map[string]int64{}
+		b.repo.SubRepoMap[path] = &subCopy
 	}
 	b.repo.SubRepoMap[""] = &repoCopy
 
@@ -207,6 +304,32 @@ type Document struct {
 	Branches          []string
 	SubRepositoryPath string
 
+	// Language is the detected language of the content. If set,
+	// the content size is counted in Repository.LanguageBytes.
+	Language string
+
+	// Generated is set for generated files. Searches can leave
+	// these files out with SearchOptions.SkipGenerated. Generated
+	// files are not counted in Repository.LanguageBytes.
+	Generated bool
+
+	// RankSignals holds named inputs for ranking, such as commit
+	// recency or popularity. They are stored in the index, and can
+	// be read back with ReadRankSignals.
+	RankSignals map[string]float64
+
+	// LastCommit is the ID of the commit that last changed the
+	// file, and LastCommitTime its time, if known. They are
+	// returned in FileMatch. The time is stored with a resolution
+	// of seconds.
+	LastCommit     string
+	LastCommitTime time.Time
+
+	// Mode is the git file mode of the file, eg. 0100755 for an
+	// executable or 0120000 for a symlink, or 0 if unknown. It is
+	// returned in FileMatch.
+	Mode uint32
+
 	Symbols []DocumentSection
 }
 
@@ -226,8 +349,18 @@ const maxLineSize = 1000
 
 // IsText returns false if the given contents are probably not source texts.
 func IsText(content []byte) bool {
+	isText, _ := CheckText(content, maxTrigramCount)
+	return isText
+}
+
+// CheckText is like IsText, but rejects content with more than
+// maxTrigrams distinct trigrams. The distinct trigrams are counted in
+// the same pass that checks for binary data, so the count stops at
+// maxTrigrams+1. It returns whether the content is text, and the
+// number of distinct trigrams counted.
+func CheckText(content []byte, maxTrigrams int) (bool, int) {
 	if len(content) < ngramSize {
-		return true
+		return true, 0
 	}
 
 	trigrams := map[ngram]struct{}{}
@@ -237,7 +370,7 @@ func IsText(content []byte) bool {
 	var cur [3]rune
 	for len(content) > 0 {
 		if content[0] == 0 {
-			return false
+			return false, len(trigrams)
 		}
 		if content[0] == '\n' {
 			lineSize = 0
@@ -245,12 +378,12 @@ func IsText(content []byte) bool {
 			lineSize++
 		}
 		if lineSize > maxLineSize {
-			return false
+			return false, len(trigrams)
 		}
 
 		r, sz := utf8.DecodeRune(content)
 		if r == utf8.RuneError {
-			return false
+			return false, len(trigrams)
 		}
 		content = content[sz:]
 
@@ -261,12 +394,12 @@ func IsText(content []byte) bool {
 		}
 
 		trigrams[runesToNGram(cur)] = struct{}{}
-		if len(trigrams) > maxTrigramCount {
+		if len(trigrams) > maxTrigrams {
 			// probably not text.
-			return false
+			return false, len(trigrams)
 		}
 	}
-	return true
+	return true, len(trigrams)
 }
 
 func (b *IndexBuilder) populateSubRepoIndices() {
@@ -320,14 +453,34 @@ func (b *IndexBuilder) Add(doc Document) error {
 		}
 		mask |= m
 	}
+	for i, br := range b.repo.Branches {
+		if mask&(uint64(1)<<uint(i)) != 0 {
+			b.repo.BranchDocuments[br.Name]++
+		}
+	}
+
+	if doc.Language != "" && !doc.Generated {
+		repo := &b.repo
+		if doc.SubRepositoryPath != "" {
+			repo = b.repo.SubRepoMap[doc.SubRepositoryPath]
+		}
+		repo.LanguageBytes[doc.Language] += int64(len(doc.Content))
+	}
 
 	b.subRepos = append(b.subRepos, subRepoIdx)
 
 	hasher.Write(doc.Content)
-	docStr := b.contentPostings.newSearchableString(doc.Content)
+	b.contentSlots = append(b.contentSlots, b.contentSlot(hasher.Sum64(), doc.Content))
+	docStr, trigrams := b.contentPostings.newSearchableString(doc.Content)
 	b.contentStrings = append(b.contentStrings, docStr)
-
-	nameStr := b.namePostings.newSearchableString([]byte(doc.Name))
+	b.trigramCounts = append(b.trigramCounts, uint32(trigrams))
+	b.rankSignals = append(b.rankSignals, doc.RankSignals)
+	b.lastCommits = append(b.lastCommits, lastCommit{id: doc.LastCommit, time: doc.LastCommitTime})
+	b.fileModes = append(b.fileModes, doc.Mode)
+	b.generated = append(b.generated, doc.Generated)
+	b.languages = append(b.languages, doc.Language)
+
+	nameStr, _ := b.namePostings.newSearchableString([]byte(doc.Name))
 	b.nameStrings = append(b.nameStrings, nameStr)
 	b.docSections = append(b.docSections, doc.Symbols)
 	b.branchMasks = append(b.branchMasks, mask)
@@ -336,6 +489,47 @@ func (b *IndexBuilder) Add(doc Document) error {
 	return nil
 }
 
+// contentSlot returns the item of the file contents section that
+// stores content, with the given checksum, adding one if no earlier
+// document has the same content. It must be called before the
+// document is added to contentStrings.
+func (b *IndexBuilder) contentSlot(checksum uint64, content []byte) uint32 {
+	for _, s := range b.slotsByChecksum[checksum] {
+		if bytes.Equal(b.contentStrings[b.slotDocs[s]].data, content) {
+			return s
+		}
+	}
+	s := uint32(len(b.slotDocs))
+	b.slotDocs = append(b.slotDocs, len(b.contentStrings))
+	b.slotsByChecksum[checksum] = append(b.slotsByChecksum[checksum], s)
+	return s
+}
+
+// DocumentStat holds indexing statistics of a single document.
+type DocumentStat struct {
+	Name string
+
+	// Size is the number of content bytes.
+	Size int
+
+	// Trigrams is the number of distinct trigrams in the content.
+	Trigrams int
+}
+
+// DocumentStats returns statistics for the documents added so far,
+// in the order they were added.
+func (b *IndexBuilder) DocumentStats() []DocumentStat {
+	stats := make([]DocumentStat, 0, len(b.contentStrings))
+	for i, c := range b.contentStrings {
+		stats = append(stats, DocumentStat{
+			Name:     string(b.nameStrings[i].data),
+			Size:     len(c.data),
+			Trigrams: int(b.trigramCounts[i]),
+		})
+	}
+	return stats
+}
+
 func (b *IndexBuilder) branchMask(br string) uint64 {
 	for i, b := range b.repo.Branches {
 		if b.Name == br {
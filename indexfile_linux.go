@@ -17,34 +17,8 @@ package zoekt
 import (
 	"fmt"
 	"os"
-	"syscall"
 )
 
-type mmapedIndexFile struct {
-	name string
-	size uint32
-	data []byte
-}
-
-func (f *mmapedIndexFile) Read(off, sz uint32) ([]byte, error) {
-	if off+sz > uint32(len(f.data)) {
-		return nil, fmt.Errorf("out of bounds: %d, len %d", off+sz, len(f.data))
-	}
-	return f.data[off : off+sz], nil
-}
-
-func (f *mmapedIndexFile) Name() string {
-	return f.name
-}
-
-func (f *mmapedIndexFile) Size() (uint32, error) {
-	return f.size, nil
-}
-
-func (f *mmapedIndexFile) Close() {
-	syscall.Munmap(f.data)
-}
-
 // NewIndexFile returns a new index file. The index file takes
 // ownership of the passed in file, and may close it.
 func NewIndexFile(f *os.File) (IndexFile, error) {
@@ -64,8 +38,7 @@ func NewIndexFile(f *os.File) (IndexFile, error) {
 		size: uint32(sz),
 	}
 
-	rounded := (r.size + 4095) &^ 4095
-	r.data, err = syscall.Mmap(int(f.Fd()), 0, int(rounded), syscall.PROT_READ, syscall.MAP_SHARED)
+	r.data, err = mmapFile(f, r.size)
 	if err != nil {
 		return nil, err
 	}
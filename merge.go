@@ -0,0 +1,352 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// MergeShards combines the shards in files srcs into a single shard
+// in file dst. A shard holds one repository, so all sources must be
+// shards of the same repository at the same branch versions, as
+// written when a repository is split over several shards; use
+// MergeRepositories for shards of different repositories. Documents
+// with the same name, sub-repository and content are stored once,
+// with the union of their branches. Segments and DeltaBase shards
+// can't be merged. The posting lists and LanguageBytes are computed
+// again from the documents; shards from before format version 24
+// don't record the language of documents, so their files are not
+// counted.
+func MergeShards(dst string, srcs []string) error {
+	parts, err := openMergeSources(srcs)
+	if err != nil {
+		return err
+	}
+	defer closeMergeSources(parts)
+	for i, d := range parts {
+		if d.repoMetaData.Name != parts[0].repoMetaData.Name {
+			return fmt.Errorf("%s: got repository %q, want %q", srcs[i], d.repoMetaData.Name, parts[0].repoMetaData.Name)
+		}
+		if !reflect.DeepEqual(d.repoMetaData.Branches, parts[0].repoMetaData.Branches) {
+			return fmt.Errorf("%s: got branches %v, want %v", srcs[i], d.repoMetaData.Branches, parts[0].repoMetaData.Branches)
+		}
+	}
+
+	// The document counts per branch and the bytes per language
+	// are computed again by Add.
+	repo := parts[0].repoMetaData
+	repo.BranchDocuments = nil
+	repo.LanguageBytes = nil
+	repo.SubRepoMap = map[string]*Repository{}
+	for _, d := range parts {
+		for p, sub := range d.repoMetaData.SubRepoMap {
+			if p != "" {
+				addMergedSubRepo(repo.SubRepoMap, p, sub)
+			}
+		}
+	}
+
+	docs, err := mergeDocuments(parts, srcs, repo.Branches, nil)
+	if err != nil {
+		return err
+	}
+	return writeMergedShard(dst, &repo, parts[0].metaData.TruncateLongLines, docs)
+}
+
+// MergeRepositories combines the shards in files srcs, which may hold
+// different repositories, into a single shard in file dst of the
+// repository named name. The source repositories become its members,
+// as gitindex.IndexGitRepos writes them: each is a sub-repository at
+// the path of its name, with its files below that path and its own
+// branch versions and URL templates, and repo queries for its name
+// match its files. A source that already has members contributes
+// those. The shards of one repository must be at the same branch
+// versions, and their documents are merged as by MergeShards.
+//
+// The branches of the result are those of all members. The version of
+// a branch is a hash of the versions of the members that have it.
+func MergeRepositories(dst, name string, srcs []string) error {
+	if name == "" {
+		return fmt.Errorf("repository name must be set")
+	}
+	parts, err := openMergeSources(srcs)
+	if err != nil {
+		return err
+	}
+	defer closeMergeSources(parts)
+
+	repo := Repository{
+		Name:       name,
+		SubRepoMap: map[string]*Repository{},
+	}
+	// members holds the description of each member, by path.
+	members := map[string]*Repository{}
+	for i, d := range parts {
+		if len(d.repoMetaData.Members) == 0 {
+			m := d.repoMetaData
+			m.SubRepoMap = nil
+			m.BranchDocuments = nil
+			m.LanguageBytes = nil
+			if err := addMember(members, m.Name, &m); err != nil {
+				return fmt.Errorf("%s: %v", srcs[i], err)
+			}
+			for p, sub := range d.repoMetaData.SubRepoMap {
+				if p != "" {
+					addMergedSubRepo(repo.SubRepoMap, path.Join(m.Name, p), sub)
+				}
+			}
+			continue
+		}
+
+		for _, p := range d.repoMetaData.Members {
+			if err := addMember(members, p, d.repoMetaData.SubRepoMap[p]); err != nil {
+				return fmt.Errorf("%s: %v", srcs[i], err)
+			}
+		}
+		for p, sub := range d.repoMetaData.SubRepoMap {
+			if p != "" {
+				addMergedSubRepo(repo.SubRepoMap, p, sub)
+			}
+		}
+	}
+	if err := checkMemberPaths(members); err != nil {
+		return err
+	}
+
+	for p, m := range members {
+		repo.Members = append(repo.Members, p)
+		repo.SubRepoMap[p] = m
+	}
+	sort.Strings(repo.Members)
+	repo.Branches = memberBranches(repo.Members, members)
+
+	docs, err := mergeDocuments(parts, srcs, repo.Branches, func(d *indexData, doc *Document) {
+		if len(d.repoMetaData.Members) > 0 {
+			return
+		}
+		p := d.repoMetaData.Name
+		doc.Name = path.Join(p, doc.Name)
+		doc.SubRepositoryPath = path.Join(p, doc.SubRepositoryPath)
+	})
+	if err != nil {
+		return err
+	}
+	return writeMergedShard(dst, &repo, parts[0].metaData.TruncateLongLines, docs)
+}
+
+// openMergeSources opens the shards in files srcs, and checks that
+// they can be merged.
+func openMergeSources(srcs []string) ([]*indexData, error) {
+	if len(srcs) == 0 {
+		return nil, fmt.Errorf("no shards to merge")
+	}
+
+	var parts []*indexData
+	for _, src := range srcs {
+		d, err := openIndexData(src)
+		if err != nil {
+			closeMergeSources(parts)
+			return nil, fmt.Errorf("%s: %v", src, err)
+		}
+		parts = append(parts, d)
+		if err := checkMergeable(parts[0], d); err != nil {
+			closeMergeSources(parts)
+			return nil, fmt.Errorf("%s: %v", src, err)
+		}
+	}
+	return parts, nil
+}
+
+func closeMergeSources(parts []*indexData) {
+	for _, d := range parts {
+		d.Close()
+	}
+}
+
+// checkMergeable returns an error if the shard d can't be merged
+// with the shard first.
+func checkMergeable(first, d *indexData) error {
+	if len(d.metaData.Supersedes) > 0 {
+		return fmt.Errorf("cannot merge a segment")
+	}
+	if d.repoMetaData.DeltaBase != "" {
+		return fmt.Errorf("cannot merge an index of changes since %s", d.repoMetaData.DeltaBase)
+	}
+	if d.metaData.TruncateLongLines != first.metaData.TruncateLongLines {
+		return fmt.Errorf("got TruncateLongLines %d, want %d", d.metaData.TruncateLongLines, first.metaData.TruncateLongLines)
+	}
+	return nil
+}
+
+// addMergedSubRepo adds the sub-repository sub at path p to subs,
+// unless it is there already. Its LanguageBytes are counted again.
+func addMergedSubRepo(subs map[string]*Repository, p string, sub *Repository) {
+	if _, ok := subs[p]; ok {
+		return
+	}
+	s := *sub
+	s.LanguageBytes = nil
+	subs[p] = &s
+}
+
+// addMember adds the member m at path p to members. A member from
+// several shards must be at the same branch versions in each.
+func addMember(members map[string]*Repository, p string, m *Repository) error {
+	if m == nil {
+		return fmt.Errorf("member %q has no sub-repository", p)
+	}
+	if other, ok := members[p]; ok {
+		if !reflect.DeepEqual(m.Branches, other.Branches) {
+			return fmt.Errorf("member %q: got branches %v, want %v", p, m.Branches, other.Branches)
+		}
+		return nil
+	}
+	s := *m
+	s.LanguageBytes = nil
+	members[p] = &s
+	return nil
+}
+
+// checkMemberPaths returns an error if the paths of members can't
+// hold their files side by side.
+func checkMemberPaths(members map[string]*Repository) error {
+	var paths []string
+	for p := range members {
+		if p == "" || path.Clean(p) != p || p == "." || p == ".." ||
+			strings.HasPrefix(p, "/") || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("member name %q is not a relative path", p)
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for i := 1; i < len(paths); i++ {
+		if strings.HasPrefix(paths[i], paths[i-1]+"/") {
+			return fmt.Errorf("member names %q and %q overlap", paths[i-1], paths[i])
+		}
+	}
+	return nil
+}
+
+// memberBranches returns the branches of all members, in order of
+// appearance when going through the members in order of paths. The
+// version of a branch is a hash of the versions of the members that
+// have it.
+func memberBranches(paths []string, members map[string]*Repository) []RepositoryBranch {
+	var names []string
+	versions := map[string][]string{}
+	for _, p := range paths {
+		for _, br := range members[p].Branches {
+			if _, ok := versions[br.Name]; !ok {
+				names = append(names, br.Name)
+			}
+			versions[br.Name] = append(versions[br.Name], fmt.Sprintf("%s %s\n", p, br.Version))
+		}
+	}
+
+	var branches []RepositoryBranch
+	for _, n := range names {
+		h := sha1.New()
+		for _, v := range versions[n] {
+			h.Write([]byte(v))
+		}
+		branches = append(branches, RepositoryBranch{Name: n, Version: fmt.Sprintf("%x", h.Sum(nil))})
+	}
+	return branches
+}
+
+// mergeDocuments returns the documents of parts, after passing each to
+// rename if it is set. Documents with the same name, sub-repository
+// and content are returned once, with the union of their branches, in
+// the order of branches.
+func mergeDocuments(parts []*indexData, srcs []string, branches []RepositoryBranch, rename func(*indexData, *Document)) ([]Document, error) {
+	type docKey struct {
+		name, subRepoPath, checksum string
+	}
+	var docs []Document
+	seen := map[docKey]int{}
+	for i, d := range parts {
+		partDocs, err := d.documents()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", srcs[i], err)
+		}
+		for j, doc := range partDocs {
+			if rename != nil {
+				rename(d, &doc)
+			}
+			key := docKey{doc.Name, doc.SubRepositoryPath, string(d.getChecksum(uint32(j)))}
+			if k, ok := seen[key]; ok && bytes.Equal(docs[k].Content, doc.Content) {
+				docs[k].Branches = mergeBranches(branches, docs[k].Branches, doc.Branches)
+				continue
+			}
+			seen[key] = len(docs)
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// writeMergedShard writes the shard of repo with docs to file dst.
+func writeMergedShard(dst string, repo *Repository, truncateLongLines int, docs []Document) error {
+	b, err := NewIndexBuilder(repo)
+	if err != nil {
+		return err
+	}
+	b.SetTruncateLongLines(truncateLongLines)
+	for _, doc := range docs {
+		if err := b.Add(doc); err != nil {
+			return fmt.Errorf("%s: %v", doc.Name, err)
+		}
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := b.Write(out); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// mergeBranches returns the union of the branch names a and b, in the
+// order of branches.
+func mergeBranches(branches []RepositoryBranch, a, b []string) []string {
+	names := map[string]bool{}
+	for _, n := range append(append([]string{}, a...), b...) {
+		names[n] = true
+	}
+	var result []string
+	for _, br := range branches {
+		if names[br.Name] {
+			result = append(result, br.Name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/zoekt/query"
+)
+
+func writeTestRepoShard(t *testing.T, fn string, repo *Repository, docs ...Document) {
+	b := testIndexBuilder(t, repo, docs...)
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if err := b.Write(f); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func TestMergeShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	newRepo := func() *Repository {
+		return &Repository{
+			Name:     "repo",
+			Branches: []RepositoryBranch{{Name: "master", Version: "v1"}, {Name: "stable", Version: "v2"}},
+		}
+	}
+	a := filepath.Join(dir, "a.zoekt")
+	b := filepath.Join(dir, "b.zoekt")
+	writeTestRepoShard(t, a, newRepo(),
+		Document{Name: "f1", Content: []byte("one"), Branches: []string{"master"}, Language: "Go"},
+		Document{Name: "f2", Content: []byte("two"), Branches: []string{"stable"}})
+	writeTestRepoShard(t, b, newRepo(),
+		Document{Name: "f1", Content: []byte("one"), Branches: []string{"stable"}, Language: "Go"},
+		Document{Name: "f3", Content: []byte("three"), Branches: []string{"master", "stable"}, Language: "C"})
+
+	dst := filepath.Join(dir, "merged.zoekt")
+	if err := MergeShards(dst, []string{a, b}); err != nil {
+		t.Fatalf("MergeShards: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	repo, docs, err := ReadDocuments(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	want := []Document{
+		{Name: "f1", Content: []byte("one"), Branches: []string{"master", "stable"}, Language: "Go"},
+		{Name: "f2", Content: []byte("two"), Branches: []string{"stable"}},
+		{Name: "f3", Content: []byte("three"), Branches: []string{"master", "stable"}, Language: "C"},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %+v, want %+v", docs, want)
+	}
+	if want := map[string]int{"master": 2, "stable": 3}; !reflect.DeepEqual(repo.BranchDocuments, want) {
+		t.Errorf("got BranchDocuments %v, want %v", repo.BranchDocuments, want)
+	}
+	// f1 is counted once.
+	if want := map[string]int64{"Go": 3, "C": 5}; !reflect.DeepEqual(repo.LanguageBytes, want) {
+		t.Errorf("got LanguageBytes %v, want %v", repo.LanguageBytes, want)
+	}
+
+	other := filepath.Join(dir, "other.zoekt")
+	otherRepo := newRepo()
+	otherRepo.Name = "other"
+	writeTestRepoShard(t, other, otherRepo, Document{Name: "f4", Content: []byte("four"), Branches: []string{"master"}})
+	if err := MergeShards(filepath.Join(dir, "bad.zoekt"), []string{a, other}); err == nil {
+		t.Errorf("MergeShards of different repositories succeeded")
+	}
+}
+
+func TestMergeRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a1 := filepath.Join(dir, "a1.zoekt")
+	a2 := filepath.Join(dir, "a2.zoekt")
+	b := filepath.Join(dir, "b.zoekt")
+	repoA := func() *Repository {
+		return &Repository{
+			Name:       "org/a",
+			Branches:   []RepositoryBranch{{Name: "master", Version: "a1"}},
+			SubRepoMap: map[string]*Repository{"sub": {Name: "sub", Branches: []RepositoryBranch{{Name: "master", Version: "s1"}}}},
+		}
+	}
+	writeTestRepoShard(t, a1, repoA(),
+		Document{Name: "f1", Content: []byte("needle one"), Branches: []string{"master"}, Language: "Go"})
+	writeTestRepoShard(t, a2, repoA(),
+		Document{Name: "f1", Content: []byte("needle one"), Branches: []string{"master"}, Language: "Go"},
+		Document{Name: "sub/f2", Content: []byte("needle two"), Branches: []string{"master"}, SubRepositoryPath: "sub"})
+	writeTestRepoShard(t, b, &Repository{
+		Name:     "org/b",
+		Branches: []RepositoryBranch{{Name: "master", Version: "b1"}, {Name: "stable", Version: "b2"}},
+	},
+		Document{Name: "f1", Content: []byte("needle three"), Branches: []string{"master", "stable"}, Language: "C"})
+
+	merged := filepath.Join(dir, "merged.zoekt")
+	if err := MergeRepositories(merged, "all", []string{a1, b, a2}); err != nil {
+		t.Fatalf("MergeRepositories: %v", err)
+	}
+	data, err := ioutil.ReadFile(merged)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	repo, docs, err := ReadDocuments(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	if repo.Name != "all" || !reflect.DeepEqual(repo.Members, []string{"org/a", "org/b"}) {
+		t.Errorf("got repository %q with members %v, want all with org/a and org/b", repo.Name, repo.Members)
+	}
+	var branches []string
+	for _, br := range repo.Branches {
+		branches = append(branches, br.Name)
+	}
+	if !reflect.DeepEqual(branches, []string{"master", "stable"}) {
+		t.Errorf("got branches %v, want master and stable", branches)
+	}
+	want := []Document{
+		{Name: "org/a/f1", Content: []byte("needle one"), Branches: []string{"master"}, SubRepositoryPath: "org/a", Language: "Go"},
+		{Name: "org/b/f1", Content: []byte("needle three"), Branches: []string{"master", "stable"}, SubRepositoryPath: "org/b", Language: "C"},
+		{Name: "org/a/sub/f2", Content: []byte("needle two"), Branches: []string{"master"}, SubRepositoryPath: "org/a/sub"},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %+v, want %+v", docs, want)
+	}
+	if got := repo.SubRepoMap["org/a"].LanguageBytes; !reflect.DeepEqual(got, map[string]int64{"Go": 10}) {
+		t.Errorf("got LanguageBytes %v for org/a, want Go: 10", got)
+	}
+
+	res := searchForTestFile(t, data, &query.And{Children: []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Repo{Pattern: "org/a"},
+	}})
+	versions := map[string]string{}
+	for _, f := range res.Files {
+		versions[f.FileName] = f.SubRepositoryName + "@" + f.Version
+	}
+	if want := map[string]string{"org/a/f1": "org/a@a1", "org/a/sub/f2": "sub@s1"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("got matches %v, want %v", versions, want)
+	}
+
+	// The members of a merged shard are merged in turn.
+	c := filepath.Join(dir, "c.zoekt")
+	writeTestRepoShard(t, c, &Repository{
+		Name:     "org/c",
+		Branches: []RepositoryBranch{{Name: "master", Version: "c1"}},
+	}, Document{Name: "f1", Content: []byte("four"), Branches: []string{"master"}})
+	again := filepath.Join(dir, "again.zoekt")
+	if err := MergeRepositories(again, "more", []string{merged, c}); err != nil {
+		t.Fatalf("MergeRepositories: %v", err)
+	}
+	data, err = ioutil.ReadFile(again)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	repo, docs, err = ReadDocuments(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	if !reflect.DeepEqual(repo.Members, []string{"org/a", "org/b", "org/c"}) {
+		t.Errorf("got members %v, want org/a, org/b and org/c", repo.Members)
+	}
+	if len(docs) != 4 {
+		t.Errorf("got %d documents, want 4", len(docs))
+	}
+
+	for name, srcs := range map[string][]string{
+		"overlapping names": {b, writeNamedShard(t, dir, "org")},
+		"other versions":    {a1, writeNamedShard(t, dir, "org/a")},
+	} {
+		if err := MergeRepositories(filepath.Join(dir, "bad.zoekt"), "bad", srcs); err == nil {
+			t.Errorf("MergeRepositories succeeded for %s", name)
+		}
+	}
+}
+
+// writeNamedShard writes a shard of the repository name at version x,
+// and returns its file name.
+func writeNamedShard(t *testing.T, dir, name string) string {
+	fn := filepath.Join(dir, strings.Replace(name, "/", "_", -1)+".x.zoekt")
+	writeTestRepoShard(t, fn, &Repository{
+		Name:     name,
+		Branches: []RepositoryBranch{{Name: "master", Version: "x"}},
+	}, Document{Name: "f", Content: []byte("x"), Branches: []string{"master"}})
+	return fn
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// mmapedIndexFile is an IndexFile backed by a read-only mapping of
+// the file. Reads return slices of the mapping, so they are only
+// valid until Close.
+type mmapedIndexFile struct {
+	name string
+	size uint32
+	data []byte
+}
+
+func (f *mmapedIndexFile) Read(off, sz uint32) ([]byte, error) {
+	if uint64(off)+uint64(sz) > uint64(f.size) {
+		return nil, fmt.Errorf("out of bounds: %d, len %d", uint64(off)+uint64(sz), f.size)
+	}
+	return f.data[off : off+sz], nil
+}
+
+func (f *mmapedIndexFile) Name() string {
+	return f.name
+}
+
+func (f *mmapedIndexFile) Size() (uint32, error) {
+	return f.size, nil
+}
+
+func (f *mmapedIndexFile) Close() {
+	if f.data != nil {
+		munmap(f.data)
+		f.data = nil
+	}
+}
+
+// memIndexFile is an IndexFile holding the whole file in memory.
+type memIndexFile struct {
+	name string
+	data []byte
+}
+
+func (f *memIndexFile) Read(off, sz uint32) ([]byte, error) {
+	if uint64(off)+uint64(sz) > uint64(len(f.data)) {
+		return nil, fmt.Errorf("out of bounds: %d, len %d", uint64(off)+uint64(sz), len(f.data))
+	}
+	return f.data[off : off+sz], nil
+}
+
+func (f *memIndexFile) Name() string {
+	return f.name
+}
+
+func (f *memIndexFile) Size() (uint32, error) {
+	return uint32(len(f.data)), nil
+}
+
+func (f *memIndexFile) Close() {
+	f.data = nil
+}
+
+// NewMmapReader opens the index file at path, mapping it into
+// memory so sections are read without copying. If the file can't be
+// mapped, eg. on Windows, the whole file is read into memory
+// instead. Close releases the mapping.
+func NewMmapReader(path string) (IndexFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sz := fi.Size()
+	if sz >= maxUInt32 {
+		return nil, fmt.Errorf("file %s too large: %d", path, sz)
+	}
+
+	if data, err := mmapFile(f, uint32(sz)); err == nil {
+		return &mmapedIndexFile{
+			name: f.Name(),
+			size: uint32(sz),
+			data: data,
+		}, nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &memIndexFile{
+		name: f.Name(),
+		data: data,
+	}, nil
+}
@@ -18,6 +18,8 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"sort"
 )
 
@@ -34,6 +36,17 @@ type IndexFile interface {
 type reader struct {
 	r   IndexFile
 	off uint32
+
+	// version is the format version to read. If zero, it is
+	// IndexFormatVersion.
+	version int
+}
+
+func (r *reader) formatVersion() int {
+	if r.version == 0 {
+		return IndexFormatVersion
+	}
+	return r.version
 }
 
 func (r *reader) seek(off uint32) {
@@ -58,39 +71,212 @@ func (r *reader) U64() (uint64, error) {
 	return binary.BigEndian.Uint64(b), nil
 }
 
-func (r *reader) readTOC(toc *indexTOC) error {
+// seekTOC positions the reader at the start of the table of
+// contents, which the file ends in. The trailer that locates it has
+// the same layout in all format versions.
+func (r *reader) seekTOC() error {
 	sz, err := r.r.Size()
 	if err != nil {
 		return err
 	}
+	if sz < 8 {
+		return fmt.Errorf("file size %d too small for table of contents", sz)
+	}
 	r.off = sz - 8
 
-	var tocSection simpleSection
-	if err := tocSection.read(r); err != nil {
+	off, err := r.U32()
+	if err != nil {
 		return err
 	}
+	tocSize, err := r.U32()
+	if err != nil {
+		return err
+	}
+	if uint64(off)+uint64(tocSize) > uint64(sz) {
+		return fmt.Errorf("table of contents at %d, size %d beyond file size %d", off, tocSize, sz)
+	}
+	r.seek(off)
+	return nil
+}
 
-	r.seek(tocSection.off)
+// readFormatVersion returns the format version of the shard, from
+// the header if it has one, or else from the metadata, which is the
+// first section of the table of contents in all versions.
+func (r *reader) readFormatVersion() (int, error) {
+	if sz, err := r.r.Size(); err != nil {
+		return 0, err
+	} else if sz >= uint32(len(indexMagic))+4 {
+		r.seek(0)
+		magic, err := r.r.Read(0, uint32(len(indexMagic)))
+		if err != nil {
+			return 0, err
+		}
+		if string(magic) == indexMagic {
+			r.seek(uint32(len(indexMagic)))
+			v, err := r.U32()
+			return int(v), err
+		}
+	}
+
+	if err := r.seekTOC(); err != nil {
+		return 0, err
+	}
+	if _, err := r.U32(); err != nil {
+		return 0, err
+	}
+
+	// The metaData entry starts with its offset and size.
+	var metaData simpleSection
+	var err error
+	if metaData.off, err = r.U32(); err != nil {
+		return 0, err
+	}
+	if metaData.sz, err = r.U32(); err != nil {
+		return 0, err
+	}
+	var md IndexMetadata
+	if err := r.readJSON(&md, &metaData); err != nil {
+		return 0, err
+	}
+	return md.IndexFormatVersion, nil
+}
+
+// oldestReadableVersion is the oldest format version that can be
+// searched. Versions before 15 have no section checksums, so their
+// TOC is read with the layout from sectionsTaggedVersion. Older
+// shards lack the content checksums and must be rebuilt.
+const oldestReadableVersion = 13
+
+// newReader returns a reader for the format version of f, which must
+// be one that can be searched.
+func newReader(f IndexFile) (*reader, error) {
+	rd := &reader{r: f}
+	version, err := rd.readFormatVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version < oldestReadableVersion || version > IndexFormatVersion {
+		return nil, fmt.Errorf("unsupported index version %d, expected %d", version, IndexFormatVersion)
+	}
+	return &reader{r: f, version: version}, nil
+}
+
+func (r *reader) readTOC(toc *indexTOC) error {
+	if err := r.seekTOC(); err != nil {
+		return err
+	}
 
 	sectionCount, err := r.U32()
 	if err != nil {
 		return err
 	}
 
-	secs := toc.sections()
+	// Only the length in the trailer is checked, as the checksums
+	// need a read of the whole file. See verifyChecksums.
+	if r.formatVersion() >= firstTrailerVersion {
+		if _, _, err = r.readTrailer(); err != nil {
+			return err
+		}
+	}
+
+	secs := toc.sectionsTaggedVersion(r.formatVersion())
 
 	if len(secs) != int(sectionCount) {
 		return fmt.Errorf("section count mismatch: got %d want %d", sectionCount, len(secs))
 	}
 
-	for _, s := range toc.sections() {
-		if err := s.read(r); err != nil {
+	for _, s := range secs {
+		if err := s.sec.read(r); err != nil {
+			return fmt.Errorf("section %s: %v", s.tag, err)
+		}
+	}
+	return nil
+}
+
+// verifyChecksums checks the sections of toc, as read by readTOC,
+// against their checksums, and the file against the checksum in the
+// trailer.
+func (r *reader) verifyChecksums(toc *indexTOC) error {
+	if r.formatVersion() >= firstChecksumVersion {
+		for _, s := range toc.sectionsTaggedVersion(r.formatVersion()) {
+			if err := s.sec.verify(r.r); err != nil {
+				return fmt.Errorf("section %s: %v", s.tag, err)
+			}
+		}
+	}
+
+	// The sections are checked first, as a mismatch there says
+	// where the damage is.
+	if r.formatVersion() >= firstTrailerVersion {
+		length, fileCRC, err := r.readTrailer()
+		if err != nil {
+			return err
+		}
+		if err := verifyFileChecksum(r.r, length, fileCRC); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// readContentSlots returns the item of the file contents section for
+// each document, or nil if each has its own.
+func (t *indexTOC) readContentSlots(f IndexFile) ([]uint32, error) {
+	blob, err := f.Read(t.contentSlots.off, t.contentSlots.sz)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalContentSlots(blob, len(t.fileNames.offsets), len(t.fileContents.offsets))
+}
+
+// firstTrailerVersion is the first format version whose trailer
+// holds the file length and checksum.
+const firstTrailerVersion = 18
+
+// readTrailer returns the length and checksum of the file before
+// the trailer. It fails if the file was not written completely.
+func (r *reader) readTrailer() (uint32, uint32, error) {
+	sz, err := r.r.Size()
+	if err != nil {
+		return 0, 0, err
+	}
+	if sz < 16 {
+		return 0, 0, fmt.Errorf("file size %d too small for trailer", sz)
+	}
+	b, err := r.r.Read(sz-16, 8)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, crc := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+	if length != sz-16 {
+		return 0, 0, fmt.Errorf("trailer says %d bytes precede it, but there are %d; the file is truncated or corrupt", length, sz-16)
+	}
+	return length, crc, nil
+}
+
+// verifyFileChecksum checks the first length bytes of f against crc.
+// They are read in chunks, so files that aren't mapped into memory
+// needn't fit in it.
+func verifyFileChecksum(f IndexFile, length, crc uint32) error {
+	const chunk = 1 << 20
+	var got uint32
+	for off := uint32(0); off < length; off += chunk {
+		sz := uint32(chunk)
+		if length-off < sz {
+			sz = length - off
+		}
+		b, err := f.Read(off, sz)
+		if err != nil {
+			return err
+		}
+		got = crc32.Update(got, crc32.IEEETable, b)
+	}
+	if got != crc {
+		return fmt.Errorf("file checksum mismatch: got %08x, want %08x", got, crc)
+	}
+	return nil
+}
+
 func (r *indexData) readSectionBlob(sec simpleSection) ([]byte, error) {
 	return r.file.Read(sec.off, sec.sz)
 }
@@ -131,6 +317,28 @@ func readSectionU64(f IndexFile, sec simpleSection) ([]uint64, error) {
 	return arr, nil
 }
 
+// sectionReader returns a reader for the bytes of sec that reads them
+// from the file as they are needed, so large sections can be
+// processed in parts.
+func (r *reader) sectionReader(sec simpleSection) *io.SectionReader {
+	return io.NewSectionReader(indexFileReaderAt{r.r}, int64(sec.off), int64(sec.sz))
+}
+
+// indexFileReaderAt is an io.ReaderAt for an IndexFile. Reads must
+// not extend past the end of the file, as they can't within a section
+// read by readTOC.
+type indexFileReaderAt struct {
+	f IndexFile
+}
+
+func (a indexFileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	b, err := a.f.Read(uint32(off), uint32(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, b), nil
+}
+
 func (r *reader) readJSON(data interface{}, sec *simpleSection) error {
 	blob, err := r.r.Read(sec.off, sec.sz)
 	if err != nil {
@@ -158,8 +366,8 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
-	if d.metaData.IndexFormatVersion != IndexFormatVersion {
-		return nil, fmt.Errorf("file is v%d, want v%d", d.metaData.IndexFormatVersion, IndexFormatVersion)
+	if d.metaData.IndexFormatVersion != r.formatVersion() {
+		return nil, fmt.Errorf("file is v%d, want v%d", d.metaData.IndexFormatVersion, r.formatVersion())
 	}
 
 	blob, err = d.readSectionBlob(toc.repoMetaData)
@@ -171,7 +379,19 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 	}
 
 	d.boundariesStart = toc.fileContents.data.off
+	d.contentSlots, err = toc.readContentSlots(r.r)
+	if err != nil {
+		return nil, err
+	}
 	d.boundaries = toc.fileContents.relativeIndex()
+	if d.contentSlots != nil {
+		d.slotIndex = d.boundaries
+		d.boundaries = contentBoundaries(d.slotIndex, d.contentSlots)
+	}
+	if toc.fileContents.codec != codecNone {
+		contents := toc.fileContents
+		d.compressedContents = &contents
+	}
 	d.newlinesStart = toc.newlines.data.off
 	d.newlinesIndex = toc.newlines.relativeIndex()
 	d.docSectionsStart = toc.fileSections.data.off
@@ -180,20 +400,61 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.rankSignals, err = d.readSectionBlob(toc.rankSignals)
+	if err != nil {
+		return nil, err
+	}
+	lastCommits, err := d.readSectionBlob(toc.lastCommits)
+	if err != nil {
+		return nil, err
+	}
+	if d.lastCommits, err = unmarshalLastCommits(lastCommits); err != nil {
+		return nil, err
+	}
+	fileModes, err := d.readSectionBlob(toc.fileModes)
+	if err != nil {
+		return nil, err
+	}
+	if d.fileModes, err = unmarshalFileModes(fileModes, len(toc.fileNames.offsets)); err != nil {
+		return nil, err
+	}
+	if d.metaData.IndexFormatVersion < firstGeneratedVersion {
+		signals, err := unmarshalRankSignals(d.rankSignals)
+		if err != nil {
+			return nil, err
+		}
+		d.generated = dropLegacyGenerated(signals)
+	} else {
+		generated, err := d.readSectionBlob(toc.generated)
+		if err != nil {
+			return nil, err
+		}
+		if d.generated, err = unmarshalGenerated(generated, len(toc.fileNames.offsets)); err != nil {
+			return nil, err
+		}
+	}
+	languages, err := d.readSectionBlob(toc.languages)
+	if err != nil {
+		return nil, err
+	}
+	if d.languages, err = unmarshalLanguages(languages, len(toc.fileNames.offsets)); err != nil {
+		return nil, err
+	}
 
 	textContent, err := d.readSectionBlob(toc.ngramText)
 	if err != nil {
 		return nil, err
 	}
 	postingsIndex := toc.postings.relativeIndex()
+	d.postingsCodec = toc.postings.codec
 
 	const ngramEncoding = 8
 	for i := 0; i < len(textContent); i += ngramEncoding {
 		j := i / ngramEncoding
 		ng := ngram(binary.BigEndian.Uint64(textContent[i : i+ngramEncoding]))
 		d.ngrams[ng] = simpleSection{
-			toc.postings.data.off + postingsIndex[j],
-			postingsIndex[j+1] - postingsIndex[j],
+			off: toc.postings.data.off + postingsIndex[j],
+			sz:  postingsIndex[j+1] - postingsIndex[j],
 		}
 	}
 
@@ -225,7 +486,10 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		off := fileNamePostingsIndex[j]
 		end := fileNamePostingsIndex[j+1]
 		ng := ngram(binary.BigEndian.Uint64(nameNgramText[i : i+ngramEncoding]))
-		d.fileNameNgrams[ng] = fromDeltas(fileNamePostingsData[off:end], nil)
+		d.fileNameNgrams[ng], err = decodePostings(toc.namePostings.codec, fileNamePostingsData[off:end], nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	for j, br := range d.repoMetaData.Branches {
@@ -287,13 +551,25 @@ func (d *indexData) verify() error {
 }
 
 func (d *indexData) readContents(i uint32) ([]byte, error) {
+	index := d.boundaries
+	if d.contentSlots != nil {
+		i = d.contentSlots[i]
+		index = d.slotIndex
+	}
+	if d.compressedContents != nil {
+		return d.compressedContents.readBlob(d, i)
+	}
 	return d.readSectionBlob(simpleSection{
-		off: d.boundariesStart + d.boundaries[i],
-		sz:  d.boundaries[i+1] - d.boundaries[i],
+		off: d.boundariesStart + index[i],
+		sz:  index[i+1] - index[i],
 	})
 }
 
 func (d *indexData) readContentSlice(off uint32, sz uint32) ([]byte, error) {
+	if d.compressedContents != nil || d.contentSlots != nil {
+		return d.readDocumentContentSlice(off, sz)
+	}
+
 	// TODO(hanwen): cap result if it is at the end of the content
 	// section.
 	return d.readSectionBlob(simpleSection{
@@ -301,6 +577,31 @@ func (d *indexData) readContentSlice(off uint32, sz uint32) ([]byte, error) {
 		sz:  sz})
 }
 
+// readDocumentContentSlice reads the documents overlapping sz bytes
+// at offset off of the decoded contents laid out back to back, for
+// when they are not stored that way. The result is cut at the end of
+// the last document.
+func (d *indexData) readDocumentContentSlice(off uint32, sz uint32) ([]byte, error) {
+	n := len(d.boundaries) - 1
+	i := sort.Search(n, func(j int) bool { return d.boundaries[j+1] > off })
+
+	var result []byte
+	for ; i < n && uint32(len(result)) < sz; i++ {
+		content, err := d.readContents(uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		if start := d.boundaries[i]; start < off {
+			content = content[off-start:]
+		}
+		result = append(result, content...)
+	}
+	if uint32(len(result)) > sz {
+		result = result[:sz]
+	}
+	return result, nil
+}
+
 func (d *indexData) readNewlines(i uint32, buf []uint32) ([]uint32, uint32, error) {
 	sec := simpleSection{
 		off: d.newlinesStart + d.newlinesIndex[i],
@@ -329,7 +630,10 @@ func (d *indexData) readDocSections(i uint32) ([]DocumentSection, uint32, error)
 
 // NewSearcher creates a Searcher for a single index file.
 func NewSearcher(r IndexFile) (Searcher, error) {
-	rd := &reader{r: r}
+	rd, err := newReader(r)
+	if err != nil {
+		return nil, err
+	}
 
 	var toc indexTOC
 	if err := rd.readTOC(&toc); err != nil {
@@ -343,10 +647,175 @@ func NewSearcher(r IndexFile) (Searcher, error) {
 	return indexData, nil
 }
 
+// ReadDocuments returns the repository and the documents stored in
+// an index shard, with their content copied out of the IndexFile.
+// The IndexFile is not closed.
+func ReadDocuments(inf IndexFile) (*Repository, []Document, error) {
+	rd, err := newReader(inf)
+	if err != nil {
+		return nil, nil, err
+	}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return nil, nil, err
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	docs, err := d.documents()
+	if err != nil {
+		return nil, nil, err
+	}
+	repo := d.repoMetaData
+	return &repo, docs, nil
+}
+
+// ForEachDocument calls f with the name and content of each document
+// stored in an index shard, in index order, without reading all
+// contents into memory at once. The content may point into the
+// IndexFile, so f must not modify it or keep it after returning.
+// Iteration stops at the first error returned by f, which is
+// returned. The IndexFile is not closed.
+func ForEachDocument(inf IndexFile, f func(name string, content []byte) error) error {
+	rd, err := newReader(inf)
+	if err != nil {
+		return err
+	}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return err
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return err
+	}
+
+	for i := range d.fileBranchMasks {
+		content, err := d.readContents(uint32(i))
+		if err != nil {
+			return fmt.Errorf("document %d: %v", i, err)
+		}
+		if err := f(string(d.fileName(uint32(i))), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// documents returns copies of all documents in the shard, including
+// their symbol sections and rank signals.
+func (d *indexData) documents() ([]Document, error) {
+	signals, err := unmarshalRankSignals(d.rankSignals)
+	if err != nil {
+		return nil, err
+	}
+	if d.metaData.IndexFormatVersion < firstGeneratedVersion {
+		dropLegacyGenerated(signals)
+	}
+
+	docs := make([]Document, 0, len(d.fileBranchMasks))
+	for i, mask := range d.fileBranchMasks {
+		content, err := d.readContents(uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		if int(d.subRepos[i]) >= len(d.subRepoPaths) {
+			return nil, fmt.Errorf("document %d: sub-repository %d out of range", i, d.subRepos[i])
+		}
+		doc := Document{
+			Name:              string(d.fileName(uint32(i))),
+			Content:           append([]byte{}, content...),
+			SubRepositoryPath: d.subRepoPaths[d.subRepos[i]],
+			RankSignals:       signals[uint32(i)],
+			Generated:         d.generated[uint32(i)],
+		}
+		if c, ok := d.lastCommits[uint32(i)]; ok {
+			doc.LastCommit = c.id
+			doc.LastCommitTime = c.time
+		}
+		if d.fileModes != nil {
+			doc.Mode = d.fileModes[i]
+		}
+		if d.languages != nil {
+			doc.Language = d.languages[i]
+		}
+		for j, br := range d.repoMetaData.Branches {
+			if mask&(uint64(1)<<uint(j)) != 0 {
+				doc.Branches = append(doc.Branches, br.Name)
+			}
+		}
+		secs, _, err := d.readDocSections(uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		if len(secs) > 0 {
+			doc.Symbols = secs
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// ReadRankSignals returns the ranking signals stored in an index
+// shard, keyed by document index in the order of ReadDocuments.
+// Documents without signals are left out. The IndexFile is not
+// closed.
+func ReadRankSignals(inf IndexFile) (map[uint32]map[string]float64, error) {
+	rd, err := newReader(inf)
+	if err != nil {
+		return nil, err
+	}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return nil, err
+	}
+	blob, err := inf.Read(toc.rankSignals.off, toc.rankSignals.sz)
+	if err != nil {
+		return nil, err
+	}
+	signals, err := unmarshalRankSignals(blob)
+	if err != nil {
+		return nil, err
+	}
+	if rd.formatVersion() < firstGeneratedVersion {
+		dropLegacyGenerated(signals)
+	}
+	return signals, nil
+}
+
+// dropLegacyGenerated removes legacyGeneratedSignal from signals, and
+// returns the documents that had it. Documents left without signals
+// are removed.
+func dropLegacyGenerated(signals map[uint32]map[string]float64) map[uint32]bool {
+	var generated map[uint32]bool
+	for doc, s := range signals {
+		v, ok := s[legacyGeneratedSignal]
+		if !ok {
+			continue
+		}
+		if v != 0 {
+			if generated == nil {
+				generated = map[uint32]bool{}
+			}
+			generated[doc] = true
+		}
+		delete(s, legacyGeneratedSignal)
+		if len(s) == 0 {
+			delete(signals, doc)
+		}
+	}
+	return generated
+}
+
 // ReadMetadata returns the metadata of index shard without reading
 // the index data. The IndexFile is not closed.
 func ReadMetadata(inf IndexFile) (*Repository, *IndexMetadata, error) {
-	rd := &reader{r: inf}
+	rd, err := newReader(inf)
+	if err != nil {
+		return nil, nil, err
+	}
 	var toc indexTOC
 	if err := rd.readTOC(&toc); err != nil {
 		return nil, nil, err
@@ -16,8 +16,21 @@ package zoekt
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/google/zoekt/query"
 )
 
 func TestReadWrite(t *testing.T) {
@@ -98,3 +111,997 @@ func TestReadWriteNames(t *testing.T) {
 		t.Errorf("got trigram bcd at bits %v, want sz 2", data.fileNameNgrams)
 	}
 }
+
+func TestReadCorruptSections(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, n := range []string{"f1", "f2"} {
+		if err := b.AddFile(n, []byte("abcde")); err != nil {
+			t.Fatalf("AddFile: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	b.Write(&buf)
+
+	var toc indexTOC
+	r := reader{r: &memSeeker{buf.Bytes()}}
+	if err := r.readTOC(&toc); err != nil {
+		t.Fatalf("readTOC: %v", err)
+	}
+
+	// The TOC starts with the section count, followed by the
+	// metaData section.
+	tocStart := binary.BigEndian.Uint32(buf.Bytes()[buf.Len()-8:])
+
+	for name, corrupt := range map[string]func(data []byte){
+		"metaData": func(data []byte) {
+			binary.BigEndian.PutUint32(data[tocStart+8:], uint32(len(data)))
+		},
+		"fileContents": func(data []byte) {
+			// Claim more items than the index holds; the
+			// item count follows the codec header.
+			data[toc.fileContents.index.off+4] = 100
+		},
+	} {
+		data := append([]byte{}, buf.Bytes()...)
+		corrupt(data)
+
+		var toc indexTOC
+		r := reader{r: &memSeeker{data}}
+		err := r.readTOC(&toc)
+		if err == nil {
+			t.Errorf("%s: corrupt TOC read without error", name)
+		} else if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: got error %v, want mention of section", name, err)
+		}
+	}
+
+	r = reader{r: &memSeeker{[]byte{1, 2}}}
+	if err := r.readTOC(&indexTOC{}); err == nil {
+		t.Errorf("truncated file read without error")
+	}
+}
+
+func TestSectionReader(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, n := range []string{"f1", "f2"} {
+		if err := b.AddFile(n, []byte("abcde"+n)); err != nil {
+			t.Fatalf("AddFile: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var toc indexTOC
+	f := &memSeeker{buf.Bytes()}
+	r := reader{r: f}
+	if err := r.readTOC(&toc); err != nil {
+		t.Fatalf("readTOC: %v", err)
+	}
+
+	sec := toc.fileContents.data
+	want, err := f.Read(sec.off, sec.sz)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	sr := r.sectionReader(sec)
+	if sr.Size() != int64(sec.sz) {
+		t.Errorf("got size %d, want %d", sr.Size(), sec.sz)
+	}
+
+	// Read in small parts, as a streaming consumer would.
+	var got []byte
+	part := make([]byte, 3)
+	for {
+		n, err := sr.Read(part)
+		got = append(got, part[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Reads don't extend past the section.
+	tail := make([]byte, 10)
+	n, err := sr.ReadAt(tail, int64(sec.sz)-2)
+	if n != 2 || err != io.EOF || !bytes.Equal(tail[:n], want[len(want)-2:]) {
+		t.Errorf("ReadAt at end: got %d, %v, %q", n, err, tail[:n])
+	}
+}
+
+func TestReadBranchDocuments(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{{Name: "master"}, {Name: "stable"}},
+	},
+		Document{Name: "f1", Content: []byte("x"), Branches: []string{"master", "stable"}},
+		Document{Name: "f2", Content: []byte("y"), Branches: []string{"master"}},
+		Document{Name: "f3", Content: []byte("z"), Branches: []string{"master"}})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	repo, _, err := ReadMetadata(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	want := map[string]int{"master": 3, "stable": 1}
+	if !reflect.DeepEqual(repo.BranchDocuments, want) {
+		t.Errorf("got %v, want %v", repo.BranchDocuments, want)
+	}
+}
+
+func TestWriteOffsetTableLimit(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("abcd")},
+		Document{Name: "f2", Content: []byte("efgh")})
+	b.SetMaxOffsetTableSize(12)
+
+	var buf bytes.Buffer
+	err := b.Write(&buf)
+	if err == nil || !strings.Contains(err.Error(), "content trigrams") {
+		t.Fatalf("got error %v, want error about content trigrams", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("wrote %d bytes despite error", buf.Len())
+	}
+
+	b.SetMaxOffsetTableSize(16)
+	if err := b.Write(&buf); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+}
+
+func TestReadArchived(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repo", Archived: true},
+		Document{Name: "f1", Content: []byte("x")})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	repo, _, err := ReadMetadata(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if !repo.Archived {
+		t.Errorf("got Archived false, want true")
+	}
+}
+
+func TestReadLanguageBytes(t *testing.T) {
+	sub := &Repository{Name: "sub"}
+	b := testIndexBuilder(t, &Repository{
+		Name:       "repo",
+		SubRepoMap: map[string]*Repository{"sub": sub},
+	},
+		Document{Name: "a.go", Content: []byte("package a"), Language: "Go"},
+		Document{Name: "b.go", Content: []byte("package b"), Language: "Go"},
+		Document{Name: "gen.go", Content: []byte("package gen"), Language: "Go", Generated: true},
+		Document{Name: "README", Content: []byte("readme")},
+		Document{Name: "sub/c.py", Content: []byte("import os"), Language: "Python", SubRepositoryPath: "sub"})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	repo, _, err := ReadMetadata(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if want := map[string]int64{"Go": 18}; !reflect.DeepEqual(repo.LanguageBytes, want) {
+		t.Errorf("got %v, want %v", repo.LanguageBytes, want)
+	}
+	if want := map[string]int64{"Python": 9}; !reflect.DeepEqual(repo.SubRepoMap["sub"].LanguageBytes, want) {
+		t.Errorf("got sub-repository %v, want %v", repo.SubRepoMap["sub"].LanguageBytes, want)
+	}
+	if sub.LanguageBytes != nil {
+		t.Errorf("builder modified the passed in sub-repository")
+	}
+}
+
+func TestReadDocuments(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name:       "repo",
+		Branches:   []RepositoryBranch{{Name: "master"}, {Name: "stable"}},
+		SubRepoMap: map[string]*Repository{"sub": {Name: "sub"}},
+	},
+		Document{Name: "f1", Content: []byte("one"), Branches: []string{"master", "stable"}, Language: "Go"},
+		Document{Name: "sub/f2", Content: []byte("two"), Branches: []string{"stable"}, SubRepositoryPath: "sub"})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	repo, docs, err := ReadDocuments(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	if repo.Name != "repo" {
+		t.Errorf("got repository %q, want repo", repo.Name)
+	}
+	want := []Document{
+		{Name: "f1", Content: []byte("one"), Branches: []string{"master", "stable"}, Language: "Go"},
+		{Name: "sub/f2", Content: []byte("two"), Branches: []string{"stable"}, SubRepositoryPath: "sub"},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %+v, want %+v", docs, want)
+	}
+}
+
+func TestForEachDocument(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("one")},
+		Document{Name: "f2", Content: []byte("Two")},
+		Document{Name: "f3", Content: []byte("three")})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got := map[string]string{}
+	if err := ForEachDocument(&memSeeker{buf.Bytes()}, func(name string, content []byte) error {
+		got[name] = string(content)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachDocument: %v", err)
+	}
+	if want := map[string]string{"f1": "one", "f2": "Two", "f3": "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	var names []string
+	if err := ForEachDocument(&memSeeker{buf.Bytes()}, func(name string, content []byte) error {
+		names = append(names, name)
+		if name == "f2" {
+			return stop
+		}
+		return nil
+	}); err != stop {
+		t.Errorf("got error %v, want %v", err, stop)
+	}
+	if want := []string{"f1", "f2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("visited %v, want %v", names, want)
+	}
+}
+
+func TestReadRankSignals(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("one")},
+		Document{Name: "f2", Content: []byte("two"), RankSignals: map[string]float64{"popularity": 3}})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := ReadRankSignals(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadRankSignals: %v", err)
+	}
+	if want := map[uint32]map[string]float64{1: {"popularity": 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLastCommit(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("one")},
+		Document{Name: "f2", Content: []byte("two"), LastCommit: "b2ca0fef", LastCommitTime: when})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	_, docs, err := ReadDocuments(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	if len(docs) != 2 || docs[0].LastCommit != "" || docs[1].LastCommit != "b2ca0fef" || !docs[1].LastCommitTime.Equal(when) {
+		t.Errorf("got %+v, want the last commit on f2 only", docs)
+	}
+
+	res := searchForTestFile(t, buf.Bytes(), &query.Substring{Pattern: "two"})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	if f := res.Files[0]; f.LastCommit != "b2ca0fef" || !f.LastCommitTime.Equal(when) {
+		t.Errorf("got last commit %q at %v, want b2ca0fef at %v", f.LastCommit, f.LastCommitTime, when)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("one"), Mode: 0100644},
+		Document{Name: "f2", Content: []byte("two"), Mode: 0100755})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	_, docs, err := ReadDocuments(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	if len(docs) != 2 || docs[0].Mode != 0100644 || docs[1].Mode != 0100755 {
+		t.Errorf("got %+v, want modes 0100644 and 0100755", docs)
+	}
+
+	res := searchForTestFile(t, buf.Bytes(), &query.Substring{Pattern: "two"})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	if f := res.Files[0]; f.Mode != 0100755 {
+		t.Errorf("got mode %o, want 100755", f.Mode)
+	}
+}
+
+func TestReadDocumentsGenerated(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("one"), Generated: true, RankSignals: map[string]float64{"popularity": 3}},
+		Document{Name: "f2", Content: []byte("two"), Generated: true})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	_, docs, err := ReadDocuments(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	want := []Document{
+		{Name: "f1", Content: []byte("one"), Generated: true, RankSignals: map[string]float64{"popularity": 3}},
+		{Name: "f2", Content: []byte("two"), Generated: true},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %+v, want %+v", docs, want)
+	}
+}
+
+func TestReadLegacyGenerated(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle"), RankSignals: map[string]float64{legacyGeneratedSignal: 1, "popularity": 3}},
+		Document{Name: "f2", Content: []byte("needle"), RankSignals: map[string]float64{legacyGeneratedSignal: 1}},
+		Document{Name: "f3", Content: []byte("needle")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	data := downgradeShard(t, buf.Bytes(), firstGeneratedVersion-1)
+
+	_, docs, err := ReadDocuments(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	want := []Document{
+		{Name: "f1", Content: []byte("needle"), Generated: true, RankSignals: map[string]float64{"popularity": 3}},
+		{Name: "f2", Content: []byte("needle"), Generated: true},
+		{Name: "f3", Content: []byte("needle")},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %+v, want %+v", docs, want)
+	}
+
+	signals, err := ReadRankSignals(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadRankSignals: %v", err)
+	}
+	if want := map[uint32]map[string]float64{0: {"popularity": 3}}; !reflect.DeepEqual(signals, want) {
+		t.Errorf("got signals %v, want %v", signals, want)
+	}
+
+	searcher, err := NewSearcher(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("NewSearcher: %v", err)
+	}
+	defer searcher.Close()
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &SearchOptions{SkipGenerated: true})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "f3" {
+		t.Errorf("got %v, want a match in f3", res.Files)
+	}
+}
+
+func TestReadChecksumMismatch(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("abcde")},
+		Document{Name: "f2", Content: []byte("fghij")})
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var toc indexTOC
+	r := reader{r: &memSeeker{buf.Bytes()}}
+	if err := r.readTOC(&toc); err != nil {
+		t.Fatalf("readTOC: %v", err)
+	}
+
+	for name, off := range map[string]uint32{
+		"fileContents":     toc.fileContents.data.off + 1,
+		"postings":         toc.postings.data.off,
+		"contentChecksums": toc.contentChecksums.off,
+	} {
+		data := append([]byte{}, buf.Bytes()...)
+		data[off] ^= 0xff
+
+		err := verifyIndexFile(&memSeeker{data})
+		if err == nil {
+			t.Errorf("%s: corrupt section verified without error", name)
+		} else if !strings.Contains(err.Error(), name) || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("%s: got error %v, want checksum mismatch in section", name, err)
+		}
+	}
+}
+
+// fullDisk is an io.Writer that fails once n bytes are written.
+type fullDisk struct {
+	n int
+}
+
+func (d *fullDisk) Write(b []byte) (int, error) {
+	if len(b) > d.n {
+		n := d.n
+		d.n = 0
+		return n, fmt.Errorf("disk full")
+	}
+	d.n -= len(b)
+	return len(b), nil
+}
+
+func TestWriteFlushError(t *testing.T) {
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: []byte("abcde")})
+
+	// The shard fits in the write buffer, so the error only shows
+	// when it is flushed.
+	if err := b.Write(&fullDisk{n: 100}); err == nil {
+		t.Errorf("Write to a full disk succeeded")
+	}
+}
+
+func TestReadTrailer(t *testing.T) {
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: []byte("abcde")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Drop the last byte of the TOC. Its location is still
+	// within the file.
+	short := append([]byte{}, data[:len(data)-17]...)
+	short = append(short, data[len(data)-16:]...)
+	if _, err := NewSearcher(&memSeeker{short}); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("got error %v for short file, want truncated", err)
+	}
+
+	// The checksum is only checked by VerifyIndex, as it needs a
+	// read of the whole file.
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-12] ^= 0xff
+	if _, err := NewSearcher(&memSeeker{corrupt}); err != nil {
+		t.Errorf("NewSearcher with bad file checksum: %v", err)
+	}
+	if err := verifyIndexFile(&memSeeker{corrupt}); err == nil || !strings.Contains(err.Error(), "file checksum") {
+		t.Errorf("got error %v for bad checksum, want file checksum mismatch", err)
+	}
+}
+
+func TestReadFormatVersion(t *testing.T) {
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: []byte("needle")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := string(buf.Bytes()[:len(indexMagic)]); got != indexMagic {
+		t.Fatalf("got header %q, want %q", got, indexMagic)
+	}
+
+	for version := oldestReadableVersion; version <= IndexFormatVersion; version++ {
+		data := downgradeShard(t, buf.Bytes(), version)
+		rd := &reader{r: &memSeeker{data}}
+		if got, err := rd.readFormatVersion(); err != nil {
+			t.Fatalf("readFormatVersion: %v", err)
+		} else if got != version {
+			t.Errorf("got version %d, want %d", got, version)
+		}
+
+		res := searchForTestFile(t, data, &query.Substring{Pattern: "needle"})
+		if len(res.Files) != 1 {
+			t.Errorf("v%d: got %v, want 1 match", version, res.Files)
+		}
+	}
+
+	old := downgradeShard(t, buf.Bytes(), oldestReadableVersion-1)
+	want := fmt.Sprintf("unsupported index version %d, expected %d", oldestReadableVersion-1, IndexFormatVersion)
+	if _, err := NewSearcher(&memSeeker{old}); err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+
+	future := append([]byte{}, buf.Bytes()...)
+	binary.BigEndian.PutUint32(future[len(indexMagic):], IndexFormatVersion+1)
+	want = fmt.Sprintf("unsupported index version %d, expected %d", IndexFormatVersion+1, IndexFormatVersion)
+	if _, err := NewSearcher(&memSeeker{future}); err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestReadVersion13(t *testing.T) {
+	repo := &Repository{
+		Name:     "repo",
+		Branches: []RepositoryBranch{{Name: "master"}, {Name: "stable"}},
+	}
+	b := testIndexBuilder(t, repo,
+		Document{Name: "f1", Content: []byte("needle haystack"), Branches: []string{"master"}},
+		Document{Name: "f2", Content: []byte("another needle"), Branches: []string{"master", "stable"}})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	wantRepo, wantDocs, err := ReadDocuments(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+
+	data := downgradeShard(t, buf.Bytes(), 13)
+	res := searchForTestFile(t, data, &query.And{Children: []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Branch{Pattern: "stable"},
+	}})
+	if len(res.Files) != 1 || res.Files[0].FileName != "f2" {
+		t.Errorf("got %v, want a match in f2", res.Files)
+	}
+
+	gotRepo, gotDocs, err := ReadDocuments(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadDocuments(v13): %v", err)
+	}
+	if !reflect.DeepEqual(gotRepo, wantRepo) {
+		t.Errorf("got repository %+v, want %+v", gotRepo, wantRepo)
+	}
+	if !reflect.DeepEqual(gotDocs, wantDocs) {
+		t.Errorf("got documents %+v, want %+v", gotDocs, wantDocs)
+	}
+	if _, md, err := ReadMetadata(&memSeeker{data}); err != nil {
+		t.Fatalf("ReadMetadata(v13): %v", err)
+	} else if md.IndexFormatVersion != 13 {
+		t.Errorf("got version %d, want 13", md.IndexFormatVersion)
+	}
+}
+
+func searchForTestFile(t *testing.T, data []byte, q query.Q) *SearchResult {
+	searcher, err := NewSearcher(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("NewSearcher: %v", err)
+	}
+	res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search(%s): %v", q, err)
+	}
+	return res
+}
+
+func compressedContentTestDocs() []Document {
+	return []Document{
+		{Name: "repeated", Content: bytes.Repeat([]byte("func repeated() {}\n"), 100)},
+		{Name: "short", Content: []byte("x")},
+		{Name: "unicode", Content: []byte(strings.Repeat("grüße ", 200) + "needle über\n")},
+	}
+}
+
+func TestReadCompressedContent(t *testing.T) {
+	docs := compressedContentTestDocs()
+	shards := map[bool][]byte{}
+	for _, compress := range []bool{false, true} {
+		b := testIndexBuilder(t, nil, docs...)
+		b.SetCompressContent(compress)
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		shards[compress] = buf.Bytes()
+	}
+	if raw, compressed := len(shards[false]), len(shards[true]); compressed >= raw {
+		t.Errorf("compressed shard has %d bytes, uncompressed %d", compressed, raw)
+	}
+
+	var toc indexTOC
+	rd := &reader{r: &memSeeker{shards[true]}}
+	if err := rd.readTOC(&toc); err != nil {
+		t.Fatalf("readTOC: %v", err)
+	}
+	if toc.fileContents.codec != codecZstd {
+		t.Fatalf("got codec %d, want %d", toc.fileContents.codec, codecZstd)
+	}
+	var flags []byte
+	for _, o := range toc.fileContents.offsets {
+		flags = append(flags, shards[true][o])
+	}
+	if want := []byte{itemZstd, itemRaw, itemZstd}; !bytes.Equal(flags, want) {
+		t.Errorf("got item flags %v, want %v", flags, want)
+	}
+
+	_, got, err := ReadDocuments(&memSeeker{shards[true]})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+	for i := range docs {
+		if !bytes.Equal(got[i].Content, docs[i].Content) {
+			t.Errorf("%s: got content %q, want %q", docs[i].Name, got[i].Content, docs[i].Content)
+		}
+	}
+
+	q := &query.Substring{Pattern: "über", Content: true}
+	want := searchForTestFile(t, shards[false], q)
+	res := searchForTestFile(t, shards[true], q)
+	if len(res.Files) != 1 || !reflect.DeepEqual(res.Files[0].LineMatches, want.Files[0].LineMatches) {
+		t.Errorf("got %+v, want %+v", res.Files, want.Files)
+	}
+}
+
+func TestSharedContent(t *testing.T) {
+	content := []byte(strings.Repeat("grüße ", 200) + "needle über\n")
+	docs := []Document{
+		{Name: "a/copy", Content: content},
+		{Name: "other", Content: []byte("needle elsewhere\n")},
+		{Name: "b/copy", Content: content},
+		{Name: "c/copy", Content: content, Symbols: []DocumentSection{{Start: 0, End: 5}}},
+	}
+	for _, compress := range []bool{false, true} {
+		b := testIndexBuilder(t, nil, docs...)
+		b.SetCompressContent(compress)
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		data := buf.Bytes()
+
+		var toc indexTOC
+		rd := &reader{r: &memSeeker{data}}
+		if err := rd.readTOC(&toc); err != nil {
+			t.Fatalf("readTOC: %v", err)
+		}
+		if got := len(toc.fileContents.offsets); got != 2 {
+			t.Errorf("compress %v: got %d content items, want 2", compress, got)
+		}
+		if err := verifyIndexFile(&memSeeker{data}); err != nil {
+			t.Errorf("compress %v: verifyIndexFile: %v", compress, err)
+		}
+
+		_, got, err := ReadDocuments(&memSeeker{data})
+		if err != nil {
+			t.Fatalf("ReadDocuments: %v", err)
+		}
+		for i := range docs {
+			if !bytes.Equal(got[i].Content, docs[i].Content) {
+				t.Errorf("compress %v: %s: got content %q, want %q", compress, docs[i].Name, got[i].Content, docs[i].Content)
+			}
+		}
+
+		res := searchForTestFile(t, data, &query.Substring{Pattern: "über", Content: true})
+		if len(res.Files) != 3 {
+			t.Fatalf("compress %v: got %v, want 3 files", compress, res.Files)
+		}
+		for _, f := range res.Files {
+			if len(f.LineMatches) != 1 || len(f.LineMatches[0].LineFragments) != 1 {
+				t.Fatalf("compress %v: %s: got matches %+v", compress, f.FileName, f.LineMatches)
+			}
+			m := f.LineMatches[0].LineFragments[0]
+			if want := bytes.Index(content, []byte("über")); m.LineOffset != want || m.MatchLength != len("über") {
+				t.Errorf("compress %v: %s: got match %+v, want offset %d", compress, f.FileName, m, want)
+			}
+		}
+
+		res = searchForTestFile(t, data, &query.Substring{Pattern: "needle", Content: true})
+		if len(res.Files) != 4 {
+			t.Errorf("compress %v: got %v, want 4 files", compress, res.Files)
+		}
+	}
+}
+
+func TestPackPostings(t *testing.T) {
+	docs := compressedContentTestDocs()
+	shards := map[bool][]byte{}
+	for _, pack := range []bool{false, true} {
+		b := testIndexBuilder(t, nil, docs...)
+		b.SetPackPostings(pack)
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		shards[pack] = buf.Bytes()
+	}
+	if raw, packed := len(shards[false]), len(shards[true]); packed >= raw {
+		t.Errorf("packed shard has %d bytes, unpacked %d", packed, raw)
+	}
+
+	var toc indexTOC
+	rd := &reader{r: &memSeeker{shards[true]}}
+	if err := rd.readTOC(&toc); err != nil {
+		t.Fatalf("readTOC: %v", err)
+	}
+	if toc.postings.codec != codecPostings || toc.namePostings.codec != codecPostings {
+		t.Fatalf("got codecs %d and %d, want %d", toc.postings.codec, toc.namePostings.codec, codecPostings)
+	}
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "repeated", Content: true},
+		&query.Substring{Pattern: "Über", Content: true},
+		&query.Substring{Pattern: "uni", FileName: true},
+	} {
+		want := searchForTestFile(t, shards[false], q)
+		res := searchForTestFile(t, shards[true], q)
+		if len(res.Files) == 0 || !reflect.DeepEqual(res.Files, want.Files) {
+			t.Errorf("%s: got %+v, want %+v", q, res.Files, want.Files)
+		}
+	}
+}
+
+// realShardBuilder returns a builder holding the Go files in the
+// current directory.
+func realShardBuilder(b *testing.B) *IndexBuilder {
+	fs, err := filepath.Glob("*.go")
+	if err != nil {
+		b.Fatalf("Glob: %v", err)
+	}
+	ib, err := NewIndexBuilder(nil)
+	if err != nil {
+		b.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, fn := range fs {
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			b.Fatalf("ReadFile: %v", err)
+		}
+		if err := ib.Add(Document{Name: fn, Content: content}); err != nil {
+			b.Fatalf("Add: %v", err)
+		}
+	}
+	return ib
+}
+
+// realPostings returns the content posting lists for the Go files in
+// the current directory.
+func realPostings(b *testing.B) [][]byte {
+	ib := realShardBuilder(b)
+	var postings [][]byte
+	for _, p := range ib.contentPostings.postings {
+		postings = append(postings, p)
+	}
+	return postings
+}
+
+func BenchmarkDecodePostings(b *testing.B) {
+	varints := realPostings(b)
+	tagged := make([][]byte, len(varints))
+	var varintBytes, taggedBytes int
+	for i, p := range varints {
+		tagged[i] = toTaggedDeltas(p)
+		varintBytes += len(p)
+		taggedBytes += len(tagged[i])
+	}
+	b.Logf("%d posting lists: %d bytes as varints, %d tagged", len(varints), varintBytes, taggedBytes)
+
+	var buf []uint32
+	b.Run("varint", func(b *testing.B) {
+		b.SetBytes(int64(varintBytes))
+		for n := 0; n < b.N; n++ {
+			for _, p := range varints {
+				buf = fromDeltas(p, buf)
+			}
+		}
+	})
+	b.Run("tagged", func(b *testing.B) {
+		b.SetBytes(int64(taggedBytes))
+		for n := 0; n < b.N; n++ {
+			for _, p := range tagged {
+				var err error
+				if buf, err = fromTaggedDeltas(p, buf); err != nil {
+					b.Fatalf("fromTaggedDeltas: %v", err)
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkPackPostings compares the size of a real shard and the
+// speed of searching it with either posting list encoding.
+func BenchmarkPackPostings(b *testing.B) {
+	ib := realShardBuilder(b)
+	q := &query.Substring{Pattern: "posting", Content: true}
+	for _, pack := range []bool{false, true} {
+		ib.SetPackPostings(pack)
+		var buf bytes.Buffer
+		if err := ib.Write(&buf); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+		searcher, err := NewSearcher(&memSeeker{buf.Bytes()})
+		if err != nil {
+			b.Fatalf("NewSearcher: %v", err)
+		}
+
+		name := "varint"
+		if pack {
+			name = "packed"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportMetric(float64(buf.Len()), "shard-bytes")
+			for n := 0; n < b.N; n++ {
+				if _, err := searcher.Search(context.Background(), q, &SearchOptions{}); err != nil {
+					b.Fatalf("Search: %v", err)
+				}
+			}
+		})
+		searcher.Close()
+	}
+}
+
+func BenchmarkReadContents(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		ib, err := NewIndexBuilder(nil)
+		if err != nil {
+			b.Fatalf("NewIndexBuilder: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			for _, d := range compressedContentTestDocs() {
+				d.Name = fmt.Sprintf("%s%d", d.Name, i)
+				if err := ib.Add(d); err != nil {
+					b.Fatalf("Add: %v", err)
+				}
+			}
+		}
+		ib.SetCompressContent(compress)
+		var buf bytes.Buffer
+		if err := ib.Write(&buf); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+		searcher, err := NewSearcher(&memSeeker{buf.Bytes()})
+		if err != nil {
+			b.Fatalf("NewSearcher: %v", err)
+		}
+		d := searcher.(*indexData)
+
+		name := "raw"
+		if compress {
+			name = "zstd"
+		}
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				for i := 0; i+1 < len(d.boundaries); i++ {
+					if _, err := d.readContents(uint32(i)); err != nil {
+						b.Fatalf("readContents: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// countingFile counts the writes to a file.
+type countingFile struct {
+	*os.File
+	writes int
+}
+
+func (f *countingFile) Write(b []byte) (int, error) {
+	f.writes++
+	return f.File.Write(b)
+}
+
+// BenchmarkWrite writes a shard of the Go files in the current
+// directory straight to a file, so each write to it is a syscall.
+func BenchmarkWrite(b *testing.B) {
+	fs, err := filepath.Glob("*.go")
+	if err != nil {
+		b.Fatalf("Glob: %v", err)
+	}
+	ib, err := NewIndexBuilder(nil)
+	if err != nil {
+		b.Fatalf("NewIndexBuilder: %v", err)
+	}
+	for _, fn := range fs {
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			b.Fatalf("ReadFile: %v", err)
+		}
+		if err := ib.Add(Document{Name: fn, Content: content}); err != nil {
+			b.Fatalf("Add: %v", err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "shard")
+	if err != nil {
+		b.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := f.Seek(0, 0); err != nil {
+			b.Fatalf("Seek: %v", err)
+		}
+		cf := &countingFile{File: f}
+		if err := ib.Write(cf); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+		b.ReportMetric(float64(cf.writes), "writes/op")
+	}
+}
+
+func TestNewMmapReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmap")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: []byte("needle")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	name := filepath.Join(dir, "shard.zoekt")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := NewMmapReader(name)
+	if err != nil {
+		t.Fatalf("NewMmapReader: %v", err)
+	}
+	searcher, err := NewSearcher(f)
+	if err != nil {
+		t.Fatalf("NewSearcher: %v", err)
+	}
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 match", res.Files)
+	}
+	searcher.Close()
+
+	// An empty file can't be mapped, so it is read instead.
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	f, err = NewMmapReader(empty)
+	if err != nil {
+		t.Fatalf("NewMmapReader: %v", err)
+	}
+	defer f.Close()
+	if sz, err := f.Size(); err != nil || sz != 0 {
+		t.Errorf("got size %d, %v, want 0", sz, err)
+	}
+	if _, err := f.Read(0, 1); err == nil {
+		t.Errorf("Read beyond the end succeeded")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RepositoryJSONVersion is the schema version written by
+// Repository.ExportJSON. It is increased for changes that older
+// readers can't handle; adding fields does not change it.
+const RepositoryJSONVersion = 1
+
+// repositoryJSON is the exported form of Repository. Unlike Repository
+// itself, its field names are part of a stable format, so they must
+// not be renamed.
+//
+// Version 1:
+//
+//	{
+//	  "version": 1,
+//	  "name": "github.com/foo/bar",
+//	  "url": "https://github.com/foo/bar",
+//	  "archived": true,
+//	  "branches": [{"name": "master", "version": "<sha1>"}],
+//	  "templates": {
+//	    "commit": "...",
+//	    "file": "...",
+//	    "lineFragment": "..."
+//	  },
+//	  "subRepositories": {"<path>": {"name": ..., ...}}
+//	}
+//
+// Sub repositories use the same schema without "version".
+type repositoryJSON struct {
+	Version         int                        `json:"version,omitempty"`
+	Name            string                     `json:"name"`
+	URL             string                     `json:"url,omitempty"`
+	Archived        bool                       `json:"archived,omitempty"`
+	Branches        []branchJSON               `json:"branches"`
+	Templates       templatesJSON              `json:"templates"`
+	SubRepositories map[string]*repositoryJSON `json:"subRepositories,omitempty"`
+}
+
+type branchJSON struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type templatesJSON struct {
+	Commit       string `json:"commit,omitempty"`
+	File         string `json:"file,omitempty"`
+	LineFragment string `json:"lineFragment,omitempty"`
+}
+
+func (r *Repository) toJSON() *repositoryJSON {
+	j := &repositoryJSON{
+		Name:     r.Name,
+		URL:      r.URL,
+		Archived: r.Archived,
+		Branches: []branchJSON{},
+		Templates: templatesJSON{
+			Commit:       r.CommitURLTemplate,
+			File:         r.FileURLTemplate,
+			LineFragment: r.LineFragmentTemplate,
+		},
+	}
+	for _, b := range r.Branches {
+		j.Branches = append(j.Branches, branchJSON{Name: b.Name, Version: b.Version})
+	}
+	if len(r.SubRepoMap) > 0 {
+		j.SubRepositories = map[string]*repositoryJSON{}
+		for path, sub := range r.SubRepoMap {
+			j.SubRepositories[path] = sub.toJSON()
+		}
+	}
+	return j
+}
+
+func (j *repositoryJSON) toRepository() *Repository {
+	r := &Repository{
+		Name:                 j.Name,
+		URL:                  j.URL,
+		Archived:             j.Archived,
+		CommitURLTemplate:    j.Templates.Commit,
+		FileURLTemplate:      j.Templates.File,
+		LineFragmentTemplate: j.Templates.LineFragment,
+	}
+	for _, b := range j.Branches {
+		r.Branches = append(r.Branches, RepositoryBranch{Name: b.Name, Version: b.Version})
+	}
+	if len(j.SubRepositories) > 0 {
+		r.SubRepoMap = map[string]*Repository{}
+		for path, sub := range j.SubRepositories {
+			r.SubRepoMap[path] = sub.toRepository()
+		}
+	}
+	return r
+}
+
+// ExportJSON returns the repository description in a versioned JSON
+// format, which is independent of the index file format.
+func (r *Repository) ExportJSON() ([]byte, error) {
+	j := r.toJSON()
+	j.Version = RepositoryJSONVersion
+	return json.MarshalIndent(j, "", "  ")
+}
+
+// ImportRepositoryJSON parses the output of Repository.ExportJSON.
+func ImportRepositoryJSON(data []byte) (*Repository, error) {
+	var j repositoryJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	if j.Version < 1 || j.Version > RepositoryJSONVersion {
+		return nil, fmt.Errorf("unsupported repository JSON version %d, want at most %d", j.Version, RepositoryJSONVersion)
+	}
+	return j.toRepository(), nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepositoryJSON(t *testing.T) {
+	repo := &Repository{
+		Name:     "repo",
+		URL:      "https://example.com/repo",
+		Archived: true,
+		Branches: []RepositoryBranch{
+			{Name: "master", Version: "abc"},
+			{Name: "stable", Version: "def"},
+		},
+		CommitURLTemplate:    "commit/{{.Version}}",
+		FileURLTemplate:      "file/{{.Version}}/{{.Path}}",
+		LineFragmentTemplate: "#L{{.LineNumber}}",
+		SubRepoMap: map[string]*Repository{
+			"sub": {
+				Name:     "subrepo",
+				Branches: []RepositoryBranch{{Name: "master", Version: "123"}},
+			},
+		},
+	}
+
+	blob, err := repo.ExportJSON()
+	if err != nil {
+		t.Fatalf("ExportJSON: %v", err)
+	}
+	if !strings.Contains(string(blob), `"version": 1`) {
+		t.Errorf("missing version in %s", blob)
+	}
+
+	got, err := ImportRepositoryJSON(blob)
+	if err != nil {
+		t.Fatalf("ImportRepositoryJSON: %v", err)
+	}
+	if !reflect.DeepEqual(got, repo) {
+		t.Errorf("got %#v, want %#v", got, repo)
+	}
+
+	for _, bad := range []string{
+		`{"name": "repo"}`,
+		`{"version": 2, "name": "repo"}`,
+		`not json`,
+	} {
+		if _, err := ImportRepositoryJSON([]byte(bad)); err == nil {
+			t.Errorf("ImportRepositoryJSON(%s): got no error", bad)
+		}
+	}
+}
@@ -16,6 +16,8 @@ package zoekt
 
 import (
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 )
@@ -27,6 +29,13 @@ type writer struct {
 	err error
 	w   io.Writer
 	off uint32
+
+	// CRC32 (IEEE) of the bytes written since the current section
+	// started.
+	crc uint32
+
+	// CRC32 (IEEE) of all bytes written.
+	fileCRC uint32
 }
 
 func (w *writer) Write(b []byte) error {
@@ -36,12 +45,36 @@ func (w *writer) Write(b []byte) error {
 
 	var n int
 	n, w.err = w.w.Write(b)
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, b[:n])
+	w.fileCRC = crc32.Update(w.fileCRC, crc32.IEEETable, b[:n])
 	w.off += uint32(n)
 	return w.err
 }
 
 func (w *writer) Off() uint32 { return w.off }
 
+// Finish ends the file with the trailer: the length and checksum of
+// everything written so far, followed by the location of the table
+// of contents. It flushes the underlying writer if it is buffered,
+// and returns the first error.
+func (w *writer) Finish(toc simpleSection) error {
+	length, crc := w.off, w.fileCRC
+	w.U32(length)
+	w.U32(crc)
+
+	// The last 8 bytes have no checksum, so readers of all
+	// versions can find the TOC.
+	w.U32(toc.off)
+	w.U32(toc.sz)
+
+	if f, ok := w.w.(interface {
+		Flush() error
+	}); ok && w.err == nil {
+		w.err = f.Flush()
+	}
+	return w.err
+}
+
 func (w *writer) B(b byte) {
 	s := []byte{b}
 	w.Write(s)
@@ -65,24 +98,40 @@ func (w *writer) Varint(n uint32) {
 	w.Write(enc[:m])
 }
 
+// start starts the section. Sections may not be nested, as they
+// share the running checksum of the writer.
 func (s *simpleSection) start(w *writer) {
 	s.off = w.Off()
+	w.crc = 0
 }
 
 func (s *simpleSection) end(w *writer) {
 	s.sz = w.Off() - s.off
+	s.checksum = w.crc
 }
 
 // section is a range of bytes in the index file.
 type section interface {
 	read(*reader) error
 	write(*writer)
+
+	// verify checks the content of the section against its
+	// checksums.
+	verify(IndexFile) error
 }
 
+// firstChecksumVersion is the first format version that stores
+// section checksums.
+const firstChecksumVersion = 15
+
 // simpleSection is a simple range of bytes.
 type simpleSection struct {
 	off uint32
 	sz  uint32
+
+	// CRC32 (IEEE) of the section content. Only sections listed
+	// in the TOC have one.
+	checksum uint32
 }
 
 func (s *simpleSection) read(r *reader) error {
@@ -95,12 +144,38 @@ func (s *simpleSection) read(r *reader) error {
 	if err != nil {
 		return err
 	}
+	if r.formatVersion() >= firstChecksumVersion {
+		s.checksum, err = r.U32()
+		if err != nil {
+			return err
+		}
+	}
+
+	fileSize, err := r.r.Size()
+	if err != nil {
+		return err
+	}
+	if uint64(s.off)+uint64(s.sz) > uint64(fileSize) {
+		return fmt.Errorf("offset %d + size %d beyond file size %d", s.off, s.sz, fileSize)
+	}
 	return nil
 }
 
 func (s *simpleSection) write(w *writer) {
 	w.U32(s.off)
 	w.U32(s.sz)
+	w.U32(s.checksum)
+}
+
+func (s *simpleSection) verify(f IndexFile) error {
+	blob, err := f.Read(s.off, s.sz)
+	if err != nil {
+		return err
+	}
+	if got := crc32.ChecksumIEEE(blob); got != s.checksum {
+		return fmt.Errorf("checksum mismatch for %d bytes at offset %d: got %08x, want %08x", s.sz, s.off, got, s.checksum)
+	}
+	return nil
 }
 
 // compoundSection is a range of bytes containg a list of variable
@@ -110,24 +185,53 @@ type compoundSection struct {
 
 	offsets []uint32
 	index   simpleSection
+
+	// codec says how the items are stored. It must be set before
+	// the section is started.
+	codec sectionCodec
+
+	// sizes holds the decoded size of each item if the codec
+	// stores sizes.
+	sizes []uint32
 }
 
 func (s *compoundSection) start(w *writer) {
 	s.data.start(w)
 }
 
+// firstDeltaIndexVersion is the first format version that stores
+// the index of compound sections as varints rather than U32s.
+const firstDeltaIndexVersion = 20
+
+// end writes the index: the codec as U32, the offsets as sized
+// deltas, and the sizes as varints if the codec stores them.
 func (s *compoundSection) end(w *writer) {
 	s.data.end(w)
 	s.index.start(w)
-	for _, o := range s.offsets {
-		w.U32(o)
+	w.U32(uint32(s.codec))
+	w.Write(toSizedDeltas(s.offsets))
+	for _, sz := range s.sizes {
+		w.Varint(sz)
 	}
 	s.index.end(w)
 }
 
 func (s *compoundSection) addItem(w *writer, item []byte) {
 	s.offsets = append(s.offsets, w.Off())
-	w.Write(item)
+	if !s.codec.storesSizes() {
+		w.Write(item)
+		return
+	}
+
+	s.sizes = append(s.sizes, uint32(len(item)))
+	enc, err := s.codec.encodeItem(item)
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	w.Write(enc)
 }
 
 func (s *compoundSection) write(w *writer) {
@@ -135,6 +239,16 @@ func (s *compoundSection) write(w *writer) {
 	s.index.write(w)
 }
 
+func (s *compoundSection) verify(f IndexFile) error {
+	if err := s.data.verify(f); err != nil {
+		return fmt.Errorf("data: %v", err)
+	}
+	if err := s.index.verify(f); err != nil {
+		return fmt.Errorf("index: %v", err)
+	}
+	return nil
+}
+
 func (s *compoundSection) read(r *reader) error {
 	if err := s.data.read(r); err != nil {
 		return err
@@ -143,14 +257,130 @@ func (s *compoundSection) read(r *reader) error {
 		return err
 	}
 	var err error
-	s.offsets, err = readSectionU32(r.r, s.index)
-	return err
+	if r.formatVersion() >= firstDeltaIndexVersion {
+		err = s.readDeltaIndex(r)
+	} else {
+		err = s.readU32Index(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	fileSize, err := r.r.Size()
+	if err != nil {
+		return err
+	}
+	last := s.data.off
+	end := s.data.off + s.data.sz
+	for i, o := range s.offsets {
+		if o < last || o > end {
+			return fmt.Errorf("item %d: offset %d outside [%d, %d] (file size %d)", i, o, last, end, fileSize)
+		}
+		last = o
+	}
+	return nil
+}
+
+// readDeltaIndex reads an index as written by end.
+func (s *compoundSection) readDeltaIndex(r *reader) error {
+	blob, err := r.r.Read(s.index.off, s.index.sz)
+	if err != nil {
+		return err
+	}
+	if len(blob) < 4 {
+		return fmt.Errorf("index without codec header")
+	}
+	s.codec = sectionCodec(binary.BigEndian.Uint32(blob))
+	blob = blob[4:]
+	switch s.codec {
+	case codecNone, codecPostings, codecZstd:
+	default:
+		return fmt.Errorf("unknown codec %d", s.codec)
+	}
+
+	n, m := binary.Uvarint(blob)
+	// Each entry takes at least a byte.
+	if m <= 0 || n > uint64(len(blob)-m) {
+		return fmt.Errorf("index has a bad item count")
+	}
+	blob = blob[m:]
+	readVarints := func(delta bool) ([]uint32, error) {
+		result := make([]uint32, 0, n)
+		var last uint32
+		for i := uint64(0); i < n; i++ {
+			v, m := binary.Uvarint(blob)
+			if m <= 0 {
+				return nil, fmt.Errorf("index ends at item %d of %d", i, n)
+			}
+			blob = blob[m:]
+			if delta {
+				last += uint32(v)
+				v = uint64(last)
+			}
+			result = append(result, uint32(v))
+		}
+		return result, nil
+	}
+	if s.offsets, err = readVarints(true); err != nil {
+		return err
+	}
+	if s.codec.storesSizes() {
+		if s.sizes, err = readVarints(false); err != nil {
+			return err
+		}
+	}
+	if len(blob) > 0 {
+		return fmt.Errorf("index has %d trailing bytes", len(blob))
+	}
+	return nil
+}
+
+// readU32Index reads an index of U32s, starting with the codec from
+// firstCodecVersion on.
+func (s *compoundSection) readU32Index(r *reader) error {
+	index, err := readSectionU32(r.r, s.index)
+	if err != nil {
+		return err
+	}
+	if r.formatVersion() >= firstCodecVersion {
+		if len(index) == 0 {
+			return fmt.Errorf("index without codec header")
+		}
+		s.codec = sectionCodec(index[0])
+		index = index[1:]
+		switch s.codec {
+		case codecNone, codecPostings:
+		case codecZstd:
+			if len(index)%2 != 0 {
+				return fmt.Errorf("index has %d entries, want offsets and sizes", len(index))
+			}
+			n := len(index) / 2
+			index, s.sizes = index[:n], index[n:]
+		default:
+			return fmt.Errorf("unknown codec %d", s.codec)
+		}
+	}
+	s.offsets = index
+	return nil
 }
 
 // relativeIndex returns the relative offsets of the items (first
-// element is 0), plus a final marking the end of the last item.
+// element is 0), plus a final marking the end of the last item. If
+// the items are encoded, the offsets are those of the decoded items
+// laid out back to back.
 func (s *compoundSection) relativeIndex() []uint32 {
 	ri := make([]uint32, 0, len(s.offsets)+1)
+	if s.codec.storesSizes() {
+		var off uint32
+		for _, sz := range s.sizes {
+			ri = append(ri, off)
+			off += sz
+		}
+		if len(s.sizes) > 0 {
+			ri = append(ri, off)
+		}
+		return ri
+	}
 	for _, o := range s.offsets {
 		ri = append(ri, o-s.offsets[0])
 	}
@@ -160,6 +390,15 @@ func (s *compoundSection) relativeIndex() []uint32 {
 	return ri
 }
 
+// readBlob returns the decoded item i.
 func (s *compoundSection) readBlob(r *indexData, i uint32) ([]byte, error) {
-	return r.readSectionBlob(simpleSection{s.offsets[i], s.offsets[i+1] - s.offsets[i]})
+	end := s.data.off + s.data.sz
+	if int(i)+1 < len(s.offsets) {
+		end = s.offsets[i+1]
+	}
+	blob, err := r.readSectionBlob(simpleSection{off: s.offsets[i], sz: end - s.offsets[i]})
+	if err != nil {
+		return nil, err
+	}
+	return s.codec.decodeItem(blob)
 }
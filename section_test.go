@@ -27,3 +27,57 @@ func TestDeltas(t *testing.T) {
 		t.Errorf("got %v, want %v", round, in)
 	}
 }
+
+func TestTaggedDeltas(t *testing.T) {
+	for _, tc := range []struct {
+		in  []uint32
+		tag byte
+	}{
+		{[]uint32{7}, postingsVarint},
+		{[]uint32{1000, 1001, 1002, 1004, 1007, 1010, 1011, 1020}, postingsPacked},
+		{[]uint32{0, 1 << 20, 1 << 31, 0xffffffff}, postingsVarint},
+		{[]uint32{0, 0xffffffff}, postingsVarint},
+		{[]uint32{5, 5, 5, 5, 5, 5, 5, 5, 5, 5}, postingsPacked},
+	} {
+		// The builder stores postings as deltas without a count.
+		varints := toSizedDeltas(tc.in)
+		varints = varints[1:]
+
+		enc := toTaggedDeltas(varints)
+		if enc[0] != tc.tag {
+			t.Errorf("%v: got encoding %d, want %d", tc.in, enc[0], tc.tag)
+		}
+		if len(enc) > len(varints)+1 {
+			t.Errorf("%v: got %d bytes, more than %d for varints", tc.in, len(enc), len(varints)+1)
+		}
+		got, err := fromTaggedDeltas(enc, nil)
+		if err != nil {
+			t.Fatalf("%v: fromTaggedDeltas: %v", tc.in, err)
+		}
+		if !reflect.DeepEqual(got, tc.in) {
+			t.Errorf("got %v, want %v", got, tc.in)
+		}
+
+		// Widths up to 32 bits must survive packing.
+		packed := packDeltas(tc.in)
+		if got, err := fromTaggedDeltas(packed, nil); err != nil || !reflect.DeepEqual(got, tc.in) {
+			t.Errorf("packed %v: got %v, %v", tc.in, got, err)
+		}
+		if _, err := fromTaggedDeltas(packed[:len(packed)-1], nil); len(tc.in) > 1 && err == nil {
+			t.Errorf("packed %v: truncated list decoded", tc.in)
+		}
+	}
+
+	if _, err := fromTaggedDeltas([]byte{9, 1}, nil); err == nil {
+		t.Errorf("unknown encoding decoded")
+	}
+	// A corrupt count must not allocate beyond the bytes it comes with.
+	huge := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x01}
+	for _, width := range []byte{0, 1} {
+		enc := append([]byte{postingsPacked}, huge...)
+		enc = append(enc, 0, width, 0xff)
+		if _, err := fromTaggedDeltas(enc, nil); err == nil {
+			t.Errorf("width %d: list of %d bytes with count 1<<35 decoded", width, len(enc))
+		}
+	}
+}
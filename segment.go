@@ -0,0 +1,177 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/zoekt/query"
+	"golang.org/x/net/context"
+)
+
+// A segment is a small shard file appended to a base shard. It uses
+// the normal shard format, and holds documents that were added or
+// changed after the base was written. Its IndexMetadata.Supersedes
+// lists the document names it hides in the base and in the segments
+// before it. Segments do not end in ".zoekt", so loaders that don't
+// know about them only see the base.
+
+// SegmentName returns the file name of segment n of the given shard.
+func SegmentName(shard string, n int) string {
+	return fmt.Sprintf("%s.%05d.segment", strings.TrimSuffix(shard, ".zoekt"), n)
+}
+
+// FindSegments returns the segment files of the given shard, oldest
+// first.
+func FindSegments(shard string) ([]string, error) {
+	pattern := strings.TrimSuffix(shard, ".zoekt") + ".*.segment"
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readSegments reads base and its segments, and marks the documents
+// hidden by later segments.
+func readSegments(base IndexFile, segments []IndexFile) ([]*indexData, error) {
+	var parts []*indexData
+	for _, f := range append([]IndexFile{base}, segments...) {
+		rd, err := newReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		var toc indexTOC
+		if err := rd.readTOC(&toc); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		d, err := rd.readIndexData(&toc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		parts = append(parts, d)
+	}
+
+	hidden := map[string]bool{}
+	for i := len(parts) - 1; i >= 0; i-- {
+		d := parts[i]
+		for doc := 0; doc+1 < len(d.fileNameIndex); doc++ {
+			if hidden[string(d.fileName(uint32(doc)))] {
+				if d.tombstones == nil {
+					d.tombstones = map[uint32]bool{}
+				}
+				d.tombstones[uint32(doc)] = true
+			}
+		}
+		for _, name := range d.metaData.Supersedes {
+			hidden[name] = true
+		}
+	}
+	return parts, nil
+}
+
+// NewSegmentedSearcher creates a Searcher for a base shard and its
+// segments, ordered oldest first. Documents are taken from the newest
+// part that holds them; the repository metadata is that of the newest
+// part.
+func NewSegmentedSearcher(base IndexFile, segments []IndexFile) (Searcher, error) {
+	parts, err := readSegments(base, segments)
+	if err != nil {
+		return nil, err
+	}
+	s := &segmentedSearcher{parts: parts}
+
+	newest := parts[len(parts)-1]
+	s.repoListEntry = newest.repoListEntry
+	s.repoListEntry.Stats = RepoStats{}
+	for _, d := range parts {
+		stats := d.repoListEntry.Stats
+		stats.Documents -= len(d.tombstones)
+		s.repoListEntry.Stats.Add(&stats)
+	}
+	return s, nil
+}
+
+type segmentedSearcher struct {
+	parts         []*indexData
+	repoListEntry RepoListEntry
+}
+
+func (s *segmentedSearcher) Search(ctx context.Context, q query.Q, opts *SearchOptions) (*SearchResult, error) {
+	var agg SearchResult
+	for _, d := range s.parts {
+		res, err := d.Search(ctx, q, opts)
+		if err != nil {
+			return nil, err
+		}
+		agg.Stats.Add(res.Stats)
+		agg.Files = append(agg.Files, res.Files...)
+	}
+	SortFilesByScore(agg.Files)
+	return &agg, nil
+}
+
+func (s *segmentedSearcher) List(ctx context.Context, q query.Q) (*RepoList, error) {
+	// All parts belong to the same repository.
+	l, err := s.parts[len(s.parts)-1].List(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Repos) > 0 {
+		l.Repos[0] = &s.repoListEntry
+	}
+	return l, nil
+}
+
+func (s *segmentedSearcher) Close() {
+	for _, d := range s.parts {
+		d.Close()
+	}
+}
+
+func (s *segmentedSearcher) String() string {
+	return fmt.Sprintf("segmented(%s, %d segments)", s.parts[0].file.Name(), len(s.parts)-1)
+}
+
+// ReadSegmentedDocuments is like ReadDocuments, but returns the
+// documents that are visible in a base shard with segments, and the
+// repository of the newest part. The IndexFiles are not closed.
+func ReadSegmentedDocuments(base IndexFile, segments []IndexFile) (*Repository, *IndexMetadata, []Document, error) {
+	parts, err := readSegments(base, segments)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var docs []Document
+	for _, d := range parts {
+		partDocs, err := d.documents()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for i, doc := range partDocs {
+			if !d.tombstones[uint32(i)] {
+				docs = append(docs, doc)
+			}
+		}
+	}
+	newest := parts[len(parts)-1]
+	repo := newest.repoMetaData
+	md := newest.metaData
+	return &repo, &md, docs, nil
+}
@@ -49,28 +49,85 @@ type shardWatcher struct {
 	quit   chan struct{}
 }
 
-func loadShard(fn string) (*searchShard, error) {
+func openIndexFile(fn string) (zoekt.IndexFile, error) {
 	f, err := os.Open(fn)
 	if err != nil {
 		return nil, err
 	}
-	fi, err := f.Stat()
+	return zoekt.NewIndexFile(f)
+}
+
+// shardModTime returns the newest modification time of the shard and
+// its segments.
+func shardModTime(fn string) (time.Time, error) {
+	fi, err := os.Lstat(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	mtime := fi.ModTime()
+
+	segments, err := zoekt.FindSegments(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, seg := range segments {
+		if fi, err := os.Lstat(seg); err == nil && fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime, nil
+}
+
+func loadShard(fn string) (*searchShard, error) {
+	mtime, err := shardModTime(fn)
 	if err != nil {
 		return nil, err
 	}
 
-	iFile, err := zoekt.NewIndexFile(f)
+	iFile, err := openIndexFile(fn)
 	if err != nil {
 		return nil, err
 	}
-	s, err := zoekt.NewSearcher(iFile)
+
+	segments, err := zoekt.FindSegments(fn)
 	if err != nil {
 		iFile.Close()
-		return nil, fmt.Errorf("NewSearcher(%s): %v", fn, err)
+		return nil, err
+	}
+	if len(segments) == 0 {
+		s, err := zoekt.NewSearcher(iFile)
+		if err != nil {
+			iFile.Close()
+			return nil, fmt.Errorf("NewSearcher(%s): %v", fn, err)
+		}
+		return &searchShard{
+			mtime:    mtime,
+			Searcher: s,
+		}, nil
 	}
 
+	segFiles := make([]zoekt.IndexFile, 0, len(segments))
+	closeAll := func() {
+		iFile.Close()
+		for _, f := range segFiles {
+			f.Close()
+		}
+	}
+	for _, seg := range segments {
+		f, err := openIndexFile(seg)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		segFiles = append(segFiles, f)
+	}
+	s, err := zoekt.NewSegmentedSearcher(iFile, segFiles)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("NewSegmentedSearcher(%s): %v", fn, err)
+	}
 	return &searchShard{
-		mtime:    fi.ModTime(),
+		mtime:    mtime,
 		Searcher: s,
 	}, nil
 }
@@ -92,12 +149,12 @@ func (s *shardWatcher) scan() error {
 	ts := map[string]time.Time{}
 	for _, fn := range fs {
 		key := filepath.Base(fn)
-		fi, err := os.Lstat(fn)
+		mtime, err := shardModTime(fn)
 		if err != nil {
 			continue
 		}
 
-		ts[key] = fi.ModTime()
+		ts[key] = mtime
 	}
 
 	s.lock()
@@ -379,10 +436,16 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q) (*zoekt.RepoList
 			prev, ok := uniq[r.Repository.Name]
 			if !ok {
 				cp := *r
+				cp.Repository.BranchDocuments = nil
+				cp.Repository.AddBranchDocuments(&r.Repository)
+				cp.Repository.LanguageBytes = nil
+				cp.Repository.AddLanguageBytes(&r.Repository)
 				uniq[r.Repository.Name] = &cp
 				names = append(names, r.Repository.Name)
 			} else {
 				prev.Stats.Add(&r.Stats)
+				prev.Repository.AddBranchDocuments(&r.Repository)
+				prev.Repository.AddLanguageBytes(&r.Repository)
 			}
 		}
 	}
@@ -25,7 +25,23 @@ package zoekt
 // 11: file ends in rune offsets.
 // 12: 64-bit branchmasks.
 // 13: content checksums
-const IndexFormatVersion = 13
+// 14: rank signals
+// 15: section checksums
+// 16: file starts with indexMagic and the format version.
+// 17: codec header in the index of compound sections.
+// 18: file length and checksum before the TOC location.
+// 19: last commits of documents.
+// 20: varint index in compound sections.
+// 21: documents with the same content share it.
+// 22: file modes of documents.
+// 23: generated documents.
+// 24: languages of documents.
+const IndexFormatVersion = 24
+
+// indexMagic starts index files from version 16 on. It is followed
+// by the format version as a big-endian uint32, so the version can be
+// read without knowing the layout of the TOC.
+const indexMagic = "\x00ZKT"
 
 // FeatureVersion is increased if a feature is added that requires reindexing data.
 const FeatureVersion = 1
@@ -50,28 +66,86 @@ type indexTOC struct {
 	repoMetaData     simpleSection
 	nameEndRunes     simpleSection
 	contentChecksums simpleSection
+	rankSignals      simpleSection
+	lastCommits      simpleSection
+	contentSlots     simpleSection
+	fileModes        simpleSection
+	generated        simpleSection
+	languages        simpleSection
+}
+
+// taggedSection is a section with a name, for error messages.
+type taggedSection struct {
+	tag string
+	sec section
 }
 
 func (t *indexTOC) sections() []section {
-	return []section{
+	var secs []section
+	for _, s := range t.sectionsTagged() {
+		secs = append(secs, s.sec)
+	}
+	return secs
+}
+
+// sectionsTaggedVersion returns the sections present in the given
+// format version. Only the versions UpgradeShard accepts are
+// supported.
+func (t *indexTOC) sectionsTaggedVersion(version int) []taggedSection {
+	secs := t.sectionsTagged()
+	if version < firstLanguageVersion {
+		// No languages.
+		secs = secs[:len(secs)-1]
+	}
+	if version < firstGeneratedVersion {
+		// No generated.
+		secs = secs[:len(secs)-1]
+	}
+	if version < firstFileModeVersion {
+		// No fileModes.
+		secs = secs[:len(secs)-1]
+	}
+	if version < firstContentSlotsVersion {
+		// No contentSlots.
+		secs = secs[:len(secs)-1]
+	}
+	if version < firstLastCommitVersion {
+		// No lastCommits.
+		secs = secs[:len(secs)-1]
+	}
+	if version < 14 {
+		// No rankSignals.
+		secs = secs[:len(secs)-1]
+	}
+	return secs
+}
+
+func (t *indexTOC) sectionsTagged() []taggedSection {
+	return []taggedSection{
 		// This must be first, so it can be reliably read across
 		// file format versions.
-		&t.metaData,
-		&t.repoMetaData,
-		&t.fileContents,
-		&t.fileNames,
-		&t.fileSections,
-		&t.newlines,
-		&t.ngramText,
-		&t.postings,
-		&t.nameNgramText,
-		&t.namePostings,
-		&t.branchMasks,
-		&t.subRepos,
-		&t.runeOffsets,
-		&t.nameRuneOffsets,
-		&t.fileEndRunes,
-		&t.nameEndRunes,
-		&t.contentChecksums,
+		{"metaData", &t.metaData},
+		{"repoMetaData", &t.repoMetaData},
+		{"fileContents", &t.fileContents},
+		{"fileNames", &t.fileNames},
+		{"fileSections", &t.fileSections},
+		{"newlines", &t.newlines},
+		{"ngramText", &t.ngramText},
+		{"postings", &t.postings},
+		{"nameNgramText", &t.nameNgramText},
+		{"namePostings", &t.namePostings},
+		{"branchMasks", &t.branchMasks},
+		{"subRepos", &t.subRepos},
+		{"runeOffsets", &t.runeOffsets},
+		{"nameRuneOffsets", &t.nameRuneOffsets},
+		{"fileEndRunes", &t.fileEndRunes},
+		{"nameEndRunes", &t.nameEndRunes},
+		{"contentChecksums", &t.contentChecksums},
+		{"rankSignals", &t.rankSignals},
+		{"lastCommits", &t.lastCommits},
+		{"contentSlots", &t.contentSlots},
+		{"fileModes", &t.fileModes},
+		{"generated", &t.generated},
+		{"languages", &t.languages},
 	}
 }
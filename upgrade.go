@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// oldestUpgradableVersion is the oldest format version that
+// UpgradeShard can read. Older versions lack the content checksums,
+// which were stored as computed by the indexer.
+const oldestUpgradableVersion = oldestReadableVersion
+
+// UpgradeShard rewrites the shard in file src in the current format
+// to file dst. The documents, their symbols and the repository
+// metadata are carried over; the posting lists are computed again
+// from the content. It fails for formats it can't read completely, in
+// which case the repository must be indexed again.
+func UpgradeShard(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	iFile, err := NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	defer iFile.Close()
+
+	rd := &reader{r: iFile}
+	version, err := rd.readFormatVersion()
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	if version < oldestUpgradableVersion || version > IndexFormatVersion {
+		return fmt.Errorf("%s: cannot upgrade format v%d to v%d, the repository must be indexed again",
+			src, version, IndexFormatVersion)
+	}
+
+	rd = &reader{r: iFile, version: version}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	docs, err := d.documents()
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+
+	// The document counts per branch are computed again by Add.
+	repo := d.repoMetaData
+	repo.BranchDocuments = nil
+	b, err := NewIndexBuilder(&repo)
+	if err != nil {
+		return err
+	}
+	b.SetTruncateLongLines(d.metaData.TruncateLongLines)
+	b.SetSupersedes(d.metaData.Supersedes)
+	for _, doc := range docs {
+		if err := b.Add(doc); err != nil {
+			return fmt.Errorf("%s: %s: %v", src, doc.Name, err)
+		}
+	}
+
+	// Older documents don't record their language, so keep the
+	// counts as they were.
+	if d.metaData.IndexFormatVersion < firstLanguageVersion {
+		b.repo.LanguageBytes = d.repoMetaData.LanguageBytes
+		for path, sub := range d.repoMetaData.SubRepoMap {
+			if path != "" {
+				b.repo.SubRepoMap[path].LanguageBytes = sub.LanguageBytes
+			}
+		}
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := b.Write(out); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := checkUpgrade(d, out.Name()); err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// checkUpgrade verifies that the rewritten shard in file name has the
+// same documents and repository metadata as the old one.
+func checkUpgrade(old *indexData, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	iFile, err := NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	defer iFile.Close()
+
+	rd := &reader{r: iFile}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return err
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return err
+	}
+
+	if len(d.checksums) != len(old.checksums) {
+		return fmt.Errorf("got %d documents, want %d", len(d.checksums)/8, len(old.checksums)/8)
+	}
+	if !bytes.Equal(d.checksums, old.checksums) {
+		return fmt.Errorf("content checksums differ")
+	}
+
+	before, err := json.Marshal(old.repoMetaData)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(d.repoMetaData)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(before, after) {
+		return fmt.Errorf("repository metadata differs: got %s, want %s", after, before)
+	}
+	return nil
+}
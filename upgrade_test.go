@@ -0,0 +1,247 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// downgradeShard rewrites a current shard as the given older format
+// version.
+func downgradeShard(t *testing.T, data []byte, version int) []byte {
+	if version == IndexFormatVersion {
+		return data
+	}
+
+	var toc indexTOC
+	r := reader{r: &memSeeker{data}}
+	if err := r.readTOC(&toc); err != nil {
+		t.Fatalf("readTOC: %v", err)
+	}
+	tocStart := binary.BigEndian.Uint32(data[len(data)-8:])
+	if version < firstContentSlotsVersion && toc.contentSlots.sz > 0 {
+		t.Fatalf("can't downgrade shared content to v%d", version)
+	}
+	if version < firstGeneratedVersion && toc.generated.sz > 0 {
+		t.Fatalf("can't downgrade generated documents to v%d", version)
+	}
+
+	out := append([]byte{}, data[:tocStart]...)
+	from := fmt.Sprintf(`"IndexFormatVersion":%d`, IndexFormatVersion)
+	to := fmt.Sprintf(`"IndexFormatVersion":%d`, version)
+	if len(from) != len(to) || bytes.Count(out, []byte(from)) != 1 {
+		t.Fatalf("can't rewrite format version in metadata")
+	}
+	out = bytes.Replace(out, []byte(from), []byte(to), 1)
+	toc.metaData.checksum = crc32.ChecksumIEEE(out[toc.metaData.off : toc.metaData.off+toc.metaData.sz])
+	if version < 16 {
+		// No header; the bytes are not part of any section, so
+		// clearing the magic is enough.
+		copy(out, make([]byte, len(indexMagic)))
+	} else {
+		binary.BigEndian.PutUint32(out[len(indexMagic):], uint32(version))
+	}
+
+	// Before section checksums, TOC entries were offset and size.
+	var buf bytes.Buffer
+	w := &writer{w: &buf}
+	secs := toc.sectionsTaggedVersion(version)
+	w.U32(uint32(len(secs)))
+	writeEntry := func(s simpleSection) {
+		w.U32(s.off)
+		w.U32(s.sz)
+		if version >= firstChecksumVersion {
+			w.U32(s.checksum)
+		}
+	}
+	for _, s := range secs {
+		switch sec := s.sec.(type) {
+		case *simpleSection:
+			writeEntry(*sec)
+		case *compoundSection:
+			writeEntry(sec.data)
+			index := sec.index
+			if version < firstDeltaIndexVersion {
+				// Append the index as U32s, before
+				// the codec header from version 17.
+				var u32s []uint32
+				if version >= firstCodecVersion {
+					u32s = append(u32s, uint32(sec.codec))
+				} else if sec.codec != codecNone {
+					t.Fatalf("section %s: can't downgrade codec %d", s.tag, sec.codec)
+				}
+				u32s = append(append(u32s, sec.offsets...), sec.sizes...)
+				index = simpleSection{off: uint32(len(out))}
+				for _, u := range u32s {
+					out = append(out, 0, 0, 0, 0)
+					binary.BigEndian.PutUint32(out[len(out)-4:], u)
+				}
+				index.sz = uint32(len(out)) - index.off
+				index.checksum = crc32.ChecksumIEEE(out[index.off:])
+			}
+			writeEntry(index)
+		default:
+			t.Fatalf("section %s: unknown type %T", s.tag, sec)
+		}
+	}
+	// Downgraded indexes are appended, so the TOC moves.
+	tocStart = uint32(len(out))
+	tocSize := uint32(buf.Len())
+	out = append(out, buf.Bytes()...)
+	buf.Reset()
+	if version >= firstTrailerVersion {
+		w.U32(uint32(len(out)))
+		w.U32(crc32.ChecksumIEEE(out))
+	}
+	w.U32(tocStart)
+	w.U32(tocSize)
+	return append(out, buf.Bytes()...)
+}
+
+func TestUpgradeShard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := &Repository{
+		Name:          "repo",
+		Branches:      []RepositoryBranch{{Name: "master"}, {Name: "stable"}},
+		SubRepoMap:    map[string]*Repository{"sub": {Name: "sub"}},
+		LanguageBytes: map[string]int64{"Go": 3},
+	}
+	docs := []Document{
+		{Name: "f1", Content: []byte("one"), Branches: []string{"master", "stable"}, Language: "Go"},
+		{Name: "sub/f2", Content: []byte("two"), Branches: []string{"stable"}, SubRepositoryPath: "sub",
+			Symbols: []DocumentSection{{Start: 0, End: 3}}},
+	}
+	b := testIndexBuilder(t, repo, docs...)
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	wantRepo, wantDocs, err := ReadDocuments(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatalf("ReadDocuments: %v", err)
+	}
+
+	for version := oldestUpgradableVersion; version <= IndexFormatVersion; version++ {
+		src := filepath.Join(dir, fmt.Sprintf("v%d.zoekt", version))
+		dst := filepath.Join(dir, fmt.Sprintf("v%d.upgraded.zoekt", version))
+		if err := ioutil.WriteFile(src, downgradeShard(t, buf.Bytes(), version), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		if err := UpgradeShard(src, dst); err != nil {
+			t.Fatalf("v%d: UpgradeShard: %v", version, err)
+		}
+		data, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		gotRepo, gotDocs, err := ReadDocuments(&memSeeker{data})
+		if err != nil {
+			t.Fatalf("v%d: ReadDocuments: %v", version, err)
+		}
+		if !reflect.DeepEqual(gotRepo, wantRepo) {
+			t.Errorf("v%d: got repository %+v, want %+v", version, gotRepo, wantRepo)
+		}
+		want := wantDocs
+		if version < firstLanguageVersion {
+			// The languages are lost, but not LanguageBytes.
+			want = nil
+			for _, d := range wantDocs {
+				d.Language = ""
+				want = append(want, d)
+			}
+		}
+		if !reflect.DeepEqual(gotDocs, want) {
+			t.Errorf("v%d: got documents %+v, want %+v", version, gotDocs, want)
+		}
+	}
+}
+
+func TestUpgradeShardRankSignals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("one"), RankSignals: map[string]float64{"popularity": 3}})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	src := filepath.Join(dir, "src.zoekt")
+	dst := filepath.Join(dir, "dst.zoekt")
+	if err := ioutil.WriteFile(src, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := UpgradeShard(src, dst); err != nil {
+		t.Fatalf("UpgradeShard: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	got, err := ReadRankSignals(&memSeeker{data})
+	if err != nil {
+		t.Fatalf("ReadRankSignals: %v", err)
+	}
+	if want := map[uint32]map[string]float64{0: {"popularity": 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpgradeShardUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: []byte("one")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	src := filepath.Join(dir, "v12.zoekt")
+	dst := filepath.Join(dir, "dst.zoekt")
+	if err := ioutil.WriteFile(src, downgradeShard(t, buf.Bytes(), 12), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	err = UpgradeShard(src, dst)
+	if err == nil || !strings.Contains(err.Error(), "indexed again") {
+		t.Fatalf("got error %v, want refusal", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q): got %v, want not exist", dst, err)
+	}
+}
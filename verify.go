@@ -0,0 +1,276 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"os"
+)
+
+// VerifyIndex checks that the shard in file path is internally
+// consistent. Besides the section bounds checked when any shard is
+// opened, it checks the section and file checksums, which is too slow
+// to do on every open, and it reads and decodes every item of every
+// compound section, and checks that the sections agree on the number
+// of documents and that the offsets within documents are in range.
+// Shards that pass can be searched without running into corrupt
+// offsets. The posting lists are decoded, but their offsets are not
+// checked against the content.
+func VerifyIndex(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	iFile, err := NewIndexFile(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer iFile.Close()
+	return verifyIndexFile(iFile)
+}
+
+// verifyIndexFile is VerifyIndex for an open IndexFile, which is not
+// closed.
+func verifyIndexFile(f IndexFile) error {
+	rd, err := newReader(f)
+	if err != nil {
+		return err
+	}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return err
+	}
+	if err := rd.verifyChecksums(&toc); err != nil {
+		return err
+	}
+
+	// Check the sections before readIndexData, which trusts the
+	// item counts and encodings.
+	if err := toc.verifyCounts(); err != nil {
+		return err
+	}
+	// This also checks the number of items in fileContents.
+	slots, err := toc.readContentSlots(f)
+	if err != nil {
+		return fmt.Errorf("section contentSlots: %v", err)
+	}
+	boundaries := contentBoundaries(toc.fileContents.relativeIndex(), slots)
+	docSize := func(i int) uint32 {
+		return boundaries[i+1] - boundaries[i]
+	}
+	for _, s := range []struct {
+		tag   string
+		sec   *compoundSection
+		check func(i int, item []byte) error
+	}{
+		{"fileContents", &toc.fileContents, nil},
+		{"fileNames", &toc.fileNames, nil},
+		{"fileSections", &toc.fileSections, func(i int, item []byte) error {
+			ints, err := checkSizedDeltas(item)
+			if err != nil {
+				return err
+			}
+			if len(ints)%2 != 0 {
+				return fmt.Errorf("odd number of section bounds %d", len(ints))
+			}
+			for j := 0; j < len(ints); j += 2 {
+				if ints[j] > ints[j+1] || ints[j+1] > docSize(i) {
+					return fmt.Errorf("section [%d, %d) outside document of %d bytes", ints[j], ints[j+1], docSize(i))
+				}
+			}
+			return nil
+		}},
+		{"newlines", &toc.newlines, func(i int, item []byte) error {
+			newlines, err := checkSizedDeltas(item)
+			if err != nil {
+				return err
+			}
+			if n := len(newlines); n > 0 && newlines[n-1] >= docSize(i) {
+				return fmt.Errorf("newline at %d beyond document of %d bytes", newlines[n-1], docSize(i))
+			}
+			return nil
+		}},
+		{"postings", &toc.postings, func(i int, item []byte) error {
+			return checkPostings(toc.postings.codec, item)
+		}},
+		{"namePostings", &toc.namePostings, func(i int, item []byte) error {
+			return checkPostings(toc.namePostings.codec, item)
+		}},
+	} {
+		if err := s.sec.verifyItems(f, s.check); err != nil {
+			return fmt.Errorf("section %s: %v", s.tag, err)
+		}
+	}
+
+	n := len(toc.fileNames.offsets)
+	for _, s := range []struct {
+		tag  string
+		sec  simpleSection
+		want int
+	}{
+		{"runeOffsets", toc.runeOffsets, -1},
+		{"nameRuneOffsets", toc.nameRuneOffsets, -1},
+		{"fileEndRunes", toc.fileEndRunes, n},
+		{"nameEndRunes", toc.nameEndRunes, n},
+		{"subRepos", toc.subRepos, n},
+	} {
+		blob, err := f.Read(s.sec.off, s.sec.sz)
+		if err != nil {
+			return fmt.Errorf("section %s: %v", s.tag, err)
+		}
+		ints, err := checkSizedDeltas(blob)
+		if err != nil {
+			return fmt.Errorf("section %s: %v", s.tag, err)
+		}
+		if s.want >= 0 && len(ints) != s.want {
+			return fmt.Errorf("section %s: got %d entries, want one for each of %d documents", s.tag, len(ints), s.want)
+		}
+	}
+
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return err
+	}
+	for i, s := range d.subRepos {
+		if int(s) >= len(d.subRepoPaths) {
+			return fmt.Errorf("document %d: sub-repository %d out of range", i, s)
+		}
+	}
+	for i, mask := range d.fileBranchMasks {
+		if nb := len(d.repoMetaData.Branches); nb < 64 && mask>>uint(nb) != 0 {
+			return fmt.Errorf("document %d: branch mask %x, but there are only %d branches", i, mask, nb)
+		}
+	}
+	return nil
+}
+
+// verifyCounts checks that the sections agree on the number of
+// documents and ngrams.
+func (t *indexTOC) verifyCounts() error {
+	n := len(t.fileNames.offsets)
+	for _, c := range []struct {
+		tag       string
+		got, want uint64
+	}{
+		{"fileSections", uint64(len(t.fileSections.offsets)), uint64(n)},
+		{"newlines", uint64(len(t.newlines.offsets)), uint64(n)},
+		{"branchMasks", uint64(t.branchMasks.sz), 8 * uint64(n)},
+		{"contentChecksums", uint64(t.contentChecksums.sz), crc64.Size * uint64(n)},
+		{"ngramText", uint64(t.ngramText.sz), 8 * uint64(len(t.postings.offsets))},
+		{"nameNgramText", uint64(t.nameNgramText.sz), 8 * uint64(len(t.namePostings.offsets))},
+	} {
+		if c.got != c.want {
+			return fmt.Errorf("section %s: got %d, want %d for %d documents", c.tag, c.got, c.want, n)
+		}
+	}
+	return nil
+}
+
+// verifyItems checks that the items of s start at the start of its
+// data, and that each can be read and decoded to its recorded size.
+// If check is set, it is called with each decoded item.
+func (s *compoundSection) verifyItems(f IndexFile, check func(i int, item []byte) error) error {
+	if len(s.offsets) > 0 && s.offsets[0] != s.data.off {
+		return fmt.Errorf("first item at %d, want section start %d", s.offsets[0], s.data.off)
+	}
+	if s.codec.storesSizes() && len(s.sizes) != len(s.offsets) {
+		return fmt.Errorf("got %d sizes for %d items", len(s.sizes), len(s.offsets))
+	}
+	end := s.data.off + s.data.sz
+	for i, off := range s.offsets {
+		next := end
+		if i+1 < len(s.offsets) {
+			next = s.offsets[i+1]
+		}
+		if next < off {
+			return fmt.Errorf("item %d: offset %d after next offset %d", i, off, next)
+		}
+		blob, err := f.Read(off, next-off)
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+		item, err := s.codec.decodeItem(blob)
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+		if s.codec.storesSizes() && uint32(len(item)) != s.sizes[i] {
+			return fmt.Errorf("item %d: decoded %d bytes, want %d", i, len(item), s.sizes[i])
+		}
+		if check != nil {
+			if err := check(i, item); err != nil {
+				return fmt.Errorf("item %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPostings checks that a posting list from a section with codec
+// c can be decoded.
+func checkPostings(c sectionCodec, data []byte) error {
+	if c != codecPostings {
+		_, err := checkDeltas(data)
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	switch data[0] {
+	case postingsVarint:
+		_, err := checkDeltas(data[1:])
+		return err
+	case postingsPacked:
+		_, err := unpackDeltas(data[1:], nil)
+		return err
+	}
+	return fmt.Errorf("unknown posting list encoding %d", data[0])
+}
+
+// checkDeltas decodes data as fromDeltas does, but returns an error
+// for malformed varints rather than misreading them.
+func checkDeltas(data []byte) ([]uint32, error) {
+	var result []uint32
+	var last uint32
+	for off := 0; off < len(data); {
+		delta, m := binary.Uvarint(data[off:])
+		if m <= 0 || delta > 1<<32-1 {
+			return nil, fmt.Errorf("bad varint at byte %d", off)
+		}
+		off += m
+		last += uint32(delta)
+		result = append(result, last)
+	}
+	return result, nil
+}
+
+// checkSizedDeltas is checkDeltas for data from toSizedDeltas, which
+// starts with the number of deltas.
+func checkSizedDeltas(data []byte) ([]uint32, error) {
+	n, m := binary.Uvarint(data)
+	if m <= 0 {
+		return nil, fmt.Errorf("bad count")
+	}
+	result, err := checkDeltas(data[m:])
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(result)) != n {
+		return nil, fmt.Errorf("got %d deltas, want %d", len(result), n)
+	}
+	return result, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func verifyTestShard(t *testing.T, compress, pack bool) []byte {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{{Name: "master"}},
+	},
+		Document{Name: "f1", Content: []byte("func needle()\nreturn\n"), Branches: []string{"master"},
+			Symbols: []DocumentSection{{5, 11}}},
+		Document{Name: "f2", Content: []byte("haystack\n"), Branches: []string{"master"}})
+	b.SetCompressContent(compress)
+	b.SetPackPostings(pack)
+
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// resum recomputes the checksums of a shard that was corrupted in
+// place, so only the checks of VerifyIndex can find the damage.
+func resum(t *testing.T, data []byte, toc *indexTOC) {
+	sum := func(s *simpleSection) {
+		s.checksum = crc32.ChecksumIEEE(data[s.off : s.off+s.sz])
+	}
+	for _, s := range toc.sections() {
+		switch s := s.(type) {
+		case *simpleSection:
+			sum(s)
+		case *compoundSection:
+			sum(&s.data)
+			sum(&s.index)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := &writer{w: &buf}
+	w.writeTOC(toc)
+	if w.err != nil {
+		t.Fatalf("writeTOC: %v", w.err)
+	}
+	tocStart := binary.BigEndian.Uint32(data[len(data)-8:])
+	copy(data[tocStart:], buf.Bytes())
+	binary.BigEndian.PutUint32(data[len(data)-12:], crc32.ChecksumIEEE(data[:len(data)-16]))
+}
+
+func TestVerifyIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, compress := range []bool{false, true} {
+		for _, pack := range []bool{false, true} {
+			fn := filepath.Join(dir, "shard.zoekt")
+			if err := ioutil.WriteFile(fn, verifyTestShard(t, compress, pack), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if err := VerifyIndex(fn); err != nil {
+				t.Errorf("compress %v, pack %v: VerifyIndex: %v", compress, pack, err)
+			}
+		}
+	}
+
+	fn := filepath.Join(dir, "truncated.zoekt")
+	data := verifyTestShard(t, false, false)
+	if err := ioutil.WriteFile(fn, data[:len(data)-1], 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := VerifyIndex(fn); err == nil {
+		t.Errorf("truncated shard verified without error")
+	}
+}
+
+func TestVerifyIndexCorrupt(t *testing.T) {
+	// lastByte returns the offset of the last byte of item i.
+	lastByte := func(s *compoundSection, i int) uint32 {
+		if i+1 < len(s.offsets) {
+			return s.offsets[i+1] - 1
+		}
+		return s.data.off + s.data.sz - 1
+	}
+
+	for _, tc := range []struct {
+		name    string
+		pack    bool
+		corrupt func(toc *indexTOC, data []byte)
+		want    string
+	}{
+		{"truncated newlines", false, func(toc *indexTOC, data []byte) {
+			data[lastByte(&toc.newlines, 0)] |= 0x80
+		}, "newlines"},
+		{"newline count", false, func(toc *indexTOC, data []byte) {
+			data[toc.newlines.offsets[0]]++
+		}, "newlines"},
+		{"symbol outside document", false, func(toc *indexTOC, data []byte) {
+			data[lastByte(&toc.fileSections, 0)] = 100
+		}, "fileSections"},
+		{"truncated postings", false, func(toc *indexTOC, data []byte) {
+			data[lastByte(&toc.postings, 0)] |= 0x80
+		}, "postings"},
+		{"posting list encoding", true, func(toc *indexTOC, data []byte) {
+			data[toc.postings.offsets[0]] = 7
+		}, "postings"},
+		{"file end runes", false, func(toc *indexTOC, data []byte) {
+			data[toc.fileEndRunes.off]++
+		}, "fileEndRunes"},
+		{"branch mask", false, func(toc *indexTOC, data []byte) {
+			data[toc.branchMasks.off] = 0x80
+		}, "branch mask"},
+	} {
+		data := verifyTestShard(t, false, tc.pack)
+		var toc indexTOC
+		r := reader{r: &memSeeker{data}}
+		if err := r.readTOC(&toc); err != nil {
+			t.Fatalf("readTOC: %v", err)
+		}
+		tc.corrupt(&toc, data)
+		resum(t, data, &toc)
+
+		err := verifyIndexFile(&memSeeker{data})
+		if err == nil {
+			t.Errorf("%s: corrupt shard verified without error", tc.name)
+		} else if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want mention of %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -382,3 +382,57 @@ func TestDupResult(t *testing.T) {
 		t.Fatalf("got %s, want substring %q", got, want)
 	}
 }
+
+func TestLineURL(t *testing.T) {
+	for _, tc := range []struct {
+		file, fragment, want string
+	}{
+		{"https://host/f", "L10", "https://host/f#L10"},
+		{"https://host/repo?path=/f", "&line=10", "https://host/repo?path=/f&line=10"},
+		{"https://host/f", "&lines=10-10", "https://host/f?lines=10-10"},
+		{"https://host/f", "?line=10", "https://host/f?line=10"},
+	} {
+		if got := lineURL(tc.file, tc.fragment); got != tc.want {
+			t.Errorf("lineURL(%q, %q) = %q, want %q", tc.file, tc.fragment, got, tc.want)
+		}
+	}
+}
+
+func TestCommitURLBranch(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name:              "name",
+		CommitURLTemplate: "commit/{{.Branch}}/{{.Version}}/{{.Name}}",
+		Branches:          []zoekt.RepositoryBranch{{Name: "master", Version: "1234"}},
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{Name: "f", Content: []byte("water"), Branches: []string{"master"}}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	srv := Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		HTML:     true,
+	}
+	mux, err := NewMux(&srv)
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/search?q=r:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := `href="commit/master/1234/master"`; !strings.Contains(string(body), want) {
+		t.Errorf("result did not have %q: %s", want, body)
+	}
+}
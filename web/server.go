@@ -358,6 +358,13 @@ func (s *Server) serveAbout(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// commitTemplateData is the data for CommitURLTemplate. It embeds
+// the branch, so templates using {{.Name}} keep working.
+type commitTemplateData struct {
+	zoekt.RepositoryBranch
+	Branch string
+}
+
 func (s *Server) serveListReposErr(q query.Q, qStr string, w http.ResponseWriter, r *http.Request) error {
 	ctx := context.Background()
 	repos, err := s.Searcher.List(ctx, q)
@@ -391,7 +398,7 @@ func (s *Server) serveListReposErr(q query.Q, qStr string, w http.ResponseWriter
 		}
 		for _, b := range r.Repository.Branches {
 			var buf bytes.Buffer
-			if err := t.Execute(&buf, b); err != nil {
+			if err := t.Execute(&buf, commitTemplateData{b, b.Name}); err != nil {
 				return err
 			}
 			repo.Branches = append(repo.Branches,
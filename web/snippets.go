@@ -113,7 +113,7 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 			md := Match{
 				FileName: f.FileName,
 				LineNum:  m.LineNumber,
-				URL:      fMatch.URL + "#" + getFragment(f.Repository, m.LineNumber),
+				URL:      lineURL(fMatch.URL, getFragment(f.Repository, m.LineNumber)),
 			}
 
 			lastEnd := 0
@@ -139,3 +139,18 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 	}
 	return fmatches, nil
 }
+
+// lineURL returns the URL for a line of the file at fileURL. A
+// fragment starting with '?' or '&' holds query parameters, as for
+// viewers that select lines in the query, and is added to the query
+// of fileURL.
+func lineURL(fileURL, fragment string) string {
+	if !strings.HasPrefix(fragment, "?") && !strings.HasPrefix(fragment, "&") {
+		return fileURL + "#" + fragment
+	}
+	sep := "?"
+	if strings.Contains(fileURL, "?") {
+		sep = "&"
+	}
+	return fileURL + sep + fragment[1:]
+}
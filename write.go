@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"sort"
 	"time"
@@ -57,7 +58,11 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 
 	postings.start(w)
 	for _, k := range keys {
-		postings.addItem(w, s.postings[k])
+		if postings.codec == codecPostings {
+			postings.addItem(w, toTaggedDeltas(s.postings[k]))
+		} else {
+			postings.addItem(w, s.postings[k])
+		}
 	}
 	postings.end(w)
 
@@ -70,14 +75,52 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	endRunes.end(w)
 }
 
+// DefaultMaxOffsetTableSize is the default limit on the size of the
+// offset table of a single section. Each entry takes 4 bytes, and
+// there is an entry per document, and per distinct trigram.
+const DefaultMaxOffsetTableSize = 64 << 20
+
+// checkOffsetTables returns an error if one of the offset tables
+// would exceed the limit.
+func (b *IndexBuilder) checkOffsetTables() error {
+	limit := b.maxOffsetTableSize
+	if limit == 0 {
+		limit = DefaultMaxOffsetTableSize
+	}
+	for _, t := range []struct {
+		what  string
+		count int
+	}{
+		{"documents", len(b.contentStrings)},
+		{"content trigrams", len(b.contentPostings.postings)},
+		{"name trigrams", len(b.namePostings.postings)},
+	} {
+		if sz := 4 * t.count; sz > limit {
+			return fmt.Errorf("offset table for %d %s takes %d bytes, more than the limit of %d; use smaller shards", t.count, t.what, sz, limit)
+		}
+	}
+	return nil
+}
+
 func (b *IndexBuilder) Write(out io.Writer) error {
-	buffered := bufio.NewWriterSize(out, 1<<20)
-	defer buffered.Flush()
+	if err := b.checkOffsetTables(); err != nil {
+		return err
+	}
 
-	w := &writer{w: buffered}
+	w := &writer{w: bufio.NewWriterSize(out, 1<<20)}
 	toc := indexTOC{}
 
-	toc.fileContents.writeStrings(w, b.contentStrings)
+	w.Write([]byte(indexMagic))
+	w.U32(IndexFormatVersion)
+
+	toc.fileContents.codec = b.contentCodec
+	toc.postings.codec = b.postingsCodec
+	toc.namePostings.codec = b.postingsCodec
+	toc.fileContents.start(w)
+	for _, doc := range b.slotDocs {
+		toc.fileContents.addItem(w, b.contentStrings[doc].data)
+	}
+	toc.fileContents.end(w)
 	toc.newlines.start(w)
 	for _, f := range b.contentStrings {
 		toc.newlines.addItem(w, toSizedDeltas(newLinesIndices(f.data)))
@@ -111,11 +154,37 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	w.Write(b.checksums)
 	toc.contentChecksums.end(w)
 
+	toc.rankSignals.start(w)
+	w.Write(marshalRankSignals(b.rankSignals))
+	toc.rankSignals.end(w)
+
+	toc.lastCommits.start(w)
+	w.Write(marshalLastCommits(b.lastCommits))
+	toc.lastCommits.end(w)
+
+	toc.contentSlots.start(w)
+	w.Write(marshalContentSlots(b.contentSlots))
+	toc.contentSlots.end(w)
+
+	toc.fileModes.start(w)
+	w.Write(marshalFileModes(b.fileModes))
+	toc.fileModes.end(w)
+
+	toc.generated.start(w)
+	w.Write(marshalGenerated(b.generated))
+	toc.generated.end(w)
+
+	toc.languages.start(w)
+	w.Write(marshalLanguages(b.languages))
+	toc.languages.end(w)
+
 	if err := b.writeJSON(&IndexMetadata{
 		IndexFormatVersion:  IndexFormatVersion,
 		IndexTime:           time.Now(),
 		IndexFeatureVersion: FeatureVersion,
 		PlainASCII:          b.contentPostings.isPlainASCII && b.namePostings.isPlainASCII,
+		TruncateLongLines:   b.truncateLongLines,
+		Supersedes:          b.supersedes,
 	}, &toc.metaData, w); err != nil {
 		return err
 	}
@@ -128,8 +197,8 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	tocSection.start(w)
 	w.writeTOC(&toc)
 	tocSection.end(w)
-	tocSection.write(w)
-	return w.err
+
+	return w.Finish(tocSection)
 }
 
 func (b *IndexBuilder) writeJSON(data interface{}, sec *simpleSection, w *writer) error {